@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Praveen005/CloudKeeper/internal/compress"
+	"github.com/Praveen005/CloudKeeper/internal/crypt"
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"github.com/Praveen005/CloudKeeper/internal/s3client"
+	"github.com/Praveen005/CloudKeeper/internal/storage"
+	"github.com/Praveen005/CloudKeeper/internal/storage/local"
+	"go.uber.org/zap"
+)
+
+// openBackend creates the storage driver picked by the `BACKEND` setting
+func openBackend(ctx context.Context, cfg fsconfig.MetaConfig) (storage.Backend, error) {
+	switch cfg.Backend {
+	case fsconfig.BackendS3:
+		return s3client.NewBackend(ctx, cfg.S3Bucket, s3client.ClientOptions{
+			Endpoint:           cfg.S3Endpoint,
+			PathStyle:          cfg.S3PathStyle,
+			CABundle:           cfg.S3CABundle,
+			InsecureSkipVerify: cfg.S3InsecureSkipVerify,
+		})
+	case fsconfig.BackendLocal:
+		return local.New(cfg.LocalBackendDir)
+	default:
+		return nil, fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
+}
+
+// checkSnapshots makes sure the snapshots of a set can hold on to what its files were. In the chunked layout the chunks do,
+// with one object per file (which is overwritten in place) it takes a bucket which keeps the older versions.
+// A backend which can't tell is given the benefit of the doubt, the snapshots then skip the files without a version.
+func checkSnapshots(ctx context.Context, cfg fsconfig.MetaConfig, backend storage.Backend) error {
+	if !cfg.Snapshots || cfg.StorageLayout != fsconfig.LayoutFiles {
+		return nil
+	}
+	versioned, err := storage.VersioningEnabled(ctx, backend)
+	if err != nil || versioned {
+		return nil
+	}
+	return fmt.Errorf("SNAPSHOTS needs STORAGE_LAYOUT=%s or a bucket with versioning enabled, the backend doesn't keep older versions", fsconfig.LayoutChunks)
+}
+
+// defaultChunkID is the unkeyed chunk naming, kept to go back to it when setupTransforms runs again
+var defaultChunkID = storage.ChunkID
+
+// setupTransforms configures what's done to file contents and names on upload (and undone on restore): chunking, compression and encryption
+func setupTransforms(cfg fsconfig.MetaConfig) error {
+	storage.SpoolDir = cfg.SpoolDir
+	storage.Layout = cfg.StorageLayout
+	storage.ChunkID = defaultChunkID
+	storage.Transforms = nil
+	storage.Names = nil
+	storage.Decoders = nil
+	for _, codec := range compress.Decoders() {
+		storage.Decoders = append(storage.Decoders, codec)
+	}
+
+	// Compression goes first, encrypted data doesn't compress
+	if cfg.Compression != fsconfig.CompressionNone {
+		skip := cfg.CompressionSkipExts
+		if skip == nil {
+			skip = compress.DefaultSkipExtensions
+		}
+		codec, err := compress.New(cfg.Compression, skip, cfg.CompressionMaxEntropy)
+		if err != nil {
+			return err
+		}
+		customlog.Logger.Info("Compressing files before upload", zap.String("codec", codec.Name()))
+		storage.Transforms = append(storage.Transforms, codec)
+	}
+
+	var key *crypt.Key
+	var err error
+	switch {
+	case cfg.EncryptionKeyFile != "":
+		key, err = crypt.LoadKeyFile(cfg.EncryptionKeyFile)
+	case cfg.EncryptionPassphrase != "":
+		key, err = crypt.KeyFromPassphrase(cfg.EncryptionPassphrase, cfg.EncryptionSalt)
+	}
+	if err != nil {
+		return fmt.Errorf("error loading encryption key: %v", err)
+	}
+	if key != nil {
+		customlog.Logger.Info("Encrypting files before upload", zap.String("key id", key.ID()))
+		storage.Transforms = append(storage.Transforms, key)
+		// Plain hashes of chunks would tell whether the backup holds some known content
+		storage.ChunkID = key.ChunkID
+		if cfg.EncryptNames {
+			customlog.Logger.Info("Encrypting file and directory names in object keys")
+			storage.Names = key.NameKey()
+		}
+	}
+	return nil
+}
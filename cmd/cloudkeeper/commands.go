@@ -0,0 +1,660 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/backup"
+	"github.com/Praveen005/CloudKeeper/internal/control"
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/db"
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"github.com/Praveen005/CloudKeeper/internal/guard"
+	"github.com/Praveen005/CloudKeeper/internal/reconcile"
+	"github.com/Praveen005/CloudKeeper/internal/restore"
+	"github.com/Praveen005/CloudKeeper/internal/storage"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// commands maps the name of a subcommand to the function running it, the function gets the arguments following the name
+var commands = map[string]func(args []string) error{
+	"restore":    runRestore,
+	"reconcile":  runReconcile,
+	"deadletter": runDeadLetter,
+	"gc":         runGC,
+	"prune":      runPrune,
+	"snapshots":  runSnapshots,
+	"trash":      runTrash,
+	"history":    runHistory,
+	"resume":     runResume,
+	"status":     runStatus,
+	"config":     runConfig,
+	"reload":     runReload,
+}
+
+// requeueRequest is the body of the requeue control command, no paths means all of them
+type requeueRequest struct {
+	Paths []string `json:"paths"`
+}
+
+type requeueResponse struct {
+	Requeued int `json:"requeued"`
+}
+
+// resumeResponse tells what the resume control command lifted, Frozen is nil if pushing wasn't frozen
+type resumeResponse struct {
+	Frozen *db.FreezeState `json:"frozen"`
+}
+
+// registerControlCommands wires up the commands the running daemon answers on its control socket
+func registerControlCommands(ctx context.Context) {
+	control.Handle("POST /reconcile", func(r *http.Request) (interface{}, error) {
+		checksum := fsconfig.Current().ReconcileChecksum
+		if v := r.URL.Query().Get("checksum"); v != "" {
+			checksum = v == "true"
+		}
+		return reconcile.Run(ctx, checksum)
+	})
+
+	control.Handle("POST /gc", func(r *http.Request) (interface{}, error) {
+		opts, err := gcOptions(r)
+		if err != nil {
+			return nil, err
+		}
+		return backup.GarbageCollect(ctx, opts)
+	})
+
+	control.Handle("POST /prune", func(r *http.Request) (interface{}, error) {
+		opts, err := gcOptions(r)
+		if err != nil {
+			return nil, err
+		}
+		return backup.Prune(ctx, backup.RetentionPolicy(), opts.Grace, opts.DryRun)
+	})
+
+	control.Handle("POST /resume", func(r *http.Request) (interface{}, error) {
+		state, err := db.Unfreeze()
+		if err != nil {
+			return nil, err
+		}
+		if guard.Default != nil {
+			guard.Default.Reset()
+		}
+		if state != nil {
+			customlog.Logger.Info("Pushing to the backend resumed", zap.String("frozen for", state.Reason))
+		}
+		return resumeResponse{Frozen: state}, nil
+	})
+
+	control.Handle("GET /status", func(r *http.Request) (interface{}, error) {
+		return backup.Status()
+	})
+
+	// Reloading outlives the request: reconciling new directories runs in the background
+	control.Handle("POST /reload", func(r *http.Request) (interface{}, error) {
+		return reloadConfig(ctx)
+	})
+
+	control.Handle("GET /deadletter", func(r *http.Request) (interface{}, error) {
+		return db.ReadDeadLetters()
+	})
+
+	control.Handle("POST /deadletter/requeue", func(r *http.Request) (interface{}, error) {
+		var req requeueRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, fmt.Errorf("invalid request: %v", err)
+		}
+		n, err := db.Requeue(req.Paths)
+		if err != nil {
+			return nil, err
+		}
+		customlog.Logger.Info("Requeued dead letters", zap.Int("paths", n))
+		return requeueResponse{Requeued: n}, nil
+	})
+}
+
+// gcOptions reads the grace period and dry run flag of the gc and prune control commands
+func gcOptions(r *http.Request) (storage.GCOptions, error) {
+	opts := storage.GCOptions{Grace: storage.DefaultGCGrace, DryRun: r.URL.Query().Get("dry-run") == "true"}
+	if v := r.URL.Query().Get("grace"); v != "" {
+		var err error
+		if opts.Grace, err = time.ParseDuration(v); err != nil {
+			return opts, fmt.Errorf("invalid grace period %q: %v", v, err)
+		}
+	}
+	return opts, nil
+}
+
+// gcQuery is the query string passing the gc flags to the daemon
+func gcQuery(grace time.Duration, dryRun bool) string {
+	query := url.Values{"grace": {grace.String()}}
+	if dryRun {
+		query.Set("dry-run", "true")
+	}
+	return query.Encode()
+}
+
+// signalContext returns a context which gets cancelled on ctrl+c, so one-off commands can stop cleanly
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// runRestore pulls the backed up tree from the backend back to local disk.
+//
+//	cloudkeeper restore [-to dir] [-path sub/dir] [-existing skip|overwrite] [-parallel n] [-snapshot id]
+//	cloudkeeper restore -path file -version id [-to dir] [-existing skip|overwrite]
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	var opts restore.Options
+	fs.StringVar(&opts.TargetDir, "to", "", "directory to restore into (defaults to the backup directory)")
+	fs.StringVar(&opts.SubPath, "path", "", "only restore this file/directory, relative to the backup directory")
+	fs.StringVar(&opts.Existing, "existing", restore.ExistingSkip, "what to do with files which already exist: skip or overwrite")
+	fs.IntVar(&opts.Parallel, "parallel", 4, "number of parallel downloads")
+	fs.StringVar(&opts.Snapshot, "snapshot", "", "restore the files as they were in this snapshot (see `snapshots`), or latest")
+	fs.StringVar(&opts.Version, "version", "", "restore this version of the file given by -path (see `history`), versioned buckets only")
+
+	cfg, err := fsconfig.ParseConfigArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	opts.Prefix = cfg.S3Prefix
+	if opts.TargetDir == "" {
+		opts.TargetDir = cfg.BackupDir
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	opts.Backend, err = openBackend(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if err := setupTransforms(cfg); err != nil {
+		return err
+	}
+
+	result, err := restore.Run(ctx, opts)
+	customlog.Logger.Info("Restore finished",
+		zap.Int("downloaded", result.Downloaded),
+		zap.Int("skipped", result.Skipped),
+		zap.Int("failed", result.Failed),
+	)
+	return err
+}
+
+// runPrune asks the running daemon to remove the snapshots the retention policy (`KEEP_*`) doesn't keep, and the chunks only they referred to.
+//
+//	cloudkeeper prune [-dry-run] [-grace 24h]
+func runPrune(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only list what would be removed")
+	grace := fs.Duration("grace", storage.DefaultGCGrace, "leave unreferenced chunks younger than this alone")
+
+	cfg, err := fsconfig.ParseConfigArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	var results []backup.PruneResult
+	if err := control.Call(ctx, cfg.ControlSocket, http.MethodPost, "/prune?"+gcQuery(*grace, *dryRun), nil, &results); err != nil {
+		return err
+	}
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	for _, result := range results {
+		for _, snapshot := range result.Snapshots {
+			if snapshot.Keep {
+				fmt.Printf("keep\tsnapshot %s\t(%s)\n", snapshot.ID, strings.Join(snapshot.Reasons, ", "))
+			} else {
+				fmt.Printf("remove\tsnapshot %s\n", snapshot.ID)
+			}
+		}
+		for _, key := range result.GC.DeletedKeys {
+			fmt.Printf("remove\tobject %s\n", key)
+		}
+		fmt.Printf("%s: %s %d of %d snapshot(s) and %d chunk(s), %d bytes\n",
+			result.Set, verb, result.Removed, len(result.Snapshots), result.GC.Deleted, result.GC.DeletedBytes)
+	}
+	return nil
+}
+
+// runSnapshots lists the snapshots stored in the backend, it doesn't need the daemon.
+//
+//	cloudkeeper snapshots
+func runSnapshots(args []string) error {
+	fs := flag.NewFlagSet("snapshots", flag.ContinueOnError)
+	cfg, err := fsconfig.ParseConfigArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	backend, err := openBackend(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	snapshots, err := storage.ListSnapshots(ctx, backend, cfg.S3Prefix)
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		fmt.Printf("%s\ttaken at: %s\tsize: %d\n", snapshot.ID, snapshot.Time.Local().Format(time.RFC3339), snapshot.StoredSize)
+	}
+	if len(snapshots) == 0 {
+		fmt.Println("There are no snapshots")
+	}
+	return nil
+}
+
+// runHistory lists the versions the backend keeps of a backed up file, newest first. It needs a bucket with versioning enabled
+// and works on the backend directly, the daemon doesn't have to run. A version is restored with `restore -path file -version id`.
+//
+//	cloudkeeper history path
+func runHistory(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	cfg, err := fsconfig.ParseConfigArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: history path")
+	}
+	path := fs.Arg(0)
+	if filepath.IsAbs(path) {
+		if path, err = filepath.Rel(cfg.BackupDir, path); err != nil {
+			return err
+		}
+	}
+	path = filepath.Clean(path)
+	if !filepath.IsLocal(path) {
+		return fmt.Errorf("%s is not below the backup directory %s", fs.Arg(0), cfg.BackupDir)
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	backend, err := openBackend(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if err := setupTransforms(cfg); err != nil {
+		return err
+	}
+	versions, err := storage.History(ctx, backend, storage.Key(cfg.S3Prefix, path))
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		var marks []string
+		if v.Latest {
+			marks = append(marks, "latest")
+		}
+		if v.DeleteMarker {
+			marks = append(marks, "deleted")
+		}
+		fmt.Printf("%s\t%s\tstored size: %d\t%s\n", v.VersionID, v.LastModified.Local().Format(time.RFC3339), v.Size, strings.Join(marks, ", "))
+	}
+	return nil
+}
+
+// runTrash lists the deleted files kept in the trash, or writes them back to disk (from where they're backed up again).
+// It works on the backend directly, the daemon doesn't have to run.
+//
+//	cloudkeeper trash ls
+//	cloudkeeper trash restore [-to dir] [-existing skip|overwrite] path ...
+func runTrash(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: trash ls | trash restore [-to dir] [-existing skip|overwrite] path ...")
+	}
+	sub := args[0]
+
+	fs := flag.NewFlagSet("trash "+sub, flag.ContinueOnError)
+	var opts restore.Options
+	fs.StringVar(&opts.TargetDir, "to", "", "directory to restore into (defaults to the backup directory)")
+	fs.StringVar(&opts.Existing, "existing", restore.ExistingSkip, "what to do with files which already exist: skip or overwrite")
+	cfg, err := fsconfig.ParseConfigArgs(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	opts.Prefix = cfg.S3Prefix
+	if opts.TargetDir == "" {
+		opts.TargetDir = cfg.BackupDir
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	if opts.Backend, err = openBackend(ctx, cfg); err != nil {
+		return err
+	}
+	if err := setupTransforms(cfg); err != nil {
+		return err
+	}
+
+	switch sub {
+	case "ls":
+		entries, err := storage.ListTrash(ctx, opts.Backend, cfg.S3Prefix)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			purge := ""
+			if cfg.TrashRetention > 0 {
+				purge = "\tpurged after: " + entry.DeletedAt.Add(cfg.TrashRetention).Local().Format(time.RFC3339)
+			}
+			fmt.Printf("%s\tdeleted at: %s\tsize: %d%s\n", entry.Path, entry.DeletedAt.Local().Format(time.RFC3339), entry.Size, purge)
+		}
+		if len(entries) == 0 {
+			fmt.Println("The trash is empty")
+		}
+		return nil
+
+	case "restore":
+		if fs.NArg() == 0 {
+			return fmt.Errorf("give the paths to restore")
+		}
+		for _, path := range fs.Args() {
+			// Paths may be given as they were on disk, or relative to the backup directory
+			if filepath.IsAbs(path) {
+				if path, err = filepath.Rel(cfg.BackupDir, path); err != nil {
+					return err
+				}
+			}
+			result, err := restore.FromTrash(ctx, opts, path)
+			customlog.Logger.Info("Restore from the trash finished",
+				zap.String("path", path),
+				zap.Int("downloaded", result.Downloaded),
+				zap.Int("skipped", result.Skipped),
+				zap.Int("failed", result.Failed),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown trash command %q, must be ls or restore", sub)
+}
+
+// runReconcile asks the running daemon to compare the local tree with s3 and queue the differences.
+//
+//	cloudkeeper reconcile [-checksum]
+func runReconcile(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	checksum := fs.Bool("checksum", false, "also compare content checksums, not just size and modification time")
+
+	cfg, err := fsconfig.ParseConfigArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	var result reconcile.Result
+	path := "/reconcile"
+	if *checksum {
+		path += "?checksum=true"
+	}
+	if err := control.Call(ctx, cfg.ControlSocket, http.MethodPost, path, nil, &result); err != nil {
+		return err
+	}
+	customlog.Logger.Info("Reconciliation finished",
+		zap.Int("local files", result.LocalFiles),
+		zap.Int("s3 objects", result.RemoteObjects),
+		zap.Int("queued for upload", result.Added),
+		zap.Int("queued for removal", result.Removed),
+	)
+	return nil
+}
+
+// runGC asks the running daemon to delete the chunks which no backed up file refers to anymore (chunked storage layout).
+//
+//	cloudkeeper gc [-dry-run] [-grace 24h]
+func runGC(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only tell what would be deleted")
+	grace := fs.Duration("grace", storage.DefaultGCGrace, "leave chunks younger than this alone")
+
+	cfg, err := fsconfig.ParseConfigArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	var result storage.GCResult
+	if err := control.Call(ctx, cfg.ControlSocket, http.MethodPost, "/gc?"+gcQuery(*grace, *dryRun), nil, &result); err != nil {
+		return err
+	}
+	verb := "Deleted"
+	if *dryRun {
+		verb = "Would delete"
+	}
+	fmt.Printf("%s %d of %d chunk(s), %d bytes. %d file(s) refer to %d chunk(s), %d unreferenced chunk(s) are younger than %s\n",
+		verb, result.Deleted, result.Chunks, result.DeletedBytes, result.Manifests, result.Referenced, result.TooRecent, *grace)
+	return nil
+}
+
+// runResume lets the running daemon push again after the guard froze it, once the changes it noticed were checked.
+//
+//	cloudkeeper resume
+func runResume(args []string) error {
+	fs := flag.NewFlagSet("resume", flag.ContinueOnError)
+	cfg, err := fsconfig.ParseConfigArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	var resp resumeResponse
+	if err := control.Call(ctx, cfg.ControlSocket, http.MethodPost, "/resume", nil, &resp); err != nil {
+		return err
+	}
+	if resp.Frozen == nil {
+		fmt.Println("Pushing wasn't frozen")
+		return nil
+	}
+	fmt.Printf("Resumed pushing, frozen since %s: %s\n", resp.Frozen.At.Format(time.RFC3339), resp.Frozen.Reason)
+	for _, path := range resp.Frozen.Samples {
+		fmt.Printf("\t%s\n", path)
+	}
+	return nil
+}
+
+// runStatus asks the running daemon how its backup sets are doing: where they're backed up to, what's queued and how the latest push went.
+//
+//	cloudkeeper status
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	cfg, err := fsconfig.ParseConfigArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	var sets []backup.SetStatus
+	if err := control.Call(ctx, cfg.ControlSocket, http.MethodGet, "/status", nil, &sets); err != nil {
+		return err
+	}
+	for _, set := range sets {
+		last := "never"
+		if !set.LastFlush.IsZero() {
+			last = set.LastFlush.Local().Format(time.RFC3339)
+			if set.LastError != "" {
+				last += " (failed: " + set.LastError + ")"
+			}
+		}
+		next := "-"
+		if !set.NextPush.IsZero() {
+			next = set.NextPush.Local().Format(time.RFC3339)
+		}
+		fmt.Printf("%s\t%s -> %s\t%s\tqueued: %d\tlast push: %s\tnext push: %s\n",
+			set.Name, set.Directory, set.Destination, set.Schedule, set.Queued, last, next)
+	}
+	return nil
+}
+
+// runConfig checks the configuration, or prints it with its secrets redacted. It doesn't need the daemon.
+//
+//	cloudkeeper config validate
+//	cloudkeeper config show [--effective]
+func runConfig(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: config validate | config show [--effective]")
+	}
+	sub := args[0]
+
+	fs := flag.NewFlagSet("config "+sub, flag.ContinueOnError)
+	effective := fs.Bool("effective", false, "show every setting as it's in effect: environment, flags and defaults included")
+	cfg, err := fsconfig.ParseConfigArgs(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	source := fsconfig.ConfigFilePath()
+	if source == "" {
+		source = "the environment"
+	}
+
+	switch sub {
+	case "validate":
+		fmt.Printf("The configuration from %s is valid, %d backup set(s)\n", source, len(cfg.Sets))
+		return nil
+
+	case "show":
+		file := fsconfig.Effective(cfg)
+		if !*effective {
+			// Only what's written in the file
+			if fsconfig.ConfigFilePath() == "" {
+				return fmt.Errorf("no configuration file found, use --effective to see the settings in effect")
+			}
+			if file, _, err = fsconfig.ReadConfigFile(fsconfig.ConfigFilePath()); err != nil {
+				return err
+			}
+			file = fsconfig.RedactFile(file)
+		}
+		out, err := yaml.Marshal(file)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+		return nil
+
+	default:
+		return fmt.Errorf("unknown config command %q, must be validate or show", sub)
+	}
+}
+
+// runReload asks the running daemon to switch over to the changed configuration, like SIGHUP does.
+//
+//	cloudkeeper reload
+func runReload(args []string) error {
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	cfg, err := fsconfig.ParseConfigArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	var resp reloadResponse
+	if err := control.Call(ctx, cfg.ControlSocket, http.MethodPost, "/reload", nil, &resp); err != nil {
+		return err
+	}
+	for _, change := range resp.Applied {
+		fmt.Printf("changed\t%s\t%s -> %s\n", change.Setting, change.Old, change.New)
+	}
+	for _, change := range resp.Pending {
+		fmt.Printf("restart\t%s\t%s -> %s\n", change.Setting, change.Old, change.New)
+	}
+	if len(resp.Applied) == 0 && len(resp.Pending) == 0 {
+		fmt.Println("The configuration didn't change")
+	} else if len(resp.Pending) > 0 {
+		fmt.Println("The settings marked restart take effect once the daemon is restarted")
+	}
+	return nil
+}
+
+// runDeadLetter lists the files the daemon gave up on, or puts them back on the queue.
+//
+//	cloudkeeper deadletter ls
+//	cloudkeeper deadletter requeue [-all] [path ...]
+func runDeadLetter(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: deadletter ls | deadletter requeue [-all] [path ...]")
+	}
+	sub := args[0]
+
+	fs := flag.NewFlagSet("deadletter "+sub, flag.ContinueOnError)
+	all := fs.Bool("all", false, "requeue every dead letter")
+	cfg, err := fsconfig.ParseConfigArgs(fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	switch sub {
+	case "ls":
+		var letters map[string]db.DeadLetter
+		if err := control.Call(ctx, cfg.ControlSocket, http.MethodGet, "/deadletter", nil, &letters); err != nil {
+			return err
+		}
+		paths := make([]string, 0, len(letters))
+		for path := range letters {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			letter := letters[path]
+			fmt.Printf("%s\taction: %s\tattempts: %d\tfailed at: %s\tlast error: %s\n",
+				path, letter.Action(), letter.Attempts, letter.FailedAt.Format(time.RFC3339), letter.LastError)
+		}
+		if len(paths) == 0 {
+			fmt.Println("The dead letter bucket is empty")
+		}
+		return nil
+
+	case "requeue":
+		paths := fs.Args()
+		if len(paths) == 0 && !*all {
+			return fmt.Errorf("give the paths to requeue, or -all")
+		}
+		if *all {
+			paths = nil
+		}
+		var resp requeueResponse
+		if err := control.Call(ctx, cfg.ControlSocket, http.MethodPost, "/deadletter/requeue", requeueRequest{Paths: paths}, &resp); err != nil {
+			return err
+		}
+		fmt.Printf("Requeued %d path(s)\n", resp.Requeued)
+		return nil
+	}
+	return fmt.Errorf("unknown deadletter command %q, must be ls or requeue", sub)
+}
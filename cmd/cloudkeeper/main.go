@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io/fs"
 	"os"
 	"os/signal"
 	"sync"
@@ -9,9 +11,14 @@ import (
 	"time"
 
 	"github.com/Praveen005/CloudKeeper/internal/backup"
+	"github.com/Praveen005/CloudKeeper/internal/control"
 	"github.com/Praveen005/CloudKeeper/internal/customlog"
 	"github.com/Praveen005/CloudKeeper/internal/db"
 	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"github.com/Praveen005/CloudKeeper/internal/guard"
+	"github.com/Praveen005/CloudKeeper/internal/reconcile"
+	"github.com/Praveen005/CloudKeeper/internal/scanner"
+	"github.com/Praveen005/CloudKeeper/internal/storage"
 	"github.com/Praveen005/CloudKeeper/internal/watcher"
 	"github.com/joho/godotenv"
 	"go.uber.org/zap"
@@ -21,10 +28,21 @@ func main() {
 	defer customlog.SyncLogger()
 
 	var err error
-	if err := godotenv.Load(); err != nil {
-		// log.Println("[WARN] Error loading .env file:", err)
-		customlog.Logger.Error("Error loading .env file", zap.String("error", err.Error()))
-		return
+	// .env is optional: settings can also come from the environment or the configuration file (--config)
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		customlog.Logger.Warn("Error loading .env file", zap.String("error", err.Error()))
+	}
+
+	// Subcommands like `cloudkeeper restore ...` run once and exit, everything else starts the backup daemon
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				customlog.Logger.Error(os.Args[1]+" failed", zap.String("error", err.Error()))
+				customlog.SyncLogger()
+				os.Exit(1)
+			}
+			return
+		}
 	}
 
 	fsconfig.MetaCfg, err = fsconfig.ParseConfig()
@@ -32,6 +50,83 @@ func main() {
 		customlog.Logger.Error("parsing config", zap.String("error", err.Error()))
 		return
 	}
+	if path := fsconfig.ConfigFilePath(); path != "" {
+		customlog.Logger.Info("Loaded configuration file", zap.String("path", path))
+	}
+
+	// Every backup set has a backend of its own, the first one is also the default for everything not tied to a set
+	for i, set := range fsconfig.MetaCfg.Sets {
+		backend, err := openBackend(context.Background(), fsconfig.MetaCfg.WithSet(set))
+		if err != nil {
+			customlog.Logger.Error("opening storage backend", zap.String("set", set.Name), zap.String("error", err.Error()))
+			return
+		}
+		storage.Backends[set.Name] = backend
+		if i == 0 {
+			storage.Default = backend
+		}
+		plan, _ := set.Plan()
+		customlog.Logger.Info("Backing up directory",
+			zap.String("set", set.Name),
+			zap.String("directory", set.BackupDir),
+			zap.String("destination", set.Destination()),
+			zap.Stringer("schedule", plan),
+		)
+
+		// With versioning on the bucket keeps what's overwritten or deleted, `cloudkeeper history` lists it
+		if versioned, err := storage.VersioningEnabled(context.Background(), backend); err != nil {
+			customlog.Logger.Warn("Can't tell if the bucket keeps versions", zap.String("set", set.Name), zap.String("error", err.Error()))
+		} else if versioned {
+			customlog.Logger.Info("Versioning is enabled on the bucket, older versions of files can be listed with `cloudkeeper history`", zap.String("set", set.Name))
+		}
+		if err := checkSnapshots(context.Background(), fsconfig.MetaCfg.WithSet(set), backend); err != nil {
+			customlog.Logger.Error("invalid configuration", zap.String("set", set.Name), zap.String("error", err.Error()))
+			return
+		}
+	}
+
+	if err := setupTransforms(fsconfig.MetaCfg); err != nil {
+		customlog.Logger.Error("setting up encryption", zap.String("error", err.Error()))
+		return
+	}
+
+	db.Path = fsconfig.MetaCfg.DBPath
+	if err := db.Open(); err != nil {
+		customlog.Logger.Error("opening database", zap.String("error", err.Error()))
+		return
+	}
+
+	// The guard freezes pushing when files are deleted or rewritten in bulk
+	if fsconfig.MetaCfg.Guard {
+		guard.Default = guard.New(guard.Thresholds{
+			Window:            fsconfig.MetaCfg.GuardWindow,
+			MaxChangedPercent: fsconfig.MetaCfg.GuardMaxChangedPct,
+			MinFiles:          fsconfig.MetaCfg.GuardMinFiles,
+			HighEntropyFiles:  fsconfig.MetaCfg.GuardHighEntropyFiles,
+			Entropy:           fsconfig.MetaCfg.GuardEntropy,
+		}, db.CountIndex)
+		guard.AlertWebhook = fsconfig.MetaCfg.GuardAlertWebhook
+	}
+	if state, err := db.Frozen(); err == nil && state != nil {
+		customlog.Logger.Warn("Pushing to the backend is frozen, run `cloudkeeper resume` once the changes are checked",
+			zap.String("reason", state.Reason),
+			zap.Time("since", state.At),
+		)
+	}
+
+	// The journal writer gets its own context: it has to outlive the watcher, so nothing appended during shutdown is lost
+	journalCtx, stopJournal := context.WithCancel(context.Background())
+	journalDone := make(chan struct{})
+	go func() {
+		defer close(journalDone)
+		db.RunJournal(journalCtx)
+	}()
+
+	// Whatever was detected before a crash is still in the journal, move it to the queue before new events arrive
+	if err := db.Recover(); err != nil {
+		customlog.Logger.Error("replaying journal", zap.String("error", err.Error()))
+		return
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -40,6 +135,10 @@ func main() {
 	wg.Add(3)
 	go func() {
 		defer wg.Done()
+		if fsconfig.MetaCfg.WatchMode == fsconfig.WatchModeScan {
+			scanner.Run(ctx)
+			return
+		}
 		watcher.Watch(ctx)
 	}()
 
@@ -53,6 +152,46 @@ func main() {
 		backup.Backup(ctx)
 	}()
 
+	registerControlCommands(ctx)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := control.Serve(ctx, fsconfig.MetaCfg.ControlSocket); err != nil {
+			customlog.Logger.Error("control socket", zap.String("error", err.Error()))
+		}
+	}()
+
+	// Anything that changed while we weren't running never produced an event, look for it.
+	// The watcher is already running at this point, so nothing slips through between the scan and the watch.
+	if fsconfig.MetaCfg.ReconcileOnStartup {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := reconcile.Run(ctx, fsconfig.MetaCfg.ReconcileChecksum); err != nil {
+				customlog.Logger.Error("startup reconciliation failed", zap.String("error", err.Error()))
+			}
+		}()
+	}
+
+	// SIGHUP switches over to a changed configuration file, like `cloudkeeper reload` does
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-hupChan:
+				customlog.Logger.Info("Received SIGHUP, reloading the configuration")
+				if _, err := reloadConfig(ctx); err != nil {
+					customlog.Logger.Error("reloading configuration", zap.String("error", err.Error()))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
@@ -81,6 +220,12 @@ func main() {
 		os.Exit(0)
 	}
 
+	stopJournal()
+	<-journalDone
+	if err := db.Close(); err != nil {
+		customlog.Logger.Error("closing database", zap.String("error", err.Error()))
+	}
+
 	customlog.Logger.Info("Shutdown complete.")
 	os.Exit(0)
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"github.com/Praveen005/CloudKeeper/internal/reconcile"
+	"github.com/Praveen005/CloudKeeper/internal/storage"
+	"go.uber.org/zap"
+)
+
+// reloadResponse is what the reload control command answers: the changes which were applied, and the ones waiting for a restart
+type reloadResponse struct {
+	Applied []fsconfig.Change `json:"applied"`
+	Pending []fsconfig.Change `json:"pending"`
+}
+
+// reloading makes sure two reloads (a SIGHUP and `cloudkeeper reload`) don't step on each other
+var reloading sync.Mutex
+
+// reloadConfig re-reads the configuration the daemon was started with (same flags, same file, the environment as it was)
+// and switches the running daemon over to it: backup sets get their new schedule, watches follow the directories, and the backends of changed destinations are swapped.
+// Queued changes stay in the database and are pushed by their set, whatever its new settings are.
+// A configuration which doesn't parse, names a missing directory or a backend which can't be opened is rejected, the running one is kept.
+func reloadConfig(ctx context.Context) (reloadResponse, error) {
+	reloading.Lock()
+	defer reloading.Unlock()
+
+	var resp reloadResponse
+	current := storage.Current()
+	old := *current.Config
+	cfg, err := fsconfig.ReadConfig(flag.NewFlagSet("reload", flag.ContinueOnError), os.Args[1:])
+	if err != nil {
+		return resp, fmt.Errorf("invalid configuration, keeping the running one: %v", err)
+	}
+	cfg, resp.Pending = fsconfig.KeepRestartOnly(old, cfg)
+	resp.Applied = fsconfig.Diff(old, cfg)
+	for _, change := range resp.Pending {
+		customlog.Logger.Warn("Setting takes effect after a restart", zap.String("setting", change.Setting), zap.String("new", change.New))
+	}
+	if len(resp.Applied) == 0 {
+		customlog.Logger.Info("Configuration reloaded, nothing to apply")
+		return resp, nil
+	}
+
+	// A watch on a directory which isn't there can't be set up
+	for _, set := range cfg.Sets {
+		if info, err := os.Stat(set.BackupDir); err != nil || !info.IsDir() {
+			return resp, fmt.Errorf("invalid configuration, keeping the running one: directory %s of backup set %q isn't accessible", set.BackupDir, set.Name)
+		}
+	}
+
+	// Sets keep their backend as long as it's the same bucket or directory, the others get a new one
+	backends := make(map[string]storage.Backend, len(cfg.Sets))
+	for _, set := range cfg.Sets {
+		if prev, ok := old.FindSet(set.Name); ok && sameBackend(old.WithSet(prev), cfg.WithSet(set)) {
+			backends[set.Name] = current.For(set.Name)
+			continue
+		}
+		backend, err := openBackend(ctx, cfg.WithSet(set))
+		if err != nil {
+			return resp, fmt.Errorf("invalid configuration, keeping the running one: opening the backend of backup set %q: %v", set.Name, err)
+		}
+		backends[set.Name] = backend
+	}
+	for _, set := range cfg.Sets {
+		if err := checkSnapshots(ctx, cfg.WithSet(set), backends[set.Name]); err != nil {
+			return resp, fmt.Errorf("invalid configuration, keeping the running one: backup set %q: %v", set.Name, err)
+		}
+	}
+	storage.Apply(cfg, backends, backends[cfg.Sets[0].Name])
+
+	for _, change := range resp.Applied {
+		customlog.Logger.Info("Configuration changed", zap.String("setting", change.Setting), zap.String("old", change.Old), zap.String("new", change.New))
+	}
+
+	// Like at startup, what's already in a new directory never produces an event
+	if cfg.ReconcileOnStartup {
+		for _, set := range cfg.Sets {
+			if prev, ok := old.FindSet(set.Name); ok && prev.BackupDir == set.BackupDir {
+				continue
+			}
+			go func() {
+				if _, err := reconcile.RunSet(ctx, set, cfg.ReconcileChecksum); err != nil {
+					customlog.Logger.Error("reconciling the reloaded backup set failed", zap.String("set", set.Name), zap.String("error", err.Error()))
+				}
+			}()
+		}
+	}
+	return resp, nil
+}
+
+// sameBackend tells if two configurations of a set talk to the same store in the same way
+func sameBackend(a, b fsconfig.MetaConfig) bool {
+	return a.Backend == b.Backend &&
+		a.S3Bucket == b.S3Bucket &&
+		a.LocalBackendDir == b.LocalBackendDir &&
+		a.S3Endpoint == b.S3Endpoint &&
+		a.S3PathStyle == b.S3PathStyle &&
+		a.S3CABundle == b.S3CABundle &&
+		a.S3InsecureSkipVerify == b.S3InsecureSkipVerify
+}
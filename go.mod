@@ -8,9 +8,15 @@ require (
 	github.com/joho/godotenv v1.5.1
 )
 
-require golang.org/x/sys v0.4.0
+require golang.org/x/sys v0.28.0
 
-require go.etcd.io/bbolt v1.3.10
+require (
+	github.com/klauspost/compress v1.17.9
+	github.com/robfig/cron/v3 v3.0.1
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/crypto v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require go.uber.org/multierr v1.10.0 // indirect
 
@@ -2,75 +2,784 @@ package backup
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/db"
 	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
-	"github.com/Praveen005/CloudKeeper/internal/s3client"
+	"github.com/Praveen005/CloudKeeper/internal/storage"
 	bolt "go.etcd.io/bbolt"
 	"go.uber.org/zap"
 )
 
-// Backup function periodically calls the flushToS3 function to flush the data(files) to s3
+// Backup function periodically calls the flushToS3 function to flush the data(files) to s3.
+// Every backup set is pushed on its own schedule (`S3BackupInterval` or `S3_BACKUP_SCHEDULE` of the set), to its own backend.
 func Backup(ctx context.Context) {
-	ticker := time.NewTicker(fsconfig.MetaCfg.S3BackupInterval)
+	// A reloaded set starts over with its new schedule, its queued changes wait for it in the database
+	fsconfig.RunSets(ctx, func(a, b fsconfig.BackupSet) bool { return reflect.DeepEqual(a, b) }, backupSet)
+}
+
+// backupSet pushes the queued changes of a single backup set on the schedule of the set: every `S3BackupInterval`,
+// or at the times of its cron expression. Nothing is pushed within a blackout window of the set, not even retries: a push under way stops when one opens.
+func backupSet(ctx context.Context, set fsconfig.BackupSet) {
+	plan, err := set.Plan()
+	if err != nil {
+		// Can't happen, the schedule was checked when the configuration was read
+		customlog.Logger.Error("invalid schedule", zap.String("set", set.Name), zap.String("error", err.Error()))
+		return
+	}
 	customlog.Logger.Debug("Inside backup function",
-		zap.String("Backup Interval", fsconfig.MetaCfg.S3BackupInterval.String()))
+		zap.String("set", set.Name),
+		zap.String("schedule", plan.String()))
+
+	// A push which was due while we weren't running is made up for right away, unless that's within a blackout window.
+	// slot is the time of the schedule the next push is planned for, the push itself starts at next: with jitter, after any blackout window.
+	now := time.Now()
+	slot := plan.Next(now)
+	next := plan.Start(slot)
+	if set.CatchUp {
+		if last, ok, err := db.LastRun(set.Name); err != nil {
+			customlog.Logger.Error("error looking up the last push", zap.String("set", set.Name), zap.String("error", err.Error()))
+		} else if ok && plan.Missed(last, now) {
+			slot, next = now, plan.Defer(now)
+			customlog.Logger.Info("Catching up on a missed push", zap.String("set", set.Name), zap.Time("last push", last))
+		}
+	}
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	planRun(set, next)
+
+	// Fires when the earliest failed file is due for another attempt, so retries don't wait for the next tick
+	retry := time.NewTimer(0)
+	<-retry.C
+	defer retry.Stop()
+
+	// current returns the configuration and backends in use, with the set as it is in there.
+	// A reload which changed the set stops this goroutine, till then it works with whatever was published last.
+	current := func() (*storage.State, fsconfig.BackupSet, bool) {
+		st := storage.Current()
+		current, ok := st.Config.FindSet(set.Name)
+		return st, current, ok
+	}
+
+	// flush tells if it pushed, or was put off by a blackout window. scheduled is for the pushes of the schedule, not the retries in between.
+	flush := func(scheduled bool) bool {
+		if end, ok := plan.Blackout(time.Now()); ok {
+			retry.Reset(time.Until(end))
+			customlog.Logger.Info("Within a blackout window, pushing later", zap.String("set", set.Name), zap.Time("at", end))
+			return false
+		}
+		st, set, ok := current()
+		if !ok {
+			return false
+		}
+
+		if err := FlushSet(st, set, scheduled); errors.Is(err, ErrFrozen) {
+			customlog.Logger.Warn("Not pushing to the backend", zap.String("set", set.Name), zap.String("error", err.Error()))
+		} else if errors.Is(err, ErrBlackout) {
+			// The window opened while pushing, the rest waits on the queue till it ends
+			end, ok := plan.Blackout(time.Now())
+			if !ok {
+				end = time.Now()
+			}
+			retry.Reset(time.Until(end))
+			customlog.Logger.Info("A blackout window started, pushing the rest later", zap.String("set", set.Name), zap.Time("at", end))
+			return false
+		} else if err != nil {
+			// One bad file mustn't take the daemon down, the failed ones are retried and everything else goes on
+			customlog.Logger.Error("Flushing data to s3 failed",
+				zap.String("set", set.Name),
+				zap.String("error", err.Error()),
+			)
+		} else {
+			customlog.Logger.Info("Success! all updates to s3 completed", zap.String("set", set.Name))
+		}
+
+		next, ok, err := db.NextRetry(inSet(st.Config, set))
+		if err != nil {
+			customlog.Logger.Error("error looking up pending retries", zap.String("error", err.Error()))
+			return true
+		}
+		if ok {
+			retry.Reset(time.Until(next))
+			customlog.Logger.Info("Retrying failed file(s) later", zap.String("set", set.Name), zap.Time("at", next))
+		}
+		return true
+	}
+
+	// Continuous sync: a commit to the journal arms the sync timer a quiet period ahead, unless it's set to go off sooner,
+	// so a stream of changes doesn't keep putting it off. SyncSet then tells when the next of the paths left is due.
+	var journaled <-chan struct{}
+	syncTimer := time.NewTimer(0)
+	<-syncTimer.C
+	defer syncTimer.Stop()
+	var syncAt time.Time
+	armSync := func(at time.Time) {
+		if !syncTimer.Stop() {
+			select {
+			case <-syncTimer.C:
+			default:
+			}
+		}
+		syncAt = at
+		if !at.IsZero() {
+			syncTimer.Reset(time.Until(at))
+		}
+	}
+	if set.ContinuousSync {
+		journaled = db.Journaled()
+		// Whatever is queued already
+		armSync(time.Now())
+	}
+	syncNow := func() {
+		syncAt = time.Time{}
+		if end, ok := plan.Blackout(time.Now()); ok {
+			armSync(end)
+			customlog.Logger.Debug("Within a blackout window, syncing later", zap.String("set", set.Name), zap.Time("at", end))
+			return
+		}
+		st, set, ok := current()
+		if !ok {
+			return
+		}
+		next, err := SyncSet(st, set)
+		if errors.Is(err, ErrFrozen) {
+			customlog.Logger.Debug("Not syncing to the backend", zap.String("set", set.Name), zap.String("error", err.Error()))
+		} else if errors.Is(err, ErrBlackout) {
+			customlog.Logger.Debug("A blackout window started, syncing the rest later", zap.String("set", set.Name))
+			if end, ok := plan.Blackout(time.Now()); ok {
+				next = end
+			}
+		} else if err != nil {
+			customlog.Logger.Error("Continuous sync failed", zap.String("set", set.Name), zap.String("error", err.Error()))
+		}
+		// Files which failed just now are due again once they're done backing off
+		if retryAt, ok, err := db.NextRetry(inSet(st.Config, set)); err != nil {
+			customlog.Logger.Error("error looking up pending retries", zap.String("error", err.Error()))
+		} else if ok && (next.IsZero() || retryAt.Before(next)) {
+			next = retryAt
+		}
+		armSync(next)
+	}
 
-	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker.C:
-			customlog.Logger.Debug("Ticker ticked: starting file(s) update to S3")
-
-			if err := FlushToS3(); err != nil {
-				customlog.Logger.Error("Flushing data to s3 failed",
-					zap.String("error", err.Error()),
-				)
-				os.Exit(1)
+		case <-journaled:
+			journaled = db.Journaled()
+			if at := time.Now().Add(set.SyncQuietPeriod); syncAt.IsZero() || at.Before(syncAt) {
+				armSync(at)
+			}
+		case <-syncTimer.C:
+			customlog.Logger.Debug("Syncing changed file(s)", zap.String("set", set.Name))
+			syncNow()
+		case <-timer.C:
+			customlog.Logger.Debug("Ticker ticked: starting file(s) update to S3", zap.String("set", set.Name))
+			// Pruning while frozen could drop the snapshots from before the damage
+			if flush(true) {
+				if state, _ := db.Frozen(); fsconfig.Current().PruneAfterBackup && state == nil {
+					if _, err := PruneSet(ctx, set, RetentionPolicy(), storage.DefaultGCGrace, false); err != nil {
+						customlog.Logger.Error("Pruning snapshots failed", zap.String("set", set.Name), zap.String("error", err.Error()))
+					}
+				}
 			}
-			customlog.Logger.Info("Success! all updates to s3 completed")
+			// Counting from the planned time, not from now: pushes neither drift by how late they started nor pile up jitter
+			slot = plan.Following(slot, time.Now())
+			next = plan.Start(slot)
+			timer.Reset(time.Until(next))
+			planRun(set, next)
+		case <-retry.C:
+			customlog.Logger.Debug("Retrying failed file(s)", zap.String("set", set.Name))
+			flush(false)
 		case <-ctx.Done():
-			customlog.Logger.Warn("[Inside Backup] Context cancellation signal received. Shutting down gracefully.")
+			customlog.Logger.Warn("[Inside Backup] Context cancellation signal received. Shutting down gracefully.", zap.String("set", set.Name))
 			return
 		}
 	}
 }
 
-// FlushToS3 function calls the deleteFromS3 or uploadToS3 function as per value of the action field specified for a file path in the metadata
+// inSet returns a match for the queued paths which belong to the set in cfg
+func inSet(cfg *fsconfig.MetaConfig, set fsconfig.BackupSet) func(path string) bool {
+	return func(path string) bool {
+		owner, ok := cfg.SetFor(path)
+		return ok && owner.Name == set.Name
+	}
+}
+
+// ErrFrozen is returned by FlushToS3 while the guard holds pushing back, till `cloudkeeper resume`
+var ErrFrozen = errors.New("pushing is frozen by the guard, run `cloudkeeper resume` once the changes are checked")
+
+// ErrBlackout is returned by FlushSet and SyncSet when a blackout window of the set opened while pushing, what's left stays on the queue
+var ErrBlackout = errors.New("a blackout window started")
+
+// FlushToS3 pushes the queued changes of every backup set, one set after the other.
+// It stops at ErrFrozen, any other error of a set doesn't keep the next one from being pushed.
 func FlushToS3() error {
-	db, err := bolt.Open("filesToS3.db", 0666, &bolt.Options{Timeout: 2 * time.Minute})
+	var errs []error
+	st := storage.Current()
+	for _, set := range st.Config.BackupSets() {
+		err := FlushSet(st, set, false)
+		if errors.Is(err, ErrFrozen) {
+			return err
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("backup set %s: %w", set.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FlushSet function calls the deleteFromS3 or uploadToS3 function as per value of the action field specified for a file path of the backup set in the metadata
+func FlushSet(st *storage.State, set fsconfig.BackupSet, scheduled bool) (err error) {
+	flushLock.RLock()
+	defer flushLock.RUnlock()
+	var ran bool
+	defer func() { recordFlush(set, err, scheduled && ran) }()
+
+	if err := prepareFlush(); err != nil {
+		return err
+	}
+
+	ctx := fsconfig.WithConfig(context.Background(), st.Config)
+	backend := st.For(set.Name)
+
+	// Parts of uploads we gave up on cost money, get rid of them before starting new ones
+	if err := storage.AbortStaleMultipartUploads(ctx, backend, set.S3Prefix); err != nil {
+		customlog.Logger.Warn("cleaning up stale multipart uploads failed", zap.String("set", set.Name), zap.String("error", err.Error()))
+	}
+
+	if st.Config.TrashRetention > 0 {
+		purged, err := storage.PurgeTrash(ctx, backend, set.S3Prefix, st.Config.TrashRetention)
+		if err != nil {
+			customlog.Logger.Warn("purging the trash failed", zap.String("set", set.Name), zap.String("error", err.Error()))
+		} else if purged > 0 {
+			customlog.Logger.Info("Purged files deleted long ago from the trash", zap.String("set", set.Name), zap.Int("objects", purged))
+		}
+	}
+
+	// A snapshot of the queue, every entry is taken off the queue as soon as its action is done:
+	// no write transaction is held open while talking to s3, and new events keep flowing into the queue meanwhile
+	queue, err := readSetQueue(st.Config, set)
 	if err != nil {
-		return fmt.Errorf("failed to create/open database at the given path: %v", err)
+		return err
+	}
+	ran, err = pushQueue(ctx, st, set, queue, false)
+	return err
+}
+
+// prepareFlush folds the journal into the queue, and refuses to go on while the guard holds pushing back
+func prepareFlush() error {
+	// Pick up everything journaled since the last compaction, not just what FlushToDB got to
+	if _, err := db.PersistData(); err != nil {
+		return fmt.Errorf("error compacting the journal: %v", err)
 	}
-	defer db.Close()
 
-	if err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("filesToUpdate"))
+	return checkFrozen()
+}
 
-		err := b.ForEach(func(k, v []byte) error {
-			fileName := string(k)
-			action := string(v)
-			var err error
-			if action == "add" {
-				err = s3client.UploadToS3(fileName, fsconfig.MetaCfg.S3Bucket, fsconfig.MetaCfg.S3Prefix)
-			} else if action == "remove" {
-				err = s3client.DeleteFromS3(fileName)
-			}
+// checkFrozen returns ErrFrozen while the guard holds pushing back.
+// The guard saw something like a mass deletion or ransomware: keep the queue, but don't let the damage reach the backup.
+func checkFrozen() error {
+	if state, err := db.Frozen(); err != nil {
+		return err
+	} else if state != nil {
+		return fmt.Errorf("%w since %s: %s", ErrFrozen, state.At.Format(time.RFC3339), state.Reason)
+	}
+	return nil
+}
+
+// unsnapshotted holds the sets which pushed changes since their last snapshot, by name.
+// Continuous sync doesn't take snapshots, the next scheduled push does.
+var unsnapshotted = struct {
+	sync.Mutex
+	sets map[string]bool
+}{sets: make(map[string]bool)}
 
-			if err != nil {
-				return fmt.Errorf("error processing file %s (action: %s): %v", fileName, action, err)
+// pushQueue carries out the queue entries of a set and tells if it ran through all of them, continuous tells if it's continuous sync doing so
+func pushQueue(ctx context.Context, st *storage.State, set fsconfig.BackupSet, queue map[string]db.QueueEntry, continuous bool) (ran bool, err error) {
+	// Moves go first, they copy what the backend has for the old path before it's removed.
+	// Removals go next: a directory that was deleted and created again is queued as a removal of the directory
+	// and uploads of the files in it, doing it the other way around would delete the fresh uploads.
+	var moves, removals, additions []queueItem
+	var deferred int
+	now := time.Now()
+	for path, entry := range queue {
+		if entry.NextAttempt.After(now) {
+			deferred++ // failed recently, backing off
+			continue
+		}
+		item := queueItem{set: set, path: path, entry: entry}
+		switch entry.Action() {
+		case db.ActionMove:
+			moves = append(moves, item)
+		case db.ActionRemove:
+			removals = append(removals, item)
+		default:
+			additions = append(additions, item)
+		}
+	}
+	// A move takes the old path off the queue itself, once its objects were copied
+	sources := make(map[string]bool)
+	for i, item := range moves {
+		if source, ok := queue[item.entry.From]; ok && source.State == db.StateMovedFrom && !sources[item.entry.From] {
+			moves[i].source = &source
+			sources[item.entry.From] = true
+		}
+	}
+	if len(sources) > 0 {
+		var rest []queueItem
+		for _, item := range removals {
+			if !sources[item.path] {
+				rest = append(rest, item)
 			}
-			// if successfully uploaded, delete from db
-			b.Delete(k)
+		}
+		removals = rest
+	}
 
+	start := time.Now()
+	var stats flushStats
+	// The guard may trip while the queue drains, e.g. on a mass deletion coming in meanwhile: what's left waits for `cloudkeeper resume`.
+	// A blackout window may open meanwhile as well, what's left waits till it ends.
+	halt := checkFrozen
+	if plan, err := set.Plan(); err == nil {
+		halt = func() error {
+			if err := checkFrozen(); err != nil {
+				return err
+			}
+			if end, ok := plan.Blackout(time.Now()); ok {
+				return fmt.Errorf("%w, pushing the rest at %s", ErrBlackout, end.Format(time.RFC3339))
+			}
 			return nil
-		})
+		}
+	}
+	for _, items := range [][]queueItem{moves, removals, additions} {
+		runWorkers(ctx, st, items, &stats, halt)
+	}
+
+	// Record the tree as it is now, unless nothing changed since the last snapshot
+	unsnapshotted.Lock()
+	if stats.done > 0 {
+		unsnapshotted.sets[set.Name] = true
+	}
+	snapshot := st.Config.Snapshots && !continuous && unsnapshotted.sets[set.Name] && stats.halted == nil
+	unsnapshotted.Unlock()
+	if snapshot {
+		if err := takeSnapshot(ctx, st.For(set.Name), set); err != nil {
+			customlog.Logger.Error("taking a snapshot failed", zap.String("set", set.Name), zap.String("error", err.Error()))
+			if stats.firstErr == nil {
+				stats.firstErr = err
+			}
+			stats.failed++
+		} else {
+			unsnapshotted.Lock()
+			delete(unsnapshotted.sets, set.Name)
+			unsnapshotted.Unlock()
+		}
+	}
+
+	fields := []zap.Field{
+		zap.String("set", set.Name),
+		zap.String("destination", set.Destination()),
+		zap.Bool("continuous sync", continuous),
+		zap.Int("queued", len(queue)),
+		zap.Int("done", stats.done),
+		zap.Int("failed", stats.failed),
+		zap.Int("skipped", stats.skipped),
+		zap.Int("deferred", deferred),
+		zap.Int("dead lettered", stats.deadLettered),
+		zap.Int("left on the queue", stats.left),
+		zap.Int64("bytes", stats.bytes),
+		zap.Int64("stored bytes", stats.storedBytes),
+	}
+	if stats.storedBytes > 0 {
+		fields = append(fields, zap.String("compression ratio", fmt.Sprintf("%.2fx", float64(stats.bytes)/float64(stats.storedBytes))))
+	}
+	fields = append(fields, zap.Duration("took", time.Since(start)))
+	customlog.Logger.Info("Flush to s3 finished", fields...)
+	if stats.halted != nil {
+		return false, stats.halted
+	}
+	if stats.failed > 0 {
+		return true, fmt.Errorf("%d of %d file(s) failed, first error: %v", stats.failed, len(queue), stats.firstErr)
+	}
+	return true, nil
+}
+
+// SyncSet pushes the queued changes of a set in continuous sync mode which are due (see dueAt) and returns when the next of the others is due
+func SyncSet(st *storage.State, set fsconfig.BackupSet) (next time.Time, err error) {
+	flushLock.RLock()
+	defer flushLock.RUnlock()
+
+	if err := prepareFlush(); err != nil {
+		return next, err
+	}
+	queue, err := readSetQueue(st.Config, set)
+	if err != nil {
+		return next, err
+	}
+
+	// The old path of a move goes along with the new one, the two are only pushed together
+	sources := make(map[string]bool)
+	for _, entry := range queue {
+		if entry.State == db.StateMoved {
+			sources[entry.From] = true
+		}
+	}
+	now := time.Now()
+	due := make(map[string]db.QueueEntry)
+	for path, entry := range queue {
+		if entry.State == db.StateMovedFrom && sources[path] {
+			continue
+		}
+		at := dueAt(set, entry)
+		if at.After(now) {
+			if next.IsZero() || at.Before(next) {
+				next = at
+			}
+			continue
+		}
+		due[path] = entry
+		if source, ok := queue[entry.From]; ok && entry.State == db.StateMoved {
+			due[entry.From] = source
+		}
+	}
+	if len(due) == 0 {
+		return next, nil
+	}
+	_, err = pushQueue(fsconfig.WithConfig(context.Background(), st.Config), st, set, due, true)
+	recordFlush(set, err, false)
+	return next, err
+}
+
+// dueAt tells when continuous sync pushes a queued path: after the quiet period, or the max delay at the latest, and not while backing off after a failure
+func dueAt(set fsconfig.BackupSet, entry db.QueueEntry) time.Time {
+	first := entry.FirstSeen
+	if first.IsZero() {
+		first = entry.LastSeen
+	}
+	at := entry.LastSeen.Add(set.SyncQuietPeriod)
+	if capped := first.Add(set.SyncMaxDelay); capped.Before(at) {
+		at = capped
+	}
+	if entry.NextAttempt.After(at) {
+		at = entry.NextAttempt
+	}
+	return at
+}
+
+// readSetQueue returns the queue entries of the paths belonging to the set in cfg
+func readSetQueue(cfg *fsconfig.MetaConfig, set fsconfig.BackupSet) (map[string]db.QueueEntry, error) {
+	queue, err := db.ReadQueue()
+	if err != nil {
+		return nil, fmt.Errorf("error reading the queue: %v", err)
+	}
+	match := inSet(cfg, set)
+	for path := range queue {
+		if !match(path) {
+			delete(queue, path)
+		}
+	}
+	return queue, nil
+}
+
+// takeSnapshot stores a snapshot of everything of the set in the object index, i.e. of what's in the backend, in backend
+func takeSnapshot(ctx context.Context, backend storage.Backend, set fsconfig.BackupSet) error {
+	index, err := db.ReadIndexBelow(set.BackupDir)
+	if err != nil {
+		return fmt.Errorf("error reading the object index: %v", err)
+	}
+	snapshot := storage.NewSnapshot(set.S3Prefix)
+	var unversioned int
+	for path, entry := range index {
+		relativePath, err := filepath.Rel(set.BackupDir, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path : %v", err)
+		}
+		file := storage.SnapshotFile{
+			Path:    relativePath,
+			Size:    entry.Size,
+			ModTime: entry.ModTime,
+			Mode:    os.FileMode(entry.Mode),
+			Chunks:  entry.Chunks,
+		}
+		// A file stored as a single object is overwritten in place, only the bucket's versions hold on to what it was.
+		// Files uploaded before versioning was turned on have none.
+		if entry.Chunks == nil {
+			if entry.VersionID == "" {
+				unversioned++
+				continue
+			}
+			file.Key, file.VersionID = storage.Key(set.S3Prefix, relativePath), entry.VersionID
+		}
+		snapshot.Files = append(snapshot.Files, file)
+	}
+	if unversioned > 0 {
+		customlog.Logger.Warn("Files stored before versioning or chunking was turned on aren't part of snapshots, touch them to upload them again",
+			zap.String("set", set.Name),
+			zap.Int("files", unversioned),
+		)
+	}
+	if err := storage.PutSnapshot(ctx, backend, set.S3Prefix, snapshot); err != nil {
 		return err
-	}); err != nil {
-		return fmt.Errorf("error updating database: %v", err)
 	}
+	customlog.Logger.Info("Snapshot taken", zap.String("set", set.Name), zap.String("id", snapshot.ID), zap.Int("files", len(snapshot.Files)))
 	return nil
 }
+
+// flushLock keeps garbage collection and flushes apart: a flush may reuse a chunk which gc found unreferenced and is about to delete
+var flushLock sync.RWMutex
+
+// GarbageCollect deletes the chunks no backed up file or snapshot refers to anymore, in every backup set. Flushes wait till it's done.
+// The result adds up the sets.
+func GarbageCollect(ctx context.Context, opts storage.GCOptions) (storage.GCResult, error) {
+	flushLock.Lock()
+	defer flushLock.Unlock()
+
+	var total storage.GCResult
+	st := storage.Current()
+	for _, set := range st.Config.BackupSets() {
+		result, err := garbageCollect(fsconfig.WithConfig(ctx, st.Config), st.For(set.Name), set, opts)
+		addGC(&total, result)
+		if err != nil {
+			return total, fmt.Errorf("backup set %s: %w", set.Name, err)
+		}
+	}
+	return total, nil
+}
+
+func garbageCollect(ctx context.Context, backend storage.Backend, set fsconfig.BackupSet, opts storage.GCOptions) (storage.GCResult, error) {
+	result, err := storage.GarbageCollect(ctx, backend, set.S3Prefix, opts)
+	customlog.Logger.Info("Garbage collection finished",
+		zap.String("set", set.Name),
+		zap.Bool("dry run", opts.DryRun),
+		zap.Int("manifests", result.Manifests),
+		zap.Int("snapshots", result.Snapshots),
+		zap.Int("chunks", result.Chunks),
+		zap.Int("referenced", result.Referenced),
+		zap.Int("deleted", result.Deleted),
+		zap.Int64("deleted bytes", result.DeletedBytes),
+		zap.Int("within grace period", result.TooRecent),
+	)
+	return result, err
+}
+
+// addGC adds the result of a garbage collection run to total
+func addGC(total *storage.GCResult, result storage.GCResult) {
+	total.Manifests += result.Manifests
+	total.Snapshots += result.Snapshots
+	total.Chunks += result.Chunks
+	total.Referenced += result.Referenced
+	total.Deleted += result.Deleted
+	total.DeletedBytes += result.DeletedBytes
+	total.TooRecent += result.TooRecent
+	total.DeletedKeys = append(total.DeletedKeys, result.DeletedKeys...)
+}
+
+type queueItem struct {
+	set    fsconfig.BackupSet
+	path   string
+	entry  db.QueueEntry
+	source *db.QueueEntry // moves only: the entry of the old path, if it's queued as moved away
+}
+
+type flushStats struct {
+	mu           sync.Mutex
+	done         int
+	failed       int
+	skipped      int // claimed by another flush still running
+	deadLettered int
+	bytes        int64 // size of the uploaded files
+	storedBytes  int64 // what they took up in the backend, after compression/encryption
+	firstErr     error
+	halted       error // why the entries left weren't processed
+	left         int   // entries left on the queue because of it
+}
+
+// inFlight holds the paths a worker is busy with. A path is claimed before it's processed,
+// so flushes running at the same time (e.g. a slow one still going when the next one starts) never work on the same path.
+var inFlight = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+func claim(path string) bool {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	if inFlight.paths[path] {
+		return false
+	}
+	inFlight.paths[path] = true
+	return true
+}
+
+func release(path string) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	delete(inFlight.paths, path)
+}
+
+// runWorkers processes the items with `UploadConcurrency` workers and waits for them, leaving the rest on the queue once halt returns an error
+func runWorkers(ctx context.Context, st *storage.State, items []queueItem, stats *flushStats, halt func() error) {
+	workers := st.Config.UploadConcurrency
+	backoff := func(attempts int) time.Duration { return backoff(st.Config, attempts) }
+	if workers <= 0 {
+		workers = 1
+	}
+	jobs := make(chan queueItem)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				if err := halt(); err != nil {
+					stats.mu.Lock()
+					if stats.halted == nil {
+						stats.halted = err
+					}
+					stats.left++
+					stats.mu.Unlock()
+					continue
+				}
+				if !claim(item.path) {
+					stats.mu.Lock()
+					stats.skipped++
+					stats.mu.Unlock()
+					continue
+				}
+				uploaded, err := processEntry(ctx, st, item)
+				var deadLettered bool
+				if err != nil {
+					var recordErr error
+					deadLettered, recordErr = db.RecordFailure(item.path, item.entry.Seq, err, st.Config.MaxAttempts, backoff)
+					if recordErr != nil {
+						customlog.Logger.Error("error recording failed attempt", zap.String("error", recordErr.Error()))
+					}
+				}
+				release(item.path)
+
+				stats.mu.Lock()
+				for _, f := range uploaded {
+					stats.bytes += f.Size
+					stats.storedBytes += f.StoredSize
+				}
+				if err != nil {
+					stats.failed++
+					if stats.firstErr == nil {
+						stats.firstErr = err
+					}
+					customlog.Logger.Error("Processing queued file failed",
+						zap.String("set", item.set.Name),
+						zap.String("path", item.path),
+						zap.Int("attempt", item.entry.Attempts+1),
+						zap.String("error", err.Error()),
+					)
+					if deadLettered {
+						stats.deadLettered++
+						customlog.Logger.Error("Giving up on file, moved it to the dead letter bucket",
+							zap.String("set", item.set.Name),
+							zap.String("path", item.path),
+						)
+					}
+				} else {
+					stats.done++
+				}
+				stats.mu.Unlock()
+			}
+		}()
+	}
+	for i, item := range items {
+		stats.mu.Lock()
+		halted := stats.halted != nil
+		if halted {
+			stats.left += len(items) - i
+		}
+		stats.mu.Unlock()
+		if halted {
+			break
+		}
+		jobs <- item
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// processEntry carries out the action of a single queue entry and takes it off the queue. It returns the files which were uploaded.
+func processEntry(ctx context.Context, st *storage.State, item queueItem) ([]storage.UploadedFile, error) {
+	fileName, entry := item.path, item.entry
+	if entry.Action() == db.ActionMove {
+		return processMove(ctx, st, item)
+	}
+
+	var update func(tx *bolt.Tx) error
+	var uploaded []storage.UploadedFile
+	action := entry.Action()
+	if action == db.ActionAdd {
+		var err error
+		uploaded, err = storage.Upload(ctx, st.For(item.set.Name), fileName, item.set.S3Prefix)
+		if err != nil {
+			// Whatever made it to s3 is indexed, even if the rest of a directory failed
+			if indexErr := db.Conn.Update(indexUploads(uploaded)); indexErr != nil {
+				customlog.Logger.Error("error indexing uploaded files", zap.String("error", indexErr.Error()))
+			}
+			return uploaded, fmt.Errorf("error processing file %s (action: %s): %v", fileName, action, err)
+		}
+		update = indexUploads(uploaded)
+	} else if action == db.ActionRemove {
+		if err := storage.Delete(ctx, st.For(item.set.Name), fileName); err != nil {
+			return nil, fmt.Errorf("error processing file %s (action: %s): %v", fileName, action, err)
+		}
+		update = func(tx *bolt.Tx) error {
+			return db.DeleteIndex(tx, fileName)
+		}
+	}
+
+	// if successfully uploaded, delete from db
+	if err := db.Dequeue(fileName, entry.Seq, action, update); err != nil {
+		return uploaded, fmt.Errorf("error updating database: %v", err)
+	}
+	return uploaded, nil
+}
+
+// backoff returns how long to wait after the given number of failed attempts: exponential, capped at `RetryMaxDelay`,
+// with jitter so files that failed together (say, during an outage) don't all come back at the same moment
+func backoff(cfg *fsconfig.MetaConfig, attempts int) time.Duration {
+	delay := cfg.RetryBaseDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for i := 1; i < attempts && delay < cfg.RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if cfg.RetryMaxDelay > 0 && delay > cfg.RetryMaxDelay {
+		delay = cfg.RetryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// indexUploads records the uploaded files in the object index
+func indexUploads(uploaded []storage.UploadedFile) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		for _, f := range uploaded {
+			if err := db.PutIndex(tx, f.Path, db.IndexEntry{
+				Size:       f.Size,
+				StoredSize: f.StoredSize,
+				ModTime:    f.ModTime,
+				ETag:       f.ETag,
+				UploadedAt: time.Now(),
+				Mode:       uint32(f.Mode),
+				VersionID:  f.VersionID,
+				Chunks:     f.Chunks,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,1461 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/compress"
+	"github.com/Praveen005/CloudKeeper/internal/crypt"
+	"github.com/Praveen005/CloudKeeper/internal/db"
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"github.com/Praveen005/CloudKeeper/internal/reconcile"
+	"github.com/Praveen005/CloudKeeper/internal/restore"
+	"github.com/Praveen005/CloudKeeper/internal/retention"
+	"github.com/Praveen005/CloudKeeper/internal/storage"
+	"github.com/Praveen005/CloudKeeper/internal/storage/local"
+)
+
+// setup runs the backup pipeline against a local backend in temporary directories and returns the backup directory
+func setup(t *testing.T) string {
+	t.Helper()
+	backupDir := t.TempDir()
+	storage.ForgetApplied()
+	t.Cleanup(storage.ForgetApplied)
+	fsconfig.MetaCfg = fsconfig.MetaConfig{
+		BackupDir:            backupDir,
+		Backend:              fsconfig.BackendLocal,
+		S3Prefix:             "backup",
+		MultipartThreshold:   64,
+		MultipartPartSize:    16,
+		MultipartConcurrency: 2,
+		MultipartStaleAfter:  24 * time.Hour,
+		UploadConcurrency:    4,
+		MaxAttempts:          3,
+	}
+
+	backend, err := local.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Default = backend
+	storage.Backends = make(map[string]storage.Backend)
+	storage.Transforms = nil
+	storage.Names = nil
+	storage.Decoders = nil
+	storage.SpoolDir = filepath.Join(t.TempDir(), "spool")
+	storage.Layout = fsconfig.LayoutFiles
+	unsnapshotted.sets = make(map[string]bool)
+
+	db.Path = filepath.Join(t.TempDir(), "test.db")
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		db.RunJournal(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		db.Close()
+	})
+	return backupDir
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func queue(t *testing.T, op string, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		db.AppendJournal(path, op)
+	}
+	db.SyncJournal(context.Background())
+}
+
+func TestFlushAndRestore(t *testing.T) {
+	backupDir := setup(t)
+	files := map[string]string{
+		"a.txt":         "small file",
+		"dir/b.txt":     "another one",
+		"dir/big.bin":   strings.Repeat("0123456789", 20), // above the multipart threshold
+		"gone/soon.txt": "deleted later",
+	}
+	for name, content := range files {
+		writeFile(t, filepath.Join(backupDir, name), content)
+		queue(t, db.OpCreate, filepath.Join(backupDir, name))
+	}
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll(filepath.Join(backupDir, "gone"))
+	queue(t, db.OpRemove, filepath.Join(backupDir, "gone"))
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+	delete(files, "gone/soon.txt")
+
+	queued, err := db.ReadQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 0 {
+		t.Errorf("want an empty queue, got %v", queued)
+	}
+	index, err := db.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != len(files) {
+		t.Errorf("want %d indexed files, got %d", len(files), len(index))
+	}
+
+	target := t.TempDir()
+	result, err := restore.Run(context.Background(), restore.Options{
+		Backend:   storage.Default,
+		Prefix:    fsconfig.MetaCfg.S3Prefix,
+		TargetDir: target,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Downloaded != len(files) {
+		t.Errorf("want %d files restored, got %d", len(files), result.Downloaded)
+	}
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(target, name))
+		if err != nil {
+			t.Errorf("%s not restored: %v", name, err)
+			continue
+		}
+		if string(got) != content {
+			t.Errorf("%s: want %q, got %q", name, content, got)
+		}
+	}
+}
+
+func TestFlushAndRestoreEncrypted(t *testing.T) {
+	backupDir := setup(t)
+	key, err := crypt.KeyFromPassphrase("test passphrase", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Transforms = []storage.Transform{key}
+
+	files := map[string]string{
+		"a.txt":       "top secret",
+		"dir/big.bin": strings.Repeat("0123456789", 20), // multipart
+	}
+	for name, content := range files {
+		writeFile(t, filepath.Join(backupDir, name), content)
+		queue(t, db.OpCreate, filepath.Join(backupDir, name))
+	}
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing readable may end up in the backend
+	for name, content := range files {
+		body, info, err := storage.Default.Get(context.Background(), "backup/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, _ := io.ReadAll(body)
+		body.Close()
+		if strings.Contains(string(stored), content) {
+			t.Errorf("%s stored in plain text", name)
+		}
+		if info.Metadata[crypt.MetaKeyID] != key.ID() {
+			t.Errorf("%s: want key id %s in metadata, got %v", name, key.ID(), info.Metadata)
+		}
+	}
+	entries, _ := os.ReadDir(storage.SpoolDir)
+	if len(entries) != 0 {
+		t.Errorf("want an empty spool directory after upload, got %d entries", len(entries))
+	}
+
+	target := t.TempDir()
+	opts := restore.Options{Backend: storage.Default, Prefix: "backup", TargetDir: target}
+	if _, err := restore.Run(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(target, name))
+		if err != nil || string(got) != content {
+			t.Errorf("%s: want %q, got %q (%v)", name, content, got, err)
+		}
+	}
+
+	// With another key nothing gets restored, and it says why
+	other, _ := crypt.KeyFromPassphrase("wrong passphrase", "")
+	storage.Transforms = []storage.Transform{other}
+	err = storage.Download(context.Background(), storage.Default, "backup/a.txt", filepath.Join(t.TempDir(), "a.txt"))
+	if !errors.Is(err, crypt.ErrWrongKey) {
+		t.Errorf("want ErrWrongKey, got %v", err)
+	}
+}
+
+func TestEncryptedNames(t *testing.T) {
+	backupDir := setup(t)
+	key, err := crypt.KeyFromPassphrase("test passphrase", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Transforms = []storage.Transform{key}
+	storage.Names = key.NameKey()
+
+	files := []string{"customer-acme/contract.txt", "customer-acme/sub/notes.txt", "project-x/plan.txt"}
+	for _, name := range files {
+		writeFile(t, filepath.Join(backupDir, name), name)
+		queue(t, db.OpCreate, filepath.Join(backupDir, name))
+	}
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := storage.ListAll(context.Background(), storage.Default, "backup/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range objects {
+		for _, word := range []string{"customer", "acme", "contract", "project", "notes", "plan"} {
+			if strings.Contains(object.Key, word) {
+				t.Errorf("key %s gives away %q", object.Key, word)
+			}
+		}
+	}
+
+	// Deleting a directory deletes everything below its encrypted prefix, and nothing else
+	os.RemoveAll(filepath.Join(backupDir, "customer-acme"))
+	queue(t, db.OpRemove, filepath.Join(backupDir, "customer-acme"))
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	target := t.TempDir()
+	result, err := restore.Run(context.Background(), restore.Options{Backend: storage.Default, Prefix: "backup", TargetDir: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Downloaded != 1 {
+		t.Errorf("want 1 file restored, got %d", result.Downloaded)
+	}
+	if got, err := os.ReadFile(filepath.Join(target, "project-x/plan.txt")); err != nil || string(got) != "project-x/plan.txt" {
+		t.Errorf("project-x/plan.txt: got %q (%v)", got, err)
+	}
+}
+
+func TestFlushAndRestoreCompressed(t *testing.T) {
+	backupDir := setup(t)
+	codec, err := compress.New(compress.Zstd, compress.DefaultSkipExtensions, compress.DefaultMaxEntropy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := crypt.KeyFromPassphrase("test passphrase", "")
+	storage.Transforms = []storage.Transform{codec, key}
+
+	files := map[string]string{
+		"app.log":   strings.Repeat("GET /index.html 200\n", 500),
+		"photo.jpg": "pretend this is compressed",
+	}
+	for name, content := range files {
+		writeFile(t, filepath.Join(backupDir, name), content)
+		queue(t, db.OpCreate, filepath.Join(backupDir, name))
+	}
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	wantTransforms := map[string]string{"app.log": "zstd,aes-256-gcm", "photo.jpg": "aes-256-gcm"}
+	for name, want := range wantTransforms {
+		info, err := storage.Default.Stat(context.Background(), "backup/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Metadata[storage.MetaTransforms]; got != want {
+			t.Errorf("%s: want transforms %q, got %q", name, want, got)
+		}
+		if name == "app.log" && info.Size*5 > int64(len(files[name])) {
+			t.Errorf("app.log: %d bytes stored for %d", info.Size, len(files[name]))
+		}
+	}
+
+	// Compression switched off since: the objects are still decompressed
+	storage.Transforms = []storage.Transform{key}
+	for _, c := range compress.Decoders() {
+		storage.Decoders = append(storage.Decoders, c)
+	}
+	target := t.TempDir()
+	if _, err := restore.Run(context.Background(), restore.Options{Backend: storage.Default, Prefix: "backup", TargetDir: target}); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(target, name))
+		if err != nil || string(got) != content {
+			t.Errorf("%s: want %q, got %q (%v)", name, content, got, err)
+		}
+	}
+}
+
+func TestChunkedDedup(t *testing.T) {
+	backupDir := setup(t)
+	storage.Layout = fsconfig.LayoutChunks
+	fsconfig.MetaCfg.MultipartThreshold = 100 << 20
+	defer func() { storage.Layout = fsconfig.LayoutFiles }()
+
+	content := make([]byte, 6<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	edited := append([]byte("a few bytes inserted at the start"), content...)
+	files := map[string][]byte{
+		"one/data.bin":   content,
+		"two/data.bin":   content,
+		"three/data.bin": content,
+		"edited.bin":     edited,
+		"empty.txt":      nil,
+	}
+	for name, data := range files {
+		writeFile(t, filepath.Join(backupDir, name), string(data))
+		queue(t, db.OpCreate, filepath.Join(backupDir, name))
+	}
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := func() []storage.ObjectInfo {
+		t.Helper()
+		objects, err := storage.ListAll(context.Background(), storage.Default, storage.ChunkPrefix("backup"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return objects
+	}
+	// Three copies are stored once, the edited one only adds the chunk around the edit
+	stored := chunks()
+	var storedBytes int64
+	for _, chunk := range stored {
+		storedBytes += chunk.Size
+	}
+	if storedBytes > int64(len(content))+5<<20 {
+		t.Errorf("%d bytes stored in %d chunks for %d bytes of unique content", storedBytes, len(stored), len(content))
+	}
+
+	target := t.TempDir()
+	result, err := restore.Run(context.Background(), restore.Options{Backend: storage.Default, Prefix: "backup", TargetDir: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Downloaded != len(files) {
+		t.Errorf("want %d files restored, got %d", len(files), result.Downloaded)
+	}
+	for name, data := range files {
+		got, err := os.ReadFile(filepath.Join(target, name))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s not restored correctly (%d bytes, %v)", name, len(got), err)
+		}
+	}
+
+	// Chunks still used by another file stay, the rest goes, but only once the grace period is over
+	for _, name := range []string{"one", "two", "edited.bin"} {
+		os.RemoveAll(filepath.Join(backupDir, name))
+		queue(t, db.OpRemove, filepath.Join(backupDir, name))
+	}
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+	gc, err := GarbageCollect(context.Background(), storage.GCOptions{Grace: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.Deleted != 0 || gc.TooRecent == 0 {
+		t.Errorf("want unreferenced chunks kept for the grace period, got %+v", gc)
+	}
+	gc, err = GarbageCollect(context.Background(), storage.GCOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.Deleted == 0 || len(chunks()) != len(stored) {
+		t.Errorf("dry run: want unreferenced chunks reported, not deleted, got %+v", gc)
+	}
+	if _, err := GarbageCollect(context.Background(), storage.GCOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if left := len(chunks()); left != len(stored)-gc.Deleted || left != gc.Referenced {
+		t.Errorf("want %d chunks left, got %d", gc.Referenced, left)
+	}
+
+	target = t.TempDir()
+	if _, err := restore.Run(context.Background(), restore.Options{Backend: storage.Default, Prefix: "backup", TargetDir: target}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(target, "three/data.bin")); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("three/data.bin not restored correctly after gc (%v)", err)
+	}
+
+	// Reconciliation doesn't mistake the chunks for files which were deleted locally
+	reconciled, err := reconcile.Run(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reconciled.Added != 0 || reconciled.Removed != 0 {
+		t.Errorf("want nothing to reconcile, got %+v", reconciled)
+	}
+}
+
+func TestReservedDir(t *testing.T) {
+	backupDir := setup(t)
+	for _, name := range []string{".cloudkeeper/trash/notes.txt", "docs/.cloudkeeper/notes.txt"} {
+		writeFile(t, filepath.Join(backupDir, name), name)
+		queue(t, db.OpCreate, filepath.Join(backupDir, name))
+	}
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+	objects, err := storage.ListAll(context.Background(), storage.Default, "backup/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "backup/docs/.cloudkeeper/notes.txt" {
+		t.Errorf("want only the directory below the top level backed up, got %v", objects)
+	}
+
+	// Nor is it missing from the backup as far as reconciliation is concerned
+	reconciled, err := reconcile.Run(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reconciled.Added != 0 || reconciled.Removed != 0 {
+		t.Errorf("want nothing to reconcile, got %+v", reconciled)
+	}
+}
+
+func TestChunksInAnotherStore(t *testing.T) {
+	backupDir := setup(t)
+	storage.Layout = fsconfig.LayoutChunks
+	defer func() { storage.Layout = fsconfig.LayoutFiles }()
+
+	content := make([]byte, 3<<20)
+	rand.New(rand.NewSource(2)).Read(content)
+	path := filepath.Join(backupDir, "data.bin")
+	writeFile(t, path, string(content))
+	queue(t, db.OpCreate, path)
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same prefix, another store: the chunks the first one has are uploaded there all the same
+	moved, err := local.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Default = moved
+	writeFile(t, filepath.Join(backupDir, "copy.bin"), string(content))
+	queue(t, db.OpCreate, path, filepath.Join(backupDir, "copy.bin"))
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	target := t.TempDir()
+	if _, err := restore.Run(context.Background(), restore.Options{Backend: moved, Prefix: "backup", TargetDir: target}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"data.bin", "copy.bin"} {
+		if got, err := os.ReadFile(filepath.Join(target, name)); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s not restored correctly from the new store (%d bytes, %v)", name, len(got), err)
+		}
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	backupDir := setup(t)
+	storage.Layout = fsconfig.LayoutChunks
+	fsconfig.MetaCfg.Snapshots = true
+	defer func() { storage.Layout = fsconfig.LayoutFiles }()
+
+	before := map[string]string{
+		"notes.txt":      "first version",
+		"dir/report.txt": "quarterly numbers",
+	}
+	for name, content := range before {
+		writeFile(t, filepath.Join(backupDir, name), content)
+		queue(t, db.OpCreate, filepath.Join(backupDir, name))
+	}
+	if err := os.Chmod(filepath.Join(backupDir, "notes.txt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An accidental rm -rf and an overwrite make it to the backend...
+	os.RemoveAll(filepath.Join(backupDir, "dir"))
+	queue(t, db.OpRemove, filepath.Join(backupDir, "dir"))
+	writeFile(t, filepath.Join(backupDir, "notes.txt"), "second version")
+	queue(t, db.OpWrite, filepath.Join(backupDir, "notes.txt"))
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+	// ...and nothing changed, no new snapshot
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := storage.ListSnapshots(context.Background(), storage.Default, "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("want 2 snapshots, got %v", snapshots)
+	}
+
+	// gc keeps what the first snapshot refers to
+	if _, err := GarbageCollect(context.Background(), storage.GCOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	target := t.TempDir()
+	result, err := restore.Run(context.Background(), restore.Options{
+		Backend:   storage.Default,
+		Prefix:    "backup",
+		TargetDir: target,
+		Snapshot:  snapshots[0].ID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Downloaded != len(before) {
+		t.Errorf("want %d files restored, got %d", len(before), result.Downloaded)
+	}
+	for name, content := range before {
+		got, err := os.ReadFile(filepath.Join(target, name))
+		if err != nil || string(got) != content {
+			t.Errorf("%s: want %q, got %q (%v)", name, content, got, err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(target, "notes.txt")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("want notes.txt restored with mode 0600, got %v (%v)", info.Mode(), err)
+	}
+
+	target = t.TempDir()
+	if _, err := restore.Run(context.Background(), restore.Options{Backend: storage.Default, Prefix: "backup", TargetDir: target, Snapshot: storage.LatestSnapshot}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(target, "notes.txt")); string(got) != "second version" {
+		t.Errorf("latest snapshot: want the second version of notes.txt, got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(target, "dir")); !os.IsNotExist(err) {
+		t.Errorf("latest snapshot: want dir gone, got %v", err)
+	}
+}
+
+// versionedStore keeps every version of what's stored in a local backend, like a bucket with versioning enabled
+type versionedStore struct {
+	*local.Backend
+	mu       sync.Mutex
+	versions map[string][]storage.ObjectVersion // by key, newest first
+	content  map[string][]byte                  // by version ID
+	metadata map[string]map[string]string       // by version ID
+}
+
+func newVersionedStore(t *testing.T) *versionedStore {
+	t.Helper()
+	backend, err := local.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &versionedStore{Backend: backend, versions: make(map[string][]storage.ObjectVersion), content: make(map[string][]byte), metadata: make(map[string]map[string]string)}
+}
+
+// keep records what's stored under the key of info now as a new version
+func (b *versionedStore) keep(ctx context.Context, info storage.ObjectInfo, err error) (storage.ObjectInfo, error) {
+	if err != nil {
+		return info, err
+	}
+	body, stored, err := b.Backend.Get(ctx, info.Key)
+	if err != nil {
+		return info, err
+	}
+	defer body.Close()
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return info, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	info.VersionID = fmt.Sprintf("v%d", len(b.content)+1)
+	b.content[info.VersionID], b.metadata[info.VersionID] = content, stored.Metadata
+	b.versions[info.Key] = append([]storage.ObjectVersion{{Key: info.Key, VersionID: info.VersionID, Size: int64(len(content))}}, b.versions[info.Key]...)
+	return info, nil
+}
+
+func (b *versionedStore) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) (storage.ObjectInfo, error) {
+	return b.keep(ctx, storage.ObjectInfo{Key: key}, ignore(b.Backend.Put(ctx, key, body, size, metadata)))
+}
+
+func (b *versionedStore) Copy(ctx context.Context, src, dst string) (storage.ObjectInfo, error) {
+	return b.keep(ctx, storage.ObjectInfo{Key: dst}, ignore(b.Backend.Copy(ctx, src, dst)))
+}
+
+func ignore(_ storage.ObjectInfo, err error) error { return err }
+
+func (b *versionedStore) Versioning(ctx context.Context) (bool, error) { return true, nil }
+
+func (b *versionedStore) ListVersions(ctx context.Context, key string) ([]storage.ObjectVersion, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.versions[key], nil
+}
+
+func (b *versionedStore) GetVersion(ctx context.Context, key, versionID string) (io.ReadCloser, storage.ObjectInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	content, ok := b.content[versionID]
+	if !ok {
+		return nil, storage.ObjectInfo{}, storage.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(content)), storage.ObjectInfo{Key: key, Size: int64(len(content)), Metadata: b.metadata[versionID], VersionID: versionID}, nil
+}
+
+func TestSnapshotsOfVersions(t *testing.T) {
+	backupDir := setup(t)
+	fsconfig.MetaCfg.Snapshots = true
+	fsconfig.MetaCfg.MultipartThreshold = 1 << 20
+	storage.Default = newVersionedStore(t)
+	ctx := context.Background()
+
+	before := map[string]string{
+		"notes.txt":      "first version",
+		"dir/report.txt": "quarterly numbers",
+	}
+	for name, content := range before {
+		writeFile(t, filepath.Join(backupDir, name), content)
+		queue(t, db.OpCreate, filepath.Join(backupDir, name))
+	}
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	// With one object per file, the rm -rf and the overwrite replace the objects themselves
+	time.Sleep(5 * time.Millisecond)
+	os.RemoveAll(filepath.Join(backupDir, "dir"))
+	queue(t, db.OpRemove, filepath.Join(backupDir, "dir"))
+	writeFile(t, filepath.Join(backupDir, "notes.txt"), "second version")
+	queue(t, db.OpWrite, filepath.Join(backupDir, "notes.txt"))
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Default.Stat(ctx, "backup/dir/report.txt"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("want the removal pushed, got %v", err)
+	}
+
+	snapshots, err := storage.ListSnapshots(ctx, storage.Default, "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("want 2 snapshots, got %v", snapshots)
+	}
+	target := t.TempDir()
+	result, err := restore.Run(ctx, restore.Options{Backend: storage.Default, Prefix: "backup", TargetDir: target, Snapshot: snapshots[0].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Downloaded != len(before) {
+		t.Errorf("want %d files restored, got %d", len(before), result.Downloaded)
+	}
+	for name, content := range before {
+		if got, err := os.ReadFile(filepath.Join(target, name)); err != nil || string(got) != content {
+			t.Errorf("%s: want %q, got %q (%v)", name, content, got, err)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	backupDir := setup(t)
+	storage.Layout = fsconfig.LayoutChunks
+	fsconfig.MetaCfg.Snapshots = true
+	defer func() { storage.Layout = fsconfig.LayoutFiles }()
+
+	path := filepath.Join(backupDir, "notes.txt")
+	for _, content := range []string{"first", "second", "third"} {
+		writeFile(t, path, content)
+		queue(t, db.OpWrite, path)
+		if err := FlushToS3(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	snapshots := func() int {
+		t.Helper()
+		infos, err := storage.ListSnapshots(ctx, storage.Default, "backup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(infos)
+	}
+	if n := snapshots(); n != 3 {
+		t.Fatalf("want 3 snapshots, got %d", n)
+	}
+
+	if _, err := Prune(ctx, retention.Policy{}, 0, true); err == nil {
+		t.Errorf("want an empty policy refused")
+	}
+
+	// The chunks of "first" and "second" are only referred to by the snapshots which go
+	dryRuns, err := Prune(ctx, retention.Policy{Last: 1}, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dryRun := dryRuns[0]
+	if dryRun.Removed != 2 || len(dryRun.GC.DeletedKeys) != 2 {
+		t.Errorf("dry run: want 2 snapshots and 2 chunks to remove, got %+v", dryRun)
+	}
+	if n := snapshots(); n != 3 {
+		t.Errorf("dry run removed snapshots, %d left", n)
+	}
+
+	results, err := Prune(ctx, retention.Policy{Last: 1}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := results[0]
+	if n := snapshots(); n != 1 {
+		t.Errorf("want 1 snapshot left, got %d", n)
+	}
+	if strings.Join(result.GC.DeletedKeys, ",") != strings.Join(dryRun.GC.DeletedKeys, ",") {
+		t.Errorf("dry run said %v would go, %v went", dryRun.GC.DeletedKeys, result.GC.DeletedKeys)
+	}
+
+	target := t.TempDir()
+	if _, err := restore.Run(ctx, restore.Options{Backend: storage.Default, Prefix: "backup", TargetDir: target, Snapshot: storage.LatestSnapshot}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(target, "notes.txt")); string(got) != "third" {
+		t.Errorf("want the latest version restored, got %q", got)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	backupDir := setup(t)
+	storage.Layout = fsconfig.LayoutChunks
+	fsconfig.MetaCfg.TrashRetention = time.Hour
+	defer func() { storage.Layout = fsconfig.LayoutFiles }()
+
+	files := map[string]string{"dir/a.txt": "precious", "dir/sub/b.txt": "irreplaceable"}
+	for name, content := range files {
+		writeFile(t, filepath.Join(backupDir, name), content)
+		queue(t, db.OpCreate, filepath.Join(backupDir, name))
+	}
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	// rm -rf dir
+	os.RemoveAll(filepath.Join(backupDir, "dir"))
+	queue(t, db.OpRemove, filepath.Join(backupDir, "dir"))
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if live, _ := storage.ListAll(ctx, storage.Default, "backup/dir"); len(live) != 0 {
+		t.Errorf("want dir gone from the backup, got %v", live)
+	}
+	entries, err := storage.ListTrash(ctx, storage.Default, "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(files) {
+		t.Fatalf("want %d files in the trash, got %v", len(files), entries)
+	}
+
+	// The chunks of files in the trash stay
+	if gc, err := GarbageCollect(ctx, storage.GCOptions{}); err != nil || gc.Deleted != 0 {
+		t.Errorf("want no chunks collected while their files are in the trash, got %+v (%v)", gc, err)
+	}
+
+	result, err := restore.FromTrash(ctx, restore.Options{Backend: storage.Default, Prefix: "backup", TargetDir: backupDir}, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Downloaded != len(files) {
+		t.Errorf("want %d files restored, got %+v", len(files), result)
+	}
+	for name, content := range files {
+		if got, err := os.ReadFile(filepath.Join(backupDir, name)); err != nil || string(got) != content {
+			t.Errorf("%s: want %q, got %q (%v)", name, content, got, err)
+		}
+	}
+
+	// Not purged before the retention is over, then gone along with the chunks
+	if n, err := storage.PurgeTrash(ctx, storage.Default, "backup", time.Hour); err != nil || n != 0 {
+		t.Errorf("want nothing purged yet, got %d (%v)", n, err)
+	}
+	if n, err := storage.PurgeTrash(ctx, storage.Default, "backup", 0); err != nil || n != len(files) {
+		t.Errorf("want %d objects purged, got %d (%v)", len(files), n, err)
+	}
+	if gc, err := GarbageCollect(ctx, storage.GCOptions{}); err != nil || gc.Deleted != len(files) {
+		t.Errorf("want the chunks of the purged files collected, got %+v (%v)", gc, err)
+	}
+}
+
+// removeSharingAPrefix backs up files whose names start like the one removed, then removes it and returns what's left in the backup
+func removeSharingAPrefix(t *testing.T, trashRetention time.Duration) []string {
+	t.Helper()
+	backupDir := setup(t)
+	fsconfig.MetaCfg.TrashRetention = trashRetention
+	for _, name := range []string{"report", "report.old", "report2/a.txt"} {
+		writeFile(t, filepath.Join(backupDir, name), name)
+		queue(t, db.OpCreate, filepath.Join(backupDir, name))
+	}
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Remove(filepath.Join(backupDir, "report"))
+	queue(t, db.OpRemove, filepath.Join(backupDir, "report"))
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+	objects, err := storage.ListAll(context.Background(), storage.Default, "backup/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var live []string
+	for _, object := range objects {
+		if relativePath, ok := storage.RelativePath("backup", object.Key); ok {
+			live = append(live, relativePath)
+		}
+	}
+	sort.Strings(live)
+	return live
+}
+
+func TestTrashSharingAPrefix(t *testing.T) {
+	live := removeSharingAPrefix(t, time.Hour)
+	if want := []string{"report.old", "report2/a.txt"}; !reflect.DeepEqual(live, want) {
+		t.Errorf("want %v left in the backup, got %v", want, live)
+	}
+	entries, err := storage.ListTrash(context.Background(), storage.Default, "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Path != "report" {
+		t.Errorf("want only report in the trash, got %+v", entries)
+	}
+}
+
+func TestDeleteSharingAPrefix(t *testing.T) {
+	live := removeSharingAPrefix(t, 0)
+	if want := []string{"report.old", "report2/a.txt"}; !reflect.DeepEqual(live, want) {
+		t.Errorf("want %v left in the backup, got %v", want, live)
+	}
+}
+
+func TestFrozenFlushKeepsTheQueue(t *testing.T) {
+	backupDir := setup(t)
+	path := filepath.Join(backupDir, "a.txt")
+	writeFile(t, path, "precious")
+	queue(t, db.OpCreate, path)
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The guard trips on the deletion
+	os.Remove(path)
+	queue(t, db.OpRemove, path)
+	if err := db.Freeze(db.FreezeState{Reason: "testing", At: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := FlushToS3(); !errors.Is(err, ErrFrozen) {
+		t.Fatalf("want ErrFrozen, got %v", err)
+	}
+	ctx := context.Background()
+	if _, err := storage.Default.Stat(ctx, "backup/a.txt"); err != nil {
+		t.Errorf("want the file kept in the backup while frozen, got %v", err)
+	}
+	if pending, err := db.ReadQueue(); err != nil || len(pending) != 1 {
+		t.Fatalf("want the removal kept on the queue, got %v (%v)", pending, err)
+	}
+
+	// Once resumed the removal goes through
+	if state, err := db.Unfreeze(); err != nil || state == nil || state.Reason != "testing" {
+		t.Fatalf("unexpected unfreeze %+v (%v)", state, err)
+	}
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := db.ReadQueue(); len(pending) != 0 {
+		t.Errorf("want an empty queue, got %v", pending)
+	}
+}
+
+// countingBackend counts the uploads going through it
+type countingBackend struct {
+	storage.Backend
+	puts int
+}
+
+func (b *countingBackend) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) (storage.ObjectInfo, error) {
+	b.puts++
+	return b.Backend.Put(ctx, key, body, size, metadata)
+}
+
+// freezingStore trips the guard on the first deletion, like a mass deletion noticed while the queue drains
+type freezingStore struct {
+	*local.Backend
+}
+
+func (b freezingStore) Delete(ctx context.Context, key string) error {
+	if err := b.Backend.Delete(ctx, key); err != nil {
+		return err
+	}
+	return db.Freeze(db.FreezeState{Reason: "testing", At: time.Now()})
+}
+
+func TestFreezeWhileFlushing(t *testing.T) {
+	backupDir := setup(t)
+	fsconfig.MetaCfg.UploadConcurrency = 1
+	var paths []string
+	for i := 0; i < 5; i++ {
+		path := filepath.Join(backupDir, fmt.Sprintf("%d.txt", i))
+		writeFile(t, path, "precious")
+		queue(t, db.OpCreate, path)
+		paths = append(paths, path)
+	}
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+
+	storage.Default = freezingStore{storage.Default.(*local.Backend)}
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	queue(t, db.OpRemove, paths...)
+	if err := FlushToS3(); !errors.Is(err, ErrFrozen) {
+		t.Fatalf("want ErrFrozen, got %v", err)
+	}
+	// One removal got through before the guard tripped, the others wait
+	if pending, err := db.ReadQueue(); err != nil || len(pending) != len(paths)-1 {
+		t.Fatalf("want %d removals kept on the queue, got %v (%v)", len(paths)-1, pending, err)
+	}
+	objects, err := storage.ListAll(context.Background(), storage.Default, "backup/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept int
+	for _, object := range objects {
+		if strings.HasSuffix(object.Key, ".txt") && !strings.Contains(object.Key, "/.") {
+			kept++
+		}
+	}
+	if kept != len(paths)-1 {
+		t.Errorf("want %d files kept in the backup, got %d", len(paths)-1, kept)
+	}
+}
+
+// slowStore takes its time with every upload, so a reload gets to happen while a flush is busy
+type slowStore struct {
+	*local.Backend
+}
+
+func (b slowStore) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) (storage.ObjectInfo, error) {
+	time.Sleep(time.Millisecond)
+	return b.Backend.Put(ctx, key, body, size, metadata)
+}
+
+// TestReloadWhileFlushing is meant for -race: reloads publish new configurations and backends while a flush is running,
+// the flush carries on with the ones it was handed
+func TestReloadWhileFlushing(t *testing.T) {
+	backupDir := setup(t)
+	fsconfig.MetaCfg.UploadConcurrency = 2
+	var paths []string
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(backupDir, fmt.Sprintf("%d.txt", i))
+		writeFile(t, path, "content")
+		paths = append(paths, path)
+	}
+	queue(t, db.OpCreate, paths...)
+	first := slowStore{storage.Default.(*local.Backend)}
+	storage.Default = first
+	other, err := local.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := storage.Current()
+	set := st.Config.BackupSets()[0]
+	done := make(chan error)
+	go func() { done <- FlushSet(st, set, false) }()
+
+	for reloads := 0; ; reloads++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reloads == 0 {
+				t.Log("the flush was done before the first reload")
+			}
+			objects, err := storage.ListAll(context.Background(), first, "backup/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(objects) != len(paths) {
+				t.Errorf("want every file in the backend the flush started with, got %d of %d", len(objects), len(paths))
+			}
+			if objects, _ := storage.ListAll(context.Background(), other, ""); len(objects) != 0 {
+				t.Errorf("want nothing in the backend of the reloaded configuration, got %d object(s)", len(objects))
+			}
+			if got := fsconfig.Current().UploadConcurrency; got != 1 {
+				t.Errorf("want the reloaded configuration in use after the flush, got upload concurrency %d", got)
+			}
+			return
+		default:
+		}
+		cfg := *st.Config
+		cfg.UploadConcurrency = 1
+		cfg.S3Prefix = fmt.Sprintf("reloaded-%d", reloads)
+		storage.Apply(cfg, map[string]storage.Backend{}, other)
+		if _, err := Status(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMove(t *testing.T) {
+	backupDir := setup(t)
+	files := map[string]string{"old/a.txt": "unchanged", "old/sub/b.txt": "changed before the move", "old/c.txt": "deleted after the move"}
+	for name, content := range files {
+		writeFile(t, filepath.Join(backupDir, name), content)
+		queue(t, db.OpCreate, filepath.Join(backupDir, name))
+	}
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+	// Something was at the destination before, it mustn't survive the move
+	writeFile(t, filepath.Join(backupDir, "new/stale.txt"), "replaced")
+	queue(t, db.OpCreate, filepath.Join(backupDir, "new/stale.txt"))
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(filepath.Join(backupDir, "new"))
+	queue(t, db.OpRemove, filepath.Join(backupDir, "new"))
+
+	// mv old new, with one file changed and one removed (without events, as if it happened before the move)
+	writeFile(t, filepath.Join(backupDir, "old/sub/b.txt"), "changed")
+	if err := os.Rename(filepath.Join(backupDir, "old"), filepath.Join(backupDir, "new")); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(backupDir, "new/c.txt"))
+	queue(t, db.OpMovedFrom, filepath.Join(backupDir, "old"))
+	db.AppendMove(filepath.Join(backupDir, "old"), filepath.Join(backupDir, "new"))
+	db.SyncJournal(context.Background())
+
+	counting := &countingBackend{Backend: storage.Default}
+	storage.Default = counting
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+	if counting.puts != 1 {
+		t.Errorf("want only the changed file uploaded, got %d uploads", counting.puts)
+	}
+	if pending, _ := db.ReadQueue(); len(pending) != 0 {
+		t.Errorf("want an empty queue, got %v", pending)
+	}
+
+	ctx := context.Background()
+	objects, err := storage.ListAll(ctx, storage.Default, "backup/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, object := range objects {
+		body, _, err := storage.Default.Get(ctx, object.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(body)
+		body.Close()
+		got[object.Key] = string(content)
+	}
+	want := map[string]string{"backup/new/a.txt": "unchanged", "backup/new/sub/b.txt": "changed"}
+	if len(got) != len(want) || got["backup/new/a.txt"] != want["backup/new/a.txt"] || got["backup/new/sub/b.txt"] != want["backup/new/sub/b.txt"] {
+		t.Errorf("want %v in the backend, got %v", want, got)
+	}
+
+	index, err := db.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 2 {
+		t.Errorf("want the index to list the 2 moved files, got %v", index)
+	}
+	if entry, ok := index[filepath.Join(backupDir, "new/a.txt")]; !ok || entry.Size != int64(len("unchanged")) {
+		t.Errorf("want the copied file indexed under its new path, got %+v", entry)
+	}
+}
+
+func TestBackupSets(t *testing.T) {
+	docsDir := setup(t)
+	photosDir := t.TempDir()
+	photos, err := local.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsconfig.MetaCfg.Sets = []fsconfig.BackupSet{
+		{Name: "docs", BackupDir: docsDir, Backend: fsconfig.BackendLocal, S3Prefix: "backup"},
+		{Name: "photos", BackupDir: photosDir, Backend: fsconfig.BackendLocal, S3Prefix: "photos", Exclude: []string{"*.tmp", "cache"}},
+	}
+	storage.Backends["photos"] = photos
+
+	writeFile(t, filepath.Join(docsDir, "a.txt"), "doc")
+	writeFile(t, filepath.Join(photosDir, "b.jpg"), "photo")
+	writeFile(t, filepath.Join(photosDir, "b.jpg.tmp"), "half written")
+	writeFile(t, filepath.Join(photosDir, "cache/c.jpg"), "thumbnail")
+	queue(t, db.OpCreate, filepath.Join(docsDir, "a.txt"), photosDir)
+
+	// Only the queue of the set being flushed is touched
+	if err := FlushSet(storage.Current(), fsconfig.MetaCfg.Sets[1], false); err != nil {
+		t.Fatal(err)
+	}
+	status, err := Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 2 || status[0].Queued != 1 || status[1].Queued != 0 || status[1].LastFlush.IsZero() || !status[0].LastFlush.IsZero() {
+		t.Errorf("want docs still queued and photos flushed, got %+v", status)
+	}
+
+	if err := FlushToS3(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	keys := func(b storage.Backend) []string {
+		objects, err := storage.ListAll(ctx, b, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, object := range objects {
+			keys = append(keys, object.Key)
+		}
+		return keys
+	}
+	if got := strings.Join(keys(storage.Default), ","); got != "backup/a.txt" {
+		t.Errorf("want only docs in the docs backend, got %s", got)
+	}
+	if got := strings.Join(keys(photos), ","); got != "photos/b.jpg" {
+		t.Errorf("want only the included photos in the photos backend, got %s", got)
+	}
+}
+
+func TestSetsSharingAPrefix(t *testing.T) {
+	docsDir := setup(t)
+	storage.Layout = fsconfig.LayoutChunks
+	defer func() { storage.Layout = fsconfig.LayoutFiles }()
+	mirrorDir := t.TempDir()
+	mirror, err := local.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same prefix, but another store
+	fsconfig.MetaCfg.Sets = []fsconfig.BackupSet{
+		{Name: "docs", BackupDir: docsDir, Backend: fsconfig.BackendLocal, S3Prefix: "backup"},
+		{Name: "mirror", BackupDir: mirrorDir, Backend: fsconfig.BackendLocal, S3Prefix: "backup"},
+	}
+	storage.Backends["mirror"] = mirror
+
+	content := make([]byte, 2<<20)
+	rand.New(rand.NewSource(3)).Read(content)
+	writeFile(t, filepath.Join(docsDir, "data.bin"), string(content))
+	writeFile(t, filepath.Join(mirrorDir, "data.bin"), string(content))
+	queue(t, db.OpCreate, filepath.Join(docsDir, "data.bin"), filepath.Join(mirrorDir, "data.bin"))
+	for _, set := range fsconfig.MetaCfg.Sets {
+		if err := FlushSet(storage.Current(), set, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each store got the chunks, even though the other one has them under the same keys
+	for _, b := range []storage.Backend{storage.Default, mirror} {
+		target := t.TempDir()
+		if _, err := restore.Run(context.Background(), restore.Options{Backend: b, Prefix: "backup", TargetDir: target}); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(filepath.Join(target, "data.bin")); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s: data.bin not restored correctly (%d bytes, %v)", storage.StoreID(b), len(got), err)
+		}
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	backupDir := setup(t)
+	fsconfig.MetaCfg.S3BackupInterval = time.Hour
+	fsconfig.MetaCfg.BackupCatchUp = true
+	fsconfig.MetaCfg.BackupTimezone = "UTC"
+	writeFile(t, filepath.Join(backupDir, "a.txt"), "missed")
+	queue(t, db.OpCreate, filepath.Join(backupDir, "a.txt"))
+
+	// The last push was more than an interval ago, but right now pushing is blacked out
+	if err := db.RecordRun(fsconfig.DefaultSetName, time.Now().Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	end := now.Add(30 * time.Minute).Truncate(time.Minute)
+	fsconfig.MetaCfg.BackupBlackout = []string{now.Add(-time.Minute).Format("15:04") + "-" + end.Format("15:04")}
+
+	run := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			backupSet(ctx, fsconfig.MetaCfg.BackupSets()[0])
+		}()
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+		<-done
+	}
+	run()
+	if _, err := db.PersistData(); err != nil {
+		t.Fatal(err)
+	}
+	status, err := Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status[0].Queued != 1 || !status[0].NextPush.Equal(end) {
+		t.Errorf("want the push put off till %s, got %+v", end, status[0])
+	}
+
+	// Without the blackout window the missed push happens right away
+	fsconfig.MetaCfg.BackupBlackout = nil
+	run()
+	if status, _ = Status(); status[0].Queued != 0 {
+		t.Errorf("want the missed push caught up on, got %+v", status[0])
+	}
+	if last, ok, _ := db.LastRun(fsconfig.DefaultSetName); !ok || time.Since(last) > time.Minute {
+		t.Errorf("want the push recorded, got %s", last)
+	}
+}
+
+// failingStore refuses to store the files whose name contains "bad"
+type failingStore struct {
+	*local.Backend
+}
+
+func (b failingStore) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) (storage.ObjectInfo, error) {
+	if strings.Contains(key, "bad") {
+		return storage.ObjectInfo{}, fmt.Errorf("refusing %s", key)
+	}
+	return b.Backend.Put(ctx, key, body, size, metadata)
+}
+
+func TestRecordRun(t *testing.T) {
+	backupDir := setup(t)
+	storage.Default = failingStore{storage.Default.(*local.Backend)}
+	set := fsconfig.MetaCfg.BackupSets()[0]
+	lastRun := func() time.Time {
+		t.Helper()
+		last, _, err := db.LastRun(set.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return last
+	}
+	push := func(name string, scheduled bool) error {
+		t.Helper()
+		path := filepath.Join(backupDir, name)
+		writeFile(t, path, name)
+		queue(t, db.OpCreate, path)
+		return FlushSet(storage.Current(), set, scheduled)
+	}
+
+	// Retries and pushes asked for don't count as a run of the schedule
+	if err := push("good.txt", false); err != nil {
+		t.Fatal(err)
+	}
+	if last := lastRun(); !last.IsZero() {
+		t.Fatalf("want no run recorded for a push outside the schedule, got %s", last)
+	}
+
+	// Neither does a scheduled push which didn't get to go through the queue
+	if err := db.Freeze(db.FreezeState{Reason: "testing", At: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := push("frozen.txt", true); !errors.Is(err, ErrFrozen) {
+		t.Fatalf("want ErrFrozen, got %v", err)
+	}
+	if last := lastRun(); !last.IsZero() {
+		t.Fatalf("want no run recorded while frozen, got %s", last)
+	}
+	if _, err := db.Unfreeze(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file which failed is retried on its own, the scheduled push still happened
+	if err := push("bad.txt", true); err == nil {
+		t.Fatal("want the failed file reported")
+	}
+	if last := lastRun(); time.Since(last) > time.Minute {
+		t.Errorf("want the scheduled push recorded even though a file failed, got %s", last)
+	}
+}
+
+func TestBlackoutWhileFlushing(t *testing.T) {
+	backupDir := setup(t)
+	fsconfig.MetaCfg.S3BackupInterval = time.Hour
+	fsconfig.MetaCfg.BackupTimezone = "UTC"
+	var paths []string
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(backupDir, fmt.Sprintf("%d.txt", i))
+		writeFile(t, path, "not now")
+		paths = append(paths, path)
+	}
+	queue(t, db.OpCreate, paths...)
+
+	// FlushSet doesn't look at the windows before it starts, backupSet does: this is a window which opened once the flush was under way
+	now := time.Now().UTC()
+	fsconfig.MetaCfg.BackupBlackout = []string{now.Add(-time.Minute).Format("15:04") + "-" + now.Add(30*time.Minute).Format("15:04")}
+	if err := FlushSet(storage.Current(), fsconfig.MetaCfg.BackupSets()[0], true); !errors.Is(err, ErrBlackout) {
+		t.Fatalf("want ErrBlackout, got %v", err)
+	}
+	if pending, err := db.ReadQueue(); err != nil || len(pending) != len(paths) {
+		t.Fatalf("want everything left on the queue, got %v (%v)", pending, err)
+	}
+	if last, ok, _ := db.LastRun(fsconfig.DefaultSetName); ok {
+		t.Errorf("want no run recorded for a push cut short, got %s", last)
+	}
+
+	fsconfig.MetaCfg.BackupBlackout = nil
+	if err := FlushSet(storage.Current(), fsconfig.MetaCfg.BackupSets()[0], true); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := db.ReadQueue(); err != nil || len(pending) != 0 {
+		t.Errorf("want the rest pushed once the window is over, got %v (%v)", pending, err)
+	}
+}
+
+func TestSyncSet(t *testing.T) {
+	backupDir := setup(t)
+	fsconfig.MetaCfg.ContinuousSync = true
+	fsconfig.MetaCfg.SyncQuietPeriod = 200 * time.Millisecond
+	fsconfig.MetaCfg.SyncMaxDelay = time.Hour
+	fsconfig.MetaCfg.Snapshots = true
+	ctx := context.Background()
+	pushed := func() string {
+		t.Helper()
+		objects, err := storage.ListAll(ctx, storage.Default, "backup/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, object := range objects {
+			if !strings.HasPrefix(object.Key, "backup/.") {
+				keys = append(keys, object.Key)
+			}
+		}
+		return strings.Join(keys, ",")
+	}
+
+	quiet, busy := filepath.Join(backupDir, "quiet.txt"), filepath.Join(backupDir, "busy.log")
+	writeFile(t, quiet, "written once")
+	writeFile(t, busy, "still being written")
+	queue(t, db.OpCreate, quiet, busy)
+	time.Sleep(250 * time.Millisecond)
+	queue(t, db.OpWrite, busy)
+
+	// Only the file which was left alone for the quiet period goes
+	next, err := SyncSet(storage.Current(), fsconfig.MetaCfg.BackupSets()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pushed(); got != "backup/quiet.txt" {
+		t.Errorf("want only the quiet file pushed, got %q", got)
+	}
+	if wait := time.Until(next); wait <= 0 || wait > 200*time.Millisecond {
+		t.Errorf("want the busy file due within the quiet period, got %s", wait)
+	}
+	if infos, _ := storage.ListSnapshots(ctx, storage.Default, "backup"); len(infos) != 0 {
+		t.Errorf("want the snapshot left to the scheduled push, got %d", len(infos))
+	}
+
+	// A file which keeps changing still goes once the max delay is up
+	fsconfig.MetaCfg.SyncQuietPeriod = time.Hour
+	fsconfig.MetaCfg.SyncMaxDelay = 200 * time.Millisecond
+	queue(t, db.OpWrite, busy)
+	if next, err = SyncSet(storage.Current(), fsconfig.MetaCfg.BackupSets()[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := pushed(); got != "backup/busy.log,backup/quiet.txt" {
+		t.Errorf("want the busy file pushed after the max delay, got %q", got)
+	}
+	if !next.IsZero() {
+		t.Errorf("want nothing left to sync, got %s", next)
+	}
+
+	// The scheduled push records what continuous sync pushed in a snapshot
+	if err := FlushSet(storage.Current(), fsconfig.MetaCfg.BackupSets()[0], false); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := storage.ListSnapshots(ctx, storage.Default, "backup"); len(infos) != 1 {
+		t.Errorf("want a snapshot from the scheduled push, got %d", len(infos))
+	}
+}
+
+func TestContinuousSync(t *testing.T) {
+	backupDir := setup(t)
+	fsconfig.MetaCfg.S3BackupInterval = time.Hour
+	fsconfig.MetaCfg.ContinuousSync = true
+	fsconfig.MetaCfg.SyncQuietPeriod = 100 * time.Millisecond
+	fsconfig.MetaCfg.SyncMaxDelay = time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		backupSet(ctx, fsconfig.MetaCfg.BackupSets()[0])
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Long before the hourly push, the change is pushed once it settled
+	path := filepath.Join(backupDir, "a.txt")
+	writeFile(t, path, "synced right away")
+	queue(t, db.OpCreate, path)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := storage.Default.Stat(ctx, "backup/a.txt"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("want the change pushed by continuous sync")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if last, ok, _ := db.LastRun(fsconfig.DefaultSetName); ok {
+		t.Errorf("want continuous sync kept out of the scheduled runs, got %s", last)
+	}
+}
@@ -0,0 +1,179 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/db"
+	"github.com/Praveen005/CloudKeeper/internal/storage"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// processMove carries out a rename/move within the tree: what the backend has for the old path is copied to the new one
+// by the backend itself, instead of uploading it all again. Only files whose backed up copy is current (same size and
+// modification time as the index says) are copied, anything else is uploaded. If the old path is queued as moved away
+// (item.source), its objects are removed once everything was copied, and both paths are taken off the queue.
+// It returns the files which had to be uploaded.
+func processMove(ctx context.Context, st *storage.State, item queueItem) ([]storage.UploadedFile, error) {
+	from, to := item.entry.From, item.path
+	if from == "" || !inSet(st.Config, item.set)(from) {
+		// Queued by something which didn't know where the path came from, or moved in from another backup set
+		// whose objects may live in another backend: upload it like anything moved in
+		item.entry.State = db.StateMovedTo
+		return processEntry(ctx, st, item)
+	}
+	backend := st.For(item.set.Name)
+	if item.source != nil {
+		if !claim(from) {
+			return nil, fmt.Errorf("error moving %s to %s: %s is being processed by another flush", from, to, from)
+		}
+		defer release(from)
+	}
+
+	index, err := db.ReadIndexBelow(from)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the object index: %v", err)
+	}
+	fromKey, err := storage.ObjectKey(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	toKey, err := storage.ObjectKey(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+
+	written := make(map[string]bool) // keys below the new path which are up to date now
+	copied := make(map[string]bool)  // keys below the old path whose content lives on below the new one
+	var moved, uploaded []storage.UploadedFile
+	err = filepath.Walk(to, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Gone again meanwhile: the removal is queued, there's nothing to copy
+			if path == to && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(to, path)
+		if err != nil {
+			return err
+		}
+		src := filepath.Join(from, relativePath)
+		srcKey, err := storage.ObjectKey(ctx, src)
+		if err != nil {
+			return err
+		}
+		dstKey, err := storage.ObjectKey(ctx, path)
+		if err != nil {
+			return err
+		}
+
+		if indexed, ok := index[src]; ok && indexed.Size == info.Size() && indexed.ModTime.Equal(info.ModTime()) {
+			object, err := backend.Copy(ctx, srcKey, dstKey)
+			if err == nil {
+				written[dstKey], copied[srcKey] = true, true
+				moved = append(moved, storage.UploadedFile{
+					Path:       path,
+					Key:        dstKey,
+					Size:       indexed.Size,
+					StoredSize: indexed.StoredSize,
+					ModTime:    indexed.ModTime,
+					Mode:       info.Mode(),
+					ETag:       object.ETag,
+					VersionID:  object.VersionID,
+					Chunks:     indexed.Chunks,
+				})
+				return nil
+			}
+			if !errors.Is(err, storage.ErrNotFound) {
+				return fmt.Errorf("error copying %s to %s: %v", srcKey, dstKey, err)
+			}
+		}
+
+		// Changed since it was backed up, or never was: upload it
+		files, err := storage.Upload(ctx, backend, path, item.set.S3Prefix)
+		uploaded = append(uploaded, files...)
+		for _, f := range files {
+			written[f.Key] = true
+		}
+		return err
+	})
+	if err != nil {
+		if indexErr := db.Conn.Update(indexUploads(uploaded)); indexErr != nil {
+			customlog.Logger.Error("error indexing uploaded files", zap.String("error", indexErr.Error()))
+		}
+		return uploaded, fmt.Errorf("error moving %s to %s: %v", from, to, err)
+	}
+
+	// Whatever was stored below the new path before the move and isn't there anymore, goes
+	existing, err := storage.ListTree(ctx, backend, toKey)
+	if err != nil {
+		return uploaded, err
+	}
+	var stale []storage.ObjectInfo
+	for _, object := range existing {
+		if !written[object.Key] {
+			stale = append(stale, object)
+		}
+	}
+	if err := storage.RemoveObjects(ctx, backend, item.set.S3Prefix, stale); err != nil {
+		return uploaded, err
+	}
+
+	// The old path: what was copied is deleted outright (it wasn't deleted, it moved), anything else is a removal like any other
+	if item.source != nil {
+		sources, err := storage.ListTree(ctx, backend, fromKey)
+		if err != nil {
+			return uploaded, err
+		}
+		var gone []storage.ObjectInfo
+		for _, object := range sources {
+			if !copied[object.Key] {
+				gone = append(gone, object)
+				continue
+			}
+			if err := backend.Delete(ctx, object.Key); err != nil {
+				return uploaded, fmt.Errorf("error deleting %s: %v", object.Key, err)
+			}
+		}
+		if err := storage.RemoveObjects(ctx, backend, item.set.S3Prefix, gone); err != nil {
+			return uploaded, err
+		}
+	}
+
+	update := func(tx *bolt.Tx) error {
+		if err := db.DeleteIndex(tx, to); err != nil {
+			return err
+		}
+		if item.source != nil {
+			if err := db.DeleteIndex(tx, from); err != nil {
+				return err
+			}
+		}
+		return indexUploads(append(moved, uploaded...))(tx)
+	}
+	if err := db.Dequeue(to, item.entry.Seq, db.ActionAdd, update); err != nil {
+		return uploaded, fmt.Errorf("error updating database: %v", err)
+	}
+	if item.source != nil {
+		if err := db.Dequeue(from, item.source.Seq, db.ActionRemove, nil); err != nil {
+			return uploaded, fmt.Errorf("error updating database: %v", err)
+		}
+	}
+	customlog.Logger.Info("Moved in the backend",
+		zap.String("set", item.set.Name),
+		zap.String("from", from),
+		zap.String("to", to),
+		zap.Int("copied", len(moved)),
+		zap.Int("uploaded", len(uploaded)),
+	)
+	return uploaded, nil
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"github.com/Praveen005/CloudKeeper/internal/retention"
+	"github.com/Praveen005/CloudKeeper/internal/storage"
+	"go.uber.org/zap"
+)
+
+// PruneResult tells which snapshots were kept (and why) or removed, and what garbage collection did afterwards
+type PruneResult struct {
+	Set       string               `json:"set,omitempty"`
+	Snapshots []retention.Decision `json:"snapshots"`
+	Removed   int                  `json:"removed"`
+	GC        storage.GCResult     `json:"gc"`
+}
+
+// RetentionPolicy is the policy configured with the `KEEP_*` settings
+func RetentionPolicy() retention.Policy {
+	cfg := fsconfig.Current()
+	return retention.Policy{
+		Last:    cfg.KeepLast,
+		Hourly:  cfg.KeepHourly,
+		Daily:   cfg.KeepDaily,
+		Weekly:  cfg.KeepWeekly,
+		Monthly: cfg.KeepMonthly,
+		Yearly:  cfg.KeepYearly,
+		Within:  cfg.KeepWithin,
+	}
+}
+
+// Prune removes the snapshots the retention policy doesn't keep and then the chunks nothing refers to anymore, in every backup set.
+// A dry run removes nothing, but tells exactly what would be removed. Flushes wait till it's done.
+func Prune(ctx context.Context, policy retention.Policy, grace time.Duration, dryRun bool) ([]PruneResult, error) {
+	var results []PruneResult
+	for _, set := range fsconfig.Current().BackupSets() {
+		result, err := PruneSet(ctx, set, policy, grace, dryRun)
+		results = append(results, result)
+		if err != nil {
+			return results, fmt.Errorf("backup set %s: %w", set.Name, err)
+		}
+	}
+	return results, nil
+}
+
+// PruneSet is Prune for a single backup set
+func PruneSet(ctx context.Context, set fsconfig.BackupSet, policy retention.Policy, grace time.Duration, dryRun bool) (PruneResult, error) {
+	result := PruneResult{Set: set.Name}
+	if policy.Empty() {
+		return result, fmt.Errorf("no retention policy configured, it would remove every snapshot")
+	}
+
+	flushLock.Lock()
+	defer flushLock.Unlock()
+
+	backend := storage.For(set.Name)
+	infos, err := storage.ListSnapshots(ctx, backend, set.S3Prefix)
+	if err != nil {
+		return result, err
+	}
+	snapshots := make([]retention.Snapshot, len(infos))
+	for i, info := range infos {
+		snapshots[i] = retention.Snapshot{ID: info.ID, Time: info.Time}
+	}
+	result.Snapshots = retention.Apply(policy, snapshots, time.Local)
+
+	drop := make(map[string]bool)
+	for _, d := range result.Snapshots {
+		if d.Keep {
+			continue
+		}
+		drop[d.ID] = true
+		result.Removed++
+		if dryRun {
+			continue
+		}
+		if err := storage.DeleteSnapshot(ctx, backend, set.S3Prefix, d.ID); err != nil {
+			return result, fmt.Errorf("error removing snapshot %s: %v", d.ID, err)
+		}
+		customlog.Logger.Debug("Snapshot removed", zap.String("id", d.ID))
+	}
+	customlog.Logger.Info("Pruning snapshots",
+		zap.String("set", set.Name),
+		zap.Bool("dry run", dryRun),
+		zap.String("policy", policy.String()),
+		zap.Int("snapshots", len(snapshots)),
+		zap.Int("removed", result.Removed),
+	)
+
+	// The removed snapshots are disregarded in a dry run as well, so it reports the chunks which would go with them
+	result.GC, err = garbageCollect(ctx, backend, set, storage.GCOptions{Grace: grace, DryRun: dryRun, DropSnapshots: drop})
+	return result, err
+}
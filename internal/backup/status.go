@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/db"
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"go.uber.org/zap"
+)
+
+// SetStatus is what `cloudkeeper status` shows about a backup set
+type SetStatus struct {
+	Name        string    `json:"name"`
+	Directory   string    `json:"directory"`
+	Destination string    `json:"destination"`
+	Interval    string    `json:"interval"`
+	Schedule    string    `json:"schedule"`
+	NextPush    time.Time `json:"nextPush,omitempty"`
+	Queued      int       `json:"queued"`
+	LastFlush   time.Time `json:"lastFlush,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// lastFlush remembers how the latest flush of every set went, and when the next one is planned, by the name of the set
+var lastFlush = struct {
+	sync.Mutex
+	sets map[string]flushOutcome
+	next map[string]time.Time
+}{sets: make(map[string]flushOutcome), next: make(map[string]time.Time)}
+
+type flushOutcome struct {
+	at  time.Time
+	err error
+}
+
+// recordFlush remembers how a flush went. run tells if it was a scheduled push which went through the queue, it's also kept in the database:
+// missed pushes are caught up on from it (BACKUP_CATCH_UP). Files which failed don't count against it, they're retried on their own.
+func recordFlush(set fsconfig.BackupSet, err error, run bool) {
+	at := time.Now()
+	if run {
+		if err := db.RecordRun(set.Name, at); err != nil {
+			customlog.Logger.Error("error recording the push", zap.String("set", set.Name), zap.String("error", err.Error()))
+		}
+	}
+	lastFlush.Lock()
+	defer lastFlush.Unlock()
+	lastFlush.sets[set.Name] = flushOutcome{at: at, err: err}
+}
+
+// planRun remembers when the next scheduled push of a set is
+func planRun(set fsconfig.BackupSet, at time.Time) {
+	customlog.Logger.Info("Next push planned", zap.String("set", set.Name), zap.Time("at", at))
+	lastFlush.Lock()
+	defer lastFlush.Unlock()
+	lastFlush.next[set.Name] = at
+}
+
+// Status reports every backup set with the number of its queued paths and how its latest flush went.
+// Queued paths which don't belong to any set (their directory was taken out of the configuration) are left out.
+func Status() ([]SetStatus, error) {
+	queue, err := db.ReadQueue()
+	if err != nil {
+		return nil, err
+	}
+	cfg := fsconfig.Current()
+	queued := make(map[string]int)
+	for path := range queue {
+		if set, ok := cfg.SetFor(path); ok {
+			queued[set.Name]++
+		}
+	}
+
+	lastFlush.Lock()
+	defer lastFlush.Unlock()
+	var status []SetStatus
+	for _, set := range cfg.BackupSets() {
+		s := SetStatus{
+			Name:        set.Name,
+			Directory:   set.BackupDir,
+			Destination: set.Destination(),
+			Interval:    set.S3BackupInterval.String(),
+			Queued:      queued[set.Name],
+		}
+		if plan, err := set.Plan(); err == nil {
+			s.Schedule = plan.String()
+		}
+		if set.ContinuousSync {
+			s.Schedule += fmt.Sprintf(", continuous sync after %s quiet (%s at most)", set.SyncQuietPeriod, set.SyncMaxDelay)
+		}
+		s.NextPush = lastFlush.next[set.Name]
+		if outcome, ok := lastFlush.sets[set.Name]; ok {
+			s.LastFlush = outcome.at
+			if outcome.err != nil {
+				s.LastError = outcome.err.Error()
+			}
+		} else if last, ok, err := db.LastRun(set.Name); err == nil && ok {
+			// Pushed before the daemon was (re)started
+			s.LastFlush = last
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
@@ -0,0 +1,126 @@
+// Package compress shrinks file contents before upload. Logs, CSVs and JSON easily compress 5-10x.
+package compress
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Gzip is the codec name for gzip, recorded in the object metadata
+	Gzip = "gzip"
+	// Zstd is the codec name for zstd, recorded in the object metadata
+	Zstd = "zstd"
+
+	// DefaultMaxEntropy (bits per byte) is where compressing stops paying off, random or already compressed data is close to 8
+	DefaultMaxEntropy = 7.5
+)
+
+// DefaultSkipExtensions are types which are compressed already
+var DefaultSkipExtensions = []string{
+	".gz", ".tgz", ".zst", ".xz", ".bz2", ".lz4", ".br", ".zip", ".7z", ".rar", ".jar", ".apk",
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic", ".mp3", ".aac", ".ogg", ".flac", ".mp4", ".mkv", ".mov", ".avi", ".webm",
+	".docx", ".xlsx", ".pptx", ".odt", ".ods", ".woff2",
+}
+
+// Codec compresses with one algorithm. It implements storage.Transform.
+type Codec struct {
+	name           string
+	skipExtensions map[string]bool
+	maxEntropy     float64
+}
+
+// New creates the codec named name (Gzip or Zstd). Files with one of the skip extensions, or whose first bytes look more random than maxEntropy, are left alone.
+func New(name string, skipExtensions []string, maxEntropy float64) (*Codec, error) {
+	if name != Gzip && name != Zstd {
+		return nil, fmt.Errorf("unknown compression %q, must be one of %s/%s", name, Gzip, Zstd)
+	}
+	c := &Codec{name: name, skipExtensions: make(map[string]bool), maxEntropy: maxEntropy}
+	for _, ext := range skipExtensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		c.skipExtensions[ext] = true
+	}
+	return c, nil
+}
+
+// Decoders returns codecs for every algorithm, to decompress whatever was stored, even with compression switched off (or changed) since
+func Decoders() []*Codec {
+	return []*Codec{{name: Gzip}, {name: Zstd}}
+}
+
+// Name is part of storage.Transform
+func (c *Codec) Name() string {
+	return c.name
+}
+
+// Applies skips types which are compressed already, going by the extension first and the entropy of the first bytes (head) otherwise
+func (c *Codec) Applies(path string, head []byte) bool {
+	if c.skipExtensions[strings.ToLower(filepath.Ext(path))] {
+		return false
+	}
+	return c.maxEntropy <= 0 || Entropy(head) <= c.maxEntropy
+}
+
+// Encode compresses src to dst, it's part of storage.Transform
+func (c *Codec) Encode(dst io.Writer, src io.Reader, metadata map[string]string) error {
+	var w io.WriteCloser
+	switch c.name {
+	case Gzip:
+		w = gzip.NewWriter(dst)
+	case Zstd:
+		zw, err := zstd.NewWriter(dst, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		w = zw
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Decode decompresses src, it's part of storage.Transform
+func (c *Codec) Decode(src io.Reader, metadata map[string]string) (io.Reader, error) {
+	switch c.name {
+	case Gzip:
+		return gzip.NewReader(src)
+	case Zstd:
+		// Decoding synchronously (concurrency 1) leaves no goroutines behind, so the reader doesn't need closing
+		return zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("unknown compression %q", c.name)
+}
+
+// Entropy is the Shannon entropy of data in bits per byte: 0 for a single repeated byte, 8 for random data
+func Entropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	var entropy float64
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(len(data))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
@@ -0,0 +1,78 @@
+package compress
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	plain := []byte(strings.Repeat(`{"level":"info","msg":"request served","status":200}`+"\n", 1000))
+	for _, name := range []string{Gzip, Zstd} {
+		c, err := New(name, nil, DefaultMaxEntropy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := c.Encode(&buf, bytes.NewReader(plain), map[string]string{}); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len()*5 > len(plain) {
+			t.Errorf("%s: %d bytes compressed to %d only", name, len(plain), buf.Len())
+		}
+
+		r, err := c.Decode(&buf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%s: content differs after round trip", name)
+		}
+	}
+}
+
+func TestApplies(t *testing.T) {
+	c, err := New(Zstd, []string{"jpg", ".GZ"}, DefaultMaxEntropy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 4096)
+	rand.Read(random)
+	text := []byte(strings.Repeat("2024-01-01,some,csv,row\n", 100))
+
+	tests := []struct {
+		path string
+		head []byte
+		want bool
+	}{
+		{"/data/report.csv", text, true},
+		{"/data/photo.JPG", text, false},
+		{"/data/archive.tar.gz", text, false},
+		{"/data/unknown.bin", random, false},
+		{"/data/empty.txt", nil, true},
+	}
+	for _, tt := range tests {
+		if got := c.Applies(tt.path, tt.head); got != tt.want {
+			t.Errorf("%s: want %v, got %v", tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	if e := Entropy(bytes.Repeat([]byte("a"), 100)); e != 0 {
+		t.Errorf("want 0 for a repeated byte, got %f", e)
+	}
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	if e := Entropy(all); e != 8 {
+		t.Errorf("want 8 for every byte once, got %f", e)
+	}
+}
@@ -0,0 +1,119 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"go.uber.org/zap"
+)
+
+// The control socket lets one-off commands (`cloudkeeper reconcile`, ...) talk to the running daemon.
+// The daemon holds the lock on the database, so anything touching the queue has to go through it.
+
+var mux = http.NewServeMux()
+
+// errorResponse is what a failed command sends back
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handle registers the function answering a command, pattern is a http.ServeMux pattern like "POST /reconcile".
+// Whatever fn returns is sent back as JSON.
+func Handle(pattern string, fn func(r *http.Request) (interface{}, error)) {
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		out, err := fn(r)
+		if err != nil {
+			customlog.Logger.Error("control command failed",
+				zap.String("command", r.URL.Path),
+				zap.String("error", err.Error()),
+			)
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(errorResponse{Error: err.Error()})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(out)
+	})
+}
+
+// Serve listens on the unix socket at socketPath till the context is cancelled
+func Serve(ctx context.Context, socketPath string) error {
+	// A socket left behind by a crashed daemon would make Listen fail
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale control socket: %v", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket: %v", err)
+	}
+	defer os.Remove(socketPath)
+
+	// Only the user running the daemon gets to control it
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict control socket permissions: %v", err)
+	}
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	customlog.Logger.Debug("Listening for control commands", zap.String("socket", socketPath))
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Call sends a command to the daemon listening on socketPath. in (may be nil) is sent as JSON, the answer is decoded into out (may be nil).
+func Call(ctx context.Context, socketPath, method, path string, in, out interface{}) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	// The host is ignored, the connection always goes to the socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://cloudkeeper"+path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the daemon on %s (is it running?): %v", socketPath, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("daemon answered with %s", resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
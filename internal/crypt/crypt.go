@@ -0,0 +1,286 @@
+// Package crypt encrypts file contents before they leave the machine.
+//
+// Files are encrypted with AES-256-GCM in chunks, so big files never have to fit in memory. The stored format is
+//
+//	header: magic "CKE1" | key ID (8 bytes) | salt (32 bytes) | chunk size (uint32)
+//	chunks: every chunk sealed on its own, with the header as additional data
+//
+// Every file gets its own key, derived from the master key and the random salt, so nonces are just the chunk counter.
+// The last byte of the nonce marks the final chunk: cutting chunks off the end (or appending some) fails authentication.
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// Name is how the encryption is recorded in the object metadata
+	Name = "aes-256-gcm"
+	// MetaKeyID is the object metadata entry holding the ID of the key an object was encrypted with
+	MetaKeyID = "cloudkeeper-key-id"
+
+	magic      = "CKE1"
+	idSize     = 8
+	saltSize   = 32
+	headerSize = len(magic) + idSize + saltSize + 4
+	chunkSize  = 64 << 10
+	keySize    = 32
+
+	// DefaultSalt is used to derive the key from a passphrase when no salt is configured
+	DefaultSalt = "cloudkeeper passphrase salt"
+)
+
+var (
+	// ErrWrongKey is returned (wrapped) when an object was encrypted with another key than the configured one
+	ErrWrongKey = errors.New("wrong encryption key")
+	// ErrCorrupted is returned (wrapped) when encrypted data fails authentication
+	ErrCorrupted = errors.New("encrypted data is corrupted or was tampered with")
+)
+
+// Key is the master key. It implements storage.Transform.
+type Key struct {
+	key []byte
+	id  [idSize]byte
+}
+
+// NewKey wraps a 32 byte master key
+func NewKey(key []byte) (*Key, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", keySize, len(key))
+	}
+	k := &Key{key: append([]byte(nil), key...)}
+	mac := hmac.New(sha256.New, k.key)
+	mac.Write([]byte("cloudkeeper key id"))
+	copy(k.id[:], mac.Sum(nil))
+	return k, nil
+}
+
+// LoadKeyFile reads a key file holding either the 32 raw key bytes or them hex encoded (e.g. `openssl rand -hex 32 > key`)
+func LoadKeyFile(path string) (*Key, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %v", err)
+	}
+	if len(content) == keySize {
+		return NewKey(content)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s holds neither %d raw bytes nor %d hex characters", path, keySize, 2*keySize)
+	}
+	return NewKey(key)
+}
+
+// KeyFromPassphrase derives the key from a passphrase with scrypt. Restoring needs the same passphrase and salt.
+func KeyFromPassphrase(passphrase, salt string) (*Key, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	if salt == "" {
+		salt = DefaultSalt
+	}
+	key, err := scrypt.Key([]byte(passphrase), []byte(salt), 1<<15, 8, 1, keySize)
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(key)
+}
+
+// ID identifies the key without giving anything away about it, it's recorded with every object
+func (k *Key) ID() string {
+	return hex.EncodeToString(k.id[:])
+}
+
+// ChunkID names a chunk of deduplicated storage after its content. It's keyed, so chunk names don't tell
+// anyone without the key whether the backup holds some known content.
+func (k *Key) ChunkID(data []byte) string {
+	mac := hmac.New(sha256.New, k.key)
+	mac.Write([]byte("cloudkeeper chunk id"))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Name is part of storage.Transform
+func (k *Key) Name() string {
+	return Name
+}
+
+// Encode encrypts src to dst and records the key ID in metadata, it's part of storage.Transform
+func (k *Key) Encode(dst io.Writer, src io.Reader, metadata map[string]string) error {
+	metadata[MetaKeyID] = k.ID()
+	return k.Encrypt(dst, src)
+}
+
+// Decode decrypts src, it's part of storage.Transform
+func (k *Key) Decode(src io.Reader, metadata map[string]string) (io.Reader, error) {
+	if id := metadata[MetaKeyID]; id != "" && id != k.ID() {
+		return nil, fmt.Errorf("%w: the object was encrypted with key %s, the configured key is %s", ErrWrongKey, id, k.ID())
+	}
+	return k.Decrypt(src)
+}
+
+// Encrypt writes the encrypted form of src to dst
+func (k *Key) Encrypt(dst io.Writer, src io.Reader) error {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	copy(header[len(magic):], k.id[:])
+	salt := header[len(magic)+idSize : len(magic)+idSize+saltSize]
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(header[headerSize-4:], chunkSize)
+
+	aead, err := k.fileCipher(salt)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(src, chunkSize)
+	plain := make([]byte, chunkSize)
+	sealed := make([]byte, 0, chunkSize+aead.Overhead())
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(r, plain)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return err
+		}
+		if !final {
+			// A chunk that exactly fills the buffer is the last one if nothing follows
+			if _, err := r.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return err
+			}
+		}
+		sealed = aead.Seal(sealed[:0], nonce(counter, final), plain[:n], header)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// Decrypt reads the header of src and returns a reader for the plaintext.
+// A header written with another key fails right away with ErrWrongKey, damaged chunks fail with ErrCorrupted when they're read.
+func (k *Key) Decrypt(src io.Reader) (io.Reader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: too short for an encrypted object", ErrCorrupted)
+		}
+		return nil, err
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, fmt.Errorf("%w: not encrypted by cloudkeeper", ErrCorrupted)
+	}
+	if id := header[len(magic) : len(magic)+idSize]; !bytes.Equal(id, k.id[:]) {
+		return nil, fmt.Errorf("%w: the object was encrypted with key %s, the configured key is %s", ErrWrongKey, hex.EncodeToString(id), k.ID())
+	}
+	size := binary.BigEndian.Uint32(header[headerSize-4:])
+	if size == 0 || size > 16<<20 {
+		return nil, fmt.Errorf("%w: invalid chunk size %d", ErrCorrupted, size)
+	}
+	aead, err := k.fileCipher(header[len(magic)+idSize : len(magic)+idSize+saltSize])
+	if err != nil {
+		return nil, err
+	}
+	return &decrypter{
+		src:    bufio.NewReader(src),
+		aead:   aead,
+		header: header,
+		sealed: make([]byte, int(size)+aead.Overhead()),
+	}, nil
+}
+
+type decrypter struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	counter uint64
+	sealed  []byte
+	plain   []byte
+	pending []byte // decrypted but not yet read
+	done    bool
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk
+func (d *decrypter) next() error {
+	n, err := io.ReadFull(d.src, d.sealed)
+	if err == io.EOF {
+		return fmt.Errorf("%w: truncated", ErrCorrupted) // the final chunk never came
+	}
+	final := err == io.ErrUnexpectedEOF
+	if err != nil && !final {
+		return err
+	}
+	if !final {
+		if _, err := d.src.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	d.plain, err = d.aead.Open(d.plain[:0], nonce(d.counter, final), d.sealed[:n], d.header)
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d", ErrCorrupted, d.counter)
+	}
+	d.counter++
+	d.pending = d.plain
+	d.done = final
+	return nil
+}
+
+// fileCipher derives the key of a single file from the master key and the file's salt
+func (k *Key) fileCipher(salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, k.key)
+	mac.Write([]byte("cloudkeeper file key"))
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(counter uint64, final bool) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n, counter)
+	if final {
+		n[11] = 1
+	}
+	return n
+}
@@ -0,0 +1,135 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T) *Key {
+	t.Helper()
+	raw := make([]byte, keySize)
+	rand.Read(raw)
+	k, err := NewKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func encrypt(t *testing.T, k *Key, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := k.Encrypt(&buf, bytes.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(k *Key, sealed []byte) ([]byte, error) {
+	r, err := k.Decrypt(bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	k := testKey(t)
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		got, err := decrypt(k, encrypt(t, k, plain))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: content differs after round trip", size)
+		}
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	sealed := encrypt(t, testKey(t), []byte("secret"))
+	if _, err := decrypt(testKey(t), sealed); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("want ErrWrongKey, got %v", err)
+	}
+	if _, err := testKey(t).Decode(bytes.NewReader(sealed), map[string]string{MetaKeyID: "0011223344556677"}); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("want ErrWrongKey from the metadata, got %v", err)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	k := testKey(t)
+	plain := make([]byte, 2*chunkSize+100)
+	sealed := encrypt(t, k, plain)
+	chunk := chunkSize + 16
+
+	flipped := cat(sealed)
+	flipped[headerSize+10] ^= 1
+
+	tests := map[string][]byte{
+		"flipped bit":       flipped,
+		"final chunk gone":  cat(sealed[:headerSize+2*chunk]),
+		"chunk cut short":   cat(sealed[:len(sealed)-1]),
+		"chunks swapped":    cat(sealed[:headerSize], sealed[headerSize+chunk:headerSize+2*chunk], sealed[headerSize:headerSize+chunk], sealed[headerSize+2*chunk:]),
+		"not encrypted":     []byte("just some plain text which is long enough for a header......"),
+		"shorter than head": cat(sealed[:10]),
+	}
+	for name, data := range tests {
+		if _, err := decrypt(k, data); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%s: want ErrCorrupted, got %v", name, err)
+		}
+	}
+}
+
+func TestKeyFromPassphrase(t *testing.T) {
+	a, err := KeyFromPassphrase("correct horse battery staple", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := KeyFromPassphrase("correct horse battery staple", "")
+	c, _ := KeyFromPassphrase("correct horse battery staple", "other salt")
+	if a.ID() != b.ID() {
+		t.Error("same passphrase and salt gave different keys")
+	}
+	if a.ID() == c.ID() {
+		t.Error("different salts gave the same key")
+	}
+}
+
+// cat copies the parts into a new slice
+func cat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func TestNames(t *testing.T) {
+	k := testKey(t)
+	names := k.NameKey()
+	for _, name := range []string{"a", "customer-acme", "ünïcödé name.txt", ".hidden"} {
+		encrypted := names.EncryptName(name)
+		if encrypted != names.EncryptName(name) {
+			t.Errorf("%q: encryption isn't deterministic", name)
+		}
+		if (len(name) > 3 && strings.Contains(encrypted, name)) || strings.ToLower(encrypted) != encrypted {
+			t.Errorf("%q: unexpected encrypted name %q", name, encrypted)
+		}
+		got, err := names.DecryptName(encrypted)
+		if err != nil || got != name {
+			t.Errorf("%q: decrypted to %q (%v)", name, got, err)
+		}
+		if _, err := testKey(t).NameKey().DecryptName(encrypted); !errors.Is(err, ErrWrongKey) {
+			t.Errorf("%q: want ErrWrongKey with another key, got %v", name, err)
+		}
+	}
+	if _, err := names.DecryptName("plain"); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("want ErrWrongKey for a plain name, got %v", err)
+	}
+}
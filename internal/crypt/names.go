@@ -0,0 +1,68 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"strings"
+)
+
+// nameEncoding keeps encrypted names to lower case letters and digits, safe for object keys and case insensitive filesystems alike
+var nameEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+const nameIVSize = 16
+
+// NameKey encrypts file and directory names deterministically, so the same name always gives the same ciphertext:
+// keys stay stable for updates and deletes, and the key of a directory is a prefix of the keys of everything in it.
+//
+// It's a synthetic IV construction (like AES-SIV, with HMAC-SHA256 standing in for S2V): the IV is the MAC of the name,
+// the name is encrypted with AES-CTR under that IV, and the IV doubles as the authentication tag on decryption.
+// Deterministic encryption does show which names are equal, nothing more.
+type NameKey struct {
+	macKey []byte
+	block  cipher.Block
+}
+
+// NameKey derives the key for names from the master key, everything needed to restore the names is the master key
+func (k *Key) NameKey() *NameKey {
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, k.key)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	block, _ := aes.NewCipher(derive("cloudkeeper name encryption key")) // 32 bytes, can't fail
+	return &NameKey{macKey: derive("cloudkeeper name mac key"), block: block}
+}
+
+// EncryptName encrypts a single path component
+func (n *NameKey) EncryptName(name string) string {
+	mac := hmac.New(sha256.New, n.macKey)
+	mac.Write([]byte(name))
+	iv := mac.Sum(nil)[:nameIVSize]
+
+	out := make([]byte, nameIVSize+len(name))
+	copy(out, iv)
+	cipher.NewCTR(n.block, iv).XORKeyStream(out[nameIVSize:], []byte(name))
+	return strings.ToLower(nameEncoding.EncodeToString(out))
+}
+
+// DecryptName reverses EncryptName. Names that weren't encrypted with this key fail with ErrWrongKey.
+func (n *NameKey) DecryptName(encrypted string) (string, error) {
+	raw, err := nameEncoding.DecodeString(strings.ToUpper(encrypted))
+	if err != nil || len(raw) < nameIVSize {
+		return "", fmt.Errorf("%w: %q is not an encrypted name", ErrWrongKey, encrypted)
+	}
+	iv := raw[:nameIVSize]
+	name := make([]byte, len(raw)-nameIVSize)
+	cipher.NewCTR(n.block, iv).XORKeyStream(name, raw[nameIVSize:])
+
+	mac := hmac.New(sha256.New, n.macKey)
+	mac.Write(name)
+	if !hmac.Equal(mac.Sum(nil)[:nameIVSize], iv) {
+		return "", fmt.Errorf("%w: can't decrypt name %q", ErrWrongKey, encrypted)
+	}
+	return string(name), nil
+}
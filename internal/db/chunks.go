@@ -0,0 +1,83 @@
+package db
+
+import (
+	"encoding/binary"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ChunkBucket remembers which chunks a store already has, so deduplicated uploads don't have to ask the backend about every single chunk.
+// It holds a bucket per store (see storage.StoreID) of chunk key -> stored size: the same key in another bucket, directory or endpoint
+// is another chunk, which may well be missing there. Entries of older versions, which didn't know about stores, sit directly in
+// ChunkBucket and are ignored, the chunks they stood for are looked up in the backend once more.
+const ChunkBucket = "chunks"
+
+// ChunkRef is one chunk of a file, Size is the size before compression/encryption
+type ChunkRef struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+// storeBucket returns the bucket of the chunks of store, nil if none was recorded yet
+func storeBucket(tx *bolt.Tx, store string) *bolt.Bucket {
+	b := tx.Bucket([]byte(ChunkBucket))
+	if b == nil {
+		return nil
+	}
+	return b.Bucket([]byte(store))
+}
+
+// HasChunk tells if the chunk was uploaded to store before
+func HasChunk(store, key string) (bool, error) {
+	var found bool
+	err := Conn.View(func(tx *bolt.Tx) error {
+		b := storeBucket(tx, store)
+		found = b != nil && b.Get([]byte(key)) != nil
+		return nil
+	})
+	return found, err
+}
+
+// PutChunks records chunks uploaded to store (chunk key -> stored size) in one transaction
+func PutChunks(store string, chunks map[string]int64) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	return Conn.Update(func(tx *bolt.Tx) error {
+		parent, err := tx.CreateBucketIfNotExists([]byte(ChunkBucket))
+		if err != nil {
+			return err
+		}
+		b, err := parent.CreateBucketIfNotExists([]byte(store))
+		if err != nil {
+			return err
+		}
+		for key, size := range chunks {
+			value := make([]byte, 8)
+			binary.BigEndian.PutUint64(value, uint64(size))
+			if err := b.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteChunks forgets chunks which were removed from store
+func DeleteChunks(store string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return Conn.Update(func(tx *bolt.Tx) error {
+		b := storeBucket(tx, store)
+		if b == nil {
+			return nil
+		}
+		for _, key := range keys {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DeadLetterBucket holds the paths which failed too often, they stay there till they are requeued by hand
+const DeadLetterBucket = "deadLetter"
+
+// DeadLetter is the queue entry of a path that was given up on
+type DeadLetter struct {
+	QueueEntry
+	FailedAt time.Time `json:"failedAt"`
+}
+
+// RecordFailure notes a failed attempt on the queue entry of path. backoff tells how long to wait before the next attempt,
+// given the number of failed attempts so far. Once maxAttempts is reached the entry is moved to the dead letter bucket,
+// which is reported back.
+// Nothing happens if new events arrived for path meanwhile (seq moved on), the next attempt works on a changed file anyway.
+func RecordFailure(path string, seq uint64, failure error, maxAttempts int, backoff func(attempts int) time.Duration) (bool, error) {
+	var deadLettered bool
+	err := Conn.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(FilesToUpdateBucket))
+		if err != nil {
+			return err
+		}
+		key := []byte(path)
+		v := b.Get(key)
+		if v == nil {
+			return nil
+		}
+		entry, err := DecodeQueueEntry(v)
+		if err != nil {
+			return fmt.Errorf("error reading queue entry of %s: %v", path, err)
+		}
+		if entry.Seq != seq {
+			return nil
+		}
+
+		now := time.Now()
+		entry.Attempts++
+		entry.LastError = failure.Error()
+		entry.NextAttempt = now.Add(backoff(entry.Attempts))
+		if entry.Attempts < maxAttempts {
+			return putQueueEntry(b, key, entry)
+		}
+
+		dl, err := tx.CreateBucketIfNotExists([]byte(DeadLetterBucket))
+		if err != nil {
+			return err
+		}
+		entry.NextAttempt = time.Time{}
+		value, err := json.Marshal(DeadLetter{QueueEntry: entry, FailedAt: now})
+		if err != nil {
+			return err
+		}
+		if err := dl.Put(key, value); err != nil {
+			return err
+		}
+		deadLettered = true
+		return b.Delete(key)
+	})
+	return deadLettered, err
+}
+
+// ReadDeadLetters returns every path in the dead letter bucket
+func ReadDeadLetters() (map[string]DeadLetter, error) {
+	letters := make(map[string]DeadLetter)
+	err := Conn.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(DeadLetterBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var letter DeadLetter
+			if err := json.Unmarshal(v, &letter); err != nil {
+				return fmt.Errorf("error reading dead letter entry of %s: %v", k, err)
+			}
+			letters[string(k)] = letter
+			return nil
+		})
+	})
+	return letters, err
+}
+
+// Requeue moves paths from the dead letter bucket back to the queue with a clean retry state, all of them if paths is empty.
+// If a path got queued again by new events meanwhile, that entry wins and the dead letter is just dropped.
+// It returns the number of paths requeued.
+func Requeue(paths []string) (int, error) {
+	var n int
+	err := Conn.Update(func(tx *bolt.Tx) error {
+		dl := tx.Bucket([]byte(DeadLetterBucket))
+		if dl == nil {
+			return nil
+		}
+		b, err := tx.CreateBucketIfNotExists([]byte(FilesToUpdateBucket))
+		if err != nil {
+			return err
+		}
+
+		if len(paths) == 0 {
+			err := dl.ForEach(func(k, _ []byte) error {
+				paths = append(paths, string(k))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, path := range paths {
+			key := []byte(path)
+			v := dl.Get(key)
+			if v == nil {
+				return fmt.Errorf("%s is not in the dead letter bucket", path)
+			}
+			var letter DeadLetter
+			if err := json.Unmarshal(v, &letter); err != nil {
+				return fmt.Errorf("error reading dead letter entry of %s: %v", path, err)
+			}
+
+			if b.Get(key) == nil {
+				entry := letter.QueueEntry
+				entry.Attempts = 0
+				entry.LastError = ""
+				entry.NextAttempt = time.Time{}
+				if entry.Seq, err = b.NextSequence(); err != nil {
+					return err
+				}
+				if err := putQueueEntry(b, key, entry); err != nil {
+					return err
+				}
+			}
+			if err := dl.Delete(key); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// NextRetry returns the earliest time a failed entry may be tried again, false if no entry is waiting for a retry.
+// Only the paths match reports true for are looked at, a nil match looks at all of them.
+func NextRetry(match func(path string) bool) (time.Time, bool, error) {
+	queue, err := ReadQueue()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	var next time.Time
+	for path, entry := range queue {
+		if entry.Attempts == 0 || (match != nil && !match(path)) {
+			continue
+		}
+		if next.IsZero() || entry.NextAttempt.Before(next) {
+			next = entry.NextAttempt
+		}
+	}
+	return next, !next.IsZero(), nil
+}
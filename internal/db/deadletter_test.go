@@ -0,0 +1,86 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRecordFailureAndRequeue(t *testing.T) {
+	const path = "/backup/unreadable.txt"
+	openTestDB(t)
+	queueEvents(t, path, OpWrite)
+
+	noDelay := func(int) time.Duration { return 0 }
+	failure := errors.New("permission denied")
+	for attempt := 1; attempt <= 3; attempt++ {
+		queue, err := ReadQueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, ok := queue[path]
+		if !ok {
+			t.Fatalf("attempt %d: path fell off the queue early", attempt)
+		}
+		if entry.Attempts != attempt-1 {
+			t.Fatalf("attempt %d: want %d failed attempts recorded, got %d", attempt, attempt-1, entry.Attempts)
+		}
+		deadLettered, err := RecordFailure(path, entry.Seq, failure, 3, noDelay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deadLettered != (attempt == 3) {
+			t.Fatalf("attempt %d: dead lettered = %v", attempt, deadLettered)
+		}
+	}
+
+	queue, err := ReadQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := queue[path]; ok {
+		t.Fatal("want path off the queue after the last attempt")
+	}
+	letters, err := ReadDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if letters[path].LastError != failure.Error() {
+		t.Fatalf("want dead letter with the last error, got %+v", letters[path])
+	}
+
+	n, err := Requeue(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("want 1 path requeued, got %d", n)
+	}
+	queue, err = ReadQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := queue[path]; entry.Attempts != 0 || entry.Action() != ActionAdd {
+		t.Fatalf("want a fresh add entry after requeue, got %+v", entry)
+	}
+	if letters, _ := ReadDeadLetters(); len(letters) != 0 {
+		t.Fatalf("want the dead letter bucket empty, got %v", letters)
+	}
+}
+
+func TestRecordFailureIgnoresChangedEntry(t *testing.T) {
+	const path = "/backup/file.txt"
+	openTestDB(t)
+	queueEvents(t, path, OpWrite)
+	queue, _ := ReadQueue()
+	seq := queue[path].Seq
+
+	queueEvents(t, path, OpWrite) // the file changed while the failed attempt was running
+	if _, err := RecordFailure(path, seq, errors.New("boom"), 1, func(int) time.Duration { return time.Hour }); err != nil {
+		t.Fatal(err)
+	}
+	queue, _ = ReadQueue()
+	if entry := queue[path]; entry.Attempts != 0 || !entry.NextAttempt.IsZero() {
+		t.Fatalf("want the new entry untouched, got %+v", entry)
+	}
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// GuardBucket keeps the state of the mass deletion guard, so a freeze survives a restart
+const GuardBucket = "guard"
+
+var frozenKey = []byte("frozen")
+
+// FreezeState tells why flushing to the backend was frozen
+type FreezeState struct {
+	Reason      string    `json:"reason"`
+	At          time.Time `json:"at"`
+	Window      string    `json:"window"`
+	Changed     int       `json:"changed"`     // distinct files removed, renamed or rewritten within the window
+	Tracked     int       `json:"tracked"`     // files in the object index
+	HighEntropy int       `json:"highEntropy"` // rewritten files which look encrypted now
+	Samples     []string  `json:"samples,omitempty"`
+}
+
+// Freeze records that flushing is frozen, an existing freeze is kept (the first alarm is the interesting one)
+func Freeze(state FreezeState) error {
+	return Conn.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(GuardBucket))
+		if err != nil {
+			return err
+		}
+		if b.Get(frozenKey) != nil {
+			return nil
+		}
+		value, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		return b.Put(frozenKey, value)
+	})
+}
+
+// Frozen returns the freeze in effect, nil if flushing isn't frozen
+func Frozen() (*FreezeState, error) {
+	var state *FreezeState
+	err := Conn.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(GuardBucket))
+		if b == nil {
+			return nil
+		}
+		v := b.Get(frozenKey)
+		if v == nil {
+			return nil
+		}
+		state = &FreezeState{}
+		if err := json.Unmarshal(v, state); err != nil {
+			return fmt.Errorf("error reading freeze state: %v", err)
+		}
+		return nil
+	})
+	return state, err
+}
+
+// Unfreeze lifts the freeze and returns what it was, nil if there was none
+func Unfreeze() (*FreezeState, error) {
+	state, err := Frozen()
+	if err != nil || state == nil {
+		return state, err
+	}
+	return state, Conn.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(GuardBucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(frozenKey)
+	})
+}
+
+// CountIndex returns the number of files in the object index
+func CountIndex() (int, error) {
+	var n int
+	err := Conn.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(ObjectIndexBucket)); b != nil {
+			n = b.Stats().KeyN
+		}
+		return nil
+	})
+	return n, err
+}
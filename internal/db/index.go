@@ -0,0 +1,117 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ObjectIndexBucket remembers what was last pushed to s3 for every local file, so changes made while CloudKeeper wasn't running can be spotted
+const ObjectIndexBucket = "objectIndex"
+
+// IndexEntry describes the local file as it was when it got uploaded
+type IndexEntry struct {
+	Size       int64      `json:"size"`
+	StoredSize int64      `json:"storedSize,omitempty"` // size of the object, differs from Size for encrypted files
+	ModTime    time.Time  `json:"modTime"`
+	ETag       string     `json:"etag"`
+	UploadedAt time.Time  `json:"uploadedAt"`
+	Mode       uint32     `json:"mode,omitempty"`
+	VersionID  string     `json:"versionId,omitempty"` // version of the object in a versioned bucket
+	Chunks     []ChunkRef `json:"chunks"`              // content of the file in the chunked layout, nil for files stored as a single object
+}
+
+// PutIndex records an upload of path, it's meant to be called in the transaction removing path from the queue
+func PutIndex(tx *bolt.Tx, path string, entry IndexEntry) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(ObjectIndexBucket))
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(path), value)
+}
+
+// DeleteIndex forgets path and, if it is a directory, everything below it. Just like DeleteFromS3 does in s3.
+func DeleteIndex(tx *bolt.Tx, path string) error {
+	b := tx.Bucket([]byte(ObjectIndexBucket))
+	if b == nil {
+		return nil
+	}
+	if err := b.Delete([]byte(path)); err != nil {
+		return err
+	}
+
+	dirPrefix := []byte(filepath.Clean(path) + string(filepath.Separator))
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek(dirPrefix); k != nil && bytes.HasPrefix(k, dirPrefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	// Deleting while iterating with a cursor skips keys, hence the two passes
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadIndex returns the whole object index, keyed by local path
+func ReadIndex() (map[string]IndexEntry, error) {
+	index := make(map[string]IndexEntry)
+	err := Conn.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ObjectIndexBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var entry IndexEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("error reading index entry of %s: %v", k, err)
+			}
+			index[string(k)] = entry
+			return nil
+		})
+	})
+	return index, err
+}
+
+// ReadIndexBelow returns the index entries of path and, if it is a directory, of everything below it
+func ReadIndexBelow(path string) (map[string]IndexEntry, error) {
+	index := make(map[string]IndexEntry)
+	err := Conn.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ObjectIndexBucket))
+		if b == nil {
+			return nil
+		}
+		read := func(k, v []byte) error {
+			var entry IndexEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("error reading index entry of %s: %v", k, err)
+			}
+			index[string(k)] = entry
+			return nil
+		}
+		if v := b.Get([]byte(path)); v != nil {
+			if err := read([]byte(path), v); err != nil {
+				return err
+			}
+		}
+		dirPrefix := []byte(filepath.Clean(path) + string(filepath.Separator))
+		c := b.Cursor()
+		for k, v := c.Seek(dirPrefix); k != nil && bytes.HasPrefix(k, dirPrefix); k, v = c.Next() {
+			if err := read(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return index, err
+}
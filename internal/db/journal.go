@@ -0,0 +1,248 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+const (
+	// JournalBucket is the write-ahead journal every detected change is appended to before anything else happens to it
+	JournalBucket = "journal"
+
+	journalBufferSize = 10000 // events waiting to be committed
+	maxGroupCommit    = 1000  // upper bound of entries written in a single transaction
+	commitRetryDelay  = time.Second
+)
+
+// JournalEntry is a single change appended to the journal
+type JournalEntry struct {
+	Path   string    `json:"path"`
+	Op     string    `json:"op"`
+	From   string    `json:"from,omitempty"`   // where the path was moved from, OpMoved only
+	Action string    `json:"action,omitempty"` // only set in journals written by older versions, which didn't record the event itself
+	Time   time.Time `json:"time"`
+}
+
+// journalRequest is either an entry to append or, if entry is nil, a request to be told once everything before it got committed
+type journalRequest struct {
+	entry *JournalEntry
+	done  chan struct{}
+}
+
+var journalCh = make(chan journalRequest, journalBufferSize)
+
+// journaled is closed (and replaced) every time new entries are committed, see Journaled
+var journaled = struct {
+	sync.Mutex
+	ch chan struct{}
+}{ch: make(chan struct{})}
+
+// Journaled returns a channel which is closed once the next change is committed to the journal.
+// Continuous sync waits on it instead of polling the queue.
+func Journaled() <-chan struct{} {
+	journaled.Lock()
+	defer journaled.Unlock()
+	return journaled.ch
+}
+
+func notifyJournaled() {
+	journaled.Lock()
+	defer journaled.Unlock()
+	close(journaled.ch)
+	journaled.ch = make(chan struct{})
+}
+
+// AppendJournal queues a change for the journal writer.
+// RunJournal commits everything that piled up since its last commit in one transaction (group commit), so a burst of events costs a handful of fsyncs instead of one each.
+func AppendJournal(path, op string) {
+	journalCh <- journalRequest{entry: &JournalEntry{
+		Path: path,
+		Op:   op,
+		Time: time.Now(),
+	}}
+}
+
+// AppendMove queues a rename/move of from to to within the backed up tree, as OpMoved of to.
+// The move of from itself is journaled on its own (OpMovedFrom), it's what takes the old path out of the backup.
+func AppendMove(from, to string) {
+	journalCh <- journalRequest{entry: &JournalEntry{
+		Path: to,
+		Op:   OpMoved,
+		From: from,
+		Time: time.Now(),
+	}}
+}
+
+// SyncJournal blocks till every entry appended before the call is committed, or the context is done
+func SyncJournal(ctx context.Context) {
+	done := make(chan struct{})
+	select {
+	case journalCh <- journalRequest{done: done}:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// RunJournal is the journal writer, it must be running for AppendJournal to make progress.
+// On context cancellation whatever is still buffered gets committed before returning.
+func RunJournal(ctx context.Context) {
+	var pending []JournalEntry
+	var waiters []chan struct{}
+
+	add := func(req journalRequest) {
+		if req.entry != nil {
+			pending = append(pending, *req.entry)
+		} else {
+			waiters = append(waiters, req.done)
+		}
+	}
+
+	commit := func() {
+		for len(pending) > 0 {
+			batch := pending
+			if len(batch) > maxGroupCommit {
+				batch = batch[:maxGroupCommit]
+			}
+			if err := writeJournal(batch); err != nil {
+				// Keep the entries, they are retried on the next round
+				customlog.Logger.Error("error appending to the journal",
+					zap.Int("entries", len(pending)),
+					zap.String("error", err.Error()),
+				)
+				return
+			}
+			pending = pending[len(batch):]
+			notifyJournaled()
+		}
+		for _, w := range waiters {
+			close(w)
+		}
+		waiters = nil
+	}
+
+	for {
+		select {
+		case req := <-journalCh:
+			add(req)
+			// Grab whatever else is already waiting, that's what makes it a group commit
+		drain:
+			for len(pending) < maxGroupCommit {
+				select {
+				case req := <-journalCh:
+					add(req)
+				default:
+					break drain
+				}
+			}
+			commit()
+			if len(pending) > 0 {
+				// commit failed, don't spin on a broken database
+				select {
+				case <-time.After(commitRetryDelay):
+				case <-ctx.Done():
+				}
+			}
+		case <-ctx.Done():
+			// RunJournal is the only reader, so whatever len reports is there to be taken
+			for len(journalCh) > 0 {
+				add(<-journalCh)
+			}
+			commit()
+			customlog.Logger.Warn("[Inside RunJournal] Context cancellation signal received. Shutting down gracefully.")
+			return
+		}
+	}
+}
+
+// writeJournal appends the entries to the journal bucket, keyed by a monotonically increasing sequence number
+func writeJournal(entries []JournalEntry) error {
+	return Conn.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(JournalBucket))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(itob(seq), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readJournal calls fn for every journal entry in the order they were appended, and returns how many there were
+func readJournal(tx *bolt.Tx, fn func(entry JournalEntry) error) (int, error) {
+	b := tx.Bucket([]byte(JournalBucket))
+	if b == nil {
+		return 0, nil
+	}
+	var n int
+	err := b.ForEach(func(k, v []byte) error {
+		var entry JournalEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			// A torn write can't happen with bbolt, so this is a bug rather than a crash artifact. Don't let it block the rest.
+			customlog.Logger.Error("skipping unreadable journal entry",
+				zap.Uint64("seq", binary.BigEndian.Uint64(k)),
+				zap.String("error", err.Error()),
+			)
+			return nil
+		}
+		if entry.Op == "" {
+			entry.Op = opFromAction(entry.Action)
+		}
+		n++
+		return fn(entry)
+	})
+	return n, err
+}
+
+// truncateJournal drops every journal entry, it must only be called in the transaction which compacted them
+func truncateJournal(tx *bolt.Tx) error {
+	if tx.Bucket([]byte(JournalBucket)) == nil {
+		return nil
+	}
+	if err := tx.DeleteBucket([]byte(JournalBucket)); err != nil {
+		return err
+	}
+	_, err := tx.CreateBucket([]byte(JournalBucket))
+	return err
+}
+
+// Recover replays whatever is left in the journal from the last run into the filesToUpdate bucket.
+// It is meant to be called once at startup, before the watcher starts appending new entries.
+func Recover() error {
+	n, err := PersistData()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		customlog.Logger.Info("Replayed journal from previous run", zap.Int("entries", n))
+	}
+	return nil
+}
+
+// itob returns an 8-byte big endian representation of v, so keys sort in the order they were written
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// MultipartBucket tracks multipart uploads in progress, so an interrupted upload resumes where it stopped.
+// Like ChunkBucket it holds a bucket per store (see storage.StoreID) of s3 key -> state: sets in different stores may upload to the same key.
+// Uploads to a backend without an identity aren't recorded, they start over. Entries of older versions, which sit directly
+// in MultipartBucket, are ignored: their uploads are aborted once they're stale.
+const MultipartBucket = "multipartUploads"
+
+// MultipartState is the progress of a multipart upload
+type MultipartState struct {
+	UploadID  string           `json:"uploadId"`
+	Path      string           `json:"path"`
+	Size      int64            `json:"size"`    // size and modification time of the file when the upload started,
+	ModTime   time.Time        `json:"modTime"` // if they changed the parts uploaded so far are worthless
+	PartSize  int64            `json:"partSize"`
+	Parts     map[int32]string `json:"parts"` // part number -> ETag of the parts uploaded so far
+	StartedAt time.Time        `json:"startedAt"`
+}
+
+// multipartBucket returns the bucket of the uploads to store, nil if none was recorded yet
+func multipartBucket(tx *bolt.Tx, store string) *bolt.Bucket {
+	b := tx.Bucket([]byte(MultipartBucket))
+	if b == nil || store == "" {
+		return nil
+	}
+	return b.Bucket([]byte(store))
+}
+
+// GetMultipart returns the upload to store in progress for key, or nil if there is none
+func GetMultipart(store, key string) (*MultipartState, error) {
+	var state *MultipartState
+	err := Conn.View(func(tx *bolt.Tx) error {
+		b := multipartBucket(tx, store)
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		state = &MultipartState{}
+		if err := json.Unmarshal(v, state); err != nil {
+			return fmt.Errorf("error reading multipart upload state of %s: %v", key, err)
+		}
+		return nil
+	})
+	return state, err
+}
+
+// PutMultipart stores the state of the upload to store for key
+func PutMultipart(store, key string, state *MultipartState) error {
+	if store == "" {
+		return nil
+	}
+	return Conn.Update(func(tx *bolt.Tx) error {
+		return putMultipart(tx, store, key, state)
+	})
+}
+
+// SaveMultipartPart records a finished part. It re-reads the state in the transaction, so parts finishing concurrently don't overwrite each other.
+func SaveMultipartPart(store, key string, partNumber int32, etag string) error {
+	if store == "" {
+		return nil
+	}
+	return Conn.Update(func(tx *bolt.Tx) error {
+		b := multipartBucket(tx, store)
+		if b == nil {
+			return fmt.Errorf("no multipart upload in progress for %s", key)
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return fmt.Errorf("no multipart upload in progress for %s", key)
+		}
+		var state MultipartState
+		if err := json.Unmarshal(v, &state); err != nil {
+			return fmt.Errorf("error reading multipart upload state of %s: %v", key, err)
+		}
+		if state.Parts == nil {
+			state.Parts = make(map[int32]string)
+		}
+		state.Parts[partNumber] = etag
+		return putMultipart(tx, store, key, &state)
+	})
+}
+
+// DeleteMultipart forgets the upload to store for key, once it was completed or aborted
+func DeleteMultipart(store, key string) error {
+	return Conn.Update(func(tx *bolt.Tx) error {
+		b := multipartBucket(tx, store)
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func putMultipart(tx *bolt.Tx, store, key string, state *MultipartState) error {
+	parent, err := tx.CreateBucketIfNotExists([]byte(MultipartBucket))
+	if err != nil {
+		return err
+	}
+	b, err := parent.CreateBucketIfNotExists([]byte(store))
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), value)
+}
@@ -0,0 +1,40 @@
+package db
+
+import "testing"
+
+func TestMultipartPerStore(t *testing.T) {
+	openTestDB(t)
+	const key = "backup/big.bin"
+	for _, store := range []string{"s3:aws/one", "s3:aws/two"} {
+		if err := PutMultipart(store, key, &MultipartState{UploadID: store}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SaveMultipartPart("s3:aws/one", key, 1, "etag"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same key in another store is another upload
+	one, err := GetMultipart("s3:aws/one", key)
+	if err != nil || one == nil || one.UploadID != "s3:aws/one" || one.Parts[1] != "etag" {
+		t.Fatalf("want the upload to the first store with its part, got %+v (%v)", one, err)
+	}
+	two, err := GetMultipart("s3:aws/two", key)
+	if err != nil || two == nil || two.UploadID != "s3:aws/two" || len(two.Parts) != 0 {
+		t.Fatalf("want the upload to the second store untouched, got %+v (%v)", two, err)
+	}
+	if err := DeleteMultipart("s3:aws/one", key); err != nil {
+		t.Fatal(err)
+	}
+	if two, err := GetMultipart("s3:aws/two", key); err != nil || two == nil {
+		t.Errorf("want the upload to the second store kept, got %+v (%v)", two, err)
+	}
+
+	// A backend without an identity has nothing recorded
+	if err := PutMultipart("", key, &MultipartState{UploadID: "anonymous"}); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := GetMultipart("", key); err != nil || state != nil {
+		t.Errorf("want nothing recorded without a store, got %+v (%v)", state, err)
+	}
+}
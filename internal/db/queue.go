@@ -0,0 +1,263 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// What happened to a path, as reported by the watcher
+const (
+	OpCreate    = "create"
+	OpWrite     = "write"
+	OpRemove    = "remove"
+	OpMovedFrom = "moved-from" // the path was renamed/moved to somewhere else
+	OpMovedTo   = "moved-to"   // something was renamed/moved to this path
+	OpMoved     = "moved"      // a path of the tree was renamed/moved to this path, both halves of the rename were seen (see AppendMove)
+)
+
+// States a queued path can be in. The state sums up every event seen for the path since it was last pushed to s3.
+const (
+	StateNew       = "new"        // created after the last push, so there is nothing in s3 for it yet
+	StateModified  = "modified"   // content changed, s3 holds an older copy
+	StateDeleted   = "deleted"    // removed locally, s3 still holds it
+	StateMovedFrom = "moved-from" // moved away, from s3's point of view that's a removal
+	StateMovedTo   = "moved-to"   // something moved in, from s3's point of view that's an upload
+	StateRecreated = "recreated"  // removed or moved away and then created again
+	StateMoved     = "moved"      // renamed/moved here from QueueEntry.From, the backend can copy what it has for that path
+)
+
+// Actions to be performed in s3 for a queued path
+const (
+	ActionAdd    = "add"
+	ActionRemove = "remove"
+	ActionMove   = "move" // copy the objects of the old path in the backend, upload only what changed
+)
+
+// QueueEntry is the value stored for a path in the filesToUpdate bucket
+type QueueEntry struct {
+	State     string    `json:"state"`
+	FirstSeen time.Time `json:"firstSeen"`      // first event since the last push
+	LastSeen  time.Time `json:"lastSeen"`       // latest event
+	Seq       uint64    `json:"seq"`            // sequence number of the latest event, grows with every event applied to the queue
+	From      string    `json:"from,omitempty"` // where the path was moved from, StateMoved only
+
+	// Retry state, reset by every new event for the path
+	Attempts    int       `json:"attempts,omitempty"`    // failed attempts so far
+	LastError   string    `json:"lastError,omitempty"`   // error of the latest failed attempt
+	NextAttempt time.Time `json:"nextAttempt,omitempty"` // don't try again before this
+}
+
+// Action tells what has to be done in s3 to bring it in line with the entry
+func (e QueueEntry) Action() string {
+	switch e.State {
+	case StateDeleted, StateMovedFrom:
+		return ActionRemove
+	case StateMoved:
+		return ActionMove
+	default:
+		return ActionAdd
+	}
+}
+
+// transitions holds the merge rules: current state -> event -> next state.
+// A missing current state ("") means the path isn't queued, a resulting "" means the entry is dropped altogether.
+var transitions = map[string]map[string]string{
+	"": {
+		OpCreate:    StateNew,
+		OpWrite:     StateModified,
+		OpRemove:    StateDeleted,
+		OpMovedFrom: StateMovedFrom,
+		OpMovedTo:   StateMovedTo,
+		OpMoved:     StateMoved,
+	},
+	// s3 never saw it, so if it goes away again there is nothing left to do
+	StateNew: {
+		OpCreate:    StateNew,
+		OpWrite:     StateNew,
+		OpRemove:    "",
+		OpMovedFrom: "",
+		OpMovedTo:   StateNew,
+		OpMoved:     StateMoved,
+	},
+	StateModified: {
+		OpCreate:    StateModified,
+		OpWrite:     StateModified,
+		OpRemove:    StateDeleted,
+		OpMovedFrom: StateMovedFrom,
+		OpMovedTo:   StateModified,
+		OpMoved:     StateMoved,
+	},
+	StateDeleted: {
+		OpCreate:    StateRecreated,
+		OpWrite:     StateRecreated,
+		OpRemove:    StateDeleted,
+		OpMovedFrom: StateDeleted,
+		OpMovedTo:   StateRecreated,
+		OpMoved:     StateMoved,
+	},
+	StateMovedFrom: {
+		OpCreate:    StateRecreated,
+		OpWrite:     StateRecreated,
+		OpRemove:    StateMovedFrom,
+		OpMovedFrom: StateMovedFrom,
+		OpMovedTo:   StateRecreated,
+		OpMoved:     StateMoved,
+	},
+	// whatever was moved in may have replaced something s3 has, so removing it has to reach s3
+	StateMovedTo: {
+		OpCreate:    StateMovedTo,
+		OpWrite:     StateMovedTo,
+		OpRemove:    StateDeleted,
+		OpMovedFrom: StateMovedFrom,
+		OpMovedTo:   StateMovedTo,
+		OpMoved:     StateMoved,
+	},
+	StateRecreated: {
+		OpCreate:    StateRecreated,
+		OpWrite:     StateRecreated,
+		OpRemove:    StateDeleted,
+		OpMovedFrom: StateMovedFrom,
+		OpMovedTo:   StateRecreated,
+		OpMoved:     StateMoved,
+	},
+	// written to after the move, the content has to be uploaded after all
+	StateMoved: {
+		OpCreate:    StateMovedTo,
+		OpWrite:     StateMovedTo,
+		OpRemove:    StateDeleted,
+		OpMovedFrom: StateMovedFrom,
+		OpMovedTo:   StateMovedTo,
+		OpMoved:     StateMoved,
+	},
+}
+
+// Apply merges an event into the queue entry of a path, prev is nil if the path isn't queued.
+// It returns the new entry, or nil if the path no longer needs anything done in s3.
+// Unknown events leave the entry as it is.
+func Apply(prev *QueueEntry, op string, at time.Time, seq uint64) *QueueEntry {
+	return ApplyMove(prev, op, "", at, seq)
+}
+
+// ApplyMove is Apply for an event which may be a move: from is where the path was moved from for OpMoved.
+// Whatever was queued for the path before is replaced by what was moved there.
+func ApplyMove(prev *QueueEntry, op, from string, at time.Time, seq uint64) *QueueEntry {
+	current := ""
+	if prev != nil {
+		current = prev.State
+	}
+	next, ok := transitions[current][op]
+	if !ok {
+		return prev
+	}
+	if next == "" {
+		return nil
+	}
+
+	entry := QueueEntry{State: next, FirstSeen: at, LastSeen: at, Seq: seq}
+	if next == StateMoved {
+		entry.From = from
+	}
+	if prev != nil {
+		entry.FirstSeen = prev.FirstSeen
+	}
+	return &entry
+}
+
+// DecodeQueueEntry reads a value of the filesToUpdate bucket.
+// Databases written by older versions hold just the action ("add"/"remove"), those are mapped to the closest state.
+func DecodeQueueEntry(v []byte) (QueueEntry, error) {
+	switch string(v) {
+	case ActionAdd:
+		return QueueEntry{State: StateModified}, nil
+	case ActionRemove:
+		return QueueEntry{State: StateDeleted}, nil
+	}
+	var entry QueueEntry
+	err := json.Unmarshal(v, &entry)
+	return entry, err
+}
+
+// opFromAction maps the actions journaled by older versions to events
+func opFromAction(action string) string {
+	switch action {
+	case ActionAdd:
+		return OpWrite
+	case ActionRemove:
+		return OpRemove
+	}
+	return action
+}
+
+// ReadQueue returns every queued path with its entry
+func ReadQueue() (map[string]QueueEntry, error) {
+	queue := make(map[string]QueueEntry)
+	err := Conn.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(FilesToUpdateBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			entry, err := DecodeQueueEntry(v)
+			if err != nil {
+				return fmt.Errorf("error reading queue entry of %s: %v", k, err)
+			}
+			queue[string(k)] = entry
+			return nil
+		})
+	})
+	return queue, err
+}
+
+// Dequeue removes path from the queue once action was carried out in s3 for the entry with sequence number seq.
+// update (may be nil) runs in the same transaction, to keep the object index in line with the queue.
+//
+// If events for path were compacted into the queue in the meantime, the entry stays, but the merge rules assumed
+// s3 didn't change. After an upload s3 does have the file, so a "new" entry becomes "modified" and a dropped one
+// (created, then removed again) comes back as "deleted".
+func Dequeue(path string, seq uint64, action string, update func(tx *bolt.Tx) error) error {
+	return Conn.Update(func(tx *bolt.Tx) error {
+		if update != nil {
+			if err := update(tx); err != nil {
+				return err
+			}
+		}
+
+		b, err := tx.CreateBucketIfNotExists([]byte(FilesToUpdateBucket))
+		if err != nil {
+			return err
+		}
+		key := []byte(path)
+		v := b.Get(key)
+		if v == nil {
+			if action != ActionAdd {
+				return nil
+			}
+			now := time.Now()
+			return putQueueEntry(b, key, QueueEntry{State: StateDeleted, FirstSeen: now, LastSeen: now, Seq: seq})
+		}
+
+		entry, err := DecodeQueueEntry(v)
+		if err != nil {
+			return fmt.Errorf("error reading queue entry of %s: %v", path, err)
+		}
+		if entry.Seq == seq {
+			return b.Delete(key)
+		}
+		if action == ActionAdd && entry.State == StateNew {
+			entry.State = StateModified
+			return putQueueEntry(b, key, entry)
+		}
+		return nil
+	})
+}
+
+func putQueueEntry(b *bolt.Bucket, key []byte, entry QueueEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
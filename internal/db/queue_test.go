@@ -0,0 +1,173 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		ops       []string
+		wantState string // "" means the path is no longer queued
+	}{
+		{"create", []string{OpCreate}, StateNew},
+		{"write", []string{OpWrite}, StateModified},
+		{"remove", []string{OpRemove}, StateDeleted},
+		{"created and written", []string{OpCreate, OpWrite, OpWrite}, StateNew},
+		{"created then removed", []string{OpCreate, OpWrite, OpRemove}, ""},
+		{"created then moved away", []string{OpCreate, OpMovedFrom}, ""},
+		{"modified then removed", []string{OpWrite, OpRemove}, StateDeleted},
+		{"removed then recreated", []string{OpRemove, OpCreate}, StateRecreated},
+		{"removed then written", []string{OpRemove, OpWrite}, StateRecreated},
+		{"recreated then removed", []string{OpRemove, OpCreate, OpRemove}, StateDeleted},
+		{"moved away", []string{OpMovedFrom}, StateMovedFrom},
+		{"moved away then back", []string{OpMovedFrom, OpMovedTo}, StateRecreated},
+		{"moved in", []string{OpMovedTo}, StateMovedTo},
+		{"moved in then written", []string{OpMovedTo, OpWrite}, StateMovedTo},
+		{"moved in then removed", []string{OpMovedTo, OpRemove}, StateDeleted},
+		{"moved in then moved away", []string{OpMovedTo, OpMovedFrom}, StateMovedFrom},
+		{"moved here", []string{OpMoved}, StateMoved},
+		{"moved here over a modified file", []string{OpWrite, OpMoved}, StateMoved},
+		{"moved here then written", []string{OpMoved, OpWrite}, StateMovedTo},
+		{"moved here then removed", []string{OpMoved, OpRemove}, StateDeleted},
+		{"moved here then moved on", []string{OpMoved, OpMovedFrom}, StateMovedFrom},
+		{"unknown event is ignored", []string{OpWrite, "chmod"}, StateModified},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			var entry *QueueEntry
+			for i, op := range tt.ops {
+				entry = Apply(entry, op, start.Add(time.Duration(i)*time.Second), uint64(i+1))
+			}
+
+			if tt.wantState == "" {
+				if entry != nil {
+					t.Fatalf("want path dropped from the queue, got state %q", entry.State)
+				}
+				return
+			}
+			if entry == nil {
+				t.Fatalf("want state %q, got path dropped from the queue", tt.wantState)
+			}
+			if entry.State != tt.wantState {
+				t.Errorf("want state %q, got %q", tt.wantState, entry.State)
+			}
+		})
+	}
+}
+
+func TestApplyKeepsFirstSeen(t *testing.T) {
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	last := first.Add(time.Hour)
+
+	entry := Apply(nil, OpWrite, first, 1)
+	entry = Apply(entry, OpRemove, last, 2)
+
+	if !entry.FirstSeen.Equal(first) {
+		t.Errorf("want first seen %v, got %v", first, entry.FirstSeen)
+	}
+	if !entry.LastSeen.Equal(last) {
+		t.Errorf("want last seen %v, got %v", last, entry.LastSeen)
+	}
+	if entry.Seq != 2 {
+		t.Errorf("want seq 2, got %d", entry.Seq)
+	}
+}
+
+func TestDecodeQueueEntryLegacyValues(t *testing.T) {
+	tests := []struct {
+		value      string
+		wantAction string
+	}{
+		{"add", ActionAdd},
+		{"remove", ActionRemove},
+		{`{"state":"new"}`, ActionAdd},
+		{`{"state":"moved-from"}`, ActionRemove},
+	}
+	for _, tt := range tests {
+		entry, err := DecodeQueueEntry([]byte(tt.value))
+		if err != nil {
+			t.Fatalf("decoding %q: %v", tt.value, err)
+		}
+		if got := entry.Action(); got != tt.wantAction {
+			t.Errorf("decoding %q: want action %q, got %q", tt.value, tt.wantAction, got)
+		}
+	}
+}
+
+func openTestDB(t *testing.T) {
+	t.Helper()
+	Path = filepath.Join(t.TempDir(), "test.db")
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Close() })
+}
+
+// queueEvents journals and compacts the events for path, bypassing the journal writer
+func queueEvents(t *testing.T, path string, ops ...string) {
+	t.Helper()
+	entries := make([]JournalEntry, 0, len(ops))
+	for _, op := range ops {
+		entries = append(entries, JournalEntry{Path: path, Op: op, Time: time.Now()})
+	}
+	if err := writeJournal(entries); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PersistData(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDequeue(t *testing.T) {
+	const path = "/backup/file.txt"
+
+	tests := []struct {
+		name      string
+		queued    []string // events queued before the action is carried out
+		meanwhile []string // events queued while it is carried out
+		wantState string   // "" means the path must be off the queue
+	}{
+		{"nothing happened meanwhile", []string{OpWrite}, nil, ""},
+		{"written meanwhile", []string{OpWrite}, []string{OpWrite}, StateModified},
+		{"new file uploaded, written meanwhile", []string{OpCreate}, []string{OpWrite}, StateModified},
+		{"new file uploaded, removed meanwhile", []string{OpCreate}, []string{OpRemove}, StateDeleted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t)
+			queueEvents(t, path, tt.queued...)
+			queue, err := ReadQueue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			snapshot := queue[path]
+
+			if len(tt.meanwhile) > 0 {
+				queueEvents(t, path, tt.meanwhile...)
+			}
+			if err := Dequeue(path, snapshot.Seq, snapshot.Action(), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			queue, err = ReadQueue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry, ok := queue[path]
+			if tt.wantState == "" {
+				if ok {
+					t.Fatalf("want path off the queue, got state %q", entry.State)
+				}
+				return
+			}
+			if entry.State != tt.wantState {
+				t.Errorf("want state %q, got %q (queued: %v)", tt.wantState, entry.State, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// RunsBucket keeps the time of the last scheduled push of every backup set which went through the queue, by the name of the set.
+// A scheduled push which was missed while the daemon wasn't running is caught up on from it.
+const RunsBucket = "lastRuns"
+
+// RecordRun remembers that the backup set was pushed on its schedule at the given time
+func RecordRun(set string, at time.Time) error {
+	return Conn.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(RunsBucket))
+		if err != nil {
+			return err
+		}
+		value, err := at.UTC().MarshalText()
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(set), value)
+	})
+}
+
+// LastRun returns when the backup set was last pushed on its schedule, ok is false if it never was
+func LastRun(set string) (at time.Time, ok bool, err error) {
+	err = Conn.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(RunsBucket))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(set))
+		if v == nil {
+			return nil
+		}
+		if err := at.UnmarshalText(v); err != nil {
+			return fmt.Errorf("error reading the last run of %s: %v", set, err)
+		}
+		ok = true
+		return nil
+	})
+	return at, ok, err
+}
@@ -2,47 +2,68 @@ package db
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/Praveen005/CloudKeeper/internal/customlog"
 	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
-	// "github.com/Praveen005/CloudKeeper/internal/utils"
 	bolt "go.etcd.io/bbolt"
 	"go.uber.org/zap"
 )
 
-// FileChangeEvent stores the action(add/remove) to be performed a given file path
-type FileChangeEvent struct {
-	Action string
-}
+const (
+	// FilesToUpdateBucket holds the compacted queue of file paths and the action(add/remove) to be performed on them in s3
+	FilesToUpdateBucket = "filesToUpdate"
+)
+
+// Path is the location of the database file
+var Path = "filesToS3.db"
 
-// FilesToUpdate function stores the metadata(filepath and action to be performed on it) in-memory to be flushed later to DB
-var FilesToUpdate map[string]FileChangeEvent
+// Conn is the database handle shared by the whole process.
+// bbolt takes an exclusive lock on the file, so opening it more than once at a time would just make everyone wait on each other.
+var Conn *bolt.DB
+
+// Open creates and opens the database at Path. If the file does not exist then it will be created automatically.
+func Open() error {
+	conn, err := bolt.Open(Path, 0666, &bolt.Options{Timeout: 2 * time.Minute})
+	if err != nil {
+		return fmt.Errorf("failed to create/open database at %s: %v", Path, err)
+	}
+	Conn = conn
+	return nil
+}
 
-// Initializes the map at the start of the program
-func init() {
-	FilesToUpdate = make(map[string]FileChangeEvent)
+// Close closes the shared database handle
+func Close() error {
+	if Conn == nil {
+		return nil
+	}
+	err := Conn.Close()
+	Conn = nil
+	return err
 }
 
-// FlushToDB function runs a ticker to periodically call PersistData function and flush the metadata stored in-memory to the database for persistence (till the files get pushed to s3).
+// FlushToDB function runs a ticker to periodically call PersistData function and compact the journal into the filesToUpdate bucket.
+// Every event is already durable once it is in the journal, this only keeps the journal short.
 func FlushToDB(ctx context.Context) {
-	ticker := time.NewTicker(fsconfig.MetaCfg.DBPersistenceInterval)
+	reloaded := fsconfig.Reloaded()
+	ticker := time.NewTicker(fsconfig.Current().DBPersistenceInterval)
 	defer ticker.Stop()
 	for {
 		select {
+		case <-reloaded:
+			reloaded = fsconfig.Reloaded()
+			ticker.Reset(fsconfig.Current().DBPersistenceInterval)
 		case <-ticker.C:
-			if len(FilesToUpdate) == 0 { // If there is no metadata stored in-memory, just continue
-				continue
-			}
-			customlog.Logger.Info("Ticker ticked: flushing data to the database")
-			err := PersistData()
+			customlog.Logger.Debug("Ticker ticked: compacting the journal")
+			n, err := PersistData()
 			if err != nil {
 				customlog.Logger.Error("error storing data to database", zap.String("error", err.Error()))
-				return
+				continue
+			}
+			if n > 0 {
+				customlog.Logger.Info("Journal compacted into the database", zap.Int("entries", n))
 			}
-			customlog.Logger.Info("Data pushed successfully to the database")
-			// utils.PrintData()
-			FilesToUpdate = make(map[string]FileChangeEvent) // Clear the map, since data has been persisted
 		case <-ctx.Done():
 			customlog.Logger.Warn("[Inside FlushToDB] Context cancellation signal received. Shutting down gracefully.")
 			return
@@ -50,38 +71,58 @@ func FlushToDB(ctx context.Context) {
 	}
 }
 
-// PersistData function stores the metadata to database
-func PersistData() error {
+// PersistData function folds the journal into the filesToUpdate bucket and truncates it, all in one transaction.
+// Every journaled event is merged into the queue entry of its path, in the order the events happened (see Apply for the rules).
+// It returns the number of journal entries which were compacted.
+func PersistData() (int, error) {
 	customlog.Logger.Debug("Inside PersistData function: writing data to the database")
-	// creates and opens a database at the given path. If the file does not exist then it will be created automatically.
-	db, err := bolt.Open("filesToS3.db", 0666, &bolt.Options{Timeout: 2 * time.Minute})
-	if err != nil {
-		return err
-	}
-	defer db.Close()
 
-	err = db.Batch(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists([]byte("filesToUpdate")) // We don't ave tables here, we have buckets
+	var n int
+	err := Conn.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(FilesToUpdateBucket)) // We don't ave tables here, we have buckets
 		if err != nil {
 			return err
 		}
-		// Persist data
-		// files that are to be added to s3
-		for path, fileChangeEvent := range FilesToUpdate {
-			exists := b.Get([]byte(path)) != nil
-			if exists {
-				continue
-			}
-			err := b.Put([]byte(path), []byte(fileChangeEvent.Action))
-			if err != nil {
-				return err
-			}
+
+		n, err = readJournal(tx, func(entry JournalEntry) error {
+			return applyEvent(b, entry.Path, entry.Op, entry.From, entry.Time)
+		})
+		if err != nil || n == 0 {
+			return err
 		}
-		return nil
+		return truncateJournal(tx)
 	})
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	return n, nil
+}
+
+// applyEvent merges a single event into the queue entry stored for path in b, from is only set for OpMoved
+func applyEvent(b *bolt.Bucket, path, op, from string, at time.Time) error {
+	key := []byte(path)
+
+	var prev *QueueEntry
+	if v := b.Get(key); v != nil {
+		entry, err := DecodeQueueEntry(v)
+		if err != nil {
+			customlog.Logger.Error("replacing unreadable queue entry",
+				zap.String("path", path),
+				zap.String("error", err.Error()),
+			)
+		} else {
+			prev = &entry
+		}
+	}
+
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	next := ApplyMove(prev, op, from, at, seq)
+	if next == nil {
+		return b.Delete(key)
+	}
+	return putQueueEntry(b, key, *next)
 }
@@ -9,85 +9,579 @@ import (
 	"time"
 
 	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/schedule"
 )
 
 const (
 	defaultS3BackupInterval      = 24 * time.Hour
+	defaultSyncQuietPeriod       = 5 * time.Second
+	defaultSyncMaxDelay          = time.Minute
 	defaultDBPersistenceInterval = 10 * time.Minute
+	defaultControlSocket         = "cloudkeeper.sock"
+	defaultDBPath                = "filesToS3.db"
+	defaultScanInterval          = 5 * time.Minute
+	defaultMultipartThreshold    = 100 << 20 // files from this size on are uploaded in parts
+	defaultMultipartPartSize     = 16 << 20
+	defaultMultipartConcurrency  = 4
+	defaultMultipartStaleAfter   = 24 * time.Hour
+	defaultUploadConcurrency     = 8
+	defaultMaxAttempts           = 5
+	defaultRetryBaseDelay        = 30 * time.Second
+	defaultRetryMaxDelay         = time.Hour
+	defaultSpoolDir              = "cloudkeeper-spool"
+	defaultCompressionMaxEntropy = 7.5
+	defaultTrashRetention        = 30 * 24 * time.Hour
+	defaultGuardWindow           = 10 * time.Minute
+	defaultGuardMaxChangedPct    = 30
+	defaultGuardMinFiles         = 50
+	defaultGuardHighEntropyFiles = 20
+	defaultGuardEntropy          = 7.5
+
+	// CompressionNone uploads files as they are
+	CompressionNone = "none"
+
+	// LayoutFiles stores every file as one object
+	LayoutFiles = "files"
+	// LayoutChunks splits files into content-defined chunks which are stored once, every file becomes a manifest listing its chunks
+	LayoutChunks = "chunks"
+
+	// BackendS3 stores the backup in an s3 bucket
+	BackendS3 = "s3"
+	// BackendLocal stores the backup in a local directory, e.g. an external disk or a NAS mount
+	BackendLocal = "local"
+
+	// WatchModeNotify picks up changes through filesystem events (inotify)
+	WatchModeNotify = "notify"
+	// WatchModeScan periodically walks the tree and compares it with the checksum index, for filesystems which don't emit events (NFS, container volumes)
+	WatchModeScan = "scan"
 )
 
 // MetaConfig holds the configuration settings needed to back up files to S3.
 type MetaConfig struct {
 	BackupDir             string
+	Backend               string // where the backup goes, one of BackendS3/BackendLocal
 	S3Bucket              string
+	S3Endpoint            string // custom endpoint for S3 compatible stores (MinIO, Ceph...), empty means AWS
+	S3PathStyle           bool   // address the bucket in the path instead of the host name
+	S3CABundle            string // PEM file with extra CA certificates to trust for the endpoint
+	S3InsecureSkipVerify  bool   // don't verify the endpoint's TLS certificate, lab setups only
+	LocalBackendDir       string // root directory of the local backend
 	S3Prefix              string
 	S3BackupInterval      time.Duration
+	S3BackupSchedule      string        // cron expression like "0 2 * * *", pushes happen at its times instead of every S3BackupInterval
+	BackupTimezone        string        // IANA name of the timezone of the schedule and the blackout windows, empty is local time
+	BackupJitter          time.Duration // every scheduled push starts up to this much later, at random
+	BackupBlackout        []string      // windows like "mon-fri 08:00-18:00" during which nothing is pushed
+	BackupCatchUp         bool          // push right away at startup if a scheduled push was missed while the daemon wasn't running
+	ContinuousSync        bool          // push every change within seconds, next to the scheduled pushes
+	SyncQuietPeriod       time.Duration // continuous sync pushes a path once it wasn't changed for this long...
+	SyncMaxDelay          time.Duration // ...or this long after its first change, whichever comes first
 	DBPersistenceInterval time.Duration
+	ReconcileOnStartup    bool   // compare the local tree with s3 when the daemon starts
+	ReconcileChecksum     bool   // also compare content checksums during reconciliation, not just size and modification time
+	ControlSocket         string // unix socket the daemon listens on for commands like `cloudkeeper reconcile`
+	WatchMode             string // one of WatchModeNotify/WatchModeScan
+	ScanInterval          time.Duration
+	MultipartThreshold    int64         // bytes, files this big or bigger are uploaded in parts
+	MultipartPartSize     int64         // bytes
+	MultipartConcurrency  int           // parts of a file uploaded in parallel
+	MultipartStaleAfter   time.Duration // incomplete multipart uploads older than this are aborted
+	UploadConcurrency     int           // queued files uploaded/deleted in parallel
+	MaxAttempts           int           // a file failing this many times in a row goes to the dead letter bucket
+	RetryBaseDelay        time.Duration // wait after the first failure, doubled with every further one
+	RetryMaxDelay         time.Duration
+	EncryptionKeyFile     string        // file holding the key to encrypt files with before upload
+	EncryptionPassphrase  string        // or a passphrase to derive it from
+	EncryptionSalt        string        // salt for deriving the key from the passphrase
+	EncryptNames          bool          // also encrypt file and directory names in object keys
+	SpoolDir              string        // encrypted copies of files are kept here while they're uploaded
+	Compression           string        // CompressionNone, gzip or zstd
+	CompressionSkipExts   []string      // extensions which aren't compressed, nil means the built in list
+	CompressionMaxEntropy float64       // files looking more random than this (bits per byte) aren't compressed, 0 turns the check off
+	StorageLayout         string        // LayoutFiles or LayoutChunks
+	Snapshots             bool          // record a snapshot of the backed up tree after every push, needs LayoutChunks or a versioned bucket
+	KeepLast              int           // retention: the newest N snapshots
+	KeepHourly            int           // retention: the newest snapshot of each of the last N hours
+	KeepDaily             int           // ... days
+	KeepWeekly            int           // ... weeks
+	KeepMonthly           int           // ... months
+	KeepYearly            int           // ... years
+	KeepWithin            time.Duration // retention: every snapshot taken within this duration of the newest one
+	PruneAfterBackup      bool          // prune snapshots (and gc) after every scheduled push
+	TrashRetention        time.Duration // deleted files are kept in the trash this long, 0 deletes them right away
+	Guard                 bool          // freeze pushing when files are deleted or rewritten in bulk (mass deletion, ransomware)
+	GuardWindow           time.Duration // changes are counted over this sliding window
+	GuardMaxChangedPct    int           // freeze when this many percent of the tracked files changed within the window...
+	GuardMinFiles         int           // ...and at least this many files
+	GuardHighEntropyFiles int           // or when this many rewritten files look encrypted, 0 turns the check off
+	GuardEntropy          float64       // bits per byte from which a file looks encrypted
+	GuardAlertWebhook     string        // URL the freeze is POSTed to, as JSON
+	Include               []string      // glob patterns of the files to back up, nil means every file
+	Exclude               []string      // glob patterns of files and directories not to back up
+	Sets                  []BackupSet   // the directories to back up, the top level settings are those of the first (or the one picked with -set)
+	DBPath                string        // the bbolt database holding the queue and the indexes
 }
 
-// MetaCfg is a MetaConfig instance
+// MetaCfg is a MetaConfig instance: the configuration the daemon was started with, it's left alone by reloads.
+// Read the running one with Current.
 var MetaCfg MetaConfig
 
 // ParseConfig retrieves the required data and stores in MetaCfg
 func ParseConfig() (MetaConfig, error) {
+	return ParseConfigArgs(flag.CommandLine, os.Args[1:])
+}
+
+// ParseConfigArgs does the same job as ParseConfig, but parses the given arguments using the given flag set.
+// Subcommands (like `restore`) register their own flags on fs before calling it.
+func ParseConfigArgs(fs *flag.FlagSet, args []string) (MetaConfig, error) {
+	cfg, err := ReadConfig(fs, args)
+	if err != nil {
+		return cfg, err
+	}
+	MetaCfg = cfg
+	return cfg, nil
+}
+
+// ReadConfig reads the configuration like ParseConfigArgs, but leaves MetaCfg alone: the running daemon checks a new configuration with it
+// before switching over. If it fails, the configuration file which was loaded before stays loaded.
+func ReadConfig(fs *flag.FlagSet, args []string) (MetaConfig, error) {
 	customlog.Logger.Debug("parsing configuration data")
 
-	var localDir, bucket, prefix string
+	var localDir, bucket, prefix, setName, configPath string
 
 	// Define flags for some meta informations you want to get though command line
-	flag.StringVar(&localDir, "d", "", "local directory to backup")
-	flag.StringVar(&bucket, "b", "", "bucket name")
-	flag.StringVar(&prefix, "p", "", "Object prefix name")
-	flag.Parse()
+	fs.StringVar(&localDir, "d", "", "local directory to backup")
+	fs.StringVar(&bucket, "b", "", "bucket name")
+	fs.StringVar(&prefix, "p", "", "Object prefix name")
+	fs.StringVar(&setName, "set", "", "backup set to work on, the first one by default")
+	fs.StringVar(&configPath, "config", "", "configuration file (default: $CLOUDKEEPER_CONFIG, ./cloudkeeper.yaml, ~/.config/cloudkeeper/config.yaml or /etc/cloudkeeper/config.yaml)")
+	if err := fs.Parse(args); err != nil {
+		return MetaConfig{}, err
+	}
+
+	// Settings not in the environment come from the configuration file, if there is one
+	loaded := configFile
+	path, err := FindConfigFile(configPath)
+	if err == nil {
+		err = loadConfigFile(path)
+	}
+	if err != nil {
+		configFile = loaded
+		return MetaConfig{}, err
+	}
+
+	cfg, err := parseSettings(localDir, bucket, prefix, setName)
+	if err != nil {
+		err = locate(err)
+		configFile = loaded
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// parseSettings reads every setting, flags win over the environment which wins over the configuration file
+func parseSettings(localDir, bucket, prefix, setName string) (MetaConfig, error) {
+	var cfg MetaConfig
+	var err error
 
 	// Get the directory which you want to backup.
 	// read from env. variable or the flag variable if specified.
-	MetaCfg.BackupDir = getConfigValue(localDir, "BACKUP_DIR")
-	if MetaCfg.BackupDir == "" {
-		return MetaCfg, fmt.Errorf("no backup directory specified")
+	// It's optional with BACKUP_SETS, every set has a directory of its own.
+	cfg.BackupDir = getConfigValue(localDir, "BACKUP_DIR")
+	setNames := getenv("BACKUP_SETS")
+	if cfg.BackupDir == "" && setNames == "" {
+		return cfg, fmt.Errorf("no backup directory specified")
+	}
+
+	// Where the backup goes, each backend has its own settings
+	cfg.Backend = strings.ToLower(getenv("BACKEND"))
+	switch cfg.Backend {
+	case "":
+		cfg.Backend = BackendS3
+	case BackendS3, BackendLocal:
+	default:
+		return cfg, fmt.Errorf("invalid BACKEND %q, must be one of %s/%s", cfg.Backend, BackendS3, BackendLocal)
 	}
 
 	// Get the name of s3 bucket into which you want to backup.
 	// read from env. variable or the flag variable if specified.
-	MetaCfg.S3Bucket = getConfigValue(bucket, "S3_BUCKET")
-	if MetaCfg.S3Bucket == "" {
-		return MetaCfg, fmt.Errorf("no s3 bucket specified")
+	cfg.S3Bucket = getConfigValue(bucket, "S3_BUCKET")
+
+	// S3 compatible stores other than AWS
+	cfg.S3Endpoint = getenv("S3_ENDPOINT")
+	cfg.S3PathStyle, err = getBoolValue("S3_FORCE_PATH_STYLE", false)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.S3CABundle = getenv("S3_CA_BUNDLE")
+	cfg.S3InsecureSkipVerify, err = getBoolValue("S3_INSECURE_SKIP_VERIFY", false)
+	if err != nil {
+		return cfg, err
 	}
 
+	cfg.LocalBackendDir = getenv("LOCAL_BACKEND_DIR")
+
 	// Get the filepath(or say prefix) from your s3 bucket which will be prefixed to your directory name.
 	// read from env. variable or the flag variable if specified.
-	MetaCfg.S3Prefix = getConfigValue(prefix, "S3_BUCKET_PREFIX")
-	if MetaCfg.S3Prefix == "" {
-		return MetaCfg, fmt.Errorf("no s3 bucket prefix specified")
-	}
+	cfg.S3Prefix = getConfigValue(prefix, "S3_BUCKET_PREFIX")
 
 	// After every `S3BackupInterval`, files will be updated to s3
-	S3BackupIntervalStr := os.Getenv("S3_BACKUP_INTERVAL")
-	if S3BackupIntervalStr == "" {
-		MetaCfg.S3BackupInterval = defaultS3BackupInterval
-	} else {
-		S3BackupIntervalInt, err := strconv.Atoi(S3BackupIntervalStr)
-		if err != nil {
-			return MetaCfg, fmt.Errorf("invalid S3_BACKUP_INTERVAL: %w", err)
+	cfg.S3BackupInterval, err = getInterval("S3_BACKUP_INTERVAL", defaultS3BackupInterval)
+	if err != nil {
+		return cfg, err
+	}
+
+	// Or at set times, like every night at 2: "0 2 * * *", in the timezone of BACKUP_TIMEZONE
+	cfg.S3BackupSchedule = strings.TrimSpace(getenv("S3_BACKUP_SCHEDULE"))
+	if cfg.S3BackupSchedule != "" {
+		if _, err := schedule.ParseCron(cfg.S3BackupSchedule); err != nil {
+			return cfg, fmt.Errorf("invalid S3_BACKUP_SCHEDULE: %v", err)
+		}
+	}
+	cfg.BackupTimezone = getenv("BACKUP_TIMEZONE")
+	if _, err := schedule.LoadLocation(cfg.BackupTimezone); err != nil {
+		return cfg, fmt.Errorf("invalid BACKUP_TIMEZONE: %v", err)
+	}
+	if v := getenv("BACKUP_JITTER"); v != "" {
+		if cfg.BackupJitter, err = parseLongDuration(v); err != nil || cfg.BackupJitter < 0 {
+			return cfg, fmt.Errorf("invalid BACKUP_JITTER %q, must be a duration like 10m or 1h", v)
+		}
+	}
+	// Pushing is put off during business hours and the like, e.g. "mon-fri 08:00-18:00, sat 10:00-12:00"
+	cfg.BackupBlackout = splitPatterns(getenv("BACKUP_BLACKOUT"))
+	if _, err := schedule.ParseWindows(cfg.BackupBlackout); err != nil {
+		return cfg, fmt.Errorf("invalid BACKUP_BLACKOUT: %v", err)
+	}
+	cfg.BackupCatchUp, err = getBoolValue("BACKUP_CATCH_UP", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	// Continuous sync: changes are pushed within seconds instead of waiting for the schedule
+	cfg.ContinuousSync, err = getBoolValue("CONTINUOUS_SYNC", false)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.SyncQuietPeriod, cfg.SyncMaxDelay = defaultSyncQuietPeriod, defaultSyncMaxDelay
+	if v := getenv("SYNC_QUIET_PERIOD"); v != "" {
+		if cfg.SyncQuietPeriod, err = parseLongDuration(v); err != nil || cfg.SyncQuietPeriod <= 0 {
+			return cfg, fmt.Errorf("invalid SYNC_QUIET_PERIOD %q, must be a duration like 5s or 1m", v)
+		}
+	}
+	if v := getenv("SYNC_MAX_DELAY"); v != "" {
+		if cfg.SyncMaxDelay, err = parseLongDuration(v); err != nil || cfg.SyncMaxDelay <= 0 {
+			return cfg, fmt.Errorf("invalid SYNC_MAX_DELAY %q, must be a duration like 1m or 10m", v)
 		}
-		timeUnit := getTimeUnit(os.Getenv("S3_BACKUP_INTERVAL_UNIT"))
-		MetaCfg.S3BackupInterval = time.Duration(S3BackupIntervalInt) * timeUnit
 	}
 
 	// After every `DBPersistenceInterval`, files will be persisted to DB
-	DBPersistenceIntervalStr := os.Getenv("DB_PERSISTENCE_INTERVAL")
-	if DBPersistenceIntervalStr == "" {
-		MetaCfg.DBPersistenceInterval = defaultDBPersistenceInterval
-	} else {
-		DBPersistenceIntervalInt, err := strconv.Atoi(DBPersistenceIntervalStr)
-		if err != nil {
-			return MetaCfg, fmt.Errorf("invalid DB_PERSISTENCE_INTERVAL: %w", err)
+	cfg.DBPersistenceInterval, err = getInterval("DB_PERSISTENCE_INTERVAL", defaultDBPersistenceInterval)
+	if err != nil {
+		return cfg, err
+	}
+
+	// Changes made while we weren't running are only caught by comparing the local tree with s3
+	cfg.ReconcileOnStartup, err = getBoolValue("RECONCILE_ON_STARTUP", true)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ReconcileChecksum, err = getBoolValue("RECONCILE_CHECKSUM", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	// How changes are detected: filesystem events, or walking the tree every `ScanInterval`
+	cfg.WatchMode = strings.ToLower(getenv("WATCH_MODE"))
+	switch cfg.WatchMode {
+	case "":
+		cfg.WatchMode = WatchModeNotify
+	case WatchModeNotify, WatchModeScan:
+	default:
+		return cfg, fmt.Errorf("invalid WATCH_MODE %q, must be one of %s/%s", cfg.WatchMode, WatchModeNotify, WatchModeScan)
+	}
+
+	cfg.ScanInterval, err = getInterval("SCAN_INTERVAL", defaultScanInterval)
+	if err != nil {
+		return cfg, err
+	}
+
+	// Big files are uploaded in parts, which can be retried and resumed one by one
+	threshold, err := getIntValue("MULTIPART_THRESHOLD_MB", defaultMultipartThreshold>>20)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MultipartThreshold = int64(threshold) << 20
+
+	partSize, err := getIntValue("MULTIPART_PART_SIZE_MB", defaultMultipartPartSize>>20)
+	if err != nil {
+		return cfg, err
+	}
+	if partSize < 5 {
+		return cfg, fmt.Errorf("invalid MULTIPART_PART_SIZE_MB: s3 needs parts of at least 5 MB")
+	}
+	cfg.MultipartPartSize = int64(partSize) << 20
+
+	cfg.MultipartConcurrency, err = getIntValue("MULTIPART_CONCURRENCY", defaultMultipartConcurrency)
+	if err != nil {
+		return cfg, err
+	}
+
+	staleAfter, err := getIntValue("MULTIPART_STALE_AFTER_HOURS", int(defaultMultipartStaleAfter/time.Hour))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MultipartStaleAfter = time.Duration(staleAfter) * time.Hour
+
+	cfg.UploadConcurrency, err = getIntValue("UPLOAD_CONCURRENCY", defaultUploadConcurrency)
+	if err != nil {
+		return cfg, err
+	}
+
+	// A failing file is retried with exponential backoff, and given up on after `MaxAttempts`
+	cfg.MaxAttempts, err = getIntValue("MAX_ATTEMPTS", defaultMaxAttempts)
+	if err != nil {
+		return cfg, err
+	}
+	baseDelay, err := getIntValue("RETRY_BASE_DELAY_SECONDS", int(defaultRetryBaseDelay/time.Second))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.RetryBaseDelay = time.Duration(baseDelay) * time.Second
+	maxDelay, err := getIntValue("RETRY_MAX_DELAY_SECONDS", int(defaultRetryMaxDelay/time.Second))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.RetryMaxDelay = time.Duration(maxDelay) * time.Second
+
+	// Client side encryption, with a key from a file or derived from a passphrase
+	cfg.EncryptionKeyFile = getenv("ENCRYPTION_KEY_FILE")
+	cfg.EncryptionPassphrase = getenv("ENCRYPTION_PASSPHRASE")
+	cfg.EncryptionSalt = getenv("ENCRYPTION_SALT")
+	if cfg.EncryptionKeyFile != "" && cfg.EncryptionPassphrase != "" {
+		return cfg, fmt.Errorf("set either ENCRYPTION_KEY_FILE or ENCRYPTION_PASSPHRASE, not both")
+	}
+	cfg.EncryptNames, err = getBoolValue("ENCRYPT_NAMES", false)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.EncryptNames && cfg.EncryptionKeyFile == "" && cfg.EncryptionPassphrase == "" {
+		return cfg, fmt.Errorf("ENCRYPT_NAMES needs an encryption key, set ENCRYPTION_KEY_FILE or ENCRYPTION_PASSPHRASE")
+	}
+	cfg.SpoolDir = getenv("SPOOL_DIR")
+	if cfg.SpoolDir == "" {
+		cfg.SpoolDir = defaultSpoolDir
+	}
+
+	// Compression before upload (and encryption), skipping what's compressed already
+	cfg.Compression = strings.ToLower(getenv("COMPRESSION"))
+	switch cfg.Compression {
+	case "":
+		cfg.Compression = CompressionNone
+	case CompressionNone, "gzip", "zstd":
+	default:
+		return cfg, fmt.Errorf("invalid COMPRESSION %q, must be one of %s/gzip/zstd", cfg.Compression, CompressionNone)
+	}
+	if exts := getenv("COMPRESSION_SKIP_EXTENSIONS"); exts != "" {
+		cfg.CompressionSkipExts = strings.Split(exts, ",")
+	}
+	cfg.CompressionMaxEntropy = defaultCompressionMaxEntropy
+	if v := getenv("COMPRESSION_MAX_ENTROPY"); v != "" {
+		cfg.CompressionMaxEntropy, err = strconv.ParseFloat(v, 64)
+		if err != nil || cfg.CompressionMaxEntropy < 0 || cfg.CompressionMaxEntropy > 8 {
+			return cfg, fmt.Errorf("invalid COMPRESSION_MAX_ENTROPY %q, must be between 0 and 8", v)
+		}
+	}
+
+	// Deduplication: content-defined chunks stored once under their hash
+	cfg.StorageLayout = strings.ToLower(getenv("STORAGE_LAYOUT"))
+	switch cfg.StorageLayout {
+	case "":
+		cfg.StorageLayout = LayoutFiles
+	case LayoutFiles, LayoutChunks:
+	default:
+		return cfg, fmt.Errorf("invalid STORAGE_LAYOUT %q, must be one of %s/%s", cfg.StorageLayout, LayoutFiles, LayoutChunks)
+	}
+
+	// Snapshots refer to content which must not change: chunks (stored under their hash), or with one object per file
+	// the versions a versioned bucket keeps. The backend is only asked about versioning once it's opened.
+	cfg.Snapshots, err = getBoolValue("SNAPSHOTS", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	// Retention of snapshots, zero turns a rule off
+	for _, keep := range []struct {
+		env   string
+		value *int
+	}{
+		{"KEEP_LAST", &cfg.KeepLast},
+		{"KEEP_HOURLY", &cfg.KeepHourly},
+		{"KEEP_DAILY", &cfg.KeepDaily},
+		{"KEEP_WEEKLY", &cfg.KeepWeekly},
+		{"KEEP_MONTHLY", &cfg.KeepMonthly},
+		{"KEEP_YEARLY", &cfg.KeepYearly},
+	} {
+		if *keep.value, err = getIntValue(keep.env, 0); err != nil {
+			return cfg, err
+		}
+	}
+	if v := getenv("KEEP_WITHIN"); v != "" {
+		if cfg.KeepWithin, err = parseLongDuration(v); err != nil || cfg.KeepWithin <= 0 {
+			return cfg, fmt.Errorf("invalid KEEP_WITHIN %q, must be a duration like 36h, 14d or 8w", v)
+		}
+	}
+	cfg.PruneAfterBackup, err = getBoolValue("PRUNE_AFTER_BACKUP", false)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.PruneAfterBackup && cfg.KeepLast+cfg.KeepHourly+cfg.KeepDaily+cfg.KeepWeekly+cfg.KeepMonthly+cfg.KeepYearly == 0 && cfg.KeepWithin == 0 {
+		return cfg, fmt.Errorf("PRUNE_AFTER_BACKUP needs a retention policy (KEEP_LAST, KEEP_DAILY...)")
+	}
+
+	// Deleted files go to the trash first, "0" turns it off
+	cfg.TrashRetention = defaultTrashRetention
+	if v := getenv("TRASH_RETENTION"); v != "" {
+		if cfg.TrashRetention, err = parseLongDuration(v); err != nil || cfg.TrashRetention < 0 {
+			return cfg, fmt.Errorf("invalid TRASH_RETENTION %q, must be a duration like 72h, 30d or 4w, or 0", v)
+		}
+	}
+
+	// Mass deletion/ransomware guard, freezes pushing till `cloudkeeper resume`
+	cfg.Guard, err = getBoolValue("GUARD", false)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.GuardWindow = defaultGuardWindow
+	if v := getenv("GUARD_WINDOW"); v != "" {
+		if cfg.GuardWindow, err = parseLongDuration(v); err != nil || cfg.GuardWindow <= 0 {
+			return cfg, fmt.Errorf("invalid GUARD_WINDOW %q, must be a duration like 10m or 1h", v)
+		}
+	}
+	cfg.GuardMaxChangedPct, err = getIntValue("GUARD_MAX_CHANGED_PERCENT", defaultGuardMaxChangedPct)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.GuardMaxChangedPct > 100 {
+		return cfg, fmt.Errorf("invalid GUARD_MAX_CHANGED_PERCENT: must be at most 100")
+	}
+	cfg.GuardMinFiles, err = getIntValue("GUARD_MIN_FILES", defaultGuardMinFiles)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.GuardHighEntropyFiles = defaultGuardHighEntropyFiles
+	if v := getenv("GUARD_HIGH_ENTROPY_FILES"); v != "" {
+		if cfg.GuardHighEntropyFiles, err = strconv.Atoi(v); err != nil || cfg.GuardHighEntropyFiles < 0 {
+			return cfg, fmt.Errorf("invalid GUARD_HIGH_ENTROPY_FILES %q, must be 0 (off) or more", v)
 		}
-		timeUnit := getTimeUnit(os.Getenv("DB_PERSISTENCE_INTERVAL_UNIT"))
-		MetaCfg.DBPersistenceInterval = time.Duration(DBPersistenceIntervalInt) * timeUnit
 	}
+	cfg.GuardEntropy = defaultGuardEntropy
+	if v := getenv("GUARD_ENTROPY"); v != "" {
+		cfg.GuardEntropy, err = strconv.ParseFloat(v, 64)
+		if err != nil || cfg.GuardEntropy <= 0 || cfg.GuardEntropy > 8 {
+			return cfg, fmt.Errorf("invalid GUARD_ENTROPY %q, must be between 0 and 8", v)
+		}
+	}
+	cfg.GuardAlertWebhook = getenv("GUARD_ALERT_WEBHOOK")
+
+	cfg.ControlSocket = getenv("CONTROL_SOCKET")
+	if cfg.ControlSocket == "" {
+		cfg.ControlSocket = defaultControlSocket
+	}
+	cfg.DBPath = getenv("DB_PATH")
+	if cfg.DBPath == "" {
+		cfg.DBPath = defaultDBPath
+	}
+
+	// What's backed up: the directory given by BACKUP_DIR/-d, and/or the sets listed in BACKUP_SETS
+	cfg.Include = splitPatterns(getenv("BACKUP_INCLUDE"))
+	cfg.Exclude = splitPatterns(getenv("BACKUP_EXCLUDE"))
+	cfg.Sets = nil
+	if cfg.BackupDir != "" {
+		cfg.Sets = append(cfg.Sets, cfg.topLevelSet(DefaultSetName))
+	}
+	named, err := parseBackupSets(cfg, setNames)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Sets = append(cfg.Sets, named...)
+	if err := validateSets(cfg.Sets); err != nil {
+		return cfg, err
+	}
+
+	// One-off commands work on a single set, through the top level settings
+	set := cfg.Sets[0]
+	if setName != "" {
+		var ok bool
+		if set, ok = cfg.FindSet(setName); !ok {
+			return cfg, fmt.Errorf("unknown backup set %q", setName)
+		}
+	}
+	cfg = cfg.WithSet(set)
 
-	return MetaCfg, nil
+	return cfg, nil
+}
+
+// getIntValue reads a positive integer env. variable, falling back to def if it isn't set
+func getIntValue(envVar string, def int) (int, error) {
+	v := getenv(envVar)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s: %w", envVar, err)
+	}
+	if i <= 0 {
+		return def, fmt.Errorf("invalid %s: must be greater than 0", envVar)
+	}
+	return i, nil
+}
+
+// getInterval reads an interval, either as a number of <envVar>_UNIT (hours by default) like it always was,
+// or as a duration like "90s", "30m" or "1d", which is what the config file uses.
+func getInterval(envVar string, def time.Duration) (time.Duration, error) {
+	v := getenv(envVar)
+	if v == "" {
+		return def, nil
+	}
+	if i, err := strconv.Atoi(v); err == nil {
+		if i <= 0 {
+			return def, fmt.Errorf("invalid %s: must be greater than 0", envVar)
+		}
+		return time.Duration(i) * getTimeUnit(getenv(envVar+"_UNIT")), nil
+	}
+	interval, err := parseLongDuration(v)
+	if err != nil || interval <= 0 {
+		return def, fmt.Errorf("invalid %s %q, must be a number of %s_UNIT or a duration like 30m, 6h or 1d", envVar, v, envVar)
+	}
+	return interval, nil
+}
+
+// parseLongDuration parses a duration like time.ParseDuration does, and also days (d) and weeks (w), e.g. "14d"
+func parseLongDuration(v string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(v, suffix); ok {
+			i, err := strconv.Atoi(n)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(i) * unit, nil
+		}
+	}
+	return time.ParseDuration(v)
+}
+
+// getBoolValue reads a boolean env. variable, falling back to def if it isn't set
+func getBoolValue(envVar string, def bool) (bool, error) {
+	v := getenv(envVar)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s: %w", envVar, err)
+	}
+	return b, nil
 }
 
 // Gets you the metadata to populate MetaConfig
@@ -95,7 +589,7 @@ func getConfigValue(flagValue, envVar string) string {
 	if flagValue != "" {
 		return flagValue
 	}
-	return os.Getenv(envVar)
+	return getenv(envVar)
 }
 
 func getTimeUnit(unit string) time.Duration {
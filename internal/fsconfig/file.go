@@ -0,0 +1,447 @@
+package fsconfig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The configuration file is YAML. Its settings have the names of the environment variables in lower case (`s3_bucket: mybucket`),
+// backup sets are a list under `backup_sets` with the BACKUP_SET_<NAME>_* settings, without the prefix:
+//
+//	backup_sets:
+//	  - name: docs
+//	    dir: /home/praveen/docs
+//	    prefix: docs/
+//
+// Whatever is set in the environment (or .env) wins over the file, flags win over both.
+
+// ConfigFileEnv names the configuration file when there's no --config flag
+const ConfigFileEnv = "CLOUDKEEPER_CONFIG"
+
+// FileConfig is the schema of the configuration file: a setting which isn't in here, or has a value of the wrong type, is an error.
+// Durations are strings like "30m" or "14d", S3_BACKUP_INTERVAL and friends also take a plain number of their _UNIT.
+type FileConfig struct {
+	BackupDir                 *string    `yaml:"backup_dir,omitempty"`
+	BackupInclude             StringList `yaml:"backup_include,omitempty"`
+	BackupExclude             StringList `yaml:"backup_exclude,omitempty"`
+	BackupSets                []FileSet  `yaml:"backup_sets,omitempty"`
+	Backend                   *string    `yaml:"backend,omitempty"`
+	S3Bucket                  *string    `yaml:"s3_bucket,omitempty"`
+	S3BucketPrefix            *string    `yaml:"s3_bucket_prefix,omitempty"`
+	S3Endpoint                *string    `yaml:"s3_endpoint,omitempty"`
+	S3ForcePathStyle          *bool      `yaml:"s3_force_path_style,omitempty"`
+	S3CABundle                *string    `yaml:"s3_ca_bundle,omitempty"`
+	S3InsecureSkipVerify      *bool      `yaml:"s3_insecure_skip_verify,omitempty"`
+	LocalBackendDir           *string    `yaml:"local_backend_dir,omitempty"`
+	S3BackupInterval          *string    `yaml:"s3_backup_interval,omitempty"`
+	S3BackupIntervalUnit      *string    `yaml:"s3_backup_interval_unit,omitempty"`
+	S3BackupSchedule          *string    `yaml:"s3_backup_schedule,omitempty"`
+	BackupTimezone            *string    `yaml:"backup_timezone,omitempty"`
+	BackupJitter              *string    `yaml:"backup_jitter,omitempty"`
+	BackupBlackout            StringList `yaml:"backup_blackout,omitempty"`
+	BackupCatchUp             *bool      `yaml:"backup_catch_up,omitempty"`
+	ContinuousSync            *bool      `yaml:"continuous_sync,omitempty"`
+	SyncQuietPeriod           *string    `yaml:"sync_quiet_period,omitempty"`
+	SyncMaxDelay              *string    `yaml:"sync_max_delay,omitempty"`
+	DBPersistenceInterval     *string    `yaml:"db_persistence_interval,omitempty"`
+	DBPersistenceIntervalUnit *string    `yaml:"db_persistence_interval_unit,omitempty"`
+	DBPath                    *string    `yaml:"db_path,omitempty"`
+	ReconcileOnStartup        *bool      `yaml:"reconcile_on_startup,omitempty"`
+	ReconcileChecksum         *bool      `yaml:"reconcile_checksum,omitempty"`
+	ControlSocket             *string    `yaml:"control_socket,omitempty"`
+	WatchMode                 *string    `yaml:"watch_mode,omitempty"`
+	ScanInterval              *string    `yaml:"scan_interval,omitempty"`
+	ScanIntervalUnit          *string    `yaml:"scan_interval_unit,omitempty"`
+	MultipartThresholdMB      *int       `yaml:"multipart_threshold_mb,omitempty"`
+	MultipartPartSizeMB       *int       `yaml:"multipart_part_size_mb,omitempty"`
+	MultipartConcurrency      *int       `yaml:"multipart_concurrency,omitempty"`
+	MultipartStaleAfterHours  *int       `yaml:"multipart_stale_after_hours,omitempty"`
+	UploadConcurrency         *int       `yaml:"upload_concurrency,omitempty"`
+	MaxAttempts               *int       `yaml:"max_attempts,omitempty"`
+	RetryBaseDelaySeconds     *int       `yaml:"retry_base_delay_seconds,omitempty"`
+	RetryMaxDelaySeconds      *int       `yaml:"retry_max_delay_seconds,omitempty"`
+	EncryptionKeyFile         *string    `yaml:"encryption_key_file,omitempty"`
+	EncryptionPassphrase      *string    `yaml:"encryption_passphrase,omitempty"`
+	EncryptionSalt            *string    `yaml:"encryption_salt,omitempty"`
+	EncryptNames              *bool      `yaml:"encrypt_names,omitempty"`
+	SpoolDir                  *string    `yaml:"spool_dir,omitempty"`
+	Compression               *string    `yaml:"compression,omitempty"`
+	CompressionSkipExts       StringList `yaml:"compression_skip_extensions,omitempty"`
+	CompressionMaxEntropy     *float64   `yaml:"compression_max_entropy,omitempty"`
+	StorageLayout             *string    `yaml:"storage_layout,omitempty"`
+	Snapshots                 *bool      `yaml:"snapshots,omitempty"`
+	KeepLast                  *int       `yaml:"keep_last,omitempty"`
+	KeepHourly                *int       `yaml:"keep_hourly,omitempty"`
+	KeepDaily                 *int       `yaml:"keep_daily,omitempty"`
+	KeepWeekly                *int       `yaml:"keep_weekly,omitempty"`
+	KeepMonthly               *int       `yaml:"keep_monthly,omitempty"`
+	KeepYearly                *int       `yaml:"keep_yearly,omitempty"`
+	KeepWithin                *string    `yaml:"keep_within,omitempty"`
+	PruneAfterBackup          *bool      `yaml:"prune_after_backup,omitempty"`
+	TrashRetention            *string    `yaml:"trash_retention,omitempty"`
+	Guard                     *bool      `yaml:"guard,omitempty"`
+	GuardWindow               *string    `yaml:"guard_window,omitempty"`
+	GuardMaxChangedPercent    *int       `yaml:"guard_max_changed_percent,omitempty"`
+	GuardMinFiles             *int       `yaml:"guard_min_files,omitempty"`
+	GuardHighEntropyFiles     *int       `yaml:"guard_high_entropy_files,omitempty"`
+	GuardEntropy              *float64   `yaml:"guard_entropy,omitempty"`
+	GuardAlertWebhook         *string    `yaml:"guard_alert_webhook,omitempty"`
+}
+
+// FileSet is a backup set in the configuration file
+type FileSet struct {
+	Name            string     `yaml:"name"`
+	Dir             string     `yaml:"dir,omitempty"`
+	Prefix          string     `yaml:"prefix,omitempty"`
+	Backend         string     `yaml:"backend,omitempty"`
+	Bucket          string     `yaml:"bucket,omitempty"`
+	LocalBackendDir string     `yaml:"local_backend_dir,omitempty"`
+	Interval        string     `yaml:"interval,omitempty"`
+	Schedule        string     `yaml:"schedule,omitempty"`
+	Timezone        string     `yaml:"timezone,omitempty"`
+	Jitter          string     `yaml:"jitter,omitempty"`
+	Blackout        StringList `yaml:"blackout,omitempty"`
+	CatchUp         *bool      `yaml:"catch_up,omitempty"`
+	ContinuousSync  *bool      `yaml:"continuous_sync,omitempty"`
+	SyncQuietPeriod string     `yaml:"sync_quiet_period,omitempty"`
+	SyncMaxDelay    string     `yaml:"sync_max_delay,omitempty"`
+	Include         StringList `yaml:"include,omitempty"`
+	Exclude         StringList `yaml:"exclude,omitempty"`
+}
+
+// StringList is a list of strings, written as a YAML list or as a comma separated string like in the environment
+type StringList []string
+
+// UnmarshalYAML accepts both forms of a StringList
+func (l *StringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*l = splitPatterns(node.Value)
+		return nil
+	}
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// Redacted replaces secrets in configuration output
+const Redacted = "<redacted>"
+
+// configFile is the configuration file which was loaded, its settings are looked up by the name of the environment variable
+var configFile struct {
+	path   string
+	values map[string]string
+	lines  map[string]int
+}
+
+// getenv looks up a setting: in the environment first, then in the configuration file
+func getenv(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return configFile.values[name]
+}
+
+// ConfigFilePath returns the configuration file which was loaded, empty if there's none
+func ConfigFilePath() string {
+	return configFile.path
+}
+
+// FindConfigFile returns the configuration file to use: the one given (by --config), $CLOUDKEEPER_CONFIG,
+// or the first one found of ./cloudkeeper.yaml, <user config dir>/cloudkeeper/config.yaml and /etc/cloudkeeper/config.yaml.
+// It returns an empty path if there's none, that's fine: everything can be set in the environment as well.
+func FindConfigFile(given string) (string, error) {
+	if given == "" {
+		given = os.Getenv(ConfigFileEnv)
+	}
+	if given != "" {
+		if _, err := os.Stat(given); err != nil {
+			return "", fmt.Errorf("config file not accessible: %v", err)
+		}
+		return given, nil
+	}
+
+	candidates := []string{"cloudkeeper.yaml"}
+	if dir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, "cloudkeeper", "config.yaml"))
+	}
+	candidates = append(candidates, "/etc/cloudkeeper/config.yaml")
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("config file not accessible: %v", err)
+		}
+	}
+	return "", nil
+}
+
+// ReadConfigFile reads and checks the configuration file against the schema, errors tell the line they're about
+func ReadConfigFile(path string) (FileConfig, *yaml.Node, error) {
+	var file FileConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return file, nil, err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return file, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(root.Content) == 0 {
+		return file, &root, nil // empty file
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		// Every problem is reported, as "path:line: problem" like compilers do
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return file, nil, fmt.Errorf("%s: %v", path, strings.TrimPrefix(err.Error(), "yaml: "))
+		}
+		problems := make([]string, len(typeErr.Errors))
+		for i, problem := range typeErr.Errors {
+			problems[i] = path + ":" + strings.TrimPrefix(problem, "line ")
+		}
+		return file, nil, errors.New(strings.Join(problems, "\n"))
+	}
+	return file, &root, nil
+}
+
+// loadConfigFile makes the settings of the configuration file available to getenv, an empty path unloads it
+func loadConfigFile(path string) error {
+	configFile.path = path
+	configFile.values = make(map[string]string)
+	configFile.lines = make(map[string]int)
+	if path == "" {
+		return nil
+	}
+
+	_, root, err := ReadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	doc := root.Content[0]
+	set := func(name string, node *yaml.Node) {
+		configFile.values[name] = nodeValue(node)
+		configFile.lines[name] = node.Line
+	}
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		key, value := doc.Content[i].Value, doc.Content[i+1]
+		if key != "backup_sets" {
+			set(strings.ToUpper(key), value)
+			continue
+		}
+
+		// Every set turns into its BACKUP_SET_<NAME>_* settings
+		var names []string
+		for _, item := range value.Content {
+			var name string
+			for j := 0; j+1 < len(item.Content); j += 2 {
+				if item.Content[j].Value == "name" {
+					name = item.Content[j+1].Value
+				}
+			}
+			if !setNameRe.MatchString(name) {
+				return fmt.Errorf("%s:%d: a backup set needs a name made of letters, digits, - and _", path, item.Line)
+			}
+			names = append(names, name)
+			env := "BACKUP_SET_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+			for j := 0; j+1 < len(item.Content); j += 2 {
+				if setting := item.Content[j].Value; setting != "name" {
+					set(env+strings.ToUpper(setting), item.Content[j+1])
+				}
+			}
+		}
+		configFile.values["BACKUP_SETS"] = strings.Join(names, ",")
+		configFile.lines["BACKUP_SETS"] = value.Line
+	}
+	return nil
+}
+
+// nodeValue turns a scalar or a list into a value like it would be written in the environment
+func nodeValue(node *yaml.Node) string {
+	if node.Kind != yaml.SequenceNode {
+		return node.Value
+	}
+	values := make([]string, len(node.Content))
+	for i, item := range node.Content {
+		values[i] = item.Value
+	}
+	return strings.Join(values, ",")
+}
+
+var settingNameRe = regexp.MustCompile(`[A-Z][A-Z0-9_]*[A-Z0-9]`)
+
+// locate points an error about a setting at the line of the configuration file it came from, unless it came from the environment.
+// Every error of ParseConfigArgs names the setting it's about.
+func locate(err error) error {
+	if configFile.path == "" {
+		return err
+	}
+	var found string
+	for _, name := range settingNameRe.FindAllString(err.Error(), -1) {
+		if _, ok := configFile.lines[name]; ok && os.Getenv(name) == "" {
+			found = name
+			break
+		}
+	}
+	if found == "" {
+		return err
+	}
+	return fmt.Errorf("%s:%d: %w", configFile.path, configFile.lines[found], err)
+}
+
+// Effective returns the configuration as it's in effect, as a configuration file. Secrets are redacted.
+func Effective(c MetaConfig) FileConfig {
+	return effective(c, true)
+}
+
+func effective(c MetaConfig, redactSecrets bool) FileConfig {
+	str := func(v string) *string {
+		if v == "" {
+			return nil
+		}
+		return &v
+	}
+	duration := func(v string) *string { return &v }
+	intp := func(v int) *int { return &v }
+	keep := func(v int) *int {
+		if v == 0 {
+			return nil // not kept by this rule, which is written by leaving it out
+		}
+		return &v
+	}
+	boolp := func(v bool) *bool { return &v }
+	floatp := func(v float64) *float64 { return &v }
+	secret := func(v string) *string {
+		if v == "" || !redactSecrets {
+			return str(v)
+		}
+		return str(Redacted)
+	}
+
+	f := FileConfig{
+		Backend:                  str(c.Backend),
+		S3Bucket:                 str(c.S3Bucket),
+		S3Endpoint:               str(c.S3Endpoint),
+		S3ForcePathStyle:         boolp(c.S3PathStyle),
+		S3CABundle:               str(c.S3CABundle),
+		S3InsecureSkipVerify:     boolp(c.S3InsecureSkipVerify),
+		LocalBackendDir:          str(c.LocalBackendDir),
+		S3BackupInterval:         duration(c.S3BackupInterval.String()),
+		S3BackupSchedule:         str(c.S3BackupSchedule),
+		BackupTimezone:           str(c.BackupTimezone),
+		BackupBlackout:           c.BackupBlackout,
+		BackupCatchUp:            boolp(c.BackupCatchUp),
+		ContinuousSync:           boolp(c.ContinuousSync),
+		SyncQuietPeriod:          duration(c.SyncQuietPeriod.String()),
+		SyncMaxDelay:             duration(c.SyncMaxDelay.String()),
+		DBPersistenceInterval:    duration(c.DBPersistenceInterval.String()),
+		DBPath:                   str(c.DBPath),
+		ReconcileOnStartup:       boolp(c.ReconcileOnStartup),
+		ReconcileChecksum:        boolp(c.ReconcileChecksum),
+		ControlSocket:            str(c.ControlSocket),
+		WatchMode:                str(c.WatchMode),
+		ScanInterval:             duration(c.ScanInterval.String()),
+		MultipartThresholdMB:     intp(int(c.MultipartThreshold >> 20)),
+		MultipartPartSizeMB:      intp(int(c.MultipartPartSize >> 20)),
+		MultipartConcurrency:     intp(c.MultipartConcurrency),
+		MultipartStaleAfterHours: intp(int(c.MultipartStaleAfter.Hours())),
+		UploadConcurrency:        intp(c.UploadConcurrency),
+		MaxAttempts:              intp(c.MaxAttempts),
+		RetryBaseDelaySeconds:    intp(int(c.RetryBaseDelay.Seconds())),
+		RetryMaxDelaySeconds:     intp(int(c.RetryMaxDelay.Seconds())),
+		EncryptionKeyFile:        str(c.EncryptionKeyFile),
+		EncryptionPassphrase:     secret(c.EncryptionPassphrase),
+		EncryptionSalt:           secret(c.EncryptionSalt),
+		EncryptNames:             boolp(c.EncryptNames),
+		SpoolDir:                 str(c.SpoolDir),
+		Compression:              str(c.Compression),
+		CompressionSkipExts:      c.CompressionSkipExts,
+		CompressionMaxEntropy:    floatp(c.CompressionMaxEntropy),
+		StorageLayout:            str(c.StorageLayout),
+		Snapshots:                boolp(c.Snapshots),
+		KeepLast:                 keep(c.KeepLast),
+		KeepHourly:               keep(c.KeepHourly),
+		KeepDaily:                keep(c.KeepDaily),
+		KeepWeekly:               keep(c.KeepWeekly),
+		KeepMonthly:              keep(c.KeepMonthly),
+		KeepYearly:               keep(c.KeepYearly),
+		PruneAfterBackup:         boolp(c.PruneAfterBackup),
+		TrashRetention:           duration(c.TrashRetention.String()),
+		Guard:                    boolp(c.Guard),
+		GuardWindow:              duration(c.GuardWindow.String()),
+		GuardMaxChangedPercent:   intp(c.GuardMaxChangedPct),
+		GuardMinFiles:            intp(c.GuardMinFiles),
+		GuardHighEntropyFiles:    intp(c.GuardHighEntropyFiles),
+		GuardEntropy:             floatp(c.GuardEntropy),
+		GuardAlertWebhook:        secret(c.GuardAlertWebhook),
+	}
+	if c.KeepWithin > 0 {
+		f.KeepWithin = duration(c.KeepWithin.String())
+	}
+	if c.BackupJitter > 0 {
+		f.BackupJitter = duration(c.BackupJitter.String())
+	}
+
+	// The top level directory is the default set, everything else is listed with all of its settings resolved
+	for _, set := range c.BackupSets() {
+		if set.Name == DefaultSetName {
+			f.BackupDir = str(set.BackupDir)
+			f.S3BucketPrefix = str(set.S3Prefix)
+			f.BackupInclude, f.BackupExclude = set.Include, set.Exclude
+			continue
+		}
+		fileSet := FileSet{
+			Name:            set.Name,
+			Dir:             set.BackupDir,
+			Prefix:          set.S3Prefix,
+			Backend:         set.Backend,
+			Bucket:          set.S3Bucket,
+			LocalBackendDir: set.LocalBackendDir,
+			Schedule:        set.Schedule,
+			Timezone:        set.Timezone,
+			Blackout:        set.Blackout,
+			CatchUp:         boolp(set.CatchUp),
+			ContinuousSync:  boolp(set.ContinuousSync),
+			SyncQuietPeriod: set.SyncQuietPeriod.String(),
+			SyncMaxDelay:    set.SyncMaxDelay.String(),
+			Include:         set.Include,
+			Exclude:         set.Exclude,
+		}
+		// An interval of a set wins over a schedule, so it's only written without one
+		if set.Schedule == "" {
+			fileSet.Interval = set.S3BackupInterval.String()
+		}
+		if set.Jitter > 0 {
+			fileSet.Jitter = set.Jitter.String()
+		}
+		f.BackupSets = append(f.BackupSets, fileSet)
+	}
+	return f
+}
+
+// RedactFile blanks the secrets in a configuration file, before it's shown
+func RedactFile(f FileConfig) FileConfig {
+	for _, secret := range []**string{&f.EncryptionPassphrase, &f.EncryptionSalt, &f.GuardAlertWebhook} {
+		if *secret != nil {
+			redacted := Redacted
+			*secret = &redacted
+		}
+	}
+	return f
+}
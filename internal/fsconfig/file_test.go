@@ -0,0 +1,132 @@
+package fsconfig
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cloudkeeper.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFile(t *testing.T) {
+	root := t.TempDir()
+	path := writeConfigFile(t, `
+backup_dir: `+filepath.Join(root, "home")+`
+s3_bucket: from-file
+s3_bucket_prefix: home
+s3_backup_interval: 30m
+upload_concurrency: 3
+backup_exclude: "*.tmp, node_modules"
+backup_sets:
+  - name: docs
+    dir: `+filepath.Join(root, "docs")+`
+    prefix: docs
+    interval: 1d
+    include: ["*.md"]
+`)
+	t.Setenv("UPLOAD_CONCURRENCY", "")
+	t.Setenv("S3_BACKUP_INTERVAL", "")
+
+	cfg, err := parse(t, map[string]string{"S3_BUCKET": "from-env"}, "--config", path, "-p", "from-flag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.S3Bucket != "from-env" {
+		t.Errorf("want the environment to win over the file, got bucket %s", cfg.S3Bucket)
+	}
+	if cfg.S3Prefix != "from-flag" {
+		t.Errorf("want the flag to win over the file, got prefix %s", cfg.S3Prefix)
+	}
+	if cfg.UploadConcurrency != 3 || cfg.S3BackupInterval != 30*time.Minute {
+		t.Errorf("want the settings of the file, got %d uploads every %s", cfg.UploadConcurrency, cfg.S3BackupInterval)
+	}
+	if strings.Join(cfg.Exclude, ",") != "*.tmp,node_modules" {
+		t.Errorf("want the excludes of the file, got %v", cfg.Exclude)
+	}
+	docs, ok := cfg.FindSet("docs")
+	if !ok || docs.S3BackupInterval != 24*time.Hour || docs.S3Bucket != "from-env" || strings.Join(docs.Include, ",") != "*.md" {
+		t.Errorf("want the docs set of the file, got %+v", docs)
+	}
+	if ConfigFilePath() != path {
+		t.Errorf("want %s loaded, got %s", path, ConfigFilePath())
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	root := t.TempDir()
+	for name, tc := range map[string]struct {
+		content string
+		want    string
+	}{
+		"unknown setting":     {"s3_bucket: b\ns3_bukcet: b\n", ":2: field s3_bukcet not found"},
+		"wrong type":          {"s3_bucket: b\nkeep_last: many\n", ":2: cannot unmarshal"},
+		"unknown set setting": {"backup_sets:\n  - name: docs\n    dirr: /docs\n", ":3: field dirr not found"},
+		"invalid value":       {"backup_dir: " + root + "\ns3_bucket: b\ns3_bucket_prefix: p\nwatch_mode: poll\n", ":4: invalid WATCH_MODE"},
+		"invalid set":         {"s3_bucket: b\nbackup_sets:\n  - name: docs\n    dir: " + root + "\n    interval: soon\n", ":5: invalid BACKUP_SET_DOCS_INTERVAL"},
+		"unnamed set":         {"backup_sets:\n  - dir: " + root + "\n", ":2: a backup set needs a name"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parse(t, map[string]string{"WATCH_MODE": ""}, "--config", writeConfigFile(t, tc.content))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("want an error about %q, got %v", tc.want, err)
+			}
+		})
+	}
+
+	// A bad value in the environment isn't blamed on the file
+	_, err := parse(t, map[string]string{"WATCH_MODE": "poll"}, "--config", writeConfigFile(t, "backup_dir: "+root+"\ns3_bucket: b\ns3_bucket_prefix: p\nwatch_mode: scan\n"))
+	if err == nil || strings.Contains(err.Error(), "cloudkeeper.yaml") {
+		t.Errorf("want an error without the file, got %v", err)
+	}
+}
+
+func TestEffective(t *testing.T) {
+	root := t.TempDir()
+	cfg, err := parse(t, map[string]string{
+		"BACKUP_DIR":               filepath.Join(root, "home"),
+		"S3_BUCKET":                "bucket",
+		"S3_BUCKET_PREFIX":         "home",
+		"ENCRYPTION_PASSPHRASE":    "hunter2",
+		"BACKUP_SETS":              "docs",
+		"BACKUP_SET_DOCS_DIR":      filepath.Join(root, "docs"),
+		"BACKUP_SET_DOCS_PREFIX":   "docs",
+		"BACKUP_SET_DOCS_INTERVAL": "6h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := yaml.Marshal(Effective(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "hunter2") || !strings.Contains(string(out), "encryption_passphrase: "+Redacted) {
+		t.Errorf("want the passphrase redacted, got\n%s", out)
+	}
+
+	// What's shown is a configuration file which gives the same sets
+	t.Setenv("ENCRYPTION_PASSPHRASE", "")
+	shown := writeConfigFile(t, strings.Replace(string(out), "encryption_passphrase: "+Redacted, "encryption_passphrase: hunter2", 1))
+	again, err := parse(t, nil, "--config", shown)
+	if err != nil {
+		t.Fatalf("the effective configuration doesn't parse: %v\n%s", err, out)
+	}
+	if len(again.Sets) != len(cfg.Sets) {
+		t.Fatalf("want %d sets, got %d", len(cfg.Sets), len(again.Sets))
+	}
+	for i := range cfg.Sets {
+		if again.Sets[i].Destination() != cfg.Sets[i].Destination() || again.Sets[i].S3BackupInterval != cfg.Sets[i].S3BackupInterval {
+			t.Errorf("want set %+v, got %+v", cfg.Sets[i], again.Sets[i])
+		}
+	}
+}
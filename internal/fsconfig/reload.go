@@ -0,0 +1,245 @@
+package fsconfig
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The running daemon can switch to a new configuration (SIGHUP, `cloudkeeper reload`): Apply publishes it,
+// and whatever runs on a schedule or per backup set waits on Reloaded to pick the new settings up.
+// A published configuration is never changed afterwards, so whoever got it from Current can keep reading it
+// while the next one is applied: a flush works with the configuration it started with till it's done.
+
+// applied is the configuration published by the last Apply, nil till the first one
+var applied atomic.Pointer[MetaConfig]
+
+// Current returns the running configuration: the one published by the last Apply, or MetaCfg as it was set up at startup.
+// Don't change what it returns.
+func Current() *MetaConfig {
+	if cfg := applied.Load(); cfg != nil {
+		return cfg
+	}
+	return &MetaCfg
+}
+
+// ForgetApplied drops the configuration published by Apply, so Current goes back to MetaCfg. Tests use it to clean up.
+func ForgetApplied() {
+	applied.Store(nil)
+}
+
+type configKey struct{}
+
+// WithConfig returns a copy of ctx which carries cfg, for the code down the line which reads its settings with FromContext
+func WithConfig(ctx context.Context, cfg *MetaConfig) context.Context {
+	return context.WithValue(ctx, configKey{}, cfg)
+}
+
+// FromContext returns the configuration ctx carries, or the running one if it carries none
+func FromContext(ctx context.Context) *MetaConfig {
+	if cfg, ok := ctx.Value(configKey{}).(*MetaConfig); ok && cfg != nil {
+		return cfg
+	}
+	return Current()
+}
+
+var reload = struct {
+	sync.Mutex
+	done chan struct{}
+}{done: make(chan struct{})}
+
+// Reloaded returns a channel which is closed by the next Apply. Get it before calling Current, so no reload goes unnoticed.
+func Reloaded() <-chan struct{} {
+	reload.Lock()
+	defer reload.Unlock()
+	return reload.done
+}
+
+// Apply makes cfg the running configuration and wakes up everything waiting on Reloaded
+func Apply(cfg MetaConfig) {
+	reload.Lock()
+	defer reload.Unlock()
+	applied.Store(&cfg)
+	close(reload.done)
+	reload.done = make(chan struct{})
+}
+
+// RunSets runs run for every backup set, each in its own goroutine, till ctx is done.
+// On every reload the sets which were removed, or changed as far as same is concerned, are stopped, changed and new ones are started.
+// The others keep running undisturbed.
+func RunSets(ctx context.Context, same func(a, b BackupSet) bool, run func(ctx context.Context, set BackupSet)) {
+	type runningSet struct {
+		set    BackupSet
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+	running := make(map[string]*runningSet)
+	stop := func(r *runningSet) {
+		r.cancel()
+		<-r.done
+	}
+
+	for {
+		reloaded := Reloaded()
+		cfg := Current()
+		sets := cfg.BackupSets()
+
+		for name, r := range running {
+			if set, ok := cfg.FindSet(name); !ok || !same(r.set, set) {
+				stop(r)
+				delete(running, name)
+			}
+		}
+		for _, set := range sets {
+			if _, ok := running[set.Name]; ok {
+				continue
+			}
+			setCtx, cancel := context.WithCancel(ctx)
+			r := &runningSet{set: set, cancel: cancel, done: make(chan struct{})}
+			running[set.Name] = r
+			go func() {
+				defer close(r.done)
+				run(setCtx, set)
+			}()
+		}
+
+		select {
+		case <-reloaded:
+		case <-ctx.Done():
+			for _, r := range running {
+				stop(r)
+			}
+			return
+		}
+	}
+}
+
+// Change is a setting which differs between two configurations, named like in the configuration file.
+// Values are written like `config show --effective` does, secrets are redacted.
+type Change struct {
+	Setting string `json:"setting"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+}
+
+// restartOnly are the settings which are read once when the daemon starts: the database, the control socket,
+// the way files are detected and what's done to their contents. Changing them takes a restart.
+var restartOnly = map[string]bool{
+	"db_path":                     true,
+	"control_socket":              true,
+	"watch_mode":                  true,
+	"spool_dir":                   true,
+	"storage_layout":              true,
+	"compression":                 true,
+	"compression_skip_extensions": true,
+	"compression_max_entropy":     true,
+	"encryption_key_file":         true,
+	"encryption_passphrase":       true,
+	"encryption_salt":             true,
+	"encrypt_names":               true,
+	"guard":                       true,
+	"guard_window":                true,
+	"guard_max_changed_percent":   true,
+	"guard_min_files":             true,
+	"guard_high_entropy_files":    true,
+	"guard_entropy":               true,
+	"guard_alert_webhook":         true,
+}
+
+// NeedsRestart tells if a setting only takes effect when the daemon starts
+func NeedsRestart(setting string) bool {
+	return restartOnly[setting]
+}
+
+// Diff lists the settings which differ between two configurations. A changed backup set is one change, named backup_sets.<name>.
+func Diff(old, new MetaConfig) []Change {
+	a, b := settingValues(old), settingValues(new)
+	var changes []Change
+	for setting := range a {
+		if _, ok := b[setting]; !ok {
+			b[setting] = ""
+		}
+	}
+	for setting, value := range b {
+		if a[setting] == value {
+			continue
+		}
+		change := Change{Setting: setting, Old: a[setting], New: value}
+		if isSecret(setting) {
+			change.Old, change.New = redact(change.Old), redact(change.New)
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Setting < changes[j].Setting })
+	return changes
+}
+
+// KeepRestartOnly returns new with the settings which need a restart taken over from old, and the changes it left out
+func KeepRestartOnly(old, new MetaConfig) (MetaConfig, []Change) {
+	var pending []Change
+	for _, change := range Diff(old, new) {
+		if NeedsRestart(change.Setting) {
+			pending = append(pending, change)
+		}
+	}
+	if len(pending) == 0 {
+		return new, nil
+	}
+	new.WatchMode, new.DBPath, new.ControlSocket, new.SpoolDir, new.StorageLayout = old.WatchMode, old.DBPath, old.ControlSocket, old.SpoolDir, old.StorageLayout
+	new.Compression, new.CompressionSkipExts, new.CompressionMaxEntropy = old.Compression, old.CompressionSkipExts, old.CompressionMaxEntropy
+	new.EncryptionKeyFile, new.EncryptionPassphrase, new.EncryptionSalt, new.EncryptNames = old.EncryptionKeyFile, old.EncryptionPassphrase, old.EncryptionSalt, old.EncryptNames
+	new.Guard, new.GuardWindow, new.GuardMaxChangedPct, new.GuardMinFiles = old.Guard, old.GuardWindow, old.GuardMaxChangedPct, old.GuardMinFiles
+	new.GuardHighEntropyFiles, new.GuardEntropy, new.GuardAlertWebhook = old.GuardHighEntropyFiles, old.GuardEntropy, old.GuardAlertWebhook
+	return new, pending
+}
+
+func isSecret(setting string) bool {
+	return setting == "encryption_passphrase" || setting == "encryption_salt" || setting == "guard_alert_webhook"
+}
+
+func redact(v string) string {
+	if v == "" {
+		return ""
+	}
+	return Redacted
+}
+
+// settingValues flattens the effective configuration (secrets included) into setting -> value
+func settingValues(c MetaConfig) map[string]string {
+	values := make(map[string]string)
+	var settings map[string]interface{}
+	out, err := yaml.Marshal(effective(c, false))
+	if err != nil {
+		return values
+	}
+	if err := yaml.Unmarshal(out, &settings); err != nil {
+		return values
+	}
+	for setting, value := range settings {
+		if setting != "backup_sets" {
+			values[setting] = compact(value)
+			continue
+		}
+		for _, item := range value.([]interface{}) {
+			set := item.(map[string]interface{})
+			values["backup_sets."+set["name"].(string)] = compact(set)
+		}
+	}
+	return values
+}
+
+// compact writes a value on a single line
+func compact(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(out)
+}
@@ -0,0 +1,107 @@
+package fsconfig
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunSets(t *testing.T) {
+	defer func(cfg MetaConfig) { MetaCfg = cfg }(MetaCfg)
+	defer ForgetApplied()
+	MetaCfg = MetaConfig{Sets: []BackupSet{
+		{Name: "a", BackupDir: "/a", S3Prefix: "a"},
+		{Name: "b", BackupDir: "/b", S3Prefix: "b"},
+		{Name: "c", BackupDir: "/c", S3Prefix: "c"},
+	}}
+
+	var mu sync.Mutex
+	started := make(map[string]int)
+	stopped := make(map[string]int)
+	count := func(m map[string]int, name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return m[name]
+	}
+	waitFor := func(what string, ok func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !ok(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		RunSets(ctx, func(a, b BackupSet) bool { return a.BackupDir == b.BackupDir }, func(ctx context.Context, set BackupSet) {
+			mu.Lock()
+			started[set.Name]++
+			mu.Unlock()
+			<-ctx.Done()
+			mu.Lock()
+			stopped[set.Name]++
+			mu.Unlock()
+		})
+	}()
+	waitFor("every set to start", func() bool { return count(started, "a") == 1 && count(started, "b") == 1 && count(started, "c") == 1 })
+
+	// a is left alone (a new prefix doesn't matter here), b moves to another directory, c is removed and d is added
+	Apply(MetaConfig{Sets: []BackupSet{
+		{Name: "a", BackupDir: "/a", S3Prefix: "new"},
+		{Name: "b", BackupDir: "/b2", S3Prefix: "b"},
+		{Name: "d", BackupDir: "/d", S3Prefix: "d"},
+	}})
+	waitFor("the changed sets to restart", func() bool {
+		return count(started, "b") == 2 && count(stopped, "c") == 1 && count(started, "d") == 1
+	})
+	if count(started, "a") != 1 || count(stopped, "a") != 0 {
+		t.Errorf("want the unchanged set to keep running, it was started %d and stopped %d times", count(started, "a"), count(stopped, "a"))
+	}
+
+	cancel()
+	<-done
+	for _, name := range []string{"a", "b", "d"} {
+		if count(started, name) != count(stopped, name) {
+			t.Errorf("want every run of %s stopped, started %d stopped %d", name, count(started, name), count(stopped, name))
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := MetaConfig{
+		Sets:                 []BackupSet{{Name: "docs", BackupDir: "/docs", S3Prefix: "docs", S3BackupInterval: time.Hour}},
+		S3BackupInterval:     time.Hour,
+		EncryptionPassphrase: "old secret",
+		DBPath:               "a.db",
+	}
+	new := old
+	new.Sets = []BackupSet{{Name: "docs", BackupDir: "/docs", S3Prefix: "docs", S3BackupInterval: 30 * time.Minute}}
+	new.EncryptionPassphrase = "new secret"
+	new.DBPath = "b.db"
+
+	changes := make(map[string]Change)
+	for _, change := range Diff(old, new) {
+		changes[change.Setting] = change
+	}
+	if len(changes) != 3 {
+		t.Errorf("want 3 changes, got %+v", changes)
+	}
+	if _, ok := changes["backup_sets.docs"]; !ok {
+		t.Errorf("want the docs set changed, got %+v", changes)
+	}
+	if change := changes["encryption_passphrase"]; change.Old != Redacted || change.New != Redacted {
+		t.Errorf("want the passphrase redacted, got %+v", change)
+	}
+
+	applied, pending := KeepRestartOnly(old, new)
+	if len(pending) != 2 || applied.DBPath != "a.db" || applied.EncryptionPassphrase != "old secret" {
+		t.Errorf("want the database and the passphrase kept till a restart, got %+v", pending)
+	}
+	if applied.Sets[0].S3BackupInterval != 30*time.Minute {
+		t.Errorf("want the new interval applied")
+	}
+}
@@ -0,0 +1,371 @@
+package fsconfig
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/schedule"
+)
+
+// DefaultSetName is the name of the backup set configured with BACKUP_DIR (or -d), next to the ones in BACKUP_SETS
+const DefaultSetName = "default"
+
+// BackupSet is a directory which is backed up on its own: with its own destination, prefix, schedule and filters.
+// Every setting a set doesn't have falls back to the top level one.
+type BackupSet struct {
+	Name             string
+	BackupDir        string
+	Backend          string // one of BackendS3/BackendLocal
+	S3Bucket         string
+	LocalBackendDir  string
+	S3Prefix         string
+	S3BackupInterval time.Duration
+	Schedule         string        // cron expression, replaces S3BackupInterval
+	Timezone         string        // of Schedule and Blackout
+	Jitter           time.Duration // pushes start up to this much later, at random
+	Blackout         []string      // windows like "mon-fri 08:00-18:00" during which nothing is pushed
+	CatchUp          bool          // push at startup if a scheduled push was missed
+	ContinuousSync   bool          // push changes within seconds, next to the scheduled pushes
+	SyncQuietPeriod  time.Duration // a change is pushed once the path wasn't changed for this long...
+	SyncMaxDelay     time.Duration // ...or this long after its first change
+	Include          []string      // glob patterns of the files to back up, nil means every file
+	Exclude          []string      // glob patterns of files and directories to leave out, they win over Include
+}
+
+// ReservedDir is the directory CloudKeeper keeps its own objects in (chunks, the trash, snapshots), right below the prefix of a set.
+// A directory of that name right in a backed up directory would end up among them, so it's always left out of the backup.
+const ReservedDir = ".cloudkeeper"
+
+var setNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// Contains tells if path is the backed up directory or lives below it
+func (s BackupSet) Contains(path string) bool {
+	root := filepath.Clean(s.BackupDir)
+	path = filepath.Clean(path)
+	return path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// Excludes tells if path, or a directory it lives in, matches one of the exclude patterns, or is ReservedDir.
+// A pattern matches a single name ("*.tmp", "node_modules") or the path relative to the backed up directory ("build/*").
+func (s BackupSet) Excludes(path string) bool {
+	relativePath, err := filepath.Rel(s.BackupDir, path)
+	if err != nil || relativePath == "." {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(relativePath), "/")
+	if parts[0] == ReservedDir {
+		return true
+	}
+	for i := range parts {
+		if matchAny(s.Exclude, parts[i]) || matchAny(s.Exclude, strings.Join(parts[:i+1], "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Includes tells if the file at path is backed up: it isn't excluded and, if there are include patterns, matches one of them.
+// Include patterns only apply to files, a directory is never left out because of them.
+func (s BackupSet) Includes(path string) bool {
+	if s.Excludes(path) {
+		return false
+	}
+	if len(s.Include) == 0 {
+		return true
+	}
+	relativePath, err := filepath.Rel(s.BackupDir, path)
+	if err != nil {
+		return false
+	}
+	return matchAny(s.Include, filepath.Base(path)) || matchAny(s.Include, filepath.ToSlash(relativePath))
+}
+
+// Plan returns the schedule the set is pushed on, its settings were checked when the configuration was read
+func (s BackupSet) Plan() (*schedule.Schedule, error) {
+	return schedule.New(s.S3BackupInterval, s.Schedule, s.Timezone, s.Jitter, s.Blackout)
+}
+
+// Destination describes where the set is backed up to, for logs and `cloudkeeper status`
+func (s BackupSet) Destination() string {
+	if s.Backend == BackendLocal {
+		return "local:" + filepath.Join(s.LocalBackendDir, s.S3Prefix)
+	}
+	return "s3://" + path.Join(s.S3Bucket, filepath.ToSlash(s.S3Prefix))
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// BackupSets returns the configured backup sets. A config without any (e.g. one put together by hand) is a single set made of the top level settings.
+func (c MetaConfig) BackupSets() []BackupSet {
+	if len(c.Sets) > 0 {
+		return c.Sets
+	}
+	return []BackupSet{c.topLevelSet(DefaultSetName)}
+}
+
+// SetFor returns the backup set path belongs to. Roots don't overlap, but the longest match wins anyway.
+func (c MetaConfig) SetFor(path string) (BackupSet, bool) {
+	var found BackupSet
+	var ok bool
+	for _, set := range c.BackupSets() {
+		if set.Contains(path) && (!ok || len(set.BackupDir) > len(found.BackupDir)) {
+			found, ok = set, true
+		}
+	}
+	return found, ok
+}
+
+// FindSet returns the backup set with the given name
+func (c MetaConfig) FindSet(name string) (BackupSet, bool) {
+	for _, set := range c.BackupSets() {
+		if set.Name == name {
+			return set, true
+		}
+	}
+	return BackupSet{}, false
+}
+
+// WithSet returns a copy of the config whose top level settings are those of the set, for code working on a single set
+// (one-off commands, opening the set's backend)
+func (c MetaConfig) WithSet(set BackupSet) MetaConfig {
+	c.BackupDir = set.BackupDir
+	c.Backend = set.Backend
+	c.S3Bucket = set.S3Bucket
+	c.LocalBackendDir = set.LocalBackendDir
+	c.S3Prefix = set.S3Prefix
+	c.S3BackupInterval = set.S3BackupInterval
+	c.S3BackupSchedule = set.Schedule
+	c.BackupTimezone = set.Timezone
+	c.BackupJitter = set.Jitter
+	c.BackupBlackout = set.Blackout
+	c.BackupCatchUp = set.CatchUp
+	c.ContinuousSync = set.ContinuousSync
+	c.SyncQuietPeriod = set.SyncQuietPeriod
+	c.SyncMaxDelay = set.SyncMaxDelay
+	c.Include = set.Include
+	c.Exclude = set.Exclude
+	return c
+}
+
+func (c MetaConfig) topLevelSet(name string) BackupSet {
+	return BackupSet{
+		Name:             name,
+		BackupDir:        c.BackupDir,
+		Backend:          c.Backend,
+		S3Bucket:         c.S3Bucket,
+		LocalBackendDir:  c.LocalBackendDir,
+		S3Prefix:         c.S3Prefix,
+		S3BackupInterval: c.S3BackupInterval,
+		Schedule:         c.S3BackupSchedule,
+		Timezone:         c.BackupTimezone,
+		Jitter:           c.BackupJitter,
+		Blackout:         c.BackupBlackout,
+		CatchUp:          c.BackupCatchUp,
+		ContinuousSync:   c.ContinuousSync,
+		SyncQuietPeriod:  c.SyncQuietPeriod,
+		SyncMaxDelay:     c.SyncMaxDelay,
+		Include:          c.Include,
+		Exclude:          c.Exclude,
+	}
+}
+
+// parseBackupSets reads the sets named in BACKUP_SETS from their BACKUP_SET_<NAME>_* variables, e.g. for "docs":
+//
+//	BACKUP_SET_DOCS_DIR, BACKUP_SET_DOCS_PREFIX, BACKUP_SET_DOCS_BACKEND, BACKUP_SET_DOCS_BUCKET, BACKUP_SET_DOCS_LOCAL_BACKEND_DIR,
+//	BACKUP_SET_DOCS_INTERVAL, BACKUP_SET_DOCS_SCHEDULE, BACKUP_SET_DOCS_TIMEZONE, BACKUP_SET_DOCS_JITTER, BACKUP_SET_DOCS_BLACKOUT,
+//	BACKUP_SET_DOCS_CATCH_UP, BACKUP_SET_DOCS_CONTINUOUS_SYNC, BACKUP_SET_DOCS_SYNC_QUIET_PERIOD, BACKUP_SET_DOCS_SYNC_MAX_DELAY,
+//	BACKUP_SET_DOCS_INCLUDE, BACKUP_SET_DOCS_EXCLUDE
+//
+// Everything but the directory and the prefix falls back to the top level setting.
+func parseBackupSets(cfg MetaConfig, names string) ([]BackupSet, error) {
+	var sets []BackupSet
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !setNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid backup set name %q, use letters, digits, - and _", name)
+		}
+		env := "BACKUP_SET_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		set := cfg.topLevelSet(name)
+		set.BackupDir = getenv(env + "DIR")
+		set.S3Prefix = getenv(env + "PREFIX")
+		if v := getenv(env + "BACKEND"); v != "" {
+			set.Backend = strings.ToLower(v)
+		}
+		if v := getenv(env + "BUCKET"); v != "" {
+			set.S3Bucket = v
+		}
+		if v := getenv(env + "LOCAL_BACKEND_DIR"); v != "" {
+			set.LocalBackendDir = v
+		}
+		if v := getenv(env + "INTERVAL"); v != "" {
+			interval, err := parseLongDuration(v)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("invalid %sINTERVAL %q, must be a duration like 30m, 6h or 1d", env, v)
+			}
+			set.S3BackupInterval = interval
+		}
+		if v := strings.TrimSpace(getenv(env + "SCHEDULE")); v != "" {
+			if _, err := schedule.ParseCron(v); err != nil {
+				return nil, fmt.Errorf("invalid %sSCHEDULE: %v", env, err)
+			}
+			set.Schedule = v
+		} else if getenv(env+"INTERVAL") != "" {
+			set.Schedule = "" // an interval of the set wins over the top level schedule
+		}
+		if v := getenv(env + "TIMEZONE"); v != "" {
+			if _, err := schedule.LoadLocation(v); err != nil {
+				return nil, fmt.Errorf("invalid %sTIMEZONE: %v", env, err)
+			}
+			set.Timezone = v
+		}
+		if v := getenv(env + "JITTER"); v != "" {
+			jitter, err := parseLongDuration(v)
+			if err != nil || jitter < 0 {
+				return nil, fmt.Errorf("invalid %sJITTER %q, must be a duration like 10m or 1h", env, v)
+			}
+			set.Jitter = jitter
+		}
+		if v := getenv(env + "BLACKOUT"); v != "" {
+			set.Blackout = splitPatterns(v)
+			if _, err := schedule.ParseWindows(set.Blackout); err != nil {
+				return nil, fmt.Errorf("invalid %sBLACKOUT: %v", env, err)
+			}
+		}
+		if v := getenv(env + "CATCH_UP"); v != "" {
+			catchUp, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %sCATCH_UP: %w", env, err)
+			}
+			set.CatchUp = catchUp
+		}
+		if v := getenv(env + "CONTINUOUS_SYNC"); v != "" {
+			continuous, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %sCONTINUOUS_SYNC: %w", env, err)
+			}
+			set.ContinuousSync = continuous
+		}
+		for setting, value := range map[string]*time.Duration{"SYNC_QUIET_PERIOD": &set.SyncQuietPeriod, "SYNC_MAX_DELAY": &set.SyncMaxDelay} {
+			if v := getenv(env + setting); v != "" {
+				d, err := parseLongDuration(v)
+				if err != nil || d <= 0 {
+					return nil, fmt.Errorf("invalid %s%s %q, must be a duration like 5s or 1m", env, setting, v)
+				}
+				*value = d
+			}
+		}
+		if v := getenv(env + "INCLUDE"); v != "" {
+			set.Include = splitPatterns(v)
+		}
+		if v := getenv(env + "EXCLUDE"); v != "" {
+			set.Exclude = splitPatterns(v)
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// splitPatterns splits a comma separated list of glob patterns
+func splitPatterns(v string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(v, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// validateSets checks every set on its own, and that no two of them step on each other's toes:
+// a directory below another one would be backed up twice, and two sets storing below the same prefix would delete each other's objects.
+func validateSets(sets []BackupSet) error {
+	if len(sets) == 0 {
+		return fmt.Errorf("no backup directory specified")
+	}
+	for i := range sets {
+		set := &sets[i]
+		if set.BackupDir == "" {
+			return fmt.Errorf("no backup directory specified for backup set %q", set.Name)
+		}
+		dir, err := filepath.Abs(set.BackupDir)
+		if err != nil {
+			return fmt.Errorf("invalid backup directory of backup set %q: %v", set.Name, err)
+		}
+		set.BackupDir = dir
+		switch set.Backend {
+		case BackendS3:
+			if set.S3Bucket == "" {
+				return fmt.Errorf("no s3 bucket specified for backup set %q", set.Name)
+			}
+		case BackendLocal:
+			if set.LocalBackendDir == "" {
+				return fmt.Errorf("no LOCAL_BACKEND_DIR specified for the local backend of backup set %q", set.Name)
+			}
+		default:
+			return fmt.Errorf("invalid backend %q of backup set %q, must be one of %s/%s", set.Backend, set.Name, BackendS3, BackendLocal)
+		}
+		if set.S3Prefix == "" {
+			return fmt.Errorf("no s3 bucket prefix specified for backup set %q", set.Name)
+		}
+		if set.ContinuousSync && set.SyncMaxDelay < set.SyncQuietPeriod {
+			return fmt.Errorf("the sync max delay (%s) of backup set %q is shorter than its quiet period (%s), see SYNC_MAX_DELAY", set.SyncMaxDelay, set.Name, set.SyncQuietPeriod)
+		}
+		for _, pattern := range append(append([]string(nil), set.Include...), set.Exclude...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q in backup set %q: %v", pattern, set.Name, err)
+			}
+		}
+
+		for _, other := range sets[:i] {
+			switch {
+			case other.Name == set.Name:
+				return fmt.Errorf("backup set %q is configured twice", set.Name)
+			case other.Contains(set.BackupDir) || set.Contains(other.BackupDir):
+				return fmt.Errorf("backup sets %q and %q overlap: %s and %s", other.Name, set.Name, other.BackupDir, set.BackupDir)
+			case sameStore(other, *set) && prefixesOverlap(other.S3Prefix, set.S3Prefix):
+				return fmt.Errorf("backup sets %q and %q store below the same prefix: %s and %s", other.Name, set.Name, other.Destination(), set.Destination())
+			}
+		}
+	}
+	return nil
+}
+
+// sameStore tells if two sets are backed up to the same bucket or directory. Sets in different stores may use the same prefix,
+// even with the chunked layout: which chunks a store has is remembered per store (see storage.StoreID).
+func sameStore(a, b BackupSet) bool {
+	if a.Backend != b.Backend {
+		return false
+	}
+	if a.Backend == BackendLocal {
+		return filepath.Clean(a.LocalBackendDir) == filepath.Clean(b.LocalBackendDir)
+	}
+	return a.S3Bucket == b.S3Bucket
+}
+
+// prefixesOverlap tells if everything below one prefix is also below the other one
+func prefixesOverlap(a, b string) bool {
+	clean := func(p string) string {
+		p = strings.Trim(path.Clean(filepath.ToSlash(p)), "/")
+		if p == "." || p == "" {
+			return ""
+		}
+		return p + "/"
+	}
+	a, b = clean(a), clean(b)
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
@@ -0,0 +1,258 @@
+package fsconfig
+
+import (
+	"flag"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parse(t *testing.T, env map[string]string, args ...string) (MetaConfig, error) {
+	t.Helper()
+	for _, name := range []string{"BACKUP_DIR", "BACKUP_SETS", "BACKEND", "S3_BUCKET", "S3_BUCKET_PREFIX", "LOCAL_BACKEND_DIR", "BACKUP_INCLUDE", "BACKUP_EXCLUDE", ConfigFileEnv} {
+		t.Setenv(name, "")
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	MetaCfg = MetaConfig{}
+	return ParseConfigArgs(flag.NewFlagSet("test", flag.ContinueOnError), args)
+}
+
+func TestBackupSets(t *testing.T) {
+	root := t.TempDir()
+	cfg, err := parse(t, map[string]string{
+		"BACKUP_DIR":                          filepath.Join(root, "home"),
+		"S3_BUCKET":                           "bucket",
+		"S3_BUCKET_PREFIX":                    "home",
+		"BACKUP_EXCLUDE":                      "*.tmp",
+		"BACKUP_SETS":                         "docs, photos",
+		"BACKUP_SET_DOCS_DIR":                 filepath.Join(root, "docs"),
+		"BACKUP_SET_DOCS_PREFIX":              "docs",
+		"BACKUP_SET_DOCS_INTERVAL":            "30m",
+		"BACKUP_SET_DOCS_INCLUDE":             "*.md",
+		"BACKUP_SET_PHOTOS_DIR":               filepath.Join(root, "photos"),
+		"BACKUP_SET_PHOTOS_PREFIX":            "photos",
+		"BACKUP_SET_PHOTOS_BACKEND":           BackendLocal,
+		"BACKUP_SET_PHOTOS_LOCAL_BACKEND_DIR": filepath.Join(root, "nas"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, set := range cfg.Sets {
+		names = append(names, set.Name)
+	}
+	if strings.Join(names, ",") != "default,docs,photos" {
+		t.Fatalf("want the sets default,docs,photos, got %v", names)
+	}
+
+	docs, _ := cfg.FindSet("docs")
+	if docs.S3Bucket != "bucket" || docs.Backend != BackendS3 || docs.S3BackupInterval != 30*time.Minute {
+		t.Errorf("want docs to fall back to the top level bucket and backend with its own interval, got %+v", docs)
+	}
+	if len(docs.Exclude) != 1 || docs.Exclude[0] != "*.tmp" {
+		t.Errorf("want docs to inherit the top level exclude, got %v", docs.Exclude)
+	}
+	photos, _ := cfg.FindSet("photos")
+	if photos.Destination() != "local:"+filepath.Join(root, "nas", "photos") {
+		t.Errorf("unexpected photos destination %s", photos.Destination())
+	}
+	if cfg.BackupDir != filepath.Join(root, "home") {
+		t.Errorf("want the top level settings to be those of the first set, got %s", cfg.BackupDir)
+	}
+
+	set, ok := cfg.SetFor(filepath.Join(root, "docs", "a", "b.md"))
+	if !ok || set.Name != "docs" {
+		t.Errorf("want a file below docs to belong to docs, got %q", set.Name)
+	}
+	if _, ok := cfg.SetFor(filepath.Join(root, "docs2", "a.md")); ok {
+		t.Errorf("want docs2 to belong to no set")
+	}
+
+	// -set makes a set the one commands work on
+	cfg, err = parse(t, map[string]string{
+		"BACKUP_SETS":            "docs",
+		"S3_BUCKET":              "bucket",
+		"BACKUP_SET_DOCS_DIR":    filepath.Join(root, "docs"),
+		"BACKUP_SET_DOCS_PREFIX": "docs",
+	}, "-set", "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.S3Prefix != "docs" || cfg.BackupDir != filepath.Join(root, "docs") {
+		t.Errorf("want the docs set selected, got %s -> %s", cfg.BackupDir, cfg.S3Prefix)
+	}
+}
+
+func TestBackupSetsRejected(t *testing.T) {
+	root := t.TempDir()
+	for name, tc := range map[string]struct {
+		env  map[string]string
+		want string
+	}{
+		"nested directories": {map[string]string{
+			"BACKUP_DIR":             root,
+			"S3_BUCKET":              "bucket",
+			"S3_BUCKET_PREFIX":       "all",
+			"BACKUP_SETS":            "docs",
+			"BACKUP_SET_DOCS_DIR":    filepath.Join(root, "docs"),
+			"BACKUP_SET_DOCS_PREFIX": "docs",
+		}, "overlap"},
+		"nested prefixes in one bucket": {map[string]string{
+			"BACKUP_SETS":         "a,b",
+			"S3_BUCKET":           "bucket",
+			"BACKUP_SET_A_DIR":    filepath.Join(root, "a"),
+			"BACKUP_SET_A_PREFIX": "backup",
+			"BACKUP_SET_B_DIR":    filepath.Join(root, "b"),
+			"BACKUP_SET_B_PREFIX": "backup/b/",
+		}, "same prefix"},
+		"missing prefix": {map[string]string{
+			"BACKUP_SETS":      "a",
+			"S3_BUCKET":        "bucket",
+			"BACKUP_SET_A_DIR": filepath.Join(root, "a"),
+		}, "no s3 bucket prefix"},
+		"bad pattern": {map[string]string{
+			"BACKUP_SETS":          "a",
+			"S3_BUCKET":            "bucket",
+			"BACKUP_SET_A_DIR":     filepath.Join(root, "a"),
+			"BACKUP_SET_A_PREFIX":  "a",
+			"BACKUP_SET_A_EXCLUDE": "[",
+		}, "invalid pattern"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parse(t, tc.env)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("want an error about %q, got %v", tc.want, err)
+			}
+		})
+	}
+
+	// The same prefix in different buckets is fine
+	if _, err := parse(t, map[string]string{
+		"BACKUP_SETS":         "a,b",
+		"S3_BUCKET":           "bucket",
+		"BACKUP_SET_A_DIR":    filepath.Join(root, "a"),
+		"BACKUP_SET_A_PREFIX": "backup",
+		"BACKUP_SET_B_DIR":    filepath.Join(root, "b"),
+		"BACKUP_SET_B_PREFIX": "backup",
+		"BACKUP_SET_B_BUCKET": "other",
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	set := BackupSet{
+		BackupDir: "/data",
+		Include:   []string{"*.md", "img/*.png"},
+		Exclude:   []string{"node_modules", "drafts/*", "*.tmp"},
+	}
+	for path, want := range map[string]bool{
+		"/data/readme.md":                 true,
+		"/data/a/b/notes.md":              true,
+		"/data/img/logo.png":              true,
+		"/data/other/logo.png":            false, // not included
+		"/data/notes.md.tmp":              false,
+		"/data/web/node_modules/x/pkg.md": false, // below an excluded directory
+		"/data/drafts/idea.md":            false,
+		"/data/drafts":                    false,
+		"/data/.cloudkeeper/notes.md":     false, // where the chunks, the trash and snapshots live
+		"/data/docs/.cloudkeeper/a.md":    true,
+	} {
+		if got := set.Includes(path); got != want {
+			t.Errorf("Includes(%s) = %v, want %v", path, got, want)
+		}
+	}
+	if !set.Excludes("/data/web/node_modules") || set.Excludes("/data/web") || set.Excludes("/data") {
+		t.Errorf("unexpected exclusion of directories")
+	}
+}
+
+func TestSetSchedules(t *testing.T) {
+	root := t.TempDir()
+	cfg, err := parse(t, map[string]string{
+		"S3_BUCKET":                  "bucket",
+		"S3_BACKUP_SCHEDULE":         "0 2 * * *",
+		"BACKUP_TIMEZONE":            "UTC",
+		"BACKUP_BLACKOUT":            "mon-fri 08:00-18:00, sat 10:00-12:00",
+		"BACKUP_SETS":                "docs,photos",
+		"BACKUP_SET_DOCS_DIR":        filepath.Join(root, "docs"),
+		"BACKUP_SET_DOCS_PREFIX":     "docs",
+		"BACKUP_SET_DOCS_CATCH_UP":   "true",
+		"BACKUP_SET_DOCS_JITTER":     "15m",
+		"BACKUP_SET_PHOTOS_DIR":      filepath.Join(root, "photos"),
+		"BACKUP_SET_PHOTOS_PREFIX":   "photos",
+		"BACKUP_SET_PHOTOS_INTERVAL": "6h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, _ := cfg.FindSet("docs")
+	if docs.Schedule != "0 2 * * *" || docs.Timezone != "UTC" || len(docs.Blackout) != 2 || !docs.CatchUp || docs.Jitter != 15*time.Minute {
+		t.Errorf("want docs to inherit the top level schedule, got %+v", docs)
+	}
+	photos, _ := cfg.FindSet("photos")
+	if plan, err := photos.Plan(); err != nil || !strings.HasPrefix(plan.String(), "every 6h0m0s") {
+		t.Errorf("want the interval of photos to win over the top level schedule, got %v %v", plan, err)
+	}
+
+	invalid := map[string]string{
+		"S3_BACKUP_SCHEDULE":       "0 2 * *",
+		"BACKUP_TIMEZONE":          "Mars/Olympus",
+		"BACKUP_BLACKOUT":          "weekdays 08:00-18:00",
+		"BACKUP_SET_DOCS_SCHEDULE": "every night",
+	}
+	for name, value := range invalid {
+		env := map[string]string{
+			"S3_BUCKET":              "bucket",
+			"BACKUP_SETS":            "docs",
+			"BACKUP_SET_DOCS_DIR":    filepath.Join(root, "docs"),
+			"BACKUP_SET_DOCS_PREFIX": "docs",
+		}
+		for other := range invalid {
+			env[other] = ""
+		}
+		env[name] = value
+		_, err := parse(t, env)
+		if err == nil || !strings.Contains(err.Error(), "invalid "+name) {
+			t.Errorf("want an error about %s, got %v", name, err)
+		}
+	}
+}
+
+func TestSetContinuousSync(t *testing.T) {
+	root := t.TempDir()
+	env := map[string]string{
+		"S3_BUCKET":                          "bucket",
+		"CONTINUOUS_SYNC":                    "true",
+		"SYNC_QUIET_PERIOD":                  "10s",
+		"SYNC_MAX_DELAY":                     "",
+		"BACKUP_SETS":                        "docs,media",
+		"BACKUP_SET_DOCS_DIR":                filepath.Join(root, "docs"),
+		"BACKUP_SET_DOCS_PREFIX":             "docs",
+		"BACKUP_SET_MEDIA_DIR":               filepath.Join(root, "media"),
+		"BACKUP_SET_MEDIA_PREFIX":            "media",
+		"BACKUP_SET_MEDIA_CONTINUOUS_SYNC":   "false",
+		"BACKUP_SET_MEDIA_SYNC_QUIET_PERIOD": "",
+	}
+	cfg, err := parse(t, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, _ := cfg.FindSet("docs")
+	if !docs.ContinuousSync || docs.SyncQuietPeriod != 10*time.Second || docs.SyncMaxDelay != time.Minute {
+		t.Errorf("want docs to inherit continuous sync, got %+v", docs)
+	}
+	if media, _ := cfg.FindSet("media"); media.ContinuousSync {
+		t.Errorf("want continuous sync off for media, got %+v", media)
+	}
+
+	// The max delay can't be shorter than the quiet period
+	env["BACKUP_SET_MEDIA_CONTINUOUS_SYNC"] = "true"
+	env["BACKUP_SET_MEDIA_SYNC_QUIET_PERIOD"] = "2m"
+	if _, err := parse(t, env); err == nil || !strings.Contains(err.Error(), "SYNC_MAX_DELAY") {
+		t.Errorf("want an error about the max delay, got %v", err)
+	}
+}
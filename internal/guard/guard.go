@@ -0,0 +1,262 @@
+// Package guard watches the stream of file changes for what mass deletions and ransomware look like:
+// a large part of the tracked files removed or rewritten within a short time, or rewritten files suddenly looking encrypted.
+// When it trips, pushing to the backend is frozen (see backup.FlushToS3) till `cloudkeeper resume`, so the damage doesn't reach the backup.
+package guard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Praveen005/CloudKeeper/internal/compress"
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/db"
+)
+
+const (
+	// the tracked file count comes from the object index, it's refreshed this often
+	trackedRefresh = time.Minute
+	// a file being written is looked at once in this interval, not on every write event
+	entropyInterval = time.Second
+	// how much of a file its entropy is computed from
+	entropySample = 64 << 10
+	// the entropy of a few bytes says little, smaller files aren't looked at
+	entropyMinSize = 4 << 10
+	// paths kept in the freeze state as examples
+	maxSamples = 10
+)
+
+// Thresholds configure when the guard trips
+type Thresholds struct {
+	Window            time.Duration // changes are counted over this sliding window
+	MaxChangedPercent int           // trip when this many percent of the tracked files were removed, moved away or rewritten...
+	MinFiles          int           // ...and at least this many
+	HighEntropyFiles  int           // or when this many rewritten files look encrypted, 0 turns the check off
+	Entropy           float64       // bits per byte from which a file looks encrypted
+}
+
+type kind int
+
+const (
+	changed kind = iota
+	created
+	highEntropy
+)
+
+type event struct {
+	at   time.Time
+	path string
+	kind kind
+}
+
+// Detector counts the changes within the window. It's fed through Observe and safe for concurrent use.
+type Detector struct {
+	thresholds Thresholds
+	tracked    func() (int, error)
+	// entropy returns the entropy of the file at path, ok is false for files which can't or shouldn't be judged by it
+	entropy func(path string) (value float64, ok bool)
+
+	mu           sync.Mutex
+	events       []event // oldest first
+	counts       [3]map[string]int
+	lastEntropy  map[string]time.Time
+	trackedCount int
+	trackedAt    time.Time
+	tripped      bool
+}
+
+// New creates a detector, tracked returns the number of files backed up (the base of the percentage)
+func New(thresholds Thresholds, tracked func() (int, error)) *Detector {
+	d := &Detector{thresholds: thresholds, tracked: tracked, entropy: fileEntropy}
+	d.Reset()
+	return d
+}
+
+// Default is the detector fed by the watcher and the scanner, nil when the guard is off
+var Default *Detector
+
+// Reset forgets everything observed so far, after the user looked into a freeze and resumed
+func (d *Detector) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events = nil
+	for i := range d.counts {
+		d.counts[i] = make(map[string]int)
+	}
+	d.lastEntropy = make(map[string]time.Time)
+	d.trackedAt = time.Time{}
+	d.tripped = false
+}
+
+// Observe takes a change to path (op is one of the db.Op* values) which happened at now.
+// It returns what to freeze with when the change tips the window over a threshold, only once till Reset.
+func (d *Detector) Observe(path, op string, now time.Time) *db.FreezeState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(now)
+
+	switch op {
+	case db.OpCreate, db.OpMovedTo:
+		d.add(now, path, created)
+	case db.OpRemove, db.OpMovedFrom:
+		d.add(now, path, changed)
+	case db.OpWrite:
+		// Writing a file created within the window is filling it, not rewriting it: copying a tree in mustn't trip the guard
+		if d.counts[created][path] > 0 {
+			break
+		}
+		d.add(now, path, changed)
+		if d.thresholds.HighEntropyFiles > 0 && d.counts[highEntropy][path] == 0 && now.Sub(d.lastEntropy[path]) >= entropyInterval {
+			d.lastEntropy[path] = now
+			if value, ok := d.entropy(path); ok && value >= d.thresholds.Entropy {
+				d.add(now, path, highEntropy)
+			}
+		}
+	}
+	if d.tripped {
+		return nil
+	}
+	return d.check(now)
+}
+
+func (d *Detector) add(now time.Time, path string, k kind) {
+	d.events = append(d.events, event{at: now, path: path, kind: k})
+	d.counts[k][path]++
+}
+
+// expire drops what happened before the window
+func (d *Detector) expire(now time.Time) {
+	cutoff := now.Add(-d.thresholds.Window)
+	var n int
+	for n < len(d.events) && d.events[n].at.Before(cutoff) {
+		e := d.events[n]
+		if d.counts[e.kind][e.path]--; d.counts[e.kind][e.path] <= 0 {
+			delete(d.counts[e.kind], e.path)
+		}
+		n++
+	}
+	d.events = d.events[n:]
+	for path, at := range d.lastEntropy {
+		if at.Before(cutoff) {
+			delete(d.lastEntropy, path)
+		}
+	}
+}
+
+func (d *Detector) check(now time.Time) *db.FreezeState {
+	if now.Sub(d.trackedAt) >= trackedRefresh {
+		tracked, err := d.tracked()
+		if err != nil {
+			customlog.Logger.Error("Error counting the tracked files", zap.String("error", err.Error()))
+		} else {
+			d.trackedCount, d.trackedAt = tracked, now
+		}
+	}
+
+	changedFiles := len(d.counts[changed])
+	highEntropyFiles := len(d.counts[highEntropy])
+	var reasons []string
+	if d.trackedCount > 0 && changedFiles >= d.thresholds.MinFiles && changedFiles*100 >= d.thresholds.MaxChangedPercent*d.trackedCount {
+		reasons = append(reasons, fmt.Sprintf("%d of %d tracked files removed or rewritten within %s", changedFiles, d.trackedCount, d.thresholds.Window))
+	}
+	if d.thresholds.HighEntropyFiles > 0 && highEntropyFiles >= d.thresholds.HighEntropyFiles {
+		reasons = append(reasons, fmt.Sprintf("%d rewritten files look encrypted (entropy of %.1f bits per byte or more)", highEntropyFiles, d.thresholds.Entropy))
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	d.tripped = true
+
+	samples := d.counts[highEntropy]
+	if len(samples) == 0 {
+		samples = d.counts[changed]
+	}
+	state := &db.FreezeState{
+		Reason:      strings.Join(reasons, ", "),
+		At:          now,
+		Window:      d.thresholds.Window.String(),
+		Changed:     changedFiles,
+		Tracked:     d.trackedCount,
+		HighEntropy: highEntropyFiles,
+	}
+	for path := range samples {
+		state.Samples = append(state.Samples, path)
+	}
+	sort.Strings(state.Samples)
+	if len(state.Samples) > maxSamples {
+		state.Samples = state.Samples[:maxSamples]
+	}
+	return state
+}
+
+// fileEntropy computes the entropy of the start of the file at path. Types which are compressed anyway look random by nature, they're skipped.
+func fileEntropy(path string) (float64, bool) {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, skip := range compress.DefaultSkipExtensions {
+		if ext == skip {
+			return 0, false
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, entropySample))
+	if err != nil || len(data) < entropyMinSize {
+		return 0, false
+	}
+	return compress.Entropy(data), true
+}
+
+// AlertWebhook is POSTed the freeze state as JSON when the guard trips, empty means logging only
+var AlertWebhook string
+
+// Observe feeds a change to Default and freezes pushing if it trips. It does nothing when the guard is off.
+func Observe(path, op string) {
+	if Default == nil {
+		return
+	}
+	state := Default.Observe(path, op, time.Now())
+	if state == nil {
+		return
+	}
+	if err := db.Freeze(*state); err != nil {
+		customlog.Logger.Error("Error freezing the backup", zap.String("error", err.Error()))
+	}
+	customlog.Logger.Error("Suspicious burst of changes, pushing to the backend is frozen till `cloudkeeper resume`",
+		zap.String("reason", state.Reason),
+		zap.Strings("samples", state.Samples),
+	)
+	if AlertWebhook != "" {
+		go alert(*state)
+	}
+}
+
+// alert POSTs the freeze to AlertWebhook
+func alert(state db.FreezeState) {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(AlertWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		customlog.Logger.Error("Error sending the guard alert", zap.String("error", err.Error()))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		customlog.Logger.Error("Guard alert rejected", zap.String("status", resp.Status))
+	}
+}
@@ -0,0 +1,141 @@
+package guard
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/db"
+)
+
+var thresholds = Thresholds{Window: 10 * time.Minute, MaxChangedPercent: 30, MinFiles: 5, HighEntropyFiles: 3, Entropy: 7.5}
+
+// newDetector tracks 100 files, the entropy of every file is looked up in entropies (missing ones can't be judged)
+func newDetector(entropies map[string]float64) *Detector {
+	d := New(thresholds, func() (int, error) { return 100, nil })
+	d.entropy = func(path string) (float64, bool) {
+		value, ok := entropies[path]
+		return value, ok
+	}
+	return d
+}
+
+// feed observes op on count files named by prefix, one every interval starting at start, and returns the first freeze
+func feed(d *Detector, prefix, op string, count int, start time.Time, interval time.Duration) *db.FreezeState {
+	for i := 0; i < count; i++ {
+		if state := d.Observe(fmt.Sprintf("%s%03d", prefix, i), op, start.Add(time.Duration(i)*interval)); state != nil {
+			return state
+		}
+	}
+	return nil
+}
+
+func TestMassDeletion(t *testing.T) {
+	d := newDetector(nil)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	if state := feed(d, "/backup/doc", db.OpRemove, 29, start, time.Second); state != nil {
+		t.Fatalf("29%% of the files removed, tripped: %+v", state)
+	}
+	state := d.Observe("/backup/last", db.OpMovedFrom, start.Add(time.Minute))
+	if state == nil {
+		t.Fatal("30% of the files removed, didn't trip")
+	}
+	if state.Changed != 30 || state.Tracked != 100 || len(state.Samples) != maxSamples {
+		t.Errorf("unexpected freeze state %+v", state)
+	}
+	if again := d.Observe("/backup/more", db.OpRemove, start.Add(2*time.Minute)); again != nil {
+		t.Error("tripped twice")
+	}
+
+	d.Reset()
+	if state := d.Observe("/backup/after", db.OpRemove, start.Add(3*time.Minute)); state != nil {
+		t.Errorf("tripped right after a reset: %+v", state)
+	}
+}
+
+func TestRemovingTheSameFileCountsOnce(t *testing.T) {
+	d := newDetector(nil)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if state := d.Observe("/backup/flapping", db.OpRemove, start.Add(time.Duration(i)*time.Second)); state != nil {
+			t.Fatalf("one file tripped the guard: %+v", state)
+		}
+	}
+}
+
+func TestCopyingNewFilesIn(t *testing.T) {
+	d := newDetector(nil)
+	d.entropy = func(string) (float64, bool) { return 7.99, true }
+	start := time.Now()
+	// A big tree copied in: create and write events for files which weren't there, whatever their content
+	for i := 0; i < 500; i++ {
+		path := fmt.Sprintf("/backup/photos/%03d.raw", i)
+		at := start.Add(time.Duration(i) * 100 * time.Millisecond)
+		if state := d.Observe(path, db.OpCreate, at); state != nil {
+			t.Fatalf("creating files tripped the guard: %+v", state)
+		}
+		if state := d.Observe(path, db.OpWrite, at); state != nil {
+			t.Fatalf("writing new files tripped the guard: %+v", state)
+		}
+	}
+}
+
+func TestHighEntropyRewrites(t *testing.T) {
+	entropies := map[string]float64{}
+	for i := 0; i < 10; i++ {
+		entropies[fmt.Sprintf("/backup/doc%03d", i)] = 7.9
+	}
+	entropies["/backup/doc001"] = 4.2 // a text file rewritten as text
+	d := newDetector(entropies)
+	d.thresholds.MinFiles = 1000 // only the entropy check can trip
+	start := time.Now()
+
+	if state := feed(d, "/backup/doc", db.OpWrite, 3, start, time.Second); state != nil {
+		t.Fatalf("2 encrypted looking files tripped: %+v", state)
+	}
+	state := d.Observe("/backup/doc003", db.OpWrite, start.Add(time.Minute))
+	if state == nil {
+		t.Fatal("3 encrypted looking files didn't trip")
+	}
+	if state.HighEntropy != 3 || len(state.Samples) != 3 || state.Samples[0] != "/backup/doc000" {
+		t.Errorf("unexpected freeze state %+v", state)
+	}
+}
+
+func TestEntropyIsCheckedOncePerInterval(t *testing.T) {
+	d := newDetector(nil)
+	var checks int
+	d.entropy = func(string) (float64, bool) {
+		checks++
+		return 1, true
+	}
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		d.Observe("/backup/big.log", db.OpWrite, start.Add(time.Duration(i)*10*time.Millisecond))
+	}
+	if checks != 1 {
+		t.Errorf("entropy checked %d times within a second, want once", checks)
+	}
+}
+
+func TestWindowExpires(t *testing.T) {
+	d := newDetector(nil)
+	start := time.Now()
+	// 40 removals, spread over more than 4 windows: never 30 within one
+	if state := feed(d, "/backup/old", db.OpRemove, 40, start, time.Minute); state != nil {
+		t.Fatalf("removals spread over hours tripped the guard: %+v", state)
+	}
+	// The last 9 old ones are still in the window and count
+	if state := feed(d, "/backup/new", db.OpRemove, 25, start.Add(40*time.Minute), time.Second); state == nil {
+		t.Fatal("30 removals within the window didn't trip")
+	}
+}
+
+func TestNotEnoughFiles(t *testing.T) {
+	d := New(thresholds, func() (int, error) { return 4, nil })
+	// Removing all of 4 files is 100%, but below MinFiles
+	if state := feed(d, "/backup/f", db.OpRemove, 4, time.Now(), time.Second); state != nil {
+		t.Errorf("a small tree tripped the guard: %+v", state)
+	}
+}
@@ -0,0 +1,246 @@
+package reconcile
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/db"
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"github.com/Praveen005/CloudKeeper/internal/guard"
+	"github.com/Praveen005/CloudKeeper/internal/storage"
+	"go.uber.org/zap"
+)
+
+// Result sums up a reconciliation pass
+type Result struct {
+	LocalFiles    int
+	RemoteObjects int
+	Added         int // local files queued for upload
+	Removed       int // s3 objects queued for removal
+}
+
+// only one pass at a time, a second one asked for meanwhile would find the same differences
+var running sync.Mutex
+
+// Run compares the directory of every backup set with what's stored under the prefix of the set and queues every difference.
+// A local file is queued for upload when s3 doesn't have it, when the sizes differ, or when it changed since it was last uploaded
+// (according to the object index, or the s3 modification time for files uploaded before the index existed).
+// With checksum set, files which look the same are also compared against the MD5 in the ETag, where s3 provides one (and the content isn't encrypted).
+// Objects without a local file are queued for removal.
+func Run(ctx context.Context, checksum bool) (Result, error) {
+	var result Result
+	if !running.TryLock() {
+		return result, fmt.Errorf("a reconciliation is already running")
+	}
+	defer running.Unlock()
+
+	for _, set := range fsconfig.Current().BackupSets() {
+		r, err := runSet(ctx, set, checksum)
+		result.LocalFiles += r.LocalFiles
+		result.RemoteObjects += r.RemoteObjects
+		result.Added += r.Added
+		result.Removed += r.Removed
+		if err != nil {
+			return result, fmt.Errorf("backup set %s: %w", set.Name, err)
+		}
+	}
+	return result, nil
+}
+
+// RunSet reconciles a single backup set, e.g. one which was just added to the configuration
+func RunSet(ctx context.Context, set fsconfig.BackupSet, checksum bool) (Result, error) {
+	if !running.TryLock() {
+		return Result{}, fmt.Errorf("a reconciliation is already running")
+	}
+	defer running.Unlock()
+	return runSet(ctx, set, checksum)
+}
+
+// runSet reconciles a single backup set. Files the set leaves out count as missing locally, their objects are removed.
+func runSet(ctx context.Context, set fsconfig.BackupSet, checksum bool) (Result, error) {
+	var result Result
+	customlog.Logger.Info("Reconciling local directory with the backend",
+		zap.String("set", set.Name),
+		zap.String("directory", set.BackupDir),
+		zap.String("backend", set.Backend),
+		zap.String("prefix", set.S3Prefix),
+	)
+
+	objects, err := storage.ListAll(ctx, storage.For(set.Name), storage.ListPrefix(set.S3Prefix))
+	if err != nil {
+		return result, err
+	}
+
+	type remoteObject struct {
+		size         int64
+		lastModified time.Time
+		etag         string
+	}
+	remote := make(map[string]remoteObject, len(objects))
+	for _, object := range objects {
+		relativePath, ok := storage.RelativePath(set.S3Prefix, object.Key)
+		if !ok {
+			continue
+		}
+		remote[relativePath] = remoteObject{size: object.Size, lastModified: object.LastModified, etag: object.ETag}
+	}
+	result.RemoteObjects = len(remote)
+
+	index, err := db.ReadIndexBelow(set.BackupDir)
+	if err != nil {
+		return result, err
+	}
+
+	// A missing (say, unmounted) backup directory must not turn into "delete everything from s3"
+	root := filepath.Clean(set.BackupDir)
+	if _, err := os.Stat(root); err != nil {
+		return result, fmt.Errorf("backup directory not accessible: %v", err)
+	}
+	var unreadable []string // we can't tell if what's below these still exists, so it's left alone in s3
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			customlog.Logger.Warn("Skipping unreadable path",
+				zap.String("path", path),
+				zap.String("error", err.Error()),
+			)
+			unreadable = append(unreadable, path)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() && set.Excludes(path) {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() || !set.Includes(path) {
+			return nil // directories, symlinks and friends aren't uploaded either
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		result.LocalFiles++
+
+		object, inS3 := remote[relativePath]
+		delete(remote, relativePath) // what's left over at the end only exists in s3
+
+		// Encrypted objects are bigger than the file, only the index knows what size they should have
+		indexed, known := index[path]
+		storedSize, sizeKnown := info.Size(), !storage.Transformed()
+		if known && indexed.StoredSize > 0 {
+			storedSize, sizeKnown = indexed.StoredSize, true
+		}
+
+		reason := ""
+		switch {
+		case !inS3:
+			reason = "missing in s3"
+		case sizeKnown && object.size != storedSize:
+			reason = "size differs"
+		case known && (indexed.Size != info.Size() || !indexed.ModTime.Equal(info.ModTime())):
+			reason = "changed since last upload"
+		case !known && info.ModTime().After(object.lastModified):
+			reason = "newer than s3 copy"
+		case checksum && !storage.Transformed() && isPlainMD5(object.etag):
+			sum, err := md5File(path)
+			if err != nil {
+				customlog.Logger.Warn("Skipping checksum of unreadable file",
+					zap.String("path", path),
+					zap.String("error", err.Error()),
+				)
+			} else if sum != object.etag {
+				reason = "checksum differs"
+			}
+		}
+		if reason == "" {
+			return nil
+		}
+
+		customlog.Logger.Debug("Queueing file for upload",
+			zap.String("path", path),
+			zap.String("reason", reason),
+		)
+		db.AppendJournal(path, db.OpWrite)
+		// What changed while we weren't running counts for the guard too, new files aren't rewrites though
+		if inS3 {
+			guard.Observe(path, db.OpWrite)
+		} else {
+			guard.Observe(path, db.OpCreate)
+		}
+		result.Added++
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("error walking %s: %v", root, err)
+	}
+
+	for relativePath := range remote {
+		path := filepath.Join(root, relativePath)
+		if below(path, unreadable) {
+			continue
+		}
+		customlog.Logger.Debug("Queueing file for removal",
+			zap.String("path", path),
+			zap.String("reason", "missing locally"),
+		)
+		db.AppendJournal(path, db.OpRemove)
+		guard.Observe(path, db.OpRemove)
+		result.Removed++
+	}
+
+	db.SyncJournal(ctx)
+	customlog.Logger.Info("Reconciliation finished",
+		zap.String("set", set.Name),
+		zap.Int("local files", result.LocalFiles),
+		zap.Int("s3 objects", result.RemoteObjects),
+		zap.Int("queued for upload", result.Added),
+		zap.Int("queued for removal", result.Removed),
+	)
+	return result, nil
+}
+
+// below tells if path is one of dirs or lives below one of them
+func below(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPlainMD5 tells if an ETag is the MD5 of the object. That's not the case for multipart uploads, their ETags end in -<number of parts>.
+func isPlainMD5(etag string) bool {
+	return len(etag) == 32 && !strings.Contains(etag, "-")
+}
+
+func md5File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
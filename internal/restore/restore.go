@@ -0,0 +1,201 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	// ExistingSkip leaves files that are already present in the target directory untouched
+	ExistingSkip = "skip"
+	// ExistingOverwrite replaces files that are already present in the target directory
+	ExistingOverwrite = "overwrite"
+
+	defaultParallelism = 4
+)
+
+// Options controls what gets restored and where
+type Options struct {
+	Backend   storage.Backend
+	Prefix    string
+	TargetDir string // local directory the tree gets written into
+	SubPath   string // only restore objects below this path (relative to the backed up directory), empty means everything
+	Existing  string // what to do with files that already exist locally, one of ExistingSkip/ExistingOverwrite
+	Parallel  int    // number of concurrent downloads
+	Snapshot  string // restore the tree as it was in this snapshot (an ID or storage.LatestSnapshot) instead of the latest state
+	Version   string // restore this version of the single file SubPath (versioned buckets, see storage.History)
+}
+
+// Result sums up a restore run
+type Result struct {
+	Downloaded int
+	Skipped    int
+	Failed     int
+}
+
+// Run pulls every object under opts.Prefix back to opts.TargetDir, or every file of opts.Snapshot.
+// Keys are mapped back to local paths the same way they were built on upload (filepath.Join(prefix, relativePath)).
+func Run(ctx context.Context, opts Options) (Result, error) {
+	var result Result
+
+	if opts.Existing == "" {
+		opts.Existing = ExistingSkip
+	}
+	if opts.Existing != ExistingSkip && opts.Existing != ExistingOverwrite {
+		return result, fmt.Errorf("invalid existing file policy %q, must be one of %s/%s", opts.Existing, ExistingSkip, ExistingOverwrite)
+	}
+	if opts.Parallel <= 0 {
+		opts.Parallel = defaultParallelism
+	}
+	if opts.TargetDir == "" {
+		return result, fmt.Errorf("no target directory specified")
+	}
+	if opts.Version != "" {
+		return version(ctx, opts)
+	}
+
+	var objects []storage.ObjectInfo
+	var snapshot *storage.Snapshot
+	var err error
+	if opts.Snapshot != "" {
+		if snapshot, err = storage.GetSnapshot(ctx, opts.Backend, opts.Prefix, opts.Snapshot); err != nil {
+			return result, err
+		}
+		customlog.Logger.Info("Starting restore",
+			zap.String("snapshot", snapshot.ID),
+			zap.String("target", opts.TargetDir),
+			zap.Int("files", len(snapshot.Files)),
+		)
+	} else {
+		// Upload uses filepath.Join, which drops any trailing slash from the prefix, listing has to match that
+		listPrefix := KeyPrefix(opts.Prefix, opts.SubPath)
+		if objects, err = storage.ListAll(ctx, opts.Backend, listPrefix); err != nil {
+			return result, err
+		}
+		customlog.Logger.Info("Starting restore",
+			zap.String("prefix", listPrefix),
+			zap.String("target", opts.TargetDir),
+			zap.Int("objects", len(objects)),
+		)
+	}
+
+	type job struct {
+		key  string
+		file *storage.SnapshotFile // set when restoring a snapshot
+		dest string
+	}
+	jobs := make(chan job)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				var err error
+				if j.file != nil {
+					err = storage.DownloadSnapshotFile(ctx, opts.Backend, snapshot, *j.file, j.dest)
+				} else {
+					err = storage.Download(ctx, opts.Backend, j.key, j.dest)
+				}
+				mu.Lock()
+				if err != nil {
+					result.Failed++
+					customlog.Logger.Error("Restoring file failed",
+						zap.String("key", j.key),
+						zap.String("error", err.Error()),
+					)
+				} else {
+					result.Downloaded++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var candidates []job
+	if snapshot != nil {
+		for i := range snapshot.Files {
+			file := &snapshot.Files[i]
+			candidates = append(candidates, job{key: file.Path, file: file, dest: file.Path})
+		}
+	} else {
+		for _, object := range objects {
+			relativePath, ok := storage.RelativePath(opts.Prefix, object.Key)
+			if !ok {
+				continue
+			}
+			candidates = append(candidates, job{key: object.Key, dest: relativePath})
+		}
+	}
+
+	for _, j := range candidates {
+		if !underSubPath(j.dest, opts.SubPath) || !safePath(j.dest) {
+			continue
+		}
+		j.dest = filepath.Join(opts.TargetDir, j.dest)
+
+		if opts.Existing == ExistingSkip {
+			if _, err := os.Stat(j.dest); err == nil {
+				mu.Lock()
+				result.Skipped++
+				mu.Unlock()
+				customlog.Logger.Debug("File already exists, skipping", zap.String("file", j.dest))
+				continue
+			}
+		}
+
+		select {
+		case jobs <- j:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	if result.Failed > 0 {
+		return result, fmt.Errorf("%d file(s) could not be restored", result.Failed)
+	}
+	return result, nil
+}
+
+// KeyPrefix builds the listing prefix for the given sub path below the backup prefix.
+// The sub path may point to a single file, so it doesn't get a trailing slash, underSubPath weeds out the siblings sharing its name as a prefix.
+func KeyPrefix(prefix, subPath string) string {
+	p := storage.Key(prefix, filepath.Clean(subPath))
+	if p == "." {
+		return ""
+	}
+	if filepath.Clean(subPath) == "." || subPath == "" {
+		return p + "/"
+	}
+	return p
+}
+
+// safePath weeds out paths which would end up outside of the target directory, snapshots are just data someone could have tampered with
+func safePath(relativePath string) bool {
+	return filepath.IsLocal(relativePath)
+}
+
+func underSubPath(relativePath, subPath string) bool {
+	subPath = filepath.Clean(subPath)
+	if subPath == "." || subPath == "" {
+		return true
+	}
+	return relativePath == subPath || strings.HasPrefix(relativePath, subPath+string(filepath.Separator))
+}
@@ -0,0 +1,65 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/storage"
+	"go.uber.org/zap"
+)
+
+// FromTrash writes the most recently deleted version of path (a file or a directory, relative to the backed up directory)
+// from the trash back to opts.TargetDir. Restored into the backed up directory, the files get uploaded again like any new file.
+func FromTrash(ctx context.Context, opts Options, path string) (Result, error) {
+	var result Result
+	if opts.Existing == "" {
+		opts.Existing = ExistingSkip
+	}
+	if opts.Existing != ExistingSkip && opts.Existing != ExistingOverwrite {
+		return result, fmt.Errorf("invalid existing file policy %q, must be one of %s/%s", opts.Existing, ExistingSkip, ExistingOverwrite)
+	}
+	if opts.TargetDir == "" {
+		return result, fmt.Errorf("no target directory specified")
+	}
+
+	entries, err := storage.FindInTrash(ctx, opts.Backend, opts.Prefix, path)
+	if err != nil {
+		return result, err
+	}
+	if len(entries) == 0 {
+		return result, fmt.Errorf("%s is not in the trash", path)
+	}
+
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		if !safePath(entry.Path) {
+			continue
+		}
+		dest := filepath.Join(opts.TargetDir, entry.Path)
+		if opts.Existing == ExistingSkip {
+			if _, err := os.Stat(dest); err == nil {
+				result.Skipped++
+				customlog.Logger.Debug("File already exists, skipping", zap.String("file", dest))
+				continue
+			}
+		}
+		if err := storage.Download(ctx, opts.Backend, entry.Key, dest); err != nil {
+			result.Failed++
+			customlog.Logger.Error("Restoring file from the trash failed",
+				zap.String("key", entry.Key),
+				zap.String("error", err.Error()),
+			)
+			continue
+		}
+		result.Downloaded++
+	}
+	if result.Failed > 0 {
+		return result, fmt.Errorf("%d file(s) could not be restored", result.Failed)
+	}
+	return result, nil
+}
@@ -0,0 +1,46 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/storage"
+	"go.uber.org/zap"
+)
+
+// version restores opts.Version of the file opts.SubPath, the versions of a file are listed by storage.History
+func version(ctx context.Context, opts Options) (Result, error) {
+	var result Result
+	if opts.Snapshot != "" {
+		return result, fmt.Errorf("restore either a snapshot or a version of a file, not both")
+	}
+	path := filepath.Clean(opts.SubPath)
+	if opts.SubPath == "" || path == "." || !safePath(path) {
+		return result, fmt.Errorf("a version can only be restored for a single file, give its path")
+	}
+
+	dest := filepath.Join(opts.TargetDir, path)
+	if opts.Existing == ExistingSkip {
+		if _, err := os.Stat(dest); err == nil {
+			result.Skipped++
+			customlog.Logger.Info("File already exists, skipping (restore with -existing overwrite to replace it)", zap.String("file", dest))
+			return result, nil
+		}
+	}
+
+	key := storage.Key(opts.Prefix, path)
+	customlog.Logger.Info("Starting restore",
+		zap.String("key", key),
+		zap.String("version", opts.Version),
+		zap.String("target", dest),
+	)
+	if err := storage.DownloadVersion(ctx, opts.Backend, key, opts.Version, dest); err != nil {
+		result.Failed++
+		return result, err
+	}
+	result.Downloaded++
+	return result, nil
+}
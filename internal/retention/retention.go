@@ -0,0 +1,129 @@
+// Package retention decides which snapshots to keep: the last N, the newest one of each of the last N hours/days/weeks/months/years
+// (grandfather-father-son), and all of those taken within some time of the newest one.
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policy is what to keep. A snapshot is kept if any of the rules wants it, zero turns a rule off.
+type Policy struct {
+	Last    int           // the N newest snapshots
+	Hourly  int           // the newest snapshot of each of the last N hours which have one
+	Daily   int           // ... days
+	Weekly  int           // ... ISO weeks
+	Monthly int           // ... months
+	Yearly  int           // ... years
+	Within  time.Duration // every snapshot taken within this duration of the newest one
+}
+
+// Empty tells if no rule is set. Applying an empty policy would remove everything, so callers refuse to.
+func (p Policy) Empty() bool {
+	return p == Policy{}
+}
+
+// String describes the policy for logs
+func (p Policy) String() string {
+	var rules []string
+	for _, r := range []struct {
+		name string
+		n    int
+	}{{"last", p.Last}, {"hourly", p.Hourly}, {"daily", p.Daily}, {"weekly", p.Weekly}, {"monthly", p.Monthly}, {"yearly", p.Yearly}} {
+		if r.n > 0 {
+			rules = append(rules, fmt.Sprintf("%s %d", r.name, r.n))
+		}
+	}
+	if p.Within > 0 {
+		rules = append(rules, "within "+p.Within.String())
+	}
+	if len(rules) == 0 {
+		return "none"
+	}
+	return strings.Join(rules, ", ")
+}
+
+// Decision tells what happens to one snapshot and why it's kept
+type Decision struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Keep    bool      `json:"keep"`
+	Reasons []string  `json:"reasons,omitempty"`
+}
+
+// Snapshot is what the policy needs to know about a snapshot
+type Snapshot struct {
+	ID   string
+	Time time.Time
+}
+
+// Apply decides for every snapshot whether the policy keeps it. The decisions are ordered newest first.
+// Periods are calendar hours, days... in loc.
+func Apply(p Policy, snapshots []Snapshot, loc *time.Location) []Decision {
+	decisions := make([]Decision, len(snapshots))
+	for i, s := range snapshots {
+		decisions[i] = Decision{ID: s.ID, Time: s.Time}
+	}
+	sort.SliceStable(decisions, func(i, j int) bool { return decisions[i].Time.After(decisions[j].Time) })
+	if len(decisions) == 0 {
+		return decisions
+	}
+
+	keep := func(d *Decision, reason string) {
+		d.Keep = true
+		d.Reasons = append(d.Reasons, reason)
+	}
+
+	for i := range decisions {
+		if i < p.Last {
+			keep(&decisions[i], "last")
+		}
+	}
+
+	// Measured from the newest snapshot, not from now: when backups stop, the old snapshots mustn't expire one after the other
+	if p.Within > 0 {
+		cutoff := decisions[0].Time.Add(-p.Within)
+		for i := range decisions {
+			if !decisions[i].Time.Before(cutoff) {
+				keep(&decisions[i], "within "+p.Within.String())
+			}
+		}
+	}
+
+	buckets := []struct {
+		reason string
+		n      int
+		period func(t time.Time) string
+	}{
+		{"hourly", p.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{"daily", p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{"monthly", p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", p.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	for _, b := range buckets {
+		if b.n <= 0 {
+			continue
+		}
+		// Newest first, so the first snapshot of every period is the newest one in it
+		last, kept := "", 0
+		for i := range decisions {
+			if kept == b.n {
+				break
+			}
+			period := b.period(decisions[i].Time.In(loc))
+			if period == last {
+				continue
+			}
+			last = period
+			kept++
+			keep(&decisions[i], b.reason)
+		}
+	}
+	return decisions
+}
@@ -0,0 +1,88 @@
+package retention
+
+import (
+	"testing"
+	"time"
+)
+
+// hourly snapshots over 400 days, ending at end
+func snapshotsUntil(end time.Time) []Snapshot {
+	var snapshots []Snapshot
+	for t := end.Add(-400 * 24 * time.Hour); !t.After(end); t = t.Add(time.Hour) {
+		snapshots = append(snapshots, Snapshot{ID: t.Format(time.RFC3339), Time: t})
+	}
+	return snapshots
+}
+
+func kept(decisions []Decision) map[string][]string {
+	m := make(map[string][]string)
+	for _, d := range decisions {
+		if d.Keep {
+			m[d.ID] = d.Reasons
+		}
+	}
+	return m
+}
+
+func TestApply(t *testing.T) {
+	end := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	snapshots := snapshotsUntil(end)
+
+	tests := []struct {
+		name   string
+		policy Policy
+		want   int
+	}{
+		{"last", Policy{Last: 5}, 5},
+		{"hourly", Policy{Hourly: 10}, 10},
+		{"daily", Policy{Daily: 7}, 7},
+		{"weekly", Policy{Weekly: 4}, 4},
+		{"monthly", Policy{Monthly: 6}, 6},
+		{"yearly", Policy{Yearly: 5}, 2}, // only 2025 and 2026 have snapshots
+		{"within", Policy{Within: 48 * time.Hour}, 49},
+		// overlapping rules: the newest snapshot counts for all of them
+		{"gfs", Policy{Last: 1, Daily: 7, Weekly: 4, Monthly: 12}, 7 + 3 + 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decisions := Apply(tt.policy, snapshots, time.UTC)
+			if len(decisions) != len(snapshots) {
+				t.Fatalf("want a decision for each of the %d snapshots, got %d", len(snapshots), len(decisions))
+			}
+			if got := len(kept(decisions)); got != tt.want {
+				t.Errorf("want %d snapshots kept, got %d", tt.want, got)
+			}
+			if !decisions[0].Keep {
+				t.Errorf("the newest snapshot wasn't kept")
+			}
+		})
+	}
+}
+
+func TestApplyPeriods(t *testing.T) {
+	at := func(s string) Snapshot {
+		ts, _ := time.Parse(time.RFC3339, s)
+		return Snapshot{ID: s, Time: ts}
+	}
+	snapshots := []Snapshot{
+		at("2026-10-17T09:00:00Z"),
+		at("2026-10-17T18:00:00Z"), // newest of the day
+		at("2026-10-16T23:59:00Z"),
+		at("2026-10-15T08:00:00Z"),
+	}
+	got := kept(Apply(Policy{Daily: 2}, snapshots, time.UTC))
+	if len(got) != 2 || got["2026-10-17T18:00:00Z"] == nil || got["2026-10-16T23:59:00Z"] == nil {
+		t.Errorf("want the newest snapshots of the last 2 days kept, got %v", got)
+	}
+
+	// Days are calendar days where the snapshots were taken
+	tokyo := time.FixedZone("JST", 9*3600)
+	got = kept(Apply(Policy{Daily: 2}, snapshots, tokyo))
+	if len(got) != 2 || got["2026-10-17T18:00:00Z"] == nil || got["2026-10-16T23:59:00Z"] != nil {
+		t.Errorf("want days counted in the given time zone, got %v", got)
+	}
+
+	if !(Policy{}).Empty() || (Policy{Within: time.Hour}).Empty() {
+		t.Errorf("Empty is wrong")
+	}
+}
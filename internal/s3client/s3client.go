@@ -0,0 +1,527 @@
+package s3client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.uber.org/zap"
+)
+
+// S3Client is an interface for the S3 client, to make it testable(creating mocks)
+type S3Client interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	GetBucketVersioning(ctx context.Context, params *s3.GetBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.GetBucketVersioningOutput, error)
+	ListObjectVersions(ctx context.Context, params *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error)
+
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	UploadPartCopy(ctx context.Context, params *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	ListParts(ctx context.Context, params *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error)
+	ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error)
+}
+
+// Backend is the S3 storage driver, it stores objects in a single bucket
+type Backend struct {
+	client   S3Client
+	bucket   string
+	endpoint string // empty for AWS
+}
+
+// ClientOptions point the client to something else than AWS, like MinIO, Ceph, Backblaze or Wasabi. The zero value talks to AWS.
+type ClientOptions struct {
+	Endpoint           string // e.g. https://minio.lan:9000
+	PathStyle          bool   // bucket in the path (endpoint/bucket/key) instead of the host name, most self hosted stores need this
+	CABundle           string // PEM file with the certificate(s) of the CA which signed the endpoint's certificate
+	InsecureSkipVerify bool   // don't verify the endpoint's certificate at all, for lab setups only
+}
+
+// defaultRegion is used when no region is configured, S3 compatible stores mostly ignore it but requests have to be signed for one
+const defaultRegion = "us-east-1"
+
+// NewClient loads the default AWS configuration (env. variables, ~/.aws/...) and creates an S3 client from it
+func NewClient(ctx context.Context, opts ClientOptions) (*s3.Client, error) {
+	var loadOpts []func(*config.LoadOptions) error
+	if opts.CABundle != "" || opts.InsecureSkipVerify {
+		tlsConfig, err := tlsConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		loadOpts = append(loadOpts, config.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			tr.TLSClientConfig = tlsConfig
+		})))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %v", err)
+	}
+	if cfg.Region == "" && opts.Endpoint != "" {
+		cfg.Region = defaultRegion
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+		o.UsePathStyle = opts.PathStyle
+	}), nil
+}
+
+// tlsConfig trusts the CA bundle on top of the system's CAs
+func tlsConfig(opts ClientOptions) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.CABundle != "" {
+		pem, err := os.ReadFile(opts.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", opts.CABundle)
+		}
+		cfg.RootCAs = pool
+	}
+	if opts.InsecureSkipVerify {
+		customlog.Logger.Warn("TLS certificate verification is disabled, only ever do this in a lab")
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg, nil
+}
+
+// NewBackend creates the S3 driver for bucket. All requests go through the one client created here.
+func NewBackend(ctx context.Context, bucket string, opts ClientOptions) (*Backend, error) {
+	client, err := NewClient(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Endpoint != "" {
+		customlog.Logger.Info("Using custom s3 endpoint",
+			zap.String("endpoint", opts.Endpoint),
+			zap.Bool("path style", opts.PathStyle),
+		)
+	}
+	b := NewBackendWithClient(client, bucket)
+	b.endpoint = opts.Endpoint
+	return b, nil
+}
+
+// NewBackendWithClient creates the S3 driver on top of the given client, e.g. a mock
+func NewBackendWithClient(client S3Client, bucket string) *Backend {
+	return &Backend{client: client, bucket: bucket}
+}
+
+// StoreID tells which bucket of which endpoint the driver talks to
+func (b *Backend) StoreID() string {
+	endpoint := b.endpoint
+	if endpoint == "" {
+		endpoint = "aws"
+	}
+	return "s3:" + endpoint + "/" + b.bucket
+}
+
+// Put uploads body in a single request
+func (b *Backend) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) (storage.ObjectInfo, error) {
+	output, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+		Metadata:      metadata,
+	})
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	return storage.ObjectInfo{Key: key, Size: size, ETag: trimETag(output.ETag), Metadata: metadata, VersionID: aws.ToString(output.VersionId)}, nil
+}
+
+// Get fetches an object
+func (b *Backend) Get(ctx context.Context, key string) (io.ReadCloser, storage.ObjectInfo, error) {
+	return b.get(ctx, key, nil)
+}
+
+// GetVersion fetches a version of an object in a versioned bucket
+func (b *Backend) GetVersion(ctx context.Context, key, versionID string) (io.ReadCloser, storage.ObjectInfo, error) {
+	return b.get(ctx, key, aws.String(versionID))
+}
+
+// get fetches versionID of an object, nil means the current one
+func (b *Backend) get(ctx context.Context, key string, versionID *string) (io.ReadCloser, storage.ObjectInfo, error) {
+	output, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(b.bucket),
+		Key:       aws.String(key),
+		VersionId: versionID,
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, storage.ObjectInfo{}, fmt.Errorf("%s: %w", key, storage.ErrNotFound)
+		}
+		return nil, storage.ObjectInfo{}, err
+	}
+	return output.Body, storage.ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(output.ContentLength),
+		LastModified: aws.ToTime(output.LastModified),
+		ETag:         trimETag(output.ETag),
+		Metadata:     output.Metadata,
+		VersionID:    aws.ToString(output.VersionId),
+	}, nil
+}
+
+// Delete removes a single object, s3 doesn't complain about missing ones
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// List pages through the objects below prefix
+func (b *Backend) List(ctx context.Context, prefix string, fn func(storage.ObjectInfo) error) error {
+	customlog.Logger.Debug("Listing objects from s3 bucket",
+		zap.String("bucket", b.bucket),
+		zap.String("prefix", prefix),
+	)
+
+	listInput := &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	// Run it till there is no more object to fetch from the bucket
+	for {
+		output, err := b.client.ListObjectsV2(ctx, listInput)
+		if err != nil {
+			return fmt.Errorf("error listing objects from s3: %v", err)
+		}
+		for _, object := range output.Contents {
+			if err := fn(storage.ObjectInfo{
+				Key:          aws.ToString(object.Key),
+				Size:         aws.ToInt64(object.Size),
+				LastModified: aws.ToTime(object.LastModified),
+				ETag:         trimETag(object.ETag),
+			}); err != nil {
+				return err
+			}
+		}
+
+		// Check if all of the results were returned
+		if !aws.ToBool(output.IsTruncated) {
+			return nil
+		}
+		// In one go not all the objects are listed, the token picks up where this page ended
+		listInput.ContinuationToken = output.NextContinuationToken
+	}
+}
+
+// Stat looks up an object without fetching it
+func (b *Backend) Stat(ctx context.Context, key string) (storage.ObjectInfo, error) {
+	output, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return storage.ObjectInfo{}, fmt.Errorf("%s: %w", key, storage.ErrNotFound)
+		}
+		return storage.ObjectInfo{}, err
+	}
+	return storage.ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(output.ContentLength),
+		LastModified: aws.ToTime(output.LastModified),
+		ETag:         trimETag(output.ETag),
+		Metadata:     output.Metadata,
+		VersionID:    aws.ToString(output.VersionId),
+	}, nil
+}
+
+// s3 copies objects up to 5 GiB in one request, bigger ones are copied in parts of copyPartSize
+const (
+	maxCopySize  = 5 << 30
+	copyPartSize = 512 << 20
+)
+
+// Copy copies an object within the bucket, s3 does the work without the data passing through here
+func (b *Backend) Copy(ctx context.Context, src, dst string) (storage.ObjectInfo, error) {
+	info, err := b.Stat(ctx, src)
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	if info.Size > maxCopySize {
+		return b.copyMultipart(ctx, info, dst)
+	}
+	output, err := b.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(b.bucket),
+		Key:        aws.String(dst),
+		CopySource: aws.String(b.copySource(src)),
+	})
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	info.Key = dst
+	info.VersionID = aws.ToString(output.VersionId)
+	if output.CopyObjectResult != nil {
+		info.ETag = trimETag(output.CopyObjectResult.ETag)
+		info.LastModified = aws.ToTime(output.CopyObjectResult.LastModified)
+	}
+	return info, nil
+}
+
+// copyMultipart copies an object too big for CopyObject part by part, the metadata is carried over by hand
+func (b *Backend) copyMultipart(ctx context.Context, src storage.ObjectInfo, dst string) (storage.ObjectInfo, error) {
+	uploadID, err := b.CreateMultipart(ctx, dst, src.Metadata)
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	parts := make(map[int32]string)
+	for offset, n := int64(0), int32(1); offset < src.Size; offset, n = offset+copyPartSize, n+1 {
+		end := min(offset+copyPartSize, src.Size) - 1
+		output, err := b.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(b.bucket),
+			Key:             aws.String(dst),
+			UploadId:        aws.String(uploadID),
+			PartNumber:      aws.Int32(n),
+			CopySource:      aws.String(b.copySource(src.Key)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+		})
+		if err != nil {
+			_ = b.AbortMultipart(ctx, dst, uploadID)
+			return storage.ObjectInfo{}, fmt.Errorf("error copying part %d of %s: %v", n, src.Key, err)
+		}
+		if output.CopyPartResult != nil {
+			parts[n] = trimETag(output.CopyPartResult.ETag)
+		}
+	}
+	info, err := b.CompleteMultipart(ctx, dst, uploadID, parts)
+	if err != nil {
+		_ = b.AbortMultipart(ctx, dst, uploadID)
+		return storage.ObjectInfo{}, err
+	}
+	info.Size = src.Size
+	info.Metadata = src.Metadata
+	return info, nil
+}
+
+// copySource is the bucket/key form of the source CopyObject wants, URL encoded (but keeping the slashes)
+func (b *Backend) copySource(key string) string {
+	parts := strings.Split(b.bucket+"/"+key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// CreateMultipart starts a multipart upload
+func (b *Backend) CreateMultipart(ctx context.Context, key string, metadata map[string]string) (string, error) {
+	output, err := b.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(b.bucket),
+		Key:      aws.String(key),
+		Metadata: metadata,
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.UploadId), nil
+}
+
+// UploadPart uploads a single part of a multipart upload
+func (b *Backend) UploadPart(ctx context.Context, key, uploadID string, partNumber int32, body io.Reader, size int64) (string, error) {
+	output, err := b.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           aws.String(key),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    aws.Int32(partNumber),
+		ContentLength: aws.Int64(size),
+		Body:          body,
+	})
+	if err != nil {
+		return "", noSuchUpload(err)
+	}
+	return trimETag(output.ETag), nil
+}
+
+// ListParts returns the parts s3 has for an upload
+func (b *Backend) ListParts(ctx context.Context, key, uploadID string) (map[int32]string, error) {
+	parts := make(map[int32]string)
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(b.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}
+	for {
+		output, err := b.client.ListParts(ctx, input)
+		if err != nil {
+			return nil, noSuchUpload(err)
+		}
+		for _, part := range output.Parts {
+			parts[aws.ToInt32(part.PartNumber)] = trimETag(part.ETag)
+		}
+		if !aws.ToBool(output.IsTruncated) {
+			return parts, nil
+		}
+		input.PartNumberMarker = output.NextPartNumberMarker
+	}
+}
+
+// CompleteMultipart assembles the parts, in part number order as s3 wants them
+func (b *Backend) CompleteMultipart(ctx context.Context, key, uploadID string, parts map[int32]string) (storage.ObjectInfo, error) {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for n, etag := range parts {
+		completed = append(completed, types.CompletedPart{PartNumber: aws.Int32(n), ETag: aws.String(`"` + etag + `"`)})
+	}
+	sort.Slice(completed, func(i, j int) bool { return *completed[i].PartNumber < *completed[j].PartNumber })
+
+	output, err := b.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(b.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return storage.ObjectInfo{}, noSuchUpload(err)
+	}
+	return storage.ObjectInfo{Key: key, ETag: trimETag(output.ETag), VersionID: aws.ToString(output.VersionId)}, nil
+}
+
+// AbortMultipart drops an upload and the parts uploaded so far
+func (b *Backend) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	_, err := b.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(b.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	return noSuchUpload(err)
+}
+
+// ListMultipartUploads pages through the incomplete uploads below prefix
+func (b *Backend) ListMultipartUploads(ctx context.Context, prefix string, fn func(storage.PendingUpload) error) error {
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(prefix),
+	}
+	for {
+		output, err := b.client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return err
+		}
+		for _, upload := range output.Uploads {
+			if err := fn(storage.PendingUpload{
+				Key:       aws.ToString(upload.Key),
+				UploadID:  aws.ToString(upload.UploadId),
+				Initiated: aws.ToTime(upload.Initiated),
+			}); err != nil {
+				return err
+			}
+		}
+		if !aws.ToBool(output.IsTruncated) {
+			return nil
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.UploadIdMarker = output.NextUploadIdMarker
+	}
+}
+
+// Versioning tells if versioning is enabled on the bucket. A suspended versioning keeps the versions made so far, but doesn't add any.
+func (b *Backend) Versioning(ctx context.Context) (bool, error) {
+	output, err := b.client.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{Bucket: aws.String(b.bucket)})
+	if err != nil {
+		return false, fmt.Errorf("error looking up versioning of bucket %s: %v", b.bucket, err)
+	}
+	return output.Status == types.BucketVersioningStatusEnabled, nil
+}
+
+// ListVersions pages through the versions and delete markers of key, newest first
+func (b *Backend) ListVersions(ctx context.Context, key string) ([]storage.ObjectVersion, error) {
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(key),
+	}
+	var versions []storage.ObjectVersion
+	for {
+		output, err := b.client.ListObjectVersions(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		// The prefix also matches longer keys ('a.txt' lists 'a.txt.bak'), only the key itself counts
+		for _, v := range output.Versions {
+			if aws.ToString(v.Key) != key {
+				continue
+			}
+			versions = append(versions, storage.ObjectVersion{
+				Key:          key,
+				VersionID:    aws.ToString(v.VersionId),
+				Size:         aws.ToInt64(v.Size),
+				LastModified: aws.ToTime(v.LastModified),
+				ETag:         trimETag(v.ETag),
+				Latest:       aws.ToBool(v.IsLatest),
+			})
+		}
+		for _, m := range output.DeleteMarkers {
+			if aws.ToString(m.Key) != key {
+				continue
+			}
+			versions = append(versions, storage.ObjectVersion{
+				Key:          key,
+				VersionID:    aws.ToString(m.VersionId),
+				LastModified: aws.ToTime(m.LastModified),
+				Latest:       aws.ToBool(m.IsLatest),
+				DeleteMarker: true,
+			})
+		}
+		if !aws.ToBool(output.IsTruncated) {
+			break
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.VersionIdMarker = output.NextVersionIdMarker
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].Latest != versions[j].Latest {
+			return versions[i].Latest
+		}
+		return versions[i].LastModified.After(versions[j].LastModified)
+	})
+	return versions, nil
+}
+
+// trimETag drops the quotes s3 puts around ETags
+func trimETag(etag *string) string {
+	return strings.Trim(aws.ToString(etag), `"`)
+}
+
+// noSuchUpload turns s3's NoSuchUpload into storage.ErrNoSuchUpload
+func noSuchUpload(err error) error {
+	var notFound *types.NoSuchUpload
+	if errors.As(err, &notFound) {
+		return fmt.Errorf("%v: %w", err, storage.ErrNoSuchUpload)
+	}
+	return err
+}
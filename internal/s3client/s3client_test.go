@@ -0,0 +1,157 @@
+package s3client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/storage"
+)
+
+// testBackend connects to the S3 compatible store named by the CLOUDKEEPER_TEST_S3_* variables, e.g. a local MinIO container:
+//
+//	docker run -d -p 9000:9000 -e MINIO_ROOT_USER=minio -e MINIO_ROOT_PASSWORD=minio123 minio/minio server /data
+//	AWS_ACCESS_KEY_ID=minio AWS_SECRET_ACCESS_KEY=minio123 CLOUDKEEPER_TEST_S3_ENDPOINT=http://localhost:9000 \
+//	CLOUDKEEPER_TEST_S3_BUCKET=cloudkeeper-test go test ./internal/s3client/
+//
+// The bucket has to exist. Without the variables the tests are skipped.
+func testBackend(t *testing.T) *Backend {
+	t.Helper()
+	endpoint, bucket := os.Getenv("CLOUDKEEPER_TEST_S3_ENDPOINT"), os.Getenv("CLOUDKEEPER_TEST_S3_BUCKET")
+	if endpoint == "" || bucket == "" {
+		t.Skip("CLOUDKEEPER_TEST_S3_ENDPOINT/CLOUDKEEPER_TEST_S3_BUCKET not set")
+	}
+	pathStyle := true
+	if v := os.Getenv("CLOUDKEEPER_TEST_S3_PATH_STYLE"); v != "" {
+		pathStyle, _ = strconv.ParseBool(v)
+	}
+	b, err := NewBackend(context.Background(), bucket, ClientOptions{
+		Endpoint:           endpoint,
+		PathStyle:          pathStyle,
+		CABundle:           os.Getenv("CLOUDKEEPER_TEST_S3_CA_BUNDLE"),
+		InsecureSkipVerify: os.Getenv("CLOUDKEEPER_TEST_S3_INSECURE") == "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	b := testBackend(t)
+	ctx := context.Background()
+	dir := "cloudkeeper-test/" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	prefix := dir + "/"
+	t.Cleanup(func() { storage.DeleteTree(ctx, b, dir) })
+
+	content := []byte("hello from cloudkeeper")
+	if _, err := b.Put(ctx, prefix+"small.txt", bytes.NewReader(content), int64(len(content)), map[string]string{"k": "v"}); err != nil {
+		t.Fatal(err)
+	}
+	body, info, err := b.Get(ctx, prefix+"small.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(got, content) || info.Metadata["k"] != "v" {
+		t.Errorf("unexpected object %q %+v", got, info)
+	}
+
+	if copied, err := b.Copy(ctx, prefix+"small.txt", prefix+"copy/small.txt"); err != nil || copied.Metadata["k"] != "v" {
+		t.Errorf("copy: %+v (%v)", copied, err)
+	}
+	if info, err := b.Stat(ctx, prefix+"copy/small.txt"); err != nil || info.Size != int64(len(content)) || info.Metadata["k"] != "v" {
+		t.Errorf("copied object: %+v (%v)", info, err)
+	}
+
+	// Every part but the last one needs at least 5 MB
+	part := bytes.Repeat([]byte("x"), 5<<20)
+	uploadID, err := b.CreateMultipart(ctx, prefix+"big.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := make(map[int32]string)
+	for n := int32(1); n <= 2; n++ {
+		etag, err := b.UploadPart(ctx, prefix+"big.bin", uploadID, n, bytes.NewReader(part), int64(len(part)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[n] = etag
+	}
+	if _, err := b.CompleteMultipart(ctx, prefix+"big.bin", uploadID, parts); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := b.Stat(ctx, prefix+"big.bin"); err != nil || info.Size != 2*int64(len(part)) {
+		t.Errorf("unexpected multipart object %+v: %v", info, err)
+	}
+
+	objects, err := storage.ListAll(ctx, b, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Errorf("want 2 objects, got %d", len(objects))
+	}
+
+	if err := storage.DeleteTree(ctx, b, dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat(ctx, prefix+"small.txt"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("want ErrNotFound after delete, got %v", err)
+	}
+}
+
+// TestVersions needs versioning enabled on the test bucket, e.g. `mc version enable local/cloudkeeper-test`
+func TestVersions(t *testing.T) {
+	b := testBackend(t)
+	ctx := context.Background()
+	if enabled, err := b.Versioning(ctx); err != nil {
+		t.Fatal(err)
+	} else if !enabled {
+		t.Skip("versioning isn't enabled on the test bucket")
+	}
+	key := "cloudkeeper-test/" + strconv.FormatInt(time.Now().UnixNano(), 10) + "/file.txt"
+
+	var ids []string
+	for _, content := range []string{"first", "second"} {
+		info, err := b.Put(ctx, key, bytes.NewReader([]byte(content)), int64(len(content)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.VersionID == "" {
+			t.Fatal("no version ID returned by a versioned bucket")
+		}
+		ids = append(ids, info.VersionID)
+	}
+	// A sibling sharing the key as prefix isn't a version of it
+	if _, err := b.Put(ctx, key+".bak", bytes.NewReader(nil), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := storage.History(ctx, b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || !versions[0].DeleteMarker || !versions[0].Latest || versions[1].VersionID != ids[1] || versions[2].VersionID != ids[0] {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+
+	body, _, err := b.GetVersion(ctx, key, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(body)
+	body.Close()
+	if string(got) != "first" {
+		t.Errorf("want the first version, got %q", got)
+	}
+}
@@ -0,0 +1,356 @@
+package scanner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/db"
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"github.com/Praveen005/CloudKeeper/internal/guard"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+const (
+	// ScanIndexBucket holds what every file looked like at the last scan
+	ScanIndexBucket = "scanIndex"
+	// ScanRootsBucket holds the directories whose baseline was recorded (directory -> time of the baseline scan).
+	// An empty index alone doesn't tell: a directory which is empty, or was emptied, has one too.
+	ScanRootsBucket = "scanRoots"
+
+	indexWriteBatch = 10000 // index updates written per transaction
+)
+
+// FileState is what the scanner remembers about a file.
+// Size, modification time and inode are cheap to compare, the content is only hashed again when one of them changed.
+type FileState struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"` // unix nanoseconds
+	Inode   uint64 `json:"inode"`
+	Hash    string `json:"hash"` // hex sha256 of the content
+}
+
+// Result sums up a scan
+type Result struct {
+	Files    int
+	Hashed   int
+	Created  int
+	Modified int
+	Removed  int
+}
+
+// Run scans the directory of every backup set every `ScanInterval` till the context is cancelled.
+// It stands in for watcher.Watch on filesystems which don't emit events.
+func Run(ctx context.Context) {
+	reloaded := fsconfig.Reloaded()
+	for _, set := range fsconfig.Current().BackupSets() {
+		customlog.Logger.Debug("Scanning the directory periodically",
+			zap.String("set", set.Name),
+			zap.String("directory", set.BackupDir),
+			zap.String("interval", fsconfig.Current().ScanInterval.String()),
+		)
+	}
+
+	// The sets are looked up for every scan, a reloaded configuration is picked up by the next one
+	scan := func() {
+		for _, set := range fsconfig.Current().BackupSets() {
+			scanSet(ctx, set)
+		}
+	}
+
+	scan()
+	ticker := time.NewTicker(fsconfig.Current().ScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			scan()
+		case <-reloaded:
+			// New directories are scanned right away, so their files don't wait for the next tick
+			reloaded = fsconfig.Reloaded()
+			ticker.Reset(fsconfig.Current().ScanInterval)
+			scan()
+		case <-ctx.Done():
+			customlog.Logger.Warn("[Inside scanner.Run] Context cancellation signal received. Shutting down gracefully.")
+			return
+		}
+	}
+}
+
+// scanSet scans the directory of a single backup set and logs how it went
+func scanSet(ctx context.Context, set fsconfig.BackupSet) {
+	result, err := Scan(ctx, set.BackupDir)
+	if err != nil {
+		customlog.Logger.Error("scanning for changes failed", zap.String("set", set.Name), zap.String("error", err.Error()))
+		return
+	}
+	customlog.Logger.Info("Scan finished",
+		zap.String("set", set.Name),
+		zap.Int("files", result.Files),
+		zap.Int("hashed", result.Hashed),
+		zap.Int("created", result.Created),
+		zap.Int("modified", result.Modified),
+		zap.Int("removed", result.Removed),
+	)
+}
+
+// Scan walks root once, compares every file with the index and queues the differences, just like watcher.AddEvent does for events.
+// The very first scan of root only records the baseline: the startup reconciliation takes care of what s3 is missing.
+// Files the backup set of root leaves out are skipped, as if they didn't exist.
+func Scan(ctx context.Context, root string) (Result, error) {
+	var result Result
+	root = filepath.Clean(root)
+	if _, err := os.Stat(root); err != nil {
+		return result, fmt.Errorf("backup directory not accessible: %v", err)
+	}
+	set, ok := fsconfig.Current().SetFor(root)
+	if !ok {
+		set = fsconfig.BackupSet{BackupDir: root}
+	}
+
+	index, err := loadIndex()
+	if err != nil {
+		return result, err
+	}
+	// The index holds the files of every backup set, only those below root are this scan's business
+	for path := range index {
+		if !below(path, []string{root}) {
+			delete(index, path)
+		}
+	}
+	baseline, err := needsBaseline(root, len(index))
+	if err != nil {
+		return result, err
+	}
+
+	updates := make(map[string]*FileState) // nil value means the file is gone
+	flush := func() error {
+		if err := writeIndex(updates); err != nil {
+			return err
+		}
+		updates = make(map[string]*FileState)
+		return nil
+	}
+	emit := func(path, op string) {
+		if !baseline {
+			db.AppendJournal(path, op)
+			guard.Observe(path, op)
+		}
+	}
+
+	var unreadable []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			customlog.Logger.Warn("Skipping unreadable path",
+				zap.String("path", path),
+				zap.String("error", err.Error()),
+			)
+			unreadable = append(unreadable, path)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() && set.Excludes(path) {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() || !set.Includes(path) {
+			return nil
+		}
+		result.Files++
+
+		prev, known := index[path]
+		delete(index, path) // what's left over at the end is gone
+
+		info, err := d.Info()
+		if err != nil {
+			return nil // vanished since it was listed, the next scan sees it removed
+		}
+		state := FileState{
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+			Inode:   inode(info),
+		}
+		if known && state.Size == prev.Size && state.ModTime == prev.ModTime && state.Inode == prev.Inode {
+			return nil
+		}
+
+		state.Hash, err = hashFile(path)
+		if err != nil {
+			customlog.Logger.Warn("Skipping file which can't be hashed",
+				zap.String("path", path),
+				zap.String("error", err.Error()),
+			)
+			if known {
+				index[path] = prev // keep it, so it isn't mistaken for a removal
+			}
+			return nil
+		}
+		result.Hashed++
+
+		switch {
+		case !known:
+			emit(path, db.OpCreate)
+			result.Created++
+		case state.Hash != prev.Hash:
+			emit(path, db.OpWrite)
+			result.Modified++
+		}
+		// Same content, but the metadata moved on (touch, copy back and forth...): just remember the new metadata
+		updates[path] = &state
+		if len(updates) >= indexWriteBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("error walking %s: %v", root, err)
+	}
+
+	for path := range index {
+		if below(path, unreadable) {
+			continue
+		}
+		emit(path, db.OpRemove)
+		updates[path] = nil
+		result.Removed++
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+
+	db.SyncJournal(ctx)
+	if baseline {
+		if err := markBaseline(root); err != nil {
+			return result, err
+		}
+		customlog.Logger.Info("Recorded the baseline index, changes are picked up from the next scan", zap.Int("files", result.Files))
+		result.Created = 0
+	}
+	return result, nil
+}
+
+// needsBaseline tells if root wasn't scanned before. Databases from before ScanRootsBucket have the baseline of a root
+// if its files are in the index (known), it's then recorded for the root.
+func needsBaseline(root string, known int) (bool, error) {
+	var done bool
+	err := db.Conn.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ScanRootsBucket))
+		done = b != nil && b.Get([]byte(root)) != nil
+		return nil
+	})
+	if err != nil || done {
+		return false, err
+	}
+	if known > 0 {
+		return false, markBaseline(root)
+	}
+	return true, nil
+}
+
+// markBaseline records that the baseline of root was taken, every later scan queues what changed
+func markBaseline(root string) error {
+	return db.Conn.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(ScanRootsBucket))
+		if err != nil {
+			return err
+		}
+		at, err := time.Now().UTC().MarshalText()
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(root), at)
+	})
+}
+
+func loadIndex() (map[string]FileState, error) {
+	index := make(map[string]FileState)
+	err := db.Conn.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ScanIndexBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var state FileState
+			if err := json.Unmarshal(v, &state); err != nil {
+				return fmt.Errorf("error reading scan index entry of %s: %v", k, err)
+			}
+			index[string(k)] = state
+			return nil
+		})
+	})
+	return index, err
+}
+
+func writeIndex(updates map[string]*FileState) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	return db.Conn.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(ScanIndexBucket))
+		if err != nil {
+			return err
+		}
+		for path, state := range updates {
+			if state == nil {
+				if err := b.Delete([]byte(path)); err != nil {
+					return err
+				}
+				continue
+			}
+			value, err := json.Marshal(state)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(path), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// inode returns the inode number of the file, or 0 where the platform doesn't tell
+func inode(info fs.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+	return 0
+}
+
+// below tells if path is one of dirs or lives below one of them
+func below(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || (len(path) > len(dir) && path[:len(dir)] == dir && path[len(dir)] == filepath.Separator) {
+			return true
+		}
+	}
+	return false
+}
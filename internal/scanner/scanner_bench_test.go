@@ -0,0 +1,200 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rjeczalik/notify"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/Praveen005/CloudKeeper/internal/db"
+)
+
+// Benchmarks comparing change detection by scanning against inotify events.
+// The trees are generated in a temporary directory, their sizes come from CLOUDKEEPER_BENCH_FILES (default 10000):
+//
+//	go test -run '^$' -bench . -benchtime 3x ./internal/scanner/
+//	CLOUDKEEPER_BENCH_FILES=10000,100000,1000000 go test -run '^$' -bench . -benchtime 1x -timeout 3h ./internal/scanner/
+//
+// Large trees need a raised fs.inotify.max_user_watches for the notify benchmarks (one watch per directory, 100 files per directory).
+
+const (
+	filesPerDir   = 100
+	benchFileSize = 1024
+	changedShare  = 100 // one in this many files is modified per iteration
+)
+
+func benchSizes(b *testing.B) []int {
+	v := os.Getenv("CLOUDKEEPER_BENCH_FILES")
+	if v == "" {
+		return []int{10000}
+	}
+	var sizes []int
+	for _, s := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			b.Fatalf("invalid CLOUDKEEPER_BENCH_FILES %q", v)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes
+}
+
+// generateTree creates n files below root and returns their paths
+func generateTree(b *testing.B, root string, n int) []string {
+	b.Helper()
+	content := make([]byte, benchFileSize)
+	paths := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("d%05d", i/filesPerDir))
+		if i%filesPerDir == 0 {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				b.Fatal(err)
+			}
+		}
+		path := filepath.Join(dir, fmt.Sprintf("f%03d.dat", i%filesPerDir))
+		copy(content, fmt.Sprintf("file %d", i))
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			b.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// modify rewrites every changedShare-th file (shifted by round, so each round touches different ones) and returns them
+func modify(b *testing.B, paths []string, round int) []string {
+	b.Helper()
+	var changed []string
+	for i := round % changedShare; i < len(paths); i += changedShare {
+		if err := os.WriteFile(paths[i], []byte(fmt.Sprintf("round %d", round)), 0644); err != nil {
+			b.Fatal(err)
+		}
+		changed = append(changed, paths[i])
+	}
+	return changed
+}
+
+// clearIndex drops the scan index and the baseline markers, so the next scan is a baseline again and has to hash everything
+func clearIndex() error {
+	return db.Conn.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{ScanIndexBucket, ScanRootsBucket} {
+			if tx.Bucket([]byte(bucket)) == nil {
+				continue
+			}
+			if err := tx.DeleteBucket([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkScan(b *testing.B) {
+	for _, n := range benchSizes(b) {
+		b.Run(fmt.Sprintf("files=%d", n), func(b *testing.B) {
+			openTestDB(b)
+			root := b.TempDir()
+			paths := generateTree(b, root, n)
+			ctx := context.Background()
+
+			b.Run("baseline", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					if err := clearIndex(); err != nil {
+						b.Fatal(err)
+					}
+					b.StartTimer()
+					if _, err := Scan(ctx, root); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run("unchanged", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := Scan(ctx, root); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			round := 0 // keeps growing across the runs of the sub-benchmark, so every round writes new content
+			b.Run("1%-modified", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					round++
+					changed := modify(b, paths, round)
+					b.StartTimer()
+					result, err := Scan(ctx, root)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if result.Modified != len(changed) {
+						b.Fatalf("want %d modified files detected, got %d", len(changed), result.Modified)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkNotify(b *testing.B) {
+	for _, n := range benchSizes(b) {
+		b.Run(fmt.Sprintf("files=%d", n), func(b *testing.B) {
+			openTestDB(b)
+			root := b.TempDir()
+			paths := generateTree(b, root, n)
+
+			round := 0
+			// Setting up the recursive watch is what notify pays instead of a scan
+			b.Run("watch-setup", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					c := make(chan notify.EventInfo, 1)
+					if err := notify.Watch(root+"/...", c, notify.Write); err != nil {
+						b.Fatal(err)
+					}
+					notify.Stop(c)
+				}
+			})
+
+			b.Run("1%-modified", func(b *testing.B) {
+				c := make(chan notify.EventInfo, n)
+				if err := notify.Watch(root+"/...", c, notify.InCreate, notify.Remove, notify.Write, notify.InMovedFrom, notify.InMovedTo); err != nil {
+					b.Fatal(err)
+				}
+				defer notify.Stop(c)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					round++
+					changed := modify(b, paths, round)
+					// Done once every modified file was reported and journaled, just like the watcher does
+					pending := make(map[string]bool, len(changed))
+					for _, p := range changed {
+						pending[p] = true
+					}
+					timeout := time.After(time.Minute)
+					for len(pending) > 0 {
+						select {
+						case ei := <-c:
+							if pending[ei.Path()] {
+								delete(pending, ei.Path())
+								db.AppendJournal(ei.Path(), db.OpWrite)
+							}
+						case <-timeout:
+							b.Fatalf("%d modified files were never reported", len(pending))
+						}
+					}
+					db.SyncJournal(context.Background())
+				}
+			})
+		})
+	}
+}
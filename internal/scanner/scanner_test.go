@@ -0,0 +1,142 @@
+package scanner
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/db"
+)
+
+// openTestDB points the db package to a fresh database and runs the journal writer till the test ends
+func openTestDB(tb testing.TB) {
+	tb.Helper()
+	db.Path = filepath.Join(tb.TempDir(), "test.db")
+	if err := db.Open(); err != nil {
+		tb.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		db.RunJournal(ctx)
+	}()
+	tb.Cleanup(func() {
+		cancel()
+		<-done
+		db.Close()
+	})
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	openTestDB(t)
+	root := t.TempDir()
+	unchanged := filepath.Join(root, "unchanged.txt")
+	touched := filepath.Join(root, "touched.txt")
+	modified := filepath.Join(root, "dir", "modified.txt")
+	removed := filepath.Join(root, "dir", "removed.txt")
+	created := filepath.Join(root, "created.txt")
+
+	writeFile(t, unchanged, "same")
+	writeFile(t, touched, "same")
+	writeFile(t, modified, "before")
+	writeFile(t, removed, "gone soon")
+
+	ctx := context.Background()
+	result, err := Scan(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 4 || result.Created != 0 {
+		t.Fatalf("baseline scan: want 4 files and nothing queued, got %+v", result)
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(touched, later, later); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, modified, "after")
+	if err := os.Chtimes(modified, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, created, "new")
+
+	result, err = Scan(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Created != 1 || result.Modified != 1 || result.Removed != 1 {
+		t.Fatalf("want 1 created, 1 modified, 1 removed, got %+v", result)
+	}
+	if result.Hashed != 3 {
+		t.Errorf("want only the touched, modified and created files hashed, got %d", result.Hashed)
+	}
+
+	if _, err := db.PersistData(); err != nil {
+		t.Fatal(err)
+	}
+	queue, err := db.ReadQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		created:  db.StateNew,
+		modified: db.StateModified,
+		removed:  db.StateDeleted,
+	}
+	if len(queue) != len(want) {
+		t.Errorf("want %d queued paths, got %v", len(want), queue)
+	}
+	for path, state := range want {
+		if queue[path].State != state {
+			t.Errorf("%s: want state %q, got %q", path, state, queue[path].State)
+		}
+	}
+}
+
+func TestScanEmptyRoot(t *testing.T) {
+	openTestDB(t)
+	root := t.TempDir()
+	ctx := context.Background()
+
+	// Nothing there yet: the baseline is empty, but it's taken all the same
+	if _, err := Scan(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(root, "first.txt")
+	writeFile(t, path, "created after the baseline")
+	result, err := Scan(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Created != 1 {
+		t.Fatalf("want the file in the empty directory queued, got %+v", result)
+	}
+
+	// Emptied and filled again, the new file is still picked up
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if result, err = Scan(ctx, root); err != nil || result.Removed != 1 {
+		t.Fatalf("want the removal queued, got %+v %v", result, err)
+	}
+	writeFile(t, filepath.Join(root, "second.txt"), "after emptying")
+	if result, err = Scan(ctx, root); err != nil || result.Created != 1 {
+		t.Fatalf("want the file in the emptied directory queued, got %+v %v", result, err)
+	}
+}
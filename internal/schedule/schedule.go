@@ -0,0 +1,269 @@
+package schedule
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule tells when a backup set is pushed: every interval (counting from the time the previous push was planned for),
+// or at the times of a cron expression like "0 2 * * *" in a given timezone. A random jitter spreads the pushes of many machines,
+// and no push starts within a blackout window: it's put off till the window ends.
+type Schedule struct {
+	interval time.Duration
+	cron     cron.Schedule
+	spec     string
+	location *time.Location
+	jitter   time.Duration
+	blackout []Window
+}
+
+// New returns the schedule of a backup set. With an empty cron expression it runs every interval.
+// timezone is an IANA name like "Europe/Berlin", empty means the local time of the machine.
+func New(interval time.Duration, spec, timezone string, jitter time.Duration, blackout []string) (*Schedule, error) {
+	s := &Schedule{interval: interval, spec: spec, jitter: jitter}
+	var err error
+	if s.location, err = LoadLocation(timezone); err != nil {
+		return nil, err
+	}
+	if spec != "" {
+		if s.cron, err = ParseCron(spec); err != nil {
+			return nil, err
+		}
+	} else if interval <= 0 {
+		return nil, fmt.Errorf("a schedule needs an interval or a cron expression")
+	}
+	if jitter < 0 {
+		return nil, fmt.Errorf("invalid jitter %s, must not be negative", jitter)
+	}
+	if s.blackout, err = ParseWindows(blackout); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ParseCron parses a standard cron expression: minute, hour, day of month, month and day of week ("0 2 * * *"),
+// or a descriptor like "@daily"
+func ParseCron(spec string) (cron.Schedule, error) {
+	if strings.Contains(spec, "TZ=") {
+		return nil, fmt.Errorf("invalid cron expression %q, the timezone is a setting of its own", spec)
+	}
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %v", spec, err)
+	}
+	return schedule, nil
+}
+
+// LoadLocation returns the timezone with the given IANA name, the local one if name is empty
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v", name, err)
+	}
+	return location, nil
+}
+
+// Next returns when the push after the one at (or, at startup, the time) t is due, jitter and blackout windows not taken into account
+func (s *Schedule) Next(t time.Time) time.Time {
+	if s.cron == nil {
+		return t.Add(s.interval)
+	}
+	return s.cron.Next(t.In(s.location))
+}
+
+// Plan returns when the push after t is to start: the next time of the schedule, plus jitter, put off past any blackout window
+func (s *Schedule) Plan(t time.Time) time.Time {
+	return s.Start(s.Next(t))
+}
+
+// Following returns the time of the schedule after the one at prev, which was planned for rather than when the push actually ran,
+// so an interval schedule doesn't drift by the time each push takes to get going. Times which already passed by now are skipped.
+func (s *Schedule) Following(prev, now time.Time) time.Time {
+	next := s.Next(prev)
+	if next.After(now) {
+		return next
+	}
+	if s.cron == nil {
+		return next.Add((now.Sub(next)/s.interval + 1) * s.interval)
+	}
+	return s.Next(now)
+}
+
+// Start returns when the push of the given time of the schedule is to start: plus jitter, put off past any blackout window.
+// The jitter is drawn for every push anew and doesn't carry over to the next one, those count from the time of the schedule.
+func (s *Schedule) Start(at time.Time) time.Time {
+	if s.jitter > 0 {
+		at = at.Add(time.Duration(rand.Int63n(int64(s.jitter))))
+	}
+	return s.Defer(at)
+}
+
+// Missed tells if a push was due between the last successful one and now, e.g. while the daemon wasn't running
+func (s *Schedule) Missed(last, now time.Time) bool {
+	return !s.Next(last).After(now)
+}
+
+// Defer returns t, or the end of the blackout window t falls in. Windows which follow each other are skipped all at once.
+func (s *Schedule) Defer(t time.Time) time.Time {
+	// Every window ends at least a minute later, so this doesn't go round forever, not even with windows covering the whole week
+	for i := 0; i < 7*24*60; i++ {
+		end, ok := s.Blackout(t)
+		if !ok {
+			return t
+		}
+		t = end
+	}
+	return t
+}
+
+// Blackout tells if t falls within a blackout window, and when the window ends
+func (s *Schedule) Blackout(t time.Time) (time.Time, bool) {
+	local := t.In(s.location)
+	for _, w := range s.blackout {
+		if end, ok := w.endsAt(local); ok {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// String describes the schedule for logs and `cloudkeeper status`
+func (s *Schedule) String() string {
+	var desc string
+	if s.cron == nil {
+		desc = "every " + s.interval.String()
+	} else {
+		desc = s.spec
+		if s.location != time.Local {
+			desc += " " + s.location.String()
+		}
+	}
+	if s.jitter > 0 {
+		desc += ", jitter " + s.jitter.String()
+	}
+	for _, w := range s.blackout {
+		desc += ", not " + w.String()
+	}
+	return desc
+}
+
+// Window is a time of day during which nothing is pushed, on some days of the week. It may go past midnight ("22:00-06:00"),
+// it then ends on the next day.
+type Window struct {
+	days       [7]bool // by time.Weekday, the day the window starts on
+	start, end int     // minutes since midnight
+	text       string
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseWindows parses blackout windows like "08:00-18:00" (every day), "mon-fri 08:00-18:00" or "sat 22:00-06:00"
+func ParseWindows(windows []string) ([]Window, error) {
+	var parsed []Window
+	for _, text := range windows {
+		w, err := parseWindow(strings.TrimSpace(text))
+		if err != nil {
+			return nil, fmt.Errorf("invalid blackout window %q: %v", text, err)
+		}
+		parsed = append(parsed, w)
+	}
+	return parsed, nil
+}
+
+func parseWindow(text string) (Window, error) {
+	w := Window{text: text}
+	fields := strings.Fields(text)
+	switch len(fields) {
+	case 1:
+		for day := range w.days {
+			w.days[day] = true
+		}
+	case 2:
+		first, last, isRange := strings.Cut(strings.ToLower(fields[0]), "-")
+		from, ok := weekdays[first]
+		if !ok {
+			return w, fmt.Errorf("unknown day %q, use mon, tue, ... sun", first)
+		}
+		to := from
+		if isRange {
+			if to, ok = weekdays[last]; !ok {
+				return w, fmt.Errorf("unknown day %q, use mon, tue, ... sun", last)
+			}
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == to {
+				break
+			}
+		}
+		fields = fields[1:]
+	default:
+		return w, fmt.Errorf("want [days] HH:MM-HH:MM")
+	}
+
+	start, end, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return w, fmt.Errorf("want [days] HH:MM-HH:MM")
+	}
+	var err error
+	if w.start, err = parseClock(start); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(end); err != nil {
+		return w, err
+	}
+	if w.start == w.end || w.start == 24*60 {
+		return w, fmt.Errorf("the window is empty")
+	}
+	return w, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight, "24:00" is the end of the day
+func parseClock(clock string) (int, error) {
+	h, m, ok := strings.Cut(clock, ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", clock)
+	}
+	return hours*60 + minutes, nil
+}
+
+// endsAt returns when the window t falls in ends, ok is false if t isn't within the window
+func (w Window) endsAt(t time.Time) (time.Time, bool) {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	at := func(daysLater, minutes int) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day()+daysLater, minutes/60, minutes%60, 0, 0, t.Location())
+	}
+	if w.start < w.end {
+		if w.days[day] && minute >= w.start && minute < w.end {
+			return at(0, w.end), true
+		}
+		return time.Time{}, false
+	}
+	// Past midnight: the evening part belongs to the day the window starts on, the morning part to the day before
+	if w.days[day] && minute >= w.start {
+		return at(1, w.end), true
+	}
+	if w.days[(day+6)%7] && minute < w.end {
+		return at(0, w.end), true
+	}
+	return time.Time{}, false
+}
+
+// String returns the window as it was written
+func (w Window) String() string {
+	return w.text
+}
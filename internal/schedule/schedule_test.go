@@ -0,0 +1,141 @@
+package schedule
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustNew(t *testing.T, interval time.Duration, spec, timezone string, jitter time.Duration, blackout ...string) *Schedule {
+	t.Helper()
+	s, err := New(interval, spec, timezone, jitter, blackout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCron(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no timezone database:", err)
+	}
+	s := mustNew(t, 0, "0 2 * * *", "Europe/Berlin", 0)
+
+	// 2026-10-17 is a Saturday, 03:00 in Berlin is past today's run
+	now := time.Date(2026, 10, 17, 3, 0, 0, 0, berlin)
+	want := time.Date(2026, 10, 18, 2, 0, 0, 0, berlin)
+	if got := s.Plan(now); !got.Equal(want) {
+		t.Errorf("want the next run at %s, got %s", want, got)
+	}
+	if got := s.Next(now.UTC()); !got.Equal(want) {
+		t.Errorf("want the timezone of the schedule, not the one of the time, got %s", got)
+	}
+	if !strings.Contains(s.String(), "Europe/Berlin") {
+		t.Errorf("unexpected description %s", s)
+	}
+
+	// Missed: the last push was the day before yesterday
+	if !s.Missed(time.Date(2026, 10, 15, 2, 0, 5, 0, berlin), now) {
+		t.Errorf("want the push of 2026-10-17 02:00 missed")
+	}
+	if s.Missed(time.Date(2026, 10, 17, 2, 0, 5, 0, berlin), now) {
+		t.Errorf("want nothing missed after today's push")
+	}
+
+	// Every interval, counting from the last push
+	s = mustNew(t, 6*time.Hour, "", "", 0)
+	if got := s.Next(now); !got.Equal(now.Add(6 * time.Hour)) {
+		t.Errorf("want the next run in 6h, got %s", got)
+	}
+	if !s.Missed(now.Add(-7*time.Hour), now) || s.Missed(now.Add(-5*time.Hour), now) {
+		t.Errorf("unexpected missed runs of an interval schedule")
+	}
+}
+
+func TestFollowing(t *testing.T) {
+	start := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	s := mustNew(t, time.Hour, "", "UTC", 10*time.Minute)
+
+	// Pushes which start late, with jitter, don't move the times of the schedule
+	slot := start
+	for i := 1; i <= 24; i++ {
+		pushed := s.Start(slot).Add(3 * time.Minute)
+		slot = s.Following(slot, pushed)
+		if want := start.Add(time.Duration(i) * time.Hour); !slot.Equal(want) {
+			t.Fatalf("push %d: want %s, got %s", i, want, slot)
+		}
+		if at := s.Start(slot); at.Before(slot) || !at.Before(slot.Add(10*time.Minute)) {
+			t.Fatalf("push %d: want the start within the jitter of %s, got %s", i, slot, at)
+		}
+	}
+
+	// Times which passed while a push took long are skipped, the schedule stays on the hour
+	if got, want := s.Following(start, start.Add(150*time.Minute)), start.Add(3*time.Hour); !got.Equal(want) {
+		t.Errorf("want %s after a long push, got %s", want, got)
+	}
+	c := mustNew(t, 0, "0 * * * *", "UTC", 0)
+	if got, want := c.Following(start, start.Add(150*time.Minute)), start.Add(3*time.Hour); !got.Equal(want) {
+		t.Errorf("want %s after a long push, got %s", want, got)
+	}
+}
+
+func TestBlackout(t *testing.T) {
+	utc := func(day, hour, minute int) time.Time { return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC) }
+	// 2026-10-16 is a Friday
+	s := mustNew(t, time.Hour, "", "UTC", 0, "mon-fri 08:00-18:00", "sat 22:00-06:00", "12:00-13:00", "fri 18:00-19:00")
+
+	for _, tc := range []struct {
+		name string
+		at   time.Time
+		want time.Time
+	}{
+		{"before office hours", utc(16, 7, 59), utc(16, 7, 59)},
+		{"office hours, then the friday evening window right after", utc(16, 9, 0), utc(16, 19, 0)},
+		{"saturday noon", utc(17, 12, 30), utc(17, 13, 0)},
+		{"saturday night, past midnight", utc(17, 23, 0), utc(18, 6, 0)},
+		{"sunday morning belongs to saturday's window", utc(18, 3, 0), utc(18, 6, 0)},
+		{"monday morning isn't blacked out by sunday", utc(19, 3, 0), utc(19, 3, 0)},
+	} {
+		if got := s.Defer(tc.at); !got.Equal(tc.want) {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+
+	// Jitter never lands in a window
+	s = mustNew(t, 0, "0 7 * * *", "UTC", 2*time.Hour, "08:00-09:00")
+	for i := 0; i < 100; i++ {
+		got := s.Plan(utc(16, 6, 0))
+		if got.Before(utc(16, 7, 0)) || got.After(utc(16, 9, 0)) {
+			t.Fatalf("want a run between 07:00 and 09:00, got %s", got)
+		}
+		if _, ok := s.Blackout(got); ok {
+			t.Fatalf("want no run within the blackout window, got %s", got)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		spec, timezone string
+		blackout       string
+		want           string
+	}{
+		{"0 2 * *", "", "", "invalid cron expression"},
+		{"CRON_TZ=UTC 0 2 * * *", "", "", "timezone is a setting"},
+		{"0 2 * * *", "Mars/Olympus", "", "invalid timezone"},
+		{"", "", "", "needs an interval"},
+		{"@daily", "", "mon-frx 08:00-18:00", "unknown day"},
+		{"@daily", "", "8-18", "invalid time of day"},
+		{"@daily", "", "08:00-08:00", "empty"},
+		{"@daily", "", "25:00-26:00", "invalid time of day"},
+	} {
+		var blackout []string
+		if tc.blackout != "" {
+			blackout = []string{tc.blackout}
+		}
+		if _, err := New(0, tc.spec, tc.timezone, 0, blackout); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q %q %q: want an error about %q, got %v", tc.spec, tc.timezone, tc.blackout, tc.want, err)
+		}
+	}
+}
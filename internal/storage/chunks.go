@@ -0,0 +1,426 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/db"
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"go.uber.org/zap"
+)
+
+const (
+	// MetaLayout is the metadata entry marking objects which are chunk manifests rather than file contents
+	MetaLayout = "cloudkeeper-layout"
+
+	// InternalDir holds what CloudKeeper keeps next to the backed up files (chunks, ...), below the prefix.
+	// It's never encrypted, and a backed up directory of that name is left out (see fsconfig.ReservedDir), so the two can't clash.
+	InternalDir = fsconfig.ReservedDir
+
+	// Chunk boundaries are where the rolling hash has chunkBits zero bits, which happens every 1 MiB on average.
+	// Chunks are at least minChunk and at most maxChunk long, so pathological content doesn't end up in tiny or huge chunks.
+	minChunk  = 256 << 10
+	maxChunk  = 4 << 20
+	chunkBits = 20
+	chunkMask = 1<<chunkBits - 1
+
+	manifestVersion = 1
+
+	// DefaultGCGrace is how long unreferenced chunks are kept by default, they may belong to a file which is being uploaded
+	DefaultGCGrace = 24 * time.Hour
+)
+
+// Layout is how files are stored, fsconfig.LayoutFiles or fsconfig.LayoutChunks
+var Layout = fsconfig.LayoutFiles
+
+// ChunkID names a chunk after its content. It's replaced with a keyed hash when files are encrypted (see crypt.Key.ChunkID).
+var ChunkID = func(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Manifest is what's stored under the key of a file in the chunked layout: the chunks making up its content, in order
+type Manifest struct {
+	Version     int             `json:"version"`
+	Size        int64           `json:"size"`
+	ChunkPrefix string          `json:"chunkPrefix"` // where the chunks live, so a manifest can be restored on its own
+	Chunks      []ManifestChunk `json:"chunks"`
+}
+
+// ManifestChunk is one chunk of a file, Size is the size before compression/encryption.
+// It's the same thing the object index keeps for every file, so snapshots can be built from the index.
+type ManifestChunk = db.ChunkRef
+
+// InternalPrefix is where CloudKeeper's own objects live below prefix
+func InternalPrefix(prefix string) string {
+	return ListPrefix(prefix) + InternalDir + "/"
+}
+
+// ChunkPrefix is where the chunks of the deduplicated layout live below prefix
+func ChunkPrefix(prefix string) string {
+	return InternalPrefix(prefix) + "chunks/"
+}
+
+// chunkKey spreads the chunks over 256 "directories", which keeps the local backend's directories at a sane size
+func chunkKey(chunkPrefix, id string) string {
+	return chunkPrefix + id[:2] + "/" + id
+}
+
+// gear maps every byte to a random looking 64 bit value for the rolling hash. It has to be the same everywhere and
+// forever (otherwise the same content would be cut differently and not deduplicated), so it's generated from a fixed seed.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x436c6f75644b6565) // "CloudKee"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// splitChunks cuts r into content-defined chunks (a gear hash, as in FastCDC) and calls fn with each of them.
+// Boundaries only depend on the last 64 bytes read, so inserting or removing data in a file only changes the chunks around the edit.
+// The slice handed to fn is reused for the next chunk.
+func splitChunks(r io.Reader, fn func(chunk []byte) error) error {
+	// Room for two chunks: the buffer is only refilled once less than a whole chunk is left, which keeps the copying down
+	buf := make([]byte, 2*maxChunk)
+	var start, end int
+	eof := false
+	for {
+		if !eof && end-start < maxChunk {
+			end = copy(buf, buf[start:end])
+			start = 0
+			n, err := io.ReadFull(r, buf[end:])
+			end += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if start == end {
+			return nil
+		}
+		data := buf[start:end]
+		if len(data) > maxChunk {
+			data = data[:maxChunk]
+		}
+		n := cutChunk(data)
+		if err := fn(data[:n]); err != nil {
+			return err
+		}
+		start += n
+	}
+}
+
+// cutChunk returns the length of the chunk data starts with: up to the first boundary past minChunk, all of data if there's none
+func cutChunk(data []byte) int {
+	if len(data) <= minChunk {
+		return len(data)
+	}
+	// The hash only remembers the last 64 bytes, there's no need to run it over the start of the chunk
+	var hash uint64
+	for i := minChunk - 64; i < len(data); i++ {
+		hash = hash<<1 + gear[data[i]]
+		if i+1 >= minChunk && hash&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// uploadChunked stores file in the chunked layout: the chunks the backend doesn't have yet are uploaded (several at a time),
+// then the manifest listing them is stored under key. It returns what was stored under key, and the manifest.
+func uploadChunked(ctx context.Context, b Backend, file *os.File, prefix, key string) (ObjectInfo, *Manifest, error) {
+	manifest := Manifest{Version: manifestVersion, ChunkPrefix: ChunkPrefix(prefix), Chunks: []ManifestChunk{}}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type job struct {
+		id   string
+		data []byte
+	}
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var uploadErr error
+	var mu sync.Mutex
+	stored := make(map[string]int64) // keys of the chunks uploaded (or found in the backend), to be recorded in the database
+	var reused int
+
+	concurrency := fsconfig.FromContext(ctx).MultipartConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				size, uploaded, err := putChunk(ctx, b, manifest.ChunkPrefix, j.id, file.Name(), j.data)
+				if err != nil {
+					once.Do(func() {
+						uploadErr = fmt.Errorf("error uploading chunk %s of %s: %v", j.id, file.Name(), err)
+						cancel()
+					})
+					continue
+				}
+				mu.Lock()
+				stored[chunkKey(manifest.ChunkPrefix, j.id)] = size
+				if !uploaded {
+					reused++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	store := StoreID(b)
+	seen := make(map[string]bool)
+	err := splitChunks(file, func(chunk []byte) (err error) {
+		id := ChunkID(chunk)
+		manifest.Chunks = append(manifest.Chunks, ManifestChunk{ID: id, Size: int64(len(chunk))})
+		manifest.Size += int64(len(chunk))
+		if seen[id] {
+			return nil
+		}
+		seen[id] = true
+
+		// A backend which can't tell which store it is gets every chunk looked up
+		known := false
+		if store != "" {
+			if known, err = db.HasChunk(store, chunkKey(manifest.ChunkPrefix, id)); err != nil {
+				return err
+			}
+		}
+		if known {
+			mu.Lock()
+			reused++
+			mu.Unlock()
+			return nil
+		}
+		select {
+		case jobs <- job{id: id, data: append([]byte(nil), chunk...)}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(jobs)
+	wg.Wait()
+	if uploadErr != nil {
+		return ObjectInfo{}, nil, uploadErr
+	}
+	if err != nil {
+		return ObjectInfo{}, nil, fmt.Errorf("error reading %s: %v", file.Name(), err)
+	}
+
+	// Recorded before the manifest is stored: a chunk which is in the backend but not in the database only costs a Stat
+	if store == "" {
+		stored = nil
+	}
+	if err := db.PutChunks(store, stored); err != nil {
+		return ObjectInfo{}, nil, fmt.Errorf("error recording uploaded chunks: %v", err)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+	object, err := putTransformed(ctx, b, key, file.Name(), data, map[string]string{MetaLayout: fsconfig.LayoutChunks})
+	if err != nil {
+		return ObjectInfo{}, nil, fmt.Errorf("error storing the manifest of %s: %v", file.Name(), err)
+	}
+	customlog.Logger.Debug("Chunked file stored",
+		zap.String("key", key),
+		zap.Int("chunks", len(manifest.Chunks)),
+		zap.Int("unique", len(seen)),
+		zap.Int("already stored", reused),
+	)
+	return object, &manifest, nil
+}
+
+// putChunk uploads a chunk unless the backend has it already (uploaded by an earlier run whose database update got lost, say).
+// It returns the stored size of the chunk and whether it was uploaded.
+func putChunk(ctx context.Context, b Backend, chunkPrefix, id, path string, data []byte) (int64, bool, error) {
+	key := chunkKey(chunkPrefix, id)
+	info, err := b.Stat(ctx, key)
+	if err == nil {
+		return info.Size, false, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return 0, false, err
+	}
+	info, err = putTransformed(ctx, b, key, path, data, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	return info.Size, true, nil
+}
+
+// isManifest tells if the object is a chunk manifest rather than the content of a file
+func isManifest(metadata map[string]string) bool {
+	return metadata[MetaLayout] == fsconfig.LayoutChunks
+}
+
+// parseManifest decodes a manifest (transforms already undone)
+func parseManifest(r io.Reader) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid chunk manifest: %v", err)
+	}
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported chunk manifest version %d", manifest.Version)
+	}
+	return &manifest, nil
+}
+
+// readManifest fetches and decodes the manifest stored under key
+func readManifest(ctx context.Context, b Backend, key string) (*Manifest, error) {
+	data, _, err := getDecoded(ctx, b, key)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(bytes.NewReader(data))
+}
+
+// writeChunks writes the content of a chunked file to dst, checking every chunk against its ID on the way
+func writeChunks(ctx context.Context, b Backend, manifest *Manifest, dst io.Writer) error {
+	var written int64
+	for _, chunk := range manifest.Chunks {
+		data, _, err := getDecoded(ctx, b, chunkKey(manifest.ChunkPrefix, chunk.ID))
+		if err != nil {
+			return fmt.Errorf("error fetching chunk %s: %w", chunk.ID, err)
+		}
+		if int64(len(data)) != chunk.Size || ChunkID(data) != chunk.ID {
+			return fmt.Errorf("chunk %s is corrupted", chunk.ID)
+		}
+		if _, err := dst.Write(data); err != nil {
+			return err
+		}
+		written += chunk.Size
+	}
+	if written != manifest.Size {
+		return fmt.Errorf("chunks add up to %d bytes, expected %d", written, manifest.Size)
+	}
+	return nil
+}
+
+// GCResult sums up a garbage collection run
+type GCResult struct {
+	Manifests    int   `json:"manifests"`
+	Snapshots    int   `json:"snapshots"`
+	Chunks       int   `json:"chunks"`
+	Referenced   int   `json:"referenced"`
+	Deleted      int   `json:"deleted"`
+	DeletedBytes int64 `json:"deletedBytes"`
+	TooRecent    int   `json:"tooRecent"` // unreferenced, but younger than the grace period
+
+	DeletedKeys []string `json:"deletedKeys,omitempty"` // the chunks which were (or in a dry run, would be) deleted
+}
+
+// GCOptions controls a garbage collection run
+type GCOptions struct {
+	Grace         time.Duration   // chunks younger than this are kept even if unreferenced
+	DryRun        bool            // only report what would be deleted
+	DropSnapshots map[string]bool // IDs of snapshots to disregard, as if they had been deleted already (dry runs of prune)
+}
+
+// GarbageCollect deletes the chunks below prefix which neither a manifest (of a file, or one in the trash) nor a snapshot refers to anymore.
+// Chunks younger than grace are left alone: a file being uploaded right now may have stored its chunks but not its manifest yet.
+// Any manifest or snapshot that can't be read stops the run, deleting chunks it might refer to would lose data.
+func GarbageCollect(ctx context.Context, b Backend, prefix string, opts GCOptions) (GCResult, error) {
+	var result GCResult
+
+	objects, err := ListAll(ctx, b, ListPrefix(prefix))
+	if err != nil {
+		return result, fmt.Errorf("error listing objects: %v", err)
+	}
+
+	internal := InternalPrefix(prefix)
+	chunkPrefix := ChunkPrefix(prefix)
+	trashPrefix := TrashPrefix(prefix)
+	referenced := make(map[string]bool)
+	var chunks []ObjectInfo
+	for _, object := range objects {
+		if strings.HasPrefix(object.Key, chunkPrefix) {
+			chunks = append(chunks, object)
+			continue
+		}
+		// Files in the trash can still be restored, their chunks are as good as referenced
+		if strings.HasPrefix(object.Key, internal) && !strings.HasPrefix(object.Key, trashPrefix) {
+			continue
+		}
+		// Listing doesn't return the metadata, only manifests are worth fetching
+		info, err := b.Stat(ctx, object.Key)
+		if errors.Is(err, ErrNotFound) {
+			continue // deleted meanwhile
+		}
+		if err != nil {
+			return result, fmt.Errorf("error looking up %s: %v", object.Key, err)
+		}
+		if !isManifest(info.Metadata) {
+			continue
+		}
+		manifest, err := readManifest(ctx, b, object.Key)
+		if err != nil {
+			return result, fmt.Errorf("error reading manifest %s: %w", object.Key, err)
+		}
+		result.Manifests++
+		for _, chunk := range manifest.Chunks {
+			referenced[chunk.ID] = true
+		}
+	}
+	// Files which were deleted or changed since may still be restored from a snapshot
+	if result.Snapshots, err = snapshotReferences(ctx, b, prefix, opts.DropSnapshots, referenced); err != nil {
+		return result, fmt.Errorf("error reading snapshots: %w", err)
+	}
+	result.Chunks = len(chunks)
+	result.Referenced = len(referenced)
+
+	cutoff := time.Now().Add(-opts.Grace)
+	var deleted []string
+	for _, chunk := range chunks {
+		id := path.Base(chunk.Key)
+		if referenced[id] {
+			continue
+		}
+		if chunk.LastModified.After(cutoff) {
+			result.TooRecent++
+			continue
+		}
+		if !opts.DryRun {
+			if err := b.Delete(ctx, chunk.Key); err != nil {
+				// Forget what's gone so far, they'd be skipped as already stored otherwise
+				if dbErr := db.DeleteChunks(StoreID(b), deleted); dbErr != nil {
+					customlog.Logger.Error("error forgetting deleted chunks", zap.String("error", dbErr.Error()))
+				}
+				return result, fmt.Errorf("error deleting chunk %s: %v", chunk.Key, err)
+			}
+			deleted = append(deleted, chunk.Key)
+		}
+		result.Deleted++
+		result.DeletedBytes += chunk.Size
+		result.DeletedKeys = append(result.DeletedKeys, chunk.Key)
+	}
+	if err := db.DeleteChunks(StoreID(b), deleted); err != nil {
+		return result, fmt.Errorf("error forgetting deleted chunks: %v", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func chunkIDs(t *testing.T, data []byte) []string {
+	t.Helper()
+	var ids []string
+	err := splitChunks(bytes.NewReader(data), func(chunk []byte) error {
+		if len(chunk) > maxChunk {
+			t.Errorf("chunk of %d bytes, max is %d", len(chunk), maxChunk)
+		}
+		ids = append(ids, ChunkID(chunk))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestSplitChunks(t *testing.T) {
+	data := make([]byte, 16<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	ids := chunkIDs(t, data)
+	if len(ids) < 4 || len(ids) > 64 {
+		t.Errorf("want about 16 chunks of 1 MiB on average, got %d", len(ids))
+	}
+
+	// Inserting data only changes the chunks around the insertion, the boundaries after it shift along
+	edited := append(append(append([]byte(nil), data[:5<<20]...), []byte("inserted")...), data[5<<20:]...)
+	before := make(map[string]bool)
+	for _, id := range ids {
+		before[id] = true
+	}
+	var changed int
+	for _, id := range chunkIDs(t, edited) {
+		if !before[id] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 2 {
+		t.Errorf("want 1 or 2 chunks changed by the insertion, got %d", changed)
+	}
+
+	if got := chunkIDs(t, nil); len(got) != 0 {
+		t.Errorf("want no chunks for empty input, got %d", len(got))
+	}
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"go.uber.org/zap"
+)
+
+// Download fetches a single object and writes it to dest.
+// The object is first written to a temporary file next to dest and then renamed, so a failed download never leaves a half written file behind.
+func Download(ctx context.Context, b Backend, key, dest string) error {
+	body, info, err := b.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("error fetching object %s: %v", key, err)
+	}
+	defer body.Close()
+	return download(ctx, b, key, body, info, dest)
+}
+
+// download writes the object stored under key, read from body, to dest. info describes the object.
+func download(ctx context.Context, b Backend, key string, body io.Reader, info ObjectInfo, dest string) error {
+	// Undo encryption and friends before anything is written, so a wrong key doesn't leave files behind
+	content, err := decode(body, info.Metadata)
+	if err != nil {
+		return fmt.Errorf("error restoring %s: %w", key, err)
+	}
+	// In the chunked layout, what's stored under the key is the list of chunks making up the file
+	var manifest *Manifest
+	if isManifest(info.Metadata) {
+		if manifest, err = parseManifest(content); err != nil {
+			return fmt.Errorf("error restoring %s: %v", key, err)
+		}
+	}
+
+	// Keep the modification time of the backed up copy, it's the closest thing we have to the original one
+	err = writeFile(dest, info.LastModified, 0, func(w io.Writer) error {
+		if manifest != nil {
+			return writeChunks(ctx, b, manifest, w)
+		}
+		_, err := io.Copy(w, content)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	customlog.Logger.Debug("File downloaded",
+		zap.String("key", key),
+		zap.String("file", dest),
+	)
+	return nil
+}
+
+// writeFile creates dest with what write writes, through a temporary file which is renamed once everything was written.
+// The modification time and permissions are set if they're known (not zero).
+func writeFile(dest string, modTime time.Time, mode os.FileMode, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", dest, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".cloudkeeper-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %v", dest, err)
+	}
+	// If anything goes wrong below, get rid of the temporary file. After a successful rename this is a no-op.
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing %s: %w", dest, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing %s: %v", dest, err)
+	}
+	if mode != 0 {
+		if err := os.Chmod(tmp.Name(), mode.Perm()); err != nil {
+			return fmt.Errorf("failed to set permissions of %s: %v", dest, err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return fmt.Errorf("failed to move downloaded file into place: %v", err)
+	}
+
+	if !modTime.IsZero() {
+		_ = os.Chtimes(dest, modTime, modTime)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"go.uber.org/zap"
+)
+
+// NameCipher encrypts single file and directory names, see crypt.NameKey
+type NameCipher interface {
+	EncryptName(name string) string
+	DecryptName(encrypted string) (string, error)
+}
+
+// Names hides the file and directory names in object keys when set. Only the part below the prefix is encrypted,
+// component by component, so the key of a directory is still a prefix of the keys of everything in it.
+var Names NameCipher
+
+// Key builds the object key of a path relative to the backed up directory
+func Key(prefix, relativePath string) string {
+	if Names != nil && relativePath != "" && relativePath != "." {
+		parts := strings.Split(filepath.ToSlash(relativePath), "/")
+		for i, part := range parts {
+			parts[i] = Names.EncryptName(part)
+		}
+		relativePath = filepath.FromSlash(strings.Join(parts, "/"))
+	}
+	return strings.ReplaceAll(filepath.Join(prefix, relativePath), "\\", "/") // Ensure forward slashes for S3 keys
+}
+
+// ObjectKey maps a file below the backup directory to its s3 key, e.g. with the prefix 's3folder/':
+//
+//	'/home/praveen/fsnotifyTest/sample21/folder1/files34.txt' -> 's3folder/sample21/folder1/files34.txt'
+//
+// The directory and the prefix are those of the backup set the file belongs to, in the configuration ctx carries.
+func ObjectKey(ctx context.Context, path string) (string, error) {
+	set, ok := fsconfig.FromContext(ctx).SetFor(path)
+	if !ok {
+		return "", fmt.Errorf("%s is not below any backed up directory", path)
+	}
+	relativePath, err := filepath.Rel(set.BackupDir, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to get relative path : %v", err)
+	}
+	return Key(set.S3Prefix, relativePath), nil
+}
+
+// RelativePath turns an s3 key back into a path relative to the backed up directory, it's the reverse of ObjectKey.
+// It reports false for keys that don't live below the prefix or would escape the backed up directory, for CloudKeeper's internal objects
+// and for names which can't be decrypted.
+func RelativePath(prefix, key string) (string, bool) {
+	relativePath, err := filepath.Rel(filepath.Join(prefix), filepath.FromSlash(key))
+	if err != nil || relativePath == "." || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	// CloudKeeper's own objects (chunks, ...) aren't backed up files
+	if first, _, _ := strings.Cut(filepath.ToSlash(relativePath), "/"); first == InternalDir {
+		return "", false
+	}
+	if Names == nil {
+		return relativePath, true
+	}
+
+	parts := strings.Split(filepath.ToSlash(relativePath), "/")
+	for i, part := range parts {
+		if parts[i], err = Names.DecryptName(part); err != nil {
+			customlog.Logger.Warn("Skipping object whose name can't be decrypted",
+				zap.String("key", key),
+				zap.String("error", err.Error()),
+			)
+			return "", false
+		}
+		// A decrypted name must still be a single, harmless path component
+		if parts[i] == "" || parts[i] == "." || parts[i] == ".." || strings.ContainsAny(parts[i], "/\\") {
+			return "", false
+		}
+	}
+	return filepath.Join(parts...), true
+}
+
+// ListPrefix is the prefix to list everything backed up under prefix.
+// Keys are built with filepath.Join, which drops a trailing slash from the prefix, so 'backup' and 'backup/' both list 'backup/...' but not 'backup-old/...'
+func ListPrefix(prefix string) string {
+	p := filepath.ToSlash(filepath.Clean(prefix))
+	if p == "." || p == "/" {
+		return ""
+	}
+	return p + "/"
+}
@@ -0,0 +1,528 @@
+// Package local is the storage driver for a plain directory, e.g. an external disk or a NAS mount.
+// Objects are regular files below the root, so the backup can be browsed (and copied back) without cloudkeeper.
+package local
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/storage"
+)
+
+// internalDir holds what isn't an object: metadata and the parts of unfinished multipart uploads. List never reports anything below it.
+const internalDir = ".cloudkeeper-local"
+
+// Backend stores objects as files below root
+type Backend struct {
+	root string
+}
+
+// upload is what's recorded about a multipart upload in its staging directory
+type upload struct {
+	Key       string            `json:"key"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Initiated time.Time         `json:"initiated"`
+}
+
+// New creates the driver for root, which has to exist already: a missing root most likely is a disk that isn't mounted,
+// creating it would quietly fill up the disk the mount point lives on
+func New(root string) (*Backend, error) {
+	root = filepath.Clean(root)
+	// The store is identified by its directory, which mustn't depend on where we were started from
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("backend directory not accessible: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("backend directory %s is not a directory", root)
+	}
+	for _, dir := range []string{"meta", "uploads"} {
+		if err := os.MkdirAll(filepath.Join(root, internalDir, dir), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &Backend{root: root}, nil
+}
+
+// StoreID tells which directory the driver stores the objects in
+func (b *Backend) StoreID() string {
+	return "local:" + b.root
+}
+
+// Put writes body to a temporary file and renames it into place, readers never see half written objects
+func (b *Backend) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) (storage.ObjectInfo, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(b.root, internalDir), "put-*")
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), body)
+	if err != nil {
+		tmp.Close()
+		return storage.ObjectInfo{}, fmt.Errorf("error writing %s: %v", key, err)
+	}
+	if n != size {
+		tmp.Close()
+		return storage.ObjectInfo{}, fmt.Errorf("error writing %s: got %d bytes, expected %d", key, n, size)
+	}
+	if err := tmp.Close(); err != nil {
+		return storage.ObjectInfo{}, fmt.Errorf("error writing %s: %v", key, err)
+	}
+	etag := hex.EncodeToString(h.Sum(nil))
+	if err := b.place(tmp.Name(), path, key, etag, metadata); err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	return b.Stat(ctx, key)
+}
+
+// Get opens the file stored for key
+func (b *Backend) Get(ctx context.Context, key string) (io.ReadCloser, storage.ObjectInfo, error) {
+	info, err := b.Stat(ctx, key)
+	if err != nil {
+		return nil, info, err
+	}
+	path, _ := b.path(key)
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, info, fmt.Errorf("%s: %w", key, storage.ErrNotFound)
+	}
+	return f, info, err
+}
+
+// Delete removes the file stored for key and the directories it leaves empty
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(b.metaPath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != b.root && strings.HasPrefix(dir, b.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break // not empty (or gone already)
+		}
+	}
+	return nil
+}
+
+// Copy hard links the file of src to dst, objects are never changed in place so they can share it.
+// Filesystems without hard links get a copy.
+func (b *Backend) Copy(ctx context.Context, src, dst string) (storage.ObjectInfo, error) {
+	info, err := b.Stat(ctx, src)
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	srcPath, _ := b.path(src)
+	dstPath, err := b.path(dst)
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(b.root, internalDir), "copy-*")
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	os.Remove(tmp.Name())
+	if err := os.Link(srcPath, tmp.Name()); err != nil {
+		f, err := os.Create(tmp.Name())
+		if err != nil {
+			return storage.ObjectInfo{}, err
+		}
+		err = appendFile(f, srcPath)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return storage.ObjectInfo{}, fmt.Errorf("error copying %s: %v", src, err)
+		}
+	}
+	if err := b.place(tmp.Name(), dstPath, dst, info.ETag, info.Metadata); err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	return b.Stat(ctx, dst)
+}
+
+// List walks the directory the prefix points into and reports every file whose key starts with prefix, in key order
+func (b *Backend) List(ctx context.Context, prefix string, fn func(storage.ObjectInfo) error) error {
+	start := b.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		var err error
+		if start, err = b.path(prefix[:i]); err != nil {
+			return err
+		}
+	}
+	err := filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() && path == filepath.Join(b.root, internalDir) {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(b.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := b.Stat(ctx, key)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil // deleted while listing
+		}
+		if err != nil {
+			return err
+		}
+		info.Metadata = nil // List doesn't return metadata with s3 either
+		return fn(info)
+	})
+	if err != nil {
+		return fmt.Errorf("error listing %s: %v", prefix, err)
+	}
+	return nil
+}
+
+// Stat describes the file stored for key
+func (b *Backend) Stat(ctx context.Context, key string) (storage.ObjectInfo, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !fi.Mode().IsRegular()) {
+		return storage.ObjectInfo{}, fmt.Errorf("%s: %w", key, storage.ErrNotFound)
+	}
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	info := storage.ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}
+
+	// Files put there by hand have no metadata, their ETag is worked out on demand
+	meta, err := b.readMeta(key)
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	if meta != nil && meta.Size == fi.Size() && meta.ModTime.Equal(fi.ModTime()) {
+		info.ETag = meta.ETag
+		info.Metadata = meta.Metadata
+		return info, nil
+	}
+	if info.ETag, err = md5File(path); err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	return info, nil
+}
+
+// CreateMultipart creates the staging directory of a new upload
+func (b *Backend) CreateMultipart(ctx context.Context, key string, metadata map[string]string) (string, error) {
+	if _, err := b.path(key); err != nil {
+		return "", err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	uploadID := hex.EncodeToString(id)
+	dir := b.uploadDir(uploadID)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", err
+	}
+	value, err := json.Marshal(upload{Key: key, Metadata: metadata, Initiated: time.Now()})
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "upload.json"), value, 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return uploadID, nil
+}
+
+// UploadPart stores a part in the staging directory, named after its number and ETag so ListParts doesn't need to read them back
+func (b *Backend) UploadPart(ctx context.Context, key, uploadID string, partNumber int32, body io.Reader, size int64) (string, error) {
+	if _, err := b.readUpload(key, uploadID); err != nil {
+		return "", err
+	}
+	dir := b.uploadDir(uploadID)
+	tmp, err := os.CreateTemp(dir, "part-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), body)
+	if err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("error writing part %d of %s: %v", partNumber, key, err)
+	}
+	if n != size {
+		tmp.Close()
+		return "", fmt.Errorf("error writing part %d of %s: got %d bytes, expected %d", partNumber, key, n, size)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	// A part uploaded again replaces the earlier one
+	old, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%05d.*", partNumber)))
+	if err != nil {
+		return "", err
+	}
+	for _, f := range old {
+		os.Remove(f)
+	}
+	etag := hex.EncodeToString(h.Sum(nil))
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, fmt.Sprintf("%05d.%s", partNumber, etag))); err != nil {
+		return "", err
+	}
+	return etag, nil
+}
+
+// ListParts returns the parts found in the staging directory
+func (b *Backend) ListParts(ctx context.Context, key, uploadID string) (map[int32]string, error) {
+	if _, err := b.readUpload(key, uploadID); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(b.uploadDir(uploadID))
+	if err != nil {
+		return nil, err
+	}
+	parts := make(map[int32]string)
+	for _, entry := range entries {
+		number, etag, ok := strings.Cut(entry.Name(), ".")
+		n, err := strconv.ParseInt(number, 10, 32)
+		if !ok || err != nil || len(etag) != 32 {
+			continue // upload.json, temporary files
+		}
+		parts[int32(n)] = etag
+	}
+	return parts, nil
+}
+
+// CompleteMultipart concatenates the parts into the object and drops the staging directory.
+// Like s3 does, the ETag is the MD5 of the part MD5s followed by the number of parts.
+func (b *Backend) CompleteMultipart(ctx context.Context, key, uploadID string, parts map[int32]string) (storage.ObjectInfo, error) {
+	u, err := b.readUpload(key, uploadID)
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	path, err := b.path(key)
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	numbers := make([]int32, 0, len(parts))
+	for n := range parts {
+		numbers = append(numbers, n)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	dir := b.uploadDir(uploadID)
+	tmp, err := os.CreateTemp(dir, "complete-*")
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := md5.New()
+	for _, n := range numbers {
+		sum, err := hex.DecodeString(parts[n])
+		if err != nil {
+			tmp.Close()
+			return storage.ObjectInfo{}, fmt.Errorf("invalid ETag of part %d: %v", n, err)
+		}
+		h.Write(sum)
+		if err := appendFile(tmp, filepath.Join(dir, fmt.Sprintf("%05d.%s", n, parts[n]))); err != nil {
+			tmp.Close()
+			return storage.ObjectInfo{}, fmt.Errorf("error assembling part %d of %s: %v", n, key, err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), len(numbers))
+	if err := b.place(tmp.Name(), path, key, etag, u.Metadata); err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	return b.Stat(ctx, key)
+}
+
+// AbortMultipart drops the staging directory of an upload
+func (b *Backend) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	if _, err := b.readUpload(key, uploadID); err != nil {
+		return err
+	}
+	return os.RemoveAll(b.uploadDir(uploadID))
+}
+
+// ListMultipartUploads reports the uploads which are still being staged
+func (b *Backend) ListMultipartUploads(ctx context.Context, prefix string, fn func(storage.PendingUpload) error) error {
+	entries, err := os.ReadDir(filepath.Join(b.root, internalDir, "uploads"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		value, err := os.ReadFile(filepath.Join(b.uploadDir(entry.Name()), "upload.json"))
+		if err != nil {
+			continue // half created, CreateMultipart never returned its ID
+		}
+		var u upload
+		if err := json.Unmarshal(value, &u); err != nil {
+			return fmt.Errorf("error reading multipart upload %s: %v", entry.Name(), err)
+		}
+		if !strings.HasPrefix(u.Key, prefix) {
+			continue
+		}
+		if err := fn(storage.PendingUpload{Key: u.Key, UploadID: entry.Name(), Initiated: u.Initiated}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// path maps a key to the file it's stored in, refusing keys which would end up outside of root or in the internal directory
+func (b *Backend) path(key string) (string, error) {
+	path := filepath.Join(b.root, filepath.FromSlash(key))
+	rel, err := filepath.Rel(b.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) ||
+		rel == internalDir || strings.HasPrefix(rel, internalDir+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return path, nil
+}
+
+func (b *Backend) uploadDir(uploadID string) string {
+	return filepath.Join(b.root, internalDir, "uploads", filepath.Base(uploadID))
+}
+
+func (b *Backend) readUpload(key, uploadID string) (*upload, error) {
+	value, err := os.ReadFile(filepath.Join(b.uploadDir(uploadID), "upload.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("upload %s: %w", uploadID, storage.ErrNoSuchUpload)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u upload
+	if err := json.Unmarshal(value, &u); err != nil {
+		return nil, err
+	}
+	if u.Key != key {
+		return nil, fmt.Errorf("upload %s is for %s: %w", uploadID, u.Key, storage.ErrNoSuchUpload)
+	}
+	return &u, nil
+}
+
+// meta is kept next to the objects, keyed by the object key, it's only trusted while size and modification time still match the file
+type meta struct {
+	ETag     string            `json:"etag"`
+	Size     int64             `json:"size"`
+	ModTime  time.Time         `json:"modTime"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (b *Backend) metaPath(key string) string {
+	return filepath.Join(b.root, internalDir, "meta", filepath.FromSlash(key)+".json")
+}
+
+func (b *Backend) readMeta(key string) (*meta, error) {
+	value, err := os.ReadFile(b.metaPath(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m meta
+	if err := json.Unmarshal(value, &m); err != nil {
+		return nil, nil // unreadable metadata is as good as none, the ETag gets worked out again
+	}
+	return &m, nil
+}
+
+// place moves a finished temporary file to path and records its metadata
+func (b *Backend) place(tmp, path, key, etag string, metadata map[string]string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to move %s into place: %v", key, err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(meta{ETag: etag, Size: fi.Size(), ModTime: fi.ModTime(), Metadata: metadata})
+	if err != nil {
+		return err
+	}
+	metaPath := b.metaPath(key)
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath, value, 0600)
+}
+
+func appendFile(dst *os.File, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func md5File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,164 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/Praveen005/CloudKeeper/internal/storage"
+)
+
+func newTestBackend(t *testing.T) *Backend {
+	t.Helper()
+	b, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestPutGetListDelete(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t)
+
+	for key, content := range map[string]string{
+		"backup/a.txt":       "first",
+		"backup/dir/b.txt":   "second",
+		"backup-old/c.txt":   "sibling",
+		"backup/dir/sub/d.x": "third",
+	} {
+		if _, err := b.Put(ctx, key, strings.NewReader(content), int64(len(content)), map[string]string{"k": "v"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body, info, err := b.Get(ctx, "backup/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(body)
+	body.Close()
+	if string(content) != "first" || info.Size != 5 || info.Metadata["k"] != "v" {
+		t.Errorf("unexpected object: %q %+v", content, info)
+	}
+	if info.ETag != "8b04d5e3775d298e78455efc5ca404d5" { // md5 of "first"
+		t.Errorf("unexpected ETag %q", info.ETag)
+	}
+
+	objects, err := storage.ListAll(ctx, b, "backup/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	if got := strings.Join(keys, ","); got != "backup/a.txt,backup/dir/b.txt,backup/dir/sub/d.x" {
+		t.Errorf("unexpected listing %s", got)
+	}
+
+	copied, err := b.Copy(ctx, "backup/a.txt", "trash/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.ETag != info.ETag || copied.Metadata["k"] != "v" {
+		t.Errorf("copy lost ETag or metadata: %+v", copied)
+	}
+	// The copy is independent of the original
+	if _, err := b.Put(ctx, "backup/a.txt", strings.NewReader("changed"), 7, nil); err != nil {
+		t.Fatal(err)
+	}
+	body, _, err = b.Get(ctx, "trash/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = io.ReadAll(body)
+	body.Close()
+	if string(content) != "first" {
+		t.Errorf("want the copy unchanged, got %q", content)
+	}
+
+	if err := storage.DeleteTree(ctx, b, "backup/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat(ctx, "backup/dir/b.txt"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("want ErrNotFound after delete, got %v", err)
+	}
+	// Only the tree itself, not whatever shares its name as a prefix
+	if err := storage.DeleteTree(ctx, b, "backup"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat(ctx, "backup-old/c.txt"); err != nil {
+		t.Errorf("want the sibling kept, got %v", err)
+	}
+	if err := b.Delete(ctx, "backup/dir/b.txt"); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+}
+
+func TestInvalidKeys(t *testing.T) {
+	b := newTestBackend(t)
+	for _, key := range []string{"../escape", internalDir + "/meta/x", "a/../../b"} {
+		if _, err := b.Put(context.Background(), key, strings.NewReader(""), 0, nil); err == nil {
+			t.Errorf("key %q was accepted", key)
+		}
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t)
+	const key = "backup/big.bin"
+	parts := [][]byte{bytes.Repeat([]byte("a"), 10), bytes.Repeat([]byte("b"), 10), []byte("c")}
+
+	uploadID, err := b.CreateMultipart(ctx, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etags := make(map[int32]string)
+	for i := len(parts) - 1; i >= 0; i-- { // out of order, like concurrent workers
+		etag, err := b.UploadPart(ctx, key, uploadID, int32(i+1), bytes.NewReader(parts[i]), int64(len(parts[i])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		etags[int32(i+1)] = etag
+	}
+
+	listed, err := b.ListParts(ctx, key, uploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != len(parts) {
+		t.Fatalf("want %d parts listed, got %d", len(parts), len(listed))
+	}
+
+	var pending int
+	b.ListMultipartUploads(ctx, "backup/", func(storage.PendingUpload) error { pending++; return nil })
+	if pending != 1 {
+		t.Errorf("want 1 pending upload, got %d", pending)
+	}
+
+	info, err := b.CompleteMultipart(ctx, key, uploadID, etags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 21 || !strings.HasSuffix(info.ETag, "-3") {
+		t.Errorf("unexpected object %+v", info)
+	}
+	body, _, err := b.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(body)
+	body.Close()
+	if string(content) != strings.Repeat("a", 10)+strings.Repeat("b", 10)+"c" {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	if err := b.AbortMultipart(ctx, key, uploadID); !errors.Is(err, storage.ErrNoSuchUpload) {
+		t.Errorf("want ErrNoSuchUpload for a completed upload, got %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"go.uber.org/zap"
+)
+
+// ListTree returns the object stored under key and, if key is a directory, everything stored below it.
+// Unlike listing key as a prefix, 'dir' doesn't pick up 'dir2/...'.
+func ListTree(ctx context.Context, b Backend, key string) ([]ObjectInfo, error) {
+	objects, err := ListAll(ctx, b, key)
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects: %v", err)
+	}
+	var tree []ObjectInfo
+	for _, object := range objects {
+		if object.Key == key || strings.HasPrefix(object.Key, key+"/") {
+			tree = append(tree, object)
+		}
+	}
+	return tree, nil
+}
+
+// RemoveObjects takes the given objects out of the backup below prefix: they're moved to the trash if that's on, deleted otherwise
+func RemoveObjects(ctx context.Context, b Backend, prefix string, objects []ObjectInfo) error {
+	if len(objects) == 0 {
+		return nil
+	}
+	if fsconfig.FromContext(ctx).TrashRetention > 0 {
+		n, err := trashObjects(ctx, b, prefix, objects)
+		if err != nil {
+			return fmt.Errorf("error moving file(s) to the trash: %v", err)
+		}
+		customlog.Logger.Info("Files moved to the trash", zap.Int("objects", n))
+		return nil
+	}
+	for _, object := range objects {
+		if err := b.Delete(ctx, object.Key); err != nil {
+			return fmt.Errorf("error deleting %s: %v", object.Key, err)
+		}
+	}
+	return nil
+}
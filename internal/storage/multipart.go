@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/db"
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"go.uber.org/zap"
+)
+
+// s3 allows at most this many parts per upload, the part size grows for files which would need more
+const maxParts = 10000
+
+// MultipartUpload uploads file in parts, several at a time. Every finished part is recorded in the database,
+// so if the upload gets interrupted (network trouble, daemon restart) the next attempt only uploads the missing parts.
+// It returns the completed object (its ETag, and its version in a versioned bucket).
+func MultipartUpload(ctx context.Context, b Backend, file *os.File, info os.FileInfo, key string, metadata map[string]string) (ObjectInfo, error) {
+	state, err := resumableUpload(ctx, b, file.Name(), info, key, metadata)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	partCount := int32((info.Size() + state.PartSize - 1) / state.PartSize)
+	var missing []int32
+	for n := int32(1); n <= partCount; n++ {
+		if _, done := state.Parts[n]; !done {
+			missing = append(missing, n)
+		}
+	}
+	customlog.Logger.Debug("Uploading file in parts",
+		zap.String("key", key),
+		zap.Int32("parts", partCount),
+		zap.Int("missing", len(missing)),
+	)
+
+	// Upload the missing parts with a bounded number of workers, the first failure stops handing out new parts
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	parts := make(chan int32)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var uploadErr error
+	var mu sync.Mutex
+	etags := make(map[int32]string, partCount)
+	for n, etag := range state.Parts {
+		etags[n] = etag
+	}
+
+	concurrency := fsconfig.FromContext(ctx).MultipartConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range parts {
+				offset := int64(n-1) * state.PartSize
+				length := state.PartSize
+				if offset+length > info.Size() {
+					length = info.Size() - offset
+				}
+				etag, err := b.UploadPart(ctx, key, state.UploadID, n, io.NewSectionReader(file, offset, length), length)
+				if err != nil {
+					once.Do(func() {
+						uploadErr = fmt.Errorf("error uploading part %d of %s: %v", n, key, err)
+						cancel()
+					})
+					continue
+				}
+				// Not being able to record the part only costs uploading it again on resume, ListParts would even find it
+				if err := db.SaveMultipartPart(StoreID(b), key, n, etag); err != nil {
+					customlog.Logger.Warn("failed to record uploaded part",
+						zap.String("key", key),
+						zap.Int32("part", n),
+						zap.String("error", err.Error()),
+					)
+				}
+				mu.Lock()
+				etags[n] = etag
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, n := range missing {
+		select {
+		case parts <- n:
+		case <-ctx.Done():
+		}
+	}
+	close(parts)
+	wg.Wait()
+	if uploadErr != nil {
+		return ObjectInfo{}, uploadErr
+	}
+	if ctx.Err() != nil {
+		return ObjectInfo{}, ctx.Err()
+	}
+
+	object, err := b.CompleteMultipart(ctx, key, state.UploadID, etags)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("error completing multipart upload of %s: %v", key, err)
+	}
+	if err := db.DeleteMultipart(StoreID(b), key); err != nil {
+		customlog.Logger.Warn("failed to forget completed multipart upload",
+			zap.String("key", key),
+			zap.String("error", err.Error()),
+		)
+	}
+	return object, nil
+}
+
+// resumableUpload returns the upload to continue for key, or starts a new one.
+// An upload is only continued if it was for the same version of the file and the backend still knows about it.
+func resumableUpload(ctx context.Context, b Backend, path string, info os.FileInfo, key string, metadata map[string]string) (*db.MultipartState, error) {
+	state, err := db.GetMultipart(StoreID(b), key)
+	if err != nil {
+		return nil, err
+	}
+
+	if state != nil {
+		sameFile := state.Path == path && state.Size == info.Size() && state.ModTime.Equal(info.ModTime()) && state.PartSize > 0
+		var parts map[int32]string
+		if sameFile {
+			parts, err = b.ListParts(ctx, key, state.UploadID)
+		}
+		if sameFile && err == nil {
+			// The backend is the source of truth, a part may have finished after we failed to record it or vice versa
+			state.Parts = parts
+			customlog.Logger.Info("Resuming multipart upload",
+				zap.String("key", key),
+				zap.Int("parts done", len(parts)),
+			)
+			return state, nil
+		}
+
+		customlog.Logger.Info("Discarding multipart upload which can't be resumed", zap.String("key", key))
+		abortUpload(ctx, b, key, state.UploadID)
+		if err := db.DeleteMultipart(StoreID(b), key); err != nil {
+			return nil, err
+		}
+	}
+
+	partSize := fsconfig.FromContext(ctx).MultipartPartSize
+	if partSize <= 0 {
+		partSize = 16 << 20
+	}
+	for info.Size()/partSize >= maxParts {
+		partSize *= 2
+	}
+
+	uploadID, err := b.CreateMultipart(ctx, key, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("error starting multipart upload of %s: %v", key, err)
+	}
+	state = &db.MultipartState{
+		UploadID:  uploadID,
+		Path:      path,
+		Size:      info.Size(),
+		ModTime:   info.ModTime(),
+		PartSize:  partSize,
+		Parts:     make(map[int32]string),
+		StartedAt: time.Now(),
+	}
+	if err := db.PutMultipart(StoreID(b), key, state); err != nil {
+		abortUpload(ctx, b, key, state.UploadID)
+		return nil, err
+	}
+	return state, nil
+}
+
+func abortUpload(ctx context.Context, b Backend, key, uploadID string) {
+	err := b.AbortMultipart(ctx, key, uploadID)
+	if err != nil && !errors.Is(err, ErrNoSuchUpload) {
+		customlog.Logger.Warn("failed to abort multipart upload",
+			zap.String("key", key),
+			zap.String("error", err.Error()),
+		)
+	}
+}
+
+// AbortStaleMultipartUploads aborts incomplete multipart uploads below the prefix which were started more than `MultipartStaleAfter` ago.
+// s3 keeps (and bills) the parts of an upload till it's completed or aborted, uploads we gave up on would pile up otherwise.
+func AbortStaleMultipartUploads(ctx context.Context, b Backend, prefix string) error {
+	staleAfter := fsconfig.FromContext(ctx).MultipartStaleAfter
+	if err := CleanSpool(staleAfter); err != nil {
+		customlog.Logger.Warn("cleaning up the spool directory failed", zap.String("error", err.Error()))
+	}
+
+	cutoff := time.Now().Add(-staleAfter)
+	var stale []PendingUpload
+	err := b.ListMultipartUploads(ctx, ListPrefix(prefix), func(upload PendingUpload) error {
+		if !upload.Initiated.IsZero() && upload.Initiated.Before(cutoff) {
+			stale = append(stale, upload)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error listing multipart uploads: %v", err)
+	}
+
+	for _, upload := range stale {
+		customlog.Logger.Info("Aborting stale multipart upload",
+			zap.String("key", upload.Key),
+			zap.Time("initiated", upload.Initiated),
+		)
+		abortUpload(ctx, b, upload.Key, upload.UploadID)
+
+		state, err := db.GetMultipart(StoreID(b), upload.Key)
+		if err == nil && state != nil && state.UploadID == upload.UploadID {
+			if err := db.DeleteMultipart(StoreID(b), upload.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotVersion = 1
+	// snapshot IDs are their UTC creation time, so they sort chronologically
+	snapshotIDFormat = "20060102T150405.000Z"
+	snapshotSuffix   = ".json"
+
+	// LatestSnapshot can be used instead of the ID of the newest snapshot
+	LatestSnapshot = "latest"
+)
+
+// ErrNoSnapshot is returned for a snapshot which doesn't exist
+var ErrNoSnapshot = errors.New("no such snapshot")
+
+// Snapshot is the backed up tree as it was at one point in time. Snapshots are never changed once stored,
+// they only refer to content which doesn't change either, so the files they list can always be restored:
+// chunks (which are stored under their hash) in the chunked layout, versions of the objects of a versioned bucket otherwise.
+type Snapshot struct {
+	Version     int            `json:"version"`
+	ID          string         `json:"id"`
+	Time        time.Time      `json:"time"`
+	ChunkPrefix string         `json:"chunkPrefix"`
+	Files       []SnapshotFile `json:"files"`
+}
+
+// SnapshotFile is a file in a snapshot, Path is relative to the backed up directory
+type SnapshotFile struct {
+	Path    string          `json:"path"`
+	Size    int64           `json:"size"`
+	ModTime time.Time       `json:"modTime"`
+	Mode    os.FileMode     `json:"mode"`
+	Chunks  []ManifestChunk `json:"chunks"`
+	// A file stored as a single object (the files layout) is the version of its object which was current when the snapshot was taken
+	Key       string `json:"key,omitempty"`
+	VersionID string `json:"versionId,omitempty"`
+}
+
+// SnapshotInfo is what listing the snapshots tells about each of them, without fetching them
+type SnapshotInfo struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Key        string    `json:"key"`
+	StoredSize int64     `json:"storedSize"`
+}
+
+// SnapshotPrefix is where the snapshots live below prefix
+func SnapshotPrefix(prefix string) string {
+	return InternalPrefix(prefix) + "snapshots/"
+}
+
+// NewSnapshot starts a snapshot of the tree backed up under prefix, taken now
+func NewSnapshot(prefix string) *Snapshot {
+	now := time.Now().UTC()
+	return &Snapshot{
+		Version:     snapshotVersion,
+		ID:          now.Format(snapshotIDFormat),
+		Time:        now,
+		ChunkPrefix: ChunkPrefix(prefix),
+		Files:       []SnapshotFile{},
+	}
+}
+
+// PutSnapshot stores the snapshot, it goes through the transforms (compression, encryption) like everything else.
+// It refuses to replace an existing snapshot.
+func PutSnapshot(ctx context.Context, b Backend, prefix string, snapshot *Snapshot) error {
+	sort.Slice(snapshot.Files, func(i, j int) bool { return snapshot.Files[i].Path < snapshot.Files[j].Path })
+
+	key := SnapshotPrefix(prefix) + snapshot.ID + snapshotSuffix
+	if _, err := b.Stat(ctx, key); err == nil {
+		return fmt.Errorf("snapshot %s exists already", snapshot.ID)
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if _, err := putTransformed(ctx, b, key, key, data, nil); err != nil {
+		return fmt.Errorf("error storing snapshot %s: %v", snapshot.ID, err)
+	}
+	return nil
+}
+
+// ListSnapshots returns the snapshots stored under prefix, oldest first
+func ListSnapshots(ctx context.Context, b Backend, prefix string) ([]SnapshotInfo, error) {
+	snapshotPrefix := SnapshotPrefix(prefix)
+	objects, err := ListAll(ctx, b, snapshotPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("error listing snapshots: %v", err)
+	}
+	var snapshots []SnapshotInfo
+	for _, object := range objects {
+		id, ok := strings.CutSuffix(strings.TrimPrefix(object.Key, snapshotPrefix), snapshotSuffix)
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(snapshotIDFormat, id)
+		if err != nil {
+			continue // not ours
+		}
+		snapshots = append(snapshots, SnapshotInfo{ID: id, Time: t, Key: object.Key, StoredSize: object.Size})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+	return snapshots, nil
+}
+
+// GetSnapshot fetches a snapshot, id may be LatestSnapshot
+func GetSnapshot(ctx context.Context, b Backend, prefix, id string) (*Snapshot, error) {
+	if id == LatestSnapshot {
+		snapshots, err := ListSnapshots(ctx, b, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if len(snapshots) == 0 {
+			return nil, fmt.Errorf("%w: there are no snapshots yet", ErrNoSnapshot)
+		}
+		id = snapshots[len(snapshots)-1].ID
+	}
+
+	data, _, err := getDecoded(ctx, b, SnapshotPrefix(prefix)+id+snapshotSuffix)
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrNoSnapshot, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching snapshot %s: %w", id, err)
+	}
+	var snapshot Snapshot
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %v", id, err)
+	}
+	if snapshot.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported version %d of snapshot %s", snapshot.Version, id)
+	}
+	return &snapshot, nil
+}
+
+// DeleteSnapshot removes a snapshot, the chunks only it referred to are left to GarbageCollect
+func DeleteSnapshot(ctx context.Context, b Backend, prefix, id string) error {
+	return b.Delete(ctx, SnapshotPrefix(prefix)+id+snapshotSuffix)
+}
+
+// DownloadSnapshotFile restores a file of a snapshot to dest, with the modification time and permissions it had
+func DownloadSnapshotFile(ctx context.Context, b Backend, snapshot *Snapshot, file SnapshotFile, dest string) error {
+	if file.VersionID != "" {
+		return downloadSnapshotVersion(ctx, b, file, dest)
+	}
+	manifest := &Manifest{Version: manifestVersion, Size: file.Size, ChunkPrefix: snapshot.ChunkPrefix, Chunks: file.Chunks}
+	return writeFile(dest, file.ModTime, file.Mode, func(w io.Writer) error {
+		return writeChunks(ctx, b, manifest, w)
+	})
+}
+
+// downloadSnapshotVersion restores a file of a snapshot which is a version of an object, it's there even if the object was overwritten or deleted since
+func downloadSnapshotVersion(ctx context.Context, b Backend, file SnapshotFile, dest string) error {
+	versioned, ok := b.(Versioned)
+	if !ok {
+		return ErrNoVersioning
+	}
+	body, info, err := versioned.GetVersion(ctx, file.Key, file.VersionID)
+	if err != nil {
+		return fmt.Errorf("error fetching version %s of %s: %w", file.VersionID, file.Key, err)
+	}
+	defer body.Close()
+	content, err := decode(body, info.Metadata)
+	if err != nil {
+		return fmt.Errorf("error restoring %s: %w", file.Key, err)
+	}
+	return writeFile(dest, file.ModTime, file.Mode, func(w io.Writer) error {
+		_, err := io.Copy(w, content)
+		return err
+	})
+}
+
+// snapshotReferences adds the chunks referred to by the snapshots under prefix (except the dropped ones) to referenced.
+// It returns the number of snapshots taken into account.
+func snapshotReferences(ctx context.Context, b Backend, prefix string, drop map[string]bool, referenced map[string]bool) (int, error) {
+	snapshots, err := ListSnapshots(ctx, b, prefix)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, info := range snapshots {
+		if drop[info.ID] {
+			continue
+		}
+		n++
+		snapshot, err := GetSnapshot(ctx, b, prefix, info.ID)
+		if err != nil {
+			return 0, err
+		}
+		for _, file := range snapshot.Files {
+			for _, chunk := range file.Chunks {
+				referenced[chunk.ID] = true
+			}
+		}
+	}
+	return n, nil
+}
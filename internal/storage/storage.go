@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+)
+
+// ErrNotFound is returned (wrapped) by backends for keys which don't exist
+var ErrNotFound = errors.New("object not found")
+
+// ErrNoSuchUpload is returned (wrapped) by backends for multipart uploads they don't know (anymore)
+var ErrNoSuchUpload = errors.New("multipart upload not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string            // MD5 of the content for single part uploads, opaque otherwise
+	Metadata     map[string]string // only filled in by Get and Stat
+	VersionID    string            // version of the object in a versioned bucket, empty otherwise
+}
+
+// PendingUpload describes an incomplete multipart upload
+type PendingUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
+
+// Backend is where the backed up files end up. s3client implements it for S3, storage/local for a plain directory (external disk, NAS mount...).
+// Keys always use forward slashes.
+type Backend interface {
+	// Put stores body (size bytes) under key, replacing what's there
+	Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) (ObjectInfo, error)
+	// Get opens the object stored under key, the caller closes it
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	// Delete removes the object stored under key, deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every object whose key starts with prefix
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+	// Stat describes the object stored under key
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Copy copies the object stored under src, with its metadata, to dst without downloading it
+	Copy(ctx context.Context, src, dst string) (ObjectInfo, error)
+
+	// CreateMultipart starts a multipart upload and returns its ID
+	CreateMultipart(ctx context.Context, key string, metadata map[string]string) (string, error)
+	// UploadPart stores part number partNumber (starting at 1) and returns its ETag
+	UploadPart(ctx context.Context, key, uploadID string, partNumber int32, body io.Reader, size int64) (string, error)
+	// ListParts returns part number -> ETag of the parts uploaded so far
+	ListParts(ctx context.Context, key, uploadID string) (map[int32]string, error)
+	// CompleteMultipart assembles the parts into the object
+	CompleteMultipart(ctx context.Context, key, uploadID string, parts map[int32]string) (ObjectInfo, error)
+	// AbortMultipart drops an upload and its parts
+	AbortMultipart(ctx context.Context, key, uploadID string) error
+	// ListMultipartUploads calls fn for every incomplete upload whose key starts with prefix
+	ListMultipartUploads(ctx context.Context, prefix string, fn func(PendingUpload) error) error
+}
+
+// Identified is implemented by backends which can tell which store they talk to, e.g. the endpoint and bucket of an s3 backend.
+// What's remembered about a store (like the chunks it has) is kept under its identity, so it doesn't leak into another store.
+type Identified interface {
+	StoreID() string
+}
+
+// StoreID returns the identity of the store b talks to, empty if b can't tell
+func StoreID(b Backend) string {
+	if identified, ok := b.(Identified); ok {
+		return identified.StoreID()
+	}
+	return ""
+}
+
+// Default is the backend the daemon and the commands work with, set up at startup from the configuration
+var Default Backend
+
+// Backends holds the backend of every backup set by the name of the set, sets missing from it use Default
+var Backends = make(map[string]Backend)
+
+// State is the configuration together with the backends opened for it. A reload publishes a new State with Apply
+// instead of changing the one in use: FlushSet and SyncSet are handed one and pass its configuration on with fsconfig.WithConfig,
+// so a flush sees the settings and backends of a single configuration, and a reload meanwhile applies to the next one.
+type State struct {
+	Config   *fsconfig.MetaConfig
+	Backends map[string]Backend
+	Default  Backend
+}
+
+// For returns the backend the backup set with the given name is stored in
+func (s *State) For(set string) Backend {
+	if b, ok := s.Backends[set]; ok {
+		return b
+	}
+	return s.Default
+}
+
+// published is the State of the last Apply, nil till the first reload
+var published atomic.Pointer[State]
+
+// Current returns the State in use: the one of the last Apply, or the configuration and backends set up at startup
+func Current() *State {
+	if s := published.Load(); s != nil {
+		return s
+	}
+	return &State{Config: fsconfig.Current(), Backends: Backends, Default: Default}
+}
+
+// Apply publishes cfg with its backends as the State in use, then applies cfg, waking up whatever waits on fsconfig.Reloaded.
+// The backends map must not be changed afterwards.
+func Apply(cfg fsconfig.MetaConfig, backends map[string]Backend, def Backend) {
+	published.Store(&State{Config: &cfg, Backends: backends, Default: def})
+	fsconfig.Apply(cfg)
+}
+
+// ForgetApplied drops what Apply published, so Current goes back to the startup configuration and backends. Tests use it to clean up.
+func ForgetApplied() {
+	published.Store(nil)
+	fsconfig.ForgetApplied()
+}
+
+// For returns the backend the backup set with the given name is stored in
+func For(set string) Backend {
+	return Current().For(set)
+}
+
+// ListAll returns every object whose key starts with prefix
+func ListAll(ctx context.Context, b Backend, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := b.List(ctx, prefix, func(o ObjectInfo) error {
+		objects = append(objects, o)
+		return nil
+	})
+	return objects, err
+}
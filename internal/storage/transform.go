@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+)
+
+// MetaTransforms is the object metadata entry listing the transforms applied on upload, in order
+const MetaTransforms = "cloudkeeper-transforms"
+
+// Transform rewrites file content on its way to the backend (encryption...), and back on restore
+type Transform interface {
+	// Name is recorded in the object metadata, so restore knows what to undo
+	Name() string
+	// Encode writes the stored form of src to dst, whatever is needed to undo it goes to metadata
+	Encode(dst io.Writer, src io.Reader, metadata map[string]string) error
+	// Decode undoes Encode, metadata is what the object was stored with
+	Decode(src io.Reader, metadata map[string]string) (io.Reader, error)
+}
+
+// Selective is implemented by transforms which don't apply to every file, e.g. compression skips what's compressed already
+type Selective interface {
+	// Applies decides by the file's path and its first bytes
+	Applies(path string, head []byte) bool
+}
+
+// Transforms are applied to every uploaded file, in order. They're set up at startup from the configuration.
+var Transforms []Transform
+
+// Decoders are only used to restore objects, for transforms which may have been used on upload but aren't configured (anymore), like compression
+var Decoders []Transform
+
+// headSize is how much of a file Selective transforms get to see
+const headSize = 64 << 10
+
+// SpoolDir holds transformed files while they're uploaded. It must not be below the backup directory.
+var SpoolDir = "cloudkeeper-spool"
+
+// Transformed tells if what's stored may differ from the local files, sizes and checksums can't be compared then
+func Transformed() bool {
+	return len(Transforms) > 0 || Layout == fsconfig.LayoutChunks
+}
+
+// applicable returns the transforms which apply to file
+func applicable(file *os.File) ([]Transform, error) {
+	head := make([]byte, headSize)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return applicableFor(file.Name(), head[:n]), nil
+}
+
+// applicableFor returns the transforms which apply to the file at path, starting with head
+func applicableFor(path string, head []byte) []Transform {
+	var applied []Transform
+	for _, t := range Transforms {
+		if selective, ok := t.(Selective); ok && !selective.Applies(path, head) {
+			continue
+		}
+		applied = append(applied, t)
+	}
+	return applied
+}
+
+// putTransformed runs data (a chunk, a manifest: something small) through the transforms that apply to path and stores it under key
+func putTransformed(ctx context.Context, b Backend, key, path string, data []byte, metadata map[string]string) (ObjectInfo, error) {
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	transforms := applicableFor(path, data[:min(len(data), headSize)])
+	if len(transforms) == 0 {
+		return b.Put(ctx, key, bytes.NewReader(data), int64(len(data)), metadata)
+	}
+	var buf bytes.Buffer
+	if err := encode(&buf, bytes.NewReader(data), metadata, transforms); err != nil {
+		return ObjectInfo{}, fmt.Errorf("error transforming %s: %v", key, err)
+	}
+	metadata[MetaTransforms] = transformNames(transforms)
+	return b.Put(ctx, key, bytes.NewReader(buf.Bytes()), int64(buf.Len()), metadata)
+}
+
+// getDecoded fetches the object stored under key and undoes its transforms
+func getDecoded(ctx context.Context, b Backend, key string) ([]byte, ObjectInfo, error) {
+	body, info, err := b.Get(ctx, key)
+	if err != nil {
+		return nil, info, err
+	}
+	defer body.Close()
+	content, err := decode(body, info.Metadata)
+	if err != nil {
+		return nil, info, err
+	}
+	data, err := io.ReadAll(content)
+	return data, info, err
+}
+
+func transformNames(transforms []Transform) string {
+	names := make([]string, 0, len(transforms))
+	for _, t := range transforms {
+		names = append(names, t.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// spoolEntry is what's remembered about a spooled file, to reuse it for the next attempt at the same version of the file
+type spoolEntry struct {
+	Path     string            `json:"path"`
+	Size     int64             `json:"size"`
+	ModTime  time.Time         `json:"modTime"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// spool runs file through the transforms into the spool directory and returns the result with the metadata to store it with.
+// The spooled file is kept till the upload went through (see unspool): a failed multipart upload then resumes with the very same bytes,
+// instead of starting over with freshly encrypted ones.
+func spool(file *os.File, info os.FileInfo, key string, transforms []Transform) (*os.File, map[string]string, error) {
+	if err := os.MkdirAll(SpoolDir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("error creating spool directory: %v", err)
+	}
+	name := spoolName(key)
+	names := transformNames(transforms)
+
+	var entry spoolEntry
+	if value, err := os.ReadFile(name + ".json"); err == nil && json.Unmarshal(value, &entry) == nil &&
+		entry.Path == file.Name() && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) &&
+		entry.Metadata[MetaTransforms] == names {
+		if spooled, err := os.Open(name); err == nil {
+			return spooled, entry.Metadata, nil
+		}
+	}
+	unspool(key)
+
+	tmp, err := os.CreateTemp(SpoolDir, "tmp-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	metadata := make(map[string]string)
+	if err := encode(tmp, file, metadata, transforms); err != nil {
+		tmp.Close()
+		return nil, nil, fmt.Errorf("error transforming %s: %v", file.Name(), err)
+	}
+	metadata[MetaTransforms] = names
+	if err := tmp.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	value, err := json.Marshal(spoolEntry{Path: file.Name(), Size: info.Size(), ModTime: info.ModTime(), Metadata: metadata})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(name+".json", value, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return nil, nil, err
+	}
+	spooled, err := os.Open(name)
+	return spooled, metadata, err
+}
+
+// encode chains the transforms: every one of them reads what the one before produced.
+// They run concurrently, so each one gets a metadata map of its own, merged into metadata at the end.
+func encode(dst io.Writer, src io.Reader, metadata map[string]string, transforms []Transform) error {
+	if len(transforms) == 0 {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	pr, pw := io.Pipe()
+	own := make(map[string]string)
+	done := make(chan error, 1)
+	go func() {
+		err := transforms[0].Encode(pw, src, own)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err := encode(dst, pr, metadata, transforms[1:])
+	pr.CloseWithError(err) // unblocks the writer if the rest of the chain gave up
+	if encodeErr := <-done; encodeErr != nil {
+		return encodeErr
+	}
+	for k, v := range own {
+		metadata[k] = v
+	}
+	return err
+}
+
+// decode undoes the transforms recorded in the metadata, last one first.
+// Transforms which aren't configured (e.g. an encrypted object, but no key) are reported as such.
+func decode(src io.Reader, metadata map[string]string) (io.Reader, error) {
+	recorded := metadata[MetaTransforms]
+	if recorded == "" {
+		return src, nil
+	}
+	names := strings.Split(recorded, ",")
+	r := src
+	for i := len(names) - 1; i >= 0; i-- {
+		transform := lookup(names[i])
+		if transform == nil {
+			return nil, fmt.Errorf("object was stored with %s, which isn't configured", names[i])
+		}
+		var err error
+		if r, err = transform.Decode(r, metadata); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// lookup finds the transform to decode name with, configured ones go first (they hold the key for encryption)
+func lookup(name string) Transform {
+	for _, transforms := range [][]Transform{Transforms, Decoders} {
+		for _, t := range transforms {
+			if t.Name() == name {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// unspool drops the spooled copy of key
+func unspool(key string) {
+	name := spoolName(key)
+	os.Remove(name)
+	os.Remove(name + ".json")
+}
+
+func spoolName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(SpoolDir, hex.EncodeToString(sum[:]))
+}
+
+// CleanSpool removes spooled files older than maxAge. Files which were given up on (dead lettered, deleted meanwhile) would pile up otherwise.
+func CleanSpool(maxAge time.Duration) error {
+	entries, err := os.ReadDir(SpoolDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		os.Remove(filepath.Join(SpoolDir, entry.Name()))
+	}
+	return nil
+}
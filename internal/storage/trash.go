@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"go.uber.org/zap"
+)
+
+// Every deletion moves the objects to a directory of the trash named after the time of the deletion,
+// so the same path can be in the trash several times and purging only has to look at the directory names.
+const trashIDFormat = "20060102T150405.000Z"
+
+// TrashEntry is a file in the trash
+type TrashEntry struct {
+	Path      string    `json:"path"` // relative to the backed up directory
+	DeletedAt time.Time `json:"deletedAt"`
+	Key       string    `json:"key"`
+	Size      int64     `json:"size"`
+}
+
+// TrashPrefix is where deleted objects are kept below prefix
+func TrashPrefix(prefix string) string {
+	return InternalPrefix(prefix) + "trash/"
+}
+
+// TrashTree moves the object stored under key, or everything below it if it's a directory, into the trash
+// instead of deleting it. Objects are copied by the backend, then deleted. It returns the number of objects moved.
+func TrashTree(ctx context.Context, b Backend, prefix, key string) (int, error) {
+	objects, err := ListTree(ctx, b, key)
+	if err != nil {
+		return 0, err
+	}
+	return trashObjects(ctx, b, prefix, objects)
+}
+
+// trashObjects moves objects into the trash, all of them below the directory of one deletion
+func trashObjects(ctx context.Context, b Backend, prefix string, objects []ObjectInfo) (int, error) {
+	trash := TrashPrefix(prefix) + time.Now().UTC().Format(trashIDFormat) + "/"
+	for i, object := range objects {
+		dst := trash + strings.TrimPrefix(object.Key, ListPrefix(prefix))
+		customlog.Logger.Debug("Moving a file to the trash", zap.String("key", object.Key), zap.String("to", dst))
+		if _, err := b.Copy(ctx, object.Key, dst); err != nil {
+			return i, fmt.Errorf("error copying %s to the trash: %v", object.Key, err)
+		}
+		if err := b.Delete(ctx, object.Key); err != nil {
+			return i, fmt.Errorf("error deleting the file: %v", err)
+		}
+	}
+	return len(objects), nil
+}
+
+// ListTrash returns what's in the trash below prefix, most recently deleted first
+func ListTrash(ctx context.Context, b Backend, prefix string) ([]TrashEntry, error) {
+	trashPrefix := TrashPrefix(prefix)
+	objects, err := ListAll(ctx, b, trashPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the trash: %v", err)
+	}
+	var entries []TrashEntry
+	for _, object := range objects {
+		id, _, _ := strings.Cut(strings.TrimPrefix(object.Key, trashPrefix), "/")
+		deletedAt, err := time.Parse(trashIDFormat, id)
+		if err != nil {
+			continue // not ours
+		}
+		// Keys in the trash are built like the original ones, below the directory of the deletion instead of the prefix
+		relativePath, ok := RelativePath(trashPrefix+id, object.Key)
+		if !ok {
+			continue
+		}
+		entries = append(entries, TrashEntry{Path: relativePath, DeletedAt: deletedAt, Key: object.Key, Size: object.Size})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].DeletedAt.Equal(entries[j].DeletedAt) {
+			return entries[i].DeletedAt.After(entries[j].DeletedAt)
+		}
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, nil
+}
+
+// FindInTrash returns the most recently deleted version of every file in the trash at or below path (relative to the backed up directory)
+func FindInTrash(ctx context.Context, b Backend, prefix, path string) ([]TrashEntry, error) {
+	entries, err := ListTrash(ctx, b, prefix)
+	if err != nil {
+		return nil, err
+	}
+	path = filepath.Clean(path)
+	seen := make(map[string]bool)
+	var found []TrashEntry
+	for _, entry := range entries {
+		below := path == "." || entry.Path == path || strings.HasPrefix(entry.Path, path+string(filepath.Separator))
+		if !below || seen[entry.Path] {
+			continue
+		}
+		seen[entry.Path] = true
+		found = append(found, entry)
+	}
+	return found, nil
+}
+
+// PurgeTrash deletes what was moved to the trash more than retention ago, it returns the number of objects deleted
+func PurgeTrash(ctx context.Context, b Backend, prefix string, retention time.Duration) (int, error) {
+	trashPrefix := TrashPrefix(prefix)
+	objects, err := ListAll(ctx, b, trashPrefix)
+	if err != nil {
+		return 0, fmt.Errorf("error listing the trash: %v", err)
+	}
+	cutoff := time.Now().Add(-retention)
+	var purged int
+	for _, object := range objects {
+		id, _, _ := strings.Cut(strings.TrimPrefix(object.Key, trashPrefix), "/")
+		deletedAt, err := time.Parse(trashIDFormat, id)
+		if err != nil || deletedAt.After(cutoff) {
+			continue
+		}
+		if err := b.Delete(ctx, object.Key); err != nil {
+			return purged, fmt.Errorf("error purging %s: %v", object.Key, err)
+		}
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"go.uber.org/zap"
+)
+
+// UploadedFile describes a file which made it to the backend
+type UploadedFile struct {
+	Path       string
+	Key        string
+	Size       int64
+	StoredSize int64 // differs from Size for transformed (e.g. encrypted) files
+	ModTime    time.Time
+	Mode       os.FileMode
+	ETag       string
+	VersionID  string          // version the backend gave the object, in a versioned bucket
+	Chunks     []ManifestChunk // content in the chunked layout, nil for files stored as a single object
+}
+
+// Upload walks through the local directory you specified, and backs it up to the backend.
+// localDir may just as well be a single file. It returns the files which were uploaded.
+// Files the backup set leaves out (BACKUP_SET_<NAME>_INCLUDE/_EXCLUDE) are skipped.
+func Upload(ctx context.Context, b Backend, localDir, prefix string) ([]UploadedFile, error) {
+	customlog.Logger.Debug("starting file upload")
+
+	set, ok := fsconfig.FromContext(ctx).SetFor(localDir)
+	if !ok {
+		return nil, fmt.Errorf("%s is not below any backed up directory", localDir)
+	}
+	var uploaded []UploadedFile
+
+	// Walk through the directory
+	err := filepath.Walk(localDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip directories, and everything in the excluded ones
+		if info.IsDir() {
+			if set.Excludes(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !set.Includes(path) {
+			return nil
+		}
+
+		// Open the file
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open file %s: %v", path, err)
+		}
+		defer file.Close()
+
+		// Calculate the object key
+		relativePath, err := filepath.Rel(set.BackupDir, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path : %v", err)
+		}
+		key := Key(prefix, relativePath)
+
+		var object ObjectInfo
+		var manifest *Manifest
+		if Layout == fsconfig.LayoutChunks {
+			object, manifest, err = uploadChunked(ctx, b, file, prefix, key)
+		} else {
+			object, err = uploadFile(ctx, b, file, info, key)
+		}
+		if err != nil {
+			return err
+		}
+
+		customlog.Logger.Debug("File uploaded",
+			zap.String("set", set.Name),
+			zap.String("file", relativePath),
+			zap.String("key", key),
+		)
+		uploaded = append(uploaded, UploadedFile{
+			Path:       path,
+			Key:        key,
+			Size:       info.Size(),
+			StoredSize: object.Size,
+			ModTime:    info.ModTime(),
+			Mode:       info.Mode(),
+			ETag:       object.ETag,
+			VersionID:  object.VersionID,
+		})
+		if manifest != nil {
+			uploaded[len(uploaded)-1].Chunks = manifest.Chunks
+		}
+		return nil
+	})
+
+	if err != nil {
+		return uploaded, fmt.Errorf("error during upload process: %v", err)
+	}
+
+	return uploaded, nil
+}
+
+// uploadFile stores file as a single object, transformed (e.g. encrypted) files are uploaded from a spooled copy.
+// It returns the size, ETag and version of what was stored.
+func uploadFile(ctx context.Context, b Backend, file *os.File, info os.FileInfo, key string) (ObjectInfo, error) {
+	transforms, err := applicable(file)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to read file %s: %v", file.Name(), err)
+	}
+	src, srcInfo := file, info
+	var metadata map[string]string
+	if len(transforms) > 0 {
+		src, metadata, err = spool(file, info, key, transforms)
+		if err != nil {
+			return ObjectInfo{}, err
+		}
+		defer src.Close()
+		if srcInfo, err = src.Stat(); err != nil {
+			return ObjectInfo{}, err
+		}
+	}
+
+	// Now Upload the file, big files in parts so they can be resumed
+	var object ObjectInfo
+	if srcInfo.Size() >= fsconfig.FromContext(ctx).MultipartThreshold {
+		object, err = MultipartUpload(ctx, b, src, srcInfo, key, metadata)
+	} else {
+		object, err = b.Put(ctx, key, src, srcInfo.Size(), metadata)
+	}
+	object.Key, object.Size = key, srcInfo.Size()
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("error uploading files: %v", err)
+	}
+	if len(transforms) > 0 {
+		unspool(key)
+	}
+	return object, nil
+}
+
+// Delete removes what's stored for a file (or a whole directory) below the backup directory, or moves it to the trash if that's on.
+// The trash is the one below the prefix of the backup set the file belongs to.
+func Delete(ctx context.Context, b Backend, fileToDelete string) error {
+	/* Let's understand what's happening here:
+
+	fsconfig.MetaCfg.BackupDir is the directory that you want to backup, say it looks like: '/home/praveen/fsnotifyTest'
+	And from the file change event, you get the following file path which has the file you want to push to s3:
+		'/home/praveen/fsnotifyTest/sample21/folder1/files34.txt'
+
+	And in your s3 bucket you want to store it in say 's3folder', so say your s3 prefix is 's3folder/'
+	So, you would want to store like: 's3folder/sample21/folder1/files34.txt'
+
+	for that, you need to trim, '/home/praveen/fsnotifyTest' from '/home/praveen/fsnotifyTest/sample21/folder1/files34.txt'. And this is what 'filepath.Rel()' does.
+	*/
+	key, err := ObjectKey(ctx, fileToDelete)
+	if err != nil {
+		return fmt.Errorf("error resolving relative path: %v", err)
+	}
+	cfg := fsconfig.FromContext(ctx)
+	set, _ := cfg.SetFor(fileToDelete)
+
+	// A deleted directory may just as well be a mistake (or ransomware), keep it in the trash for a while
+	if cfg.TrashRetention > 0 {
+		n, err := TrashTree(ctx, b, set.S3Prefix, key)
+		if err != nil {
+			return fmt.Errorf("error moving file(s) to the trash: %v", err)
+		}
+		customlog.Logger.Info("Files moved to the trash", zap.String("key", key), zap.Int("objects", n))
+		return nil
+	}
+
+	if err := DeleteTree(ctx, b, key); err != nil {
+		return fmt.Errorf("error deleting file(s): %v", err)
+	}
+
+	customlog.Logger.Info("All files successfully deleted", zap.String("key", key))
+	return nil
+}
+
+// DeleteTree deletes the object stored under key, or everything that was stored below it if it's a directory
+func DeleteTree(ctx context.Context, b Backend, key string) error {
+	customlog.Logger.Debug("Fetching file(s) to delete", zap.String("key", key))
+
+	// Collect first, deleting while listing would pull the rug from under the pagination
+	objects, err := ListTree(ctx, b, key)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		customlog.Logger.Debug("Deleting a file", zap.String("key", object.Key))
+		if err := b.Delete(ctx, object.Key); err != nil {
+			return fmt.Errorf("error deleting the file: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrNoVersioning is returned when asking for older versions of a file from a backend which doesn't keep them
+var ErrNoVersioning = errors.New("the backend doesn't keep versions of objects, enable versioning on the bucket")
+
+// ObjectVersion is one version of an object in a versioned bucket
+type ObjectVersion struct {
+	Key          string    `json:"key"`
+	VersionID    string    `json:"versionId"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	ETag         string    `json:"etag"`
+	Latest       bool      `json:"latest"`
+	DeleteMarker bool      `json:"deleteMarker"` // the object was deleted at this point, there's nothing to fetch
+}
+
+// Versioned is implemented by backends which can keep older versions of objects, like s3 buckets with versioning enabled.
+// Plain deletes leave a delete marker there, the versions before it stay.
+type Versioned interface {
+	// Versioning tells if versions are kept (versioning is enabled on the bucket)
+	Versioning(ctx context.Context) (bool, error)
+	// ListVersions returns the versions of the object stored under key, delete markers included, newest first
+	ListVersions(ctx context.Context, key string) ([]ObjectVersion, error)
+	// GetVersion opens a version of the object stored under key, the caller closes it
+	GetVersion(ctx context.Context, key, versionID string) (io.ReadCloser, ObjectInfo, error)
+}
+
+// VersioningEnabled tells if b keeps versions of objects
+func VersioningEnabled(ctx context.Context, b Backend) (bool, error) {
+	versioned, ok := b.(Versioned)
+	if !ok {
+		return false, nil
+	}
+	return versioned.Versioning(ctx)
+}
+
+// History returns the versions of the object stored under key, newest first
+func History(ctx context.Context, b Backend, key string) ([]ObjectVersion, error) {
+	versioned, ok := b.(Versioned)
+	if !ok {
+		return nil, ErrNoVersioning
+	}
+	versions, err := versioned.ListVersions(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("error listing versions of %s: %v", key, err)
+	}
+	if len(versions) == 0 {
+		// Objects stored before versioning was turned on have a single "null" version, so nothing at all means the bucket doesn't know the key
+		if enabled, err := versioned.Versioning(ctx); err == nil && !enabled {
+			return nil, ErrNoVersioning
+		}
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return versions, nil
+}
+
+// DownloadVersion writes a version of the object stored under key to dest, like Download does with the current one.
+// In the chunked layout the old manifest refers to chunks by their hash, they're only there as long as gc didn't collect them.
+func DownloadVersion(ctx context.Context, b Backend, key, versionID, dest string) error {
+	versioned, ok := b.(Versioned)
+	if !ok {
+		return ErrNoVersioning
+	}
+	body, info, err := versioned.GetVersion(ctx, key, versionID)
+	if err != nil {
+		return fmt.Errorf("error fetching version %s of %s: %w", versionID, key, err)
+	}
+	defer body.Close()
+	return download(ctx, b, key, body, info, dest)
+}
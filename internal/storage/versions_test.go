@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// versionedBackend keeps every version of a single object in memory, like a versioned bucket would
+type versionedBackend struct {
+	Backend  // nil, only the Versioned methods are used
+	versions []ObjectVersion
+	content  map[string][]byte
+}
+
+func (b *versionedBackend) Versioning(ctx context.Context) (bool, error) { return true, nil }
+
+func (b *versionedBackend) ListVersions(ctx context.Context, key string) ([]ObjectVersion, error) {
+	return b.versions, nil
+}
+
+func (b *versionedBackend) GetVersion(ctx context.Context, key, versionID string) (io.ReadCloser, ObjectInfo, error) {
+	content, ok := b.content[versionID]
+	if !ok {
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(content)), ObjectInfo{Key: key, Size: int64(len(content)), LastModified: time.Unix(1700000000, 0), VersionID: versionID}, nil
+}
+
+func TestDownloadVersion(t *testing.T) {
+	ctx := context.Background()
+	b := &versionedBackend{
+		versions: []ObjectVersion{{Key: "backup/a.txt", VersionID: "v2", Latest: true}, {Key: "backup/a.txt", VersionID: "v1"}},
+		content:  map[string][]byte{"v1": []byte("first"), "v2": []byte("second")},
+	}
+	versions, err := History(ctx, b, "backup/a.txt")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("unexpected history %+v (%v)", versions, err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "a.txt")
+	if err := DownloadVersion(ctx, b, "backup/a.txt", "v1", dest); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dest); string(got) != "first" {
+		t.Errorf("want the first version, got %q", got)
+	}
+	if info, _ := os.Stat(dest); !info.ModTime().Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("want the modification time of the version, got %s", info.ModTime())
+	}
+	if err := DownloadVersion(ctx, b, "backup/a.txt", "v3", dest); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound for an unknown version, got %v", err)
+	}
+}
+
+func TestHistoryWithoutVersioning(t *testing.T) {
+	var b struct{ Backend }
+	if _, err := History(context.Background(), b, "backup/a.txt"); !errors.Is(err, ErrNoVersioning) {
+		t.Errorf("want ErrNoVersioning, got %v", err)
+	}
+}
@@ -6,33 +6,28 @@ import (
 	"time"
 
 	"github.com/Praveen005/CloudKeeper/internal/customlog"
+	"github.com/Praveen005/CloudKeeper/internal/db"
 	bolt "go.etcd.io/bbolt"
 	"go.uber.org/zap"
 )
 
 // PrintData function is a utility function to print the data present in db
 func PrintData() {
-	db, err := bolt.Open("filesToS3.db", 0666, &bolt.Options{Timeout: 2 * time.Minute})
-	if err != nil {
-		customlog.Logger.Error("failed to create/open database at the given path",
-			zap.String("path", "filesToS3.db"),
-			zap.String("error", err.Error()),
-		)
-		os.Exit(1)
-	}
-	defer db.Close()
-
-	if err := db.View(func(tx *bolt.Tx) error {
+	if err := db.Conn.View(func(tx *bolt.Tx) error {
 		// Printing data from bucket
-		bu := tx.Bucket([]byte("filesToUpdate"))
+		bu := tx.Bucket([]byte(db.FilesToUpdateBucket))
 		if bu == nil {
 			customlog.Logger.Error("bucket not found",
-				zap.String("bucket", "filesToUpdate"),
+				zap.String("bucket", db.FilesToUpdateBucket),
 			)
 			os.Exit(1)
 		}
 		err := bu.ForEach(func(k, v []byte) error {
-			fmt.Printf("Filepath: %s, Action: %s\n", k, v)
+			entry, err := db.DecodeQueueEntry(v)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Filepath: %s, Action: %s, State: %s, Last seen: %s\n", k, entry.Action(), entry.State, entry.LastSeen.Format(time.RFC3339))
 			return nil
 		})
 		if err != nil {
@@ -2,8 +2,8 @@ package watcher
 
 import (
 	"context"
-	"log"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
@@ -13,19 +13,32 @@ import (
 	"github.com/Praveen005/CloudKeeper/internal/customlog"
 	"github.com/Praveen005/CloudKeeper/internal/db"
 	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+	"github.com/Praveen005/CloudKeeper/internal/guard"
 )
 
 const (
 	eventChannelBufferSize = 1000
+	unmatchedMoveTimeout   = time.Minute // a move source is forgotten if its destination didn't show up within this time
 )
 
-// Watch function keeps an eye over the directory you want to backup for any modfication.
+// watchRetryDelay is how long a watch which couldn't be set up waits till it's tried again
+var watchRetryDelay = time.Minute
+
+// Watch function keeps an eye over the directories you want to backup for any modfication, with one watch per backup set.
+// When the configuration is reloaded, watches are set up for new directories and taken down for the ones which are gone.
+// Filters are looked up for every event, so a set only gets a new watch if its directory changed.
 func Watch(ctx context.Context) {
+	fsconfig.RunSets(ctx, func(a, b fsconfig.BackupSet) bool { return a.BackupDir == b.BackupDir }, watchSet)
+}
+
+// watchSet watches the directory of a single backup set. Every set has its own event handlers,
+// so the two halves of a move are only paired within a set: a move from one set to another is a removal and an upload.
+func watchSet(ctx context.Context, set fsconfig.BackupSet) {
 	c := make(chan notify.EventInfo, eventChannelBufferSize)
 
 	regularEvents := make(chan notify.EventInfo, 1) // stores events like, creation/motification/removal
 	renameEvents := make(chan notify.EventInfo, 2)  // stores Rename events(In rename previous file is deleted, and a new one is created with the same name. It also caters for file/folder movement, like: moved from & moved to)
-	dirToWatch := fsconfig.MetaCfg.BackupDir
+	dirToWatch := set.BackupDir
 
 	// we have to set a recursive Watch, hence adding a /...
 	if dirToWatch[len(dirToWatch)-1] == '/' {
@@ -34,20 +47,30 @@ func Watch(ctx context.Context) {
 		dirToWatch += "/..."
 	}
 	customlog.Logger.Debug("Setting up a watch on the directory",
+		zap.String("set", set.Name),
 		zap.String("directory", dirToWatch),
 	)
-	// As and when any event occurs, it is stored in channel 'c'. It is of the type notify.EventInfo
-	if err := notify.Watch(dirToWatch, c, notify.InCreate, notify.Remove, notify.Write, notify.InMovedFrom, notify.InMovedTo); err != nil {
-		log.Fatal(err)
+	// As and when any event occurs, it is stored in channel 'c'. It is of the type notify.EventInfo.
+	// A watch which can't be set up (inotify limits, permissions, the directory is gone) mustn't take the other sets down, it's tried again.
+	for {
+		err := notify.Watch(dirToWatch, c, notify.InCreate, notify.Remove, notify.Write, notify.InMovedFrom, notify.InMovedTo)
+		if err == nil {
+			break
+		}
+		customlog.Logger.Error("setting up the watch failed, trying again later",
+			zap.String("set", set.Name),
+			zap.String("directory", set.BackupDir),
+			zap.Duration("retry in", watchRetryDelay),
+			zap.String("error", err.Error()),
+		)
+		select {
+		case <-time.After(watchRetryDelay):
+		case <-ctx.Done():
+			return
+		}
 	}
 	defer notify.Stop(c)
 
-	// go DirectEvents(ctx, c, regularEvents, renameEvents)
-	// go HandleRegularEvents(ctx, regularEvents)
-	// go HandleRenameEvents(ctx, renameEvents)
-
-	// select {}
-
 	var wg sync.WaitGroup
 	wg.Add(3)
 	go func() {
@@ -74,8 +97,13 @@ func DirectEvents(ctx context.Context, c, regularEvents, renameEvents chan notif
 		select {
 		case eventInfo := <-c:
 			event := eventInfo.Event()
+			// Left out of the backup set (BACKUP_SET_<NAME>_EXCLUDE), e.g. a build directory: not even the guard cares
+			if set, ok := fsconfig.Current().SetFor(eventInfo.Path()); ok && set.Excludes(eventInfo.Path()) {
+				continue
+			}
+			guard.Observe(eventInfo.Path(), guardOp(event))
 			switch event {
-			case notify.Create, notify.Remove, notify.Write:
+			case notify.Create, notify.InCreate, notify.Remove, notify.Write:
 				regularEvents <- eventInfo
 			case notify.InMovedFrom, notify.InMovedTo:
 				renameEvents <- eventInfo
@@ -87,24 +115,47 @@ func DirectEvents(ctx context.Context, c, regularEvents, renameEvents chan notif
 	}
 }
 
+// guardOp maps a filesystem event to the db.Op* value the guard counts it as
+func guardOp(event notify.Event) string {
+	switch event {
+	case notify.Create, notify.InCreate:
+		return db.OpCreate
+	case notify.Write:
+		return db.OpWrite
+	case notify.Remove:
+		return db.OpRemove
+	case notify.InMovedFrom:
+		return db.OpMovedFrom
+	case notify.InMovedTo:
+		return db.OpMovedTo
+	}
+	return ""
+}
+
 // HandleRegularEvents takes in events like creation/motification/removal
 func HandleRegularEvents(ctx context.Context, regularEvents chan notify.EventInfo) {
 	for {
 		select {
 		case ei := <-regularEvents:
 			switch ei.Event() {
-			case notify.InCreate, notify.Write:
+			case notify.Create, notify.InCreate, notify.Write:
 
-				AddEvent(ei, "add")
+				op := db.OpWrite
+				if ei.Event() != notify.Write {
+					op = db.OpCreate
+				}
+				AddEvent(ei, op)
 				customlog.Logger.Info("Regular file change event",
+					zap.String("set", setName(ei.Path())),
 					zap.String("path", ei.Path()),
 					zap.String("event", ei.Event().String()),
 				)
 
 			case notify.Remove:
 
-				AddEvent(ei, "remove")
+				AddEvent(ei, db.OpRemove)
 				customlog.Logger.Info("Regular file change event",
+					zap.String("set", setName(ei.Path())),
 					zap.String("path", ei.Path()),
 					zap.String("event", ei.Event().String()),
 				)
@@ -116,34 +167,56 @@ func HandleRegularEvents(ctx context.Context, regularEvents chan notify.EventInf
 	}
 }
 
-// HandleRenameEvents function takes in events like, Rename, and file/folder movement from one to another
+// HandleRenameEvents function takes in events like, Rename, and file/folder movement from one to another.
+// The two halves of a move within the tree share an inotify cookie, such a pair is journaled as a move (see db.AppendMove),
+// which the backend carries out by copying instead of uploading again. A half without its other half (moved in from
+// outside the tree, or out of it) is a plain upload/removal.
 func HandleRenameEvents(ctx context.Context, renameEvents chan notify.EventInfo) {
-	moves := make(map[uint32]struct {
+	type pendingMove struct {
 		From string
-		To   string
-	})
+		At   time.Time
+	}
+	moves := make(map[uint32]pendingMove)
 
 	for {
 		select {
 		case ei := <-renameEvents:
 			cookie := ei.Sys().(*unix.InotifyEvent).Cookie
-			info := moves[cookie]
+
+			// Both halves arrive back to back, a source which didn't get its destination by now was moved out of the tree
+			for c, move := range moves {
+				if time.Since(move.At) > unmatchedMoveTimeout {
+					delete(moves, c)
+				}
+			}
 
 			switch ei.Event() {
 			case notify.InMovedFrom:
-				info.From = ei.Path()
+				moves[cookie] = pendingMove{From: ei.Path(), At: time.Now()}
 
-				AddEvent(ei, "remove")
+				AddEvent(ei, db.OpMovedFrom)
 				customlog.Logger.Info("File moved",
-					zap.String("from", info.From),
+					zap.String("set", setName(ei.Path())),
+					zap.String("from", ei.Path()),
 				)
 
 			case notify.InMovedTo:
-				info.To = ei.Path()
-
-				AddEvent(ei, "add")
+				move, paired := moves[cookie]
+				delete(moves, cookie)
+				if paired && cookie != 0 {
+					db.AppendMove(move.From, ei.Path())
+					customlog.Logger.Info("File moved",
+						zap.String("set", setName(ei.Path())),
+						zap.String("from", move.From),
+						zap.String("to", ei.Path()),
+					)
+					continue
+				}
+
+				AddEvent(ei, db.OpMovedTo)
 				customlog.Logger.Info("File moved",
-					zap.String("to", info.To),
+					zap.String("set", setName(ei.Path())),
+					zap.String("to", ei.Path()),
 				)
 			}
 
@@ -154,13 +227,16 @@ func HandleRenameEvents(ctx context.Context, renameEvents chan notify.EventInfo)
 	}
 }
 
-// AddEvent function stores the file change metadata in-memory
-func AddEvent(ei notify.EventInfo, action string) {
-	f := db.FileChangeEvent{
-		Action: action,
-	}
+// AddEvent function appends the file change metadata to the journal, from where it survives a crash till it's pushed to s3.
+// op is one of the db.Op* values, the action to be taken in s3 is worked out from it when the journal is compacted.
+func AddEvent(ei notify.EventInfo, op string) {
+	db.AppendJournal(ei.Path(), op)
+}
 
-	db.FilesToUpdate[ei.Path()] = f
+// setName returns the name of the backup set path belongs to, for the logs
+func setName(path string) string {
+	set, _ := fsconfig.Current().SetFor(path)
+	return set.Name
 }
 
 // Observation: DirectEvents, HandleRegularEvents & HandleRenameEvents functions can very well be clubbed together :)
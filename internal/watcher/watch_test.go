@@ -0,0 +1,297 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rjeczalik/notify"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/sys/unix"
+
+	"github.com/Praveen005/CloudKeeper/internal/db"
+	"github.com/Praveen005/CloudKeeper/internal/fsconfig"
+)
+
+// fakeEvent is a synthetic notify.EventInfo
+type fakeEvent struct {
+	event  notify.Event
+	path   string
+	cookie uint32
+}
+
+func (e fakeEvent) Event() notify.Event { return e.event }
+func (e fakeEvent) Path() string        { return e.path }
+func (e fakeEvent) Sys() interface{}    { return &unix.InotifyEvent{Cookie: e.cookie} }
+
+// openTestDB points the db package to a fresh database and runs the journal writer till the test ends
+func openTestDB(t *testing.T) {
+	t.Helper()
+	db.Path = filepath.Join(t.TempDir(), "test.db")
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		db.RunJournal(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		db.Close()
+	})
+}
+
+// feed runs the handlers, pushes the events through them in order and returns the resulting queue
+func feed(t *testing.T, events []fakeEvent) map[string]db.QueueEntry {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	regularEvents := make(chan notify.EventInfo)
+	renameEvents := make(chan notify.EventInfo)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		HandleRegularEvents(ctx, regularEvents)
+	}()
+	go func() {
+		defer wg.Done()
+		HandleRenameEvents(ctx, renameEvents)
+	}()
+
+	for i, e := range events {
+		switch e.event {
+		case notify.InMovedFrom, notify.InMovedTo:
+			renameEvents <- e
+		default:
+			regularEvents <- e
+		}
+		// The handlers run concurrently, wait for each event to reach the journal so the order is kept
+		waitForJournal(t, i+1)
+	}
+	cancel()
+	wg.Wait()
+
+	if _, err := db.PersistData(); err != nil {
+		t.Fatal(err)
+	}
+	queue, err := db.ReadQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue
+}
+
+// waitForJournal waits till the journal holds n entries
+func waitForJournal(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.SyncJournal(context.Background())
+		var got int
+		err := db.Conn.View(func(tx *bolt.Tx) error {
+			if b := tx.Bucket([]byte(db.JournalBucket)); b != nil {
+				got = b.Stats().KeyN
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d journal entries, got %d", n, got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHandleEventSequences(t *testing.T) {
+	const file = "/backup/dir/file.txt"
+
+	tests := []struct {
+		name       string
+		events     []fakeEvent
+		wantState  string // "" means the path must not be queued
+		wantAction string
+	}{
+		{
+			name:       "created",
+			events:     []fakeEvent{{event: notify.InCreate, path: file}},
+			wantState:  db.StateNew,
+			wantAction: db.ActionAdd,
+		},
+		{
+			name:       "written",
+			events:     []fakeEvent{{event: notify.Write, path: file}},
+			wantState:  db.StateModified,
+			wantAction: db.ActionAdd,
+		},
+		{
+			name: "created then deleted",
+			events: []fakeEvent{
+				{event: notify.InCreate, path: file},
+				{event: notify.Write, path: file},
+				{event: notify.Remove, path: file},
+			},
+		},
+		{
+			name: "modified then deleted",
+			events: []fakeEvent{
+				{event: notify.Write, path: file},
+				{event: notify.Remove, path: file},
+			},
+			wantState:  db.StateDeleted,
+			wantAction: db.ActionRemove,
+		},
+		{
+			name: "deleted then recreated",
+			events: []fakeEvent{
+				{event: notify.Remove, path: file},
+				{event: notify.InCreate, path: file},
+			},
+			wantState:  db.StateRecreated,
+			wantAction: db.ActionAdd,
+		},
+		{
+			name: "moved away",
+			events: []fakeEvent{
+				{event: notify.InMovedFrom, path: file, cookie: 7},
+			},
+			wantState:  db.StateMovedFrom,
+			wantAction: db.ActionRemove,
+		},
+		{
+			name: "moved away then recreated",
+			events: []fakeEvent{
+				{event: notify.InMovedFrom, path: file, cookie: 7},
+				{event: notify.InCreate, path: file},
+			},
+			wantState:  db.StateRecreated,
+			wantAction: db.ActionAdd,
+		},
+		{
+			name: "moved in then deleted",
+			events: []fakeEvent{
+				{event: notify.InMovedTo, path: file, cookie: 9},
+				{event: notify.Remove, path: file},
+			},
+			wantState:  db.StateDeleted,
+			wantAction: db.ActionRemove,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t)
+			queue := feed(t, tt.events)
+
+			entry, ok := queue[file]
+			if tt.wantState == "" {
+				if ok {
+					t.Fatalf("want %s not queued, got state %q", file, entry.State)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("want %s queued with state %q, it isn't queued", file, tt.wantState)
+			}
+			if entry.State != tt.wantState {
+				t.Errorf("want state %q, got %q", tt.wantState, entry.State)
+			}
+			if entry.Action() != tt.wantAction {
+				t.Errorf("want action %q, got %q", tt.wantAction, entry.Action())
+			}
+		})
+	}
+}
+
+// The queue must merge events arriving in separate compactions the same way as events compacted together
+func TestPersistedLayerMerge(t *testing.T) {
+	const file = "/backup/dir/file.txt"
+	openTestDB(t)
+
+	feed(t, []fakeEvent{{event: notify.Write, path: file}})
+	queue := feed(t, []fakeEvent{{event: notify.Remove, path: file}})
+	if got := queue[file].State; got != db.StateDeleted {
+		t.Fatalf("want state %q after the second compaction, got %q", db.StateDeleted, got)
+	}
+
+	queue = feed(t, []fakeEvent{{event: notify.InCreate, path: file}})
+	entry := queue[file]
+	if entry.State != db.StateRecreated {
+		t.Fatalf("want state %q after the third compaction, got %q", db.StateRecreated, entry.State)
+	}
+	if !entry.FirstSeen.Before(entry.LastSeen) {
+		t.Errorf("want first seen (%v) to be kept from the first event, last seen is %v", entry.FirstSeen, entry.LastSeen)
+	}
+}
+
+func TestMovePairing(t *testing.T) {
+	openTestDB(t)
+	queue := feed(t, []fakeEvent{
+		{event: notify.InMovedFrom, path: "/backup/old", cookie: 3},
+		{event: notify.InMovedTo, path: "/backup/new", cookie: 3},
+		{event: notify.InMovedTo, path: "/backup/from-outside", cookie: 4},
+	})
+
+	if entry := queue["/backup/old"]; entry.Action() != db.ActionRemove {
+		t.Errorf("want the source removed, got %+v", entry)
+	}
+	if entry := queue["/backup/new"]; entry.State != db.StateMoved || entry.From != "/backup/old" || entry.Action() != db.ActionMove {
+		t.Errorf("want the destination moved from /backup/old, got %+v", entry)
+	}
+	// Nothing was moved away with cookie 4, it came from outside the tree
+	if entry := queue["/backup/from-outside"]; entry.State != db.StateMovedTo || entry.Action() != db.ActionAdd {
+		t.Errorf("want the unmatched destination uploaded, got %+v", entry)
+	}
+}
+
+func TestWatchRetries(t *testing.T) {
+	openTestDB(t)
+	dir := filepath.Join(t.TempDir(), "later")
+	defer func(cfg fsconfig.MetaConfig, delay time.Duration) { fsconfig.MetaCfg, watchRetryDelay = cfg, delay }(fsconfig.MetaCfg, watchRetryDelay)
+	fsconfig.MetaCfg = fsconfig.MetaConfig{BackupDir: dir, S3Prefix: "backup"}
+	watchRetryDelay = 10 * time.Millisecond
+
+	// The directory isn't there yet: the watch is tried again instead of taking the daemon down
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchSet(ctx, fsconfig.MetaCfg.BackupSets()[0])
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "a.txt")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the watch to pick up a new file")
+		}
+		// Written again till the watch is set up and sees it
+		if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		db.SyncJournal(context.Background())
+		if _, err := db.PersistData(); err != nil {
+			t.Fatal(err)
+		}
+		if queue, err := db.ReadQueue(); err == nil && len(queue) > 0 {
+			break
+		}
+	}
+	cancel()
+	<-done
+}